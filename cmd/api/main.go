@@ -9,6 +9,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/adiecho/echobilling/internal/accounting"
 	"github.com/adiecho/echobilling/internal/admin"
 	"github.com/adiecho/echobilling/internal/app"
 	"github.com/adiecho/echobilling/internal/app/middleware"
@@ -16,14 +17,22 @@ import (
 	"github.com/adiecho/echobilling/internal/billing"
 	"github.com/adiecho/echobilling/internal/catalog"
 	"github.com/adiecho/echobilling/internal/content"
+	"github.com/adiecho/echobilling/internal/coupon"
+	"github.com/adiecho/echobilling/internal/credit"
 	"github.com/adiecho/echobilling/internal/customer"
+	"github.com/adiecho/echobilling/internal/dispute"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/adiecho/echobilling/internal/ipam"
 	"github.com/adiecho/echobilling/internal/order"
 	"github.com/adiecho/echobilling/internal/payment"
+	"github.com/adiecho/echobilling/internal/paymethod"
+	"github.com/adiecho/echobilling/internal/planchange"
+	"github.com/adiecho/echobilling/internal/report"
 	"github.com/adiecho/echobilling/internal/settings"
 	"github.com/adiecho/echobilling/internal/setup"
+	"github.com/adiecho/echobilling/internal/tax"
 	"github.com/adiecho/echobilling/internal/template"
 	"github.com/hibiken/asynq"
-	"github.com/stripe/stripe-go/v82"
 )
 
 func main() {
@@ -52,13 +61,14 @@ func main() {
 	defer rdb.Close()
 	log.Println("Connected to Redis")
 
-	// 统一设置 Stripe Key（全局只设置一次）
 	// 初始化 SettingsStore
 	settingsStore := app.NewSettingsStore(pool, app.BuildEnvDefaults(cfg))
 	if err := settingsStore.Load(ctx); err != nil {
 		log.Fatalf("Failed to load settings store: %v", err)
 	}
-	stripe.Key = settingsStore.StripeSecretKey()
+
+	// 支付网关按当前设置读取密钥，设置修改后立即生效
+	gateways := gateway.NewRegistry(cfg, settingsStore)
 
 	// 创建共享的 Asynq Client
 	asynqClient := asynq.NewClient(asynq.RedisClientOpt{Addr: cfg.RedisAddr, Password: cfg.RedisPassword})
@@ -102,26 +112,66 @@ func main() {
 	customerHandler := customer.NewHandler(pool)
 	customer.RegisterRoutes(portal, customerHandler)
 
+	// 套餐升降级路由
+	planChangeHandler := planchange.NewHandler(pool, asynqClient, settingsStore)
+	planchange.RegisterRoutes(portal, planChangeHandler)
+
 	// 订单路由
-	orderHandler := order.NewHandler(pool)
+	orderHandler := order.NewHandler(pool, settingsStore)
 	adminGroup := v1.Group("/admin", authMiddleware, adminMiddleware)
 	order.RegisterRoutes(portal, adminGroup, orderHandler)
 	order.RegisterCartRoutes(authed, orderHandler)
 
 	// 账单路由
-	billingHandler := billing.NewHandler(pool)
+	billingHandler := billing.NewHandler(pool, asynqClient, settingsStore)
 	billing.RegisterRoutes(portal, adminGroup, billingHandler)
 
 	// 支付路由
-	paymentHandler := payment.NewHandler(pool, cfg, asynqClient, settingsStore)
+	paymentHandler := payment.NewHandler(pool, cfg, asynqClient, settingsStore, gateways)
 	payment.RegisterRoutes(authed, v1.Group("/webhooks"), paymentHandler)
+	payment.RegisterPortalRoutes(portal, paymentHandler)
+	payment.RegisterAdminRoutes(adminGroup, paymentHandler)
+	// 沙箱支付页（仅非生产环境可用）
+	payment.RegisterSandboxRoutes(v1.Group("/sandbox"), paymentHandler)
+
+	// 争议处理路由
+	disputeHandler := dispute.NewHandler(pool, asynqClient, settingsStore, gateways)
+	dispute.RegisterRoutes(adminGroup, disputeHandler)
+
+	// 已保存支付方式路由
+	payMethodHandler := paymethod.NewHandler(pool, gateways)
+	paymethod.RegisterRoutes(portal, payMethodHandler)
 	// 兼容旧路径
 	portal.POST("/checkout/session", paymentHandler.CreateCheckoutSession)
 
 	// 管理后台路由
-	adminHandler := admin.NewHandler(pool, cfg, asynqClient)
+	adminHandler := admin.NewHandler(pool, cfg, asynqClient, settingsStore, gateways)
 	admin.RegisterRoutes(adminGroup, adminHandler)
 
+	// IP 地址池管理路由
+	ipamHandler := ipam.NewHandler(pool)
+	ipam.RegisterRoutes(adminGroup, ipamHandler)
+
+	// 税率规则管理路由
+	taxHandler := tax.NewHandler(pool)
+	tax.RegisterRoutes(adminGroup, taxHandler)
+
+	// 优惠券管理路由
+	couponHandler := coupon.NewHandler(pool)
+	coupon.RegisterRoutes(adminGroup, couponHandler)
+
+	// 账户余额路由
+	creditHandler := credit.NewHandler(pool)
+	credit.RegisterRoutes(portal, adminGroup, creditHandler)
+
+	// 收入报表路由
+	reportHandler := report.NewHandler(pool)
+	report.RegisterRoutes(adminGroup, reportHandler)
+
+	// 会计导出路由
+	accountingHandler := accounting.NewHandler(pool)
+	accounting.RegisterRoutes(adminGroup, accountingHandler)
+
 	// 系统设置路由
 	settingsSvc := settings.NewService(pool)
 	settingsHandler := settings.NewHandler(settingsSvc, settingsStore)
@@ -9,6 +9,9 @@ import (
 	"time"
 
 	"github.com/adiecho/echobilling/internal/app"
+	"github.com/adiecho/echobilling/internal/dispute"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/adiecho/echobilling/internal/payment"
 	"github.com/adiecho/echobilling/internal/provisioning"
 	"github.com/hibiken/asynq"
 )
@@ -42,8 +45,19 @@ func main() {
 	defer reloadCancel()
 	settingsStore.StartPeriodicReload(reloadCtx, 30*time.Second)
 
+	// 催缴终止服务等后续任务通过 Asynq 投递
+	asynqClient := asynq.NewClient(asynq.RedisClientOpt{Addr: cfg.RedisAddr})
+	defer asynqClient.Close()
+
 	// 创建任务处理器
-	handler := provisioning.NewTaskHandler(pool, cfg, settingsStore)
+	handler := provisioning.NewTaskHandler(pool, cfg, settingsStore, asynqClient)
+
+	// 续费自动扣款通过支持保存卡片的支付网关完成
+	gateways := gateway.NewRegistry(cfg, settingsStore)
+	paymentHandler := payment.NewHandler(pool, cfg, asynqClient, settingsStore, gateways)
+
+	// 争议证据截止提醒
+	disputeHandler := dispute.NewHandler(pool, asynqClient, settingsStore, gateways)
 
 	// 创建 Asynq 服务器
 	srv := asynq.NewServer(
@@ -66,17 +80,27 @@ func main() {
 	// 注册任务处理器
 	mux.HandleFunc(provisioning.TypeProvisionVPS, handler.HandleProvisionVPS)
 	mux.HandleFunc(provisioning.TypeSuspendVPS, handler.HandleSuspendVPS)
+	mux.HandleFunc(provisioning.TypeUnsuspendVPS, handler.HandleUnsuspendVPS)
 	mux.HandleFunc(provisioning.TypeTerminateVPS, handler.HandleTerminateVPS)
+	mux.HandleFunc(provisioning.TypeResizeVPS, handler.HandleResizeVPS)
 	mux.HandleFunc(provisioning.TypeRenewalReminder, handler.HandleRenewalReminder)
 	mux.HandleFunc(provisioning.TypeGenerateInvoice, handler.HandleGenerateInvoice)
 	mux.HandleFunc(provisioning.TypeExpireService, handler.HandleExpireService)
+	mux.HandleFunc(provisioning.TypeAutoCharge, paymentHandler.HandleAutoCharge)
+	mux.HandleFunc(provisioning.TypeDisputeAlert, disputeHandler.HandleDisputeAlerts)
+	mux.HandleFunc(provisioning.TypeExpireCheckouts, paymentHandler.HandleExpireInvoiceCheckouts)
 
 	log.Println("Registered task handlers:")
 	log.Println("  - vps:provision")
 	log.Println("  - vps:suspend")
+	log.Println("  - vps:unsuspend")
 	log.Println("  - vps:terminate")
+	log.Println("  - vps:resize")
 	log.Println("  - billing:renewal_reminder")
 	log.Println("  - billing:generate_invoice")
+	log.Println("  - billing:auto_charge")
+	log.Println("  - billing:dispute_alert")
+	log.Println("  - billing:expire_checkouts")
 	log.Println("  - service:expire")
 
 	// 创建调度器（用于周期性任务）
@@ -0,0 +1,185 @@
+package accounting
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+)
+
+// 导出格式
+const (
+	FormatCSV  = "csv"
+	FormatXero = "xero"
+	FormatIIF  = "iif"
+)
+
+// Account 科目表中的一个科目
+type Account struct {
+	Role      string    `json:"role"`
+	Code      string    `json:"code"`
+	Name      string    `json:"name"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Chart 按用途索引的科目表
+type Chart map[string]Account
+
+func (c Chart) account(role string) Account {
+	if a, ok := c[role]; ok {
+		return a
+	}
+	return Account{Role: role, Code: role, Name: role}
+}
+
+// iifAccountTypes QuickBooks 科目类型
+var iifAccountTypes = map[string]string{
+	AccountReceivable:        "AR",
+	AccountBank:              "BANK",
+	AccountDisputedFunds:     "OCASSET",
+	AccountTaxPayable:        "OCLIAB",
+	AccountCustomerCredit:    "OCLIAB",
+	AccountRevenue:           "INC",
+	AccountCreditAdjustments: "EXP",
+	AccountChargebackLosses:  "EXP",
+}
+
+// FileExtension 导出文件扩展名
+func FileExtension(format string) string {
+	if format == FormatIIF {
+		return "iif"
+	}
+	return "csv"
+}
+
+// ContentType 导出文件的 MIME 类型
+func ContentType(format string) string {
+	if format == FormatIIF {
+		return "text/plain; charset=utf-8"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// Render 按格式输出分录
+func Render(format string, entries []Entry, chart Chart) ([]byte, error) {
+	switch format {
+	case FormatCSV:
+		return renderCSV(entries, chart)
+	case FormatXero:
+		return renderXero(entries, chart)
+	case FormatIIF:
+		return renderIIF(entries, chart), nil
+	default:
+		return nil, fmt.Errorf("unsupported export format %q", format)
+	}
+}
+
+func amountOrEmpty(cents int64) string {
+	if cents == 0 {
+		return ""
+	}
+	return common.CentsToDecimal(cents)
+}
+
+// renderCSV 通用格式：每行一个分录行，同一分录的行共用 journal_no
+func renderCSV(entries []Entry, chart Chart) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{
+		"journal_no", "date", "source_type", "source_id", "reference", "description", "customer",
+		"account_code", "account_name", "debit", "credit", "currency",
+	})
+	for i, e := range entries {
+		for _, l := range e.Lines {
+			account := chart.account(l.Account)
+			_ = w.Write([]string{
+				strconv.Itoa(i + 1), e.Date.UTC().Format("2006-01-02"), e.SourceType, e.SourceID, e.Reference,
+				e.Description, e.Customer, account.Code, account.Name,
+				amountOrEmpty(l.Debit), amountOrEmpty(l.Credit), e.Currency,
+			})
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// renderXero Xero 手工日记账导入模板：同一 Narration 和日期的行组成一张日记账，借方为正数、贷方为负数。
+// 税费已单独记入应交税费科目，TaxRate 统一为 Tax Exempt
+func renderXero(entries []Entry, chart Chart) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{
+		"*Narration", "*Date", "Description", "*AccountCode", "*TaxRate", "*Amount",
+		"TrackingName1", "TrackingOption1", "TrackingName2", "TrackingOption2",
+	})
+	for _, e := range entries {
+		narration := e.Description
+		if e.Reference != "" && !strings.Contains(narration, e.Reference) {
+			narration = e.Reference + " " + narration
+		}
+		for _, l := range e.Lines {
+			description := e.Description
+			if e.Customer != "" {
+				description += " - " + e.Customer
+			}
+			_ = w.Write([]string{
+				narration, e.Date.UTC().Format("02/01/2006"), description,
+				chart.account(l.Account).Code, "Tax Exempt", common.CentsToDecimal(l.Debit - l.Credit),
+				"", "", "", "",
+			})
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// iifField IIF 以制表符分隔，字段中不能包含制表符和换行
+func iifField(value string) string {
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ", `"`, "'").Replace(value)
+}
+
+// renderIIF QuickBooks Desktop IIF：先声明用到的科目，再以 GENERAL JOURNAL 交易写入每笔分录，
+// 第一行为 TRNS，其余为 SPL，借方为正数、贷方为负数
+func renderIIF(entries []Entry, chart Chart) []byte {
+	var buf bytes.Buffer
+	writeRow := func(fields ...string) {
+		buf.WriteString(strings.Join(fields, "\t"))
+		buf.WriteString("\r\n")
+	}
+
+	used := make(map[string]bool)
+	for _, e := range entries {
+		for _, l := range e.Lines {
+			used[l.Account] = true
+		}
+	}
+	writeRow("!ACCNT", "NAME", "ACCNTTYPE", "ACCNUM")
+	for _, role := range Roles {
+		if !used[role] {
+			continue
+		}
+		account := chart.account(role)
+		writeRow("ACCNT", iifField(account.Name), iifAccountTypes[role], iifField(account.Code))
+	}
+
+	writeRow("!TRNS", "TRNSID", "TRNSTYPE", "DATE", "ACCNT", "NAME", "AMOUNT", "DOCNUM", "MEMO")
+	writeRow("!SPL", "SPLID", "TRNSTYPE", "DATE", "ACCNT", "NAME", "AMOUNT", "DOCNUM", "MEMO")
+	writeRow("!ENDTRNS")
+	for _, e := range entries {
+		date := e.Date.UTC().Format("01/02/2006")
+		for i, l := range e.Lines {
+			kind := "SPL"
+			if i == 0 {
+				kind = "TRNS"
+			}
+			writeRow(kind, "", "GENERAL JOURNAL", date, iifField(chart.account(l.Account).Name), iifField(e.Customer),
+				common.CentsToDecimal(l.Debit-l.Credit), iifField(e.Reference), iifField(e.Description))
+		}
+		writeRow("ENDTRNS")
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,235 @@
+package accounting
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// maxExportDays 单次导出最多覆盖的天数
+const maxExportDays = 366
+
+type Handler struct {
+	pool *pgxpool.Pool
+}
+
+func NewHandler(pool *pgxpool.Pool) *Handler {
+	return &Handler{pool: pool}
+}
+
+// Batch 已导出的批次
+type Batch struct {
+	ID          string    `json:"id"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	Format      string    `json:"format"`
+	Currency    string    `json:"currency,omitempty"`
+	EntryCount  int       `json:"entry_count"`
+	TotalDebit  string    `json:"total_debit"`
+	Filename    string    `json:"filename"`
+	CreatedBy   *string   `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ExportRequest 导出 from 到 to（含当天）期间的分录。currency 为空时导出所有币种（仅通用 CSV 支持多币种）；
+// 期间与已有批次重叠时需要 force 才会再次导出
+type ExportRequest struct {
+	From     string `json:"from" binding:"required"`
+	To       string `json:"to" binding:"required"`
+	Format   string `json:"format" binding:"required,oneof=csv xero iif"`
+	Currency string `json:"currency" binding:"omitempty,len=3,alpha"`
+	Force    bool   `json:"force"`
+}
+
+// UpdateAccountRequest 修改科目编码和名称
+type UpdateAccountRequest struct {
+	Code string `json:"code" binding:"required,max=20"`
+	Name string `json:"name" binding:"required,max=255"`
+}
+
+// JournalLine 分录行，debit 和 credit 为空表示零
+type JournalLine struct {
+	Account     string `json:"account"`
+	AccountCode string `json:"account_code"`
+	AccountName string `json:"account_name"`
+	Debit       string `json:"debit"`
+	Credit      string `json:"credit"`
+}
+
+// JournalEntry 日记账分录
+type JournalEntry struct {
+	Date        string        `json:"date"`
+	SourceType  string        `json:"source_type"`
+	SourceID    string        `json:"source_id"`
+	Reference   string        `json:"reference"`
+	Description string        `json:"description"`
+	Customer    string        `json:"customer"`
+	Currency    string        `json:"currency"`
+	Lines       []JournalLine `json:"lines"`
+}
+
+// parsePeriod 解析 YYYY-MM-DD 格式的起止日期（含 to 当天）
+func parsePeriod(fromValue, toValue string) (time.Time, time.Time, *common.ServiceError) {
+	from, err := time.Parse("2006-01-02", fromValue)
+	if err != nil {
+		return time.Time{}, time.Time{}, common.ErrBadRequest("Invalid from date, expected YYYY-MM-DD", err)
+	}
+	to, err := time.Parse("2006-01-02", toValue)
+	if err != nil {
+		return time.Time{}, time.Time{}, common.ErrBadRequest("Invalid to date, expected YYYY-MM-DD", err)
+	}
+	if to.Before(from) {
+		return time.Time{}, time.Time{}, common.ErrBadRequest("from must not be after to", nil)
+	}
+	if to.Sub(from) >= maxExportDays*24*time.Hour {
+		return time.Time{}, time.Time{}, common.ErrBadRequest(fmt.Sprintf("Export period cannot exceed %d days", maxExportDays), nil)
+	}
+	return from, to, nil
+}
+
+// ListAccounts - GET /api/v1/admin/exports/accounting/accounts
+func (h *Handler) ListAccounts(c *gin.Context) {
+	accounts, err := h.listAccounts(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query chart of accounts"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"accounts": accounts})
+}
+
+// UpdateAccount - PUT /api/v1/admin/exports/accounting/accounts/:role
+func (h *Handler) UpdateAccount(c *gin.Context) {
+	var req UpdateAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.WriteServiceError(c, common.ErrBadRequest("Invalid request body", err))
+		return
+	}
+
+	account, svcErr := h.updateAccount(c.Request.Context(), c.Param("role"), req)
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+	c.JSON(http.StatusOK, account)
+}
+
+// GetJournal - GET /api/v1/admin/exports/accounting/journal
+// 预览期间内的分录，不记录导出批次
+func (h *Handler) GetJournal(c *gin.Context) {
+	from, to, svcErr := parsePeriod(c.Query("from"), c.Query("to"))
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+
+	ctx := c.Request.Context()
+	entries, svcErr := h.journal(ctx, from, to, strings.ToUpper(c.Query("currency")))
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+	chart, err := h.loadChart(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query chart of accounts"})
+		return
+	}
+
+	resp := make([]JournalEntry, 0, len(entries))
+	for _, e := range entries {
+		entry := JournalEntry{
+			Date:        e.Date.UTC().Format("2006-01-02"),
+			SourceType:  e.SourceType,
+			SourceID:    e.SourceID,
+			Reference:   e.Reference,
+			Description: e.Description,
+			Customer:    e.Customer,
+			Currency:    e.Currency,
+			Lines:       make([]JournalLine, 0, len(e.Lines)),
+		}
+		for _, l := range e.Lines {
+			account := chart.account(l.Account)
+			entry.Lines = append(entry.Lines, JournalLine{
+				Account:     l.Account,
+				AccountCode: account.Code,
+				AccountName: account.Name,
+				Debit:       amountOrEmpty(l.Debit),
+				Credit:      amountOrEmpty(l.Credit),
+			})
+		}
+		resp = append(resp, entry)
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": resp})
+}
+
+// ListExports - GET /api/v1/admin/exports/accounting
+func (h *Handler) ListExports(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	batches, total, err := h.listBatches(c.Request.Context(), page, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query exports"})
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+	c.Header("X-Page", strconv.Itoa(page))
+	c.Header("X-Limit", strconv.Itoa(limit))
+	c.JSON(http.StatusOK, batches)
+}
+
+// CreateExport - POST /api/v1/admin/exports/accounting
+// 生成导出文件并记录批次，响应体为文件内容，批次 ID 在 X-Export-ID 头中返回
+func (h *Handler) CreateExport(c *gin.Context) {
+	adminID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	var req ExportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.WriteServiceError(c, common.ErrBadRequest("Invalid request body", err))
+		return
+	}
+	from, to, svcErr := parsePeriod(req.From, req.To)
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+
+	batch, content, svcErr := h.createExport(c.Request.Context(), adminID, req, from, to, c.ClientIP(), c.Request.UserAgent())
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+	writeExport(c, batch, content)
+}
+
+// DownloadExport - GET /api/v1/admin/exports/accounting/:id/download
+// 重新下载已记录批次的原始文件
+func (h *Handler) DownloadExport(c *gin.Context) {
+	batch, content, svcErr := h.getBatchContent(c.Request.Context(), c.Param("id"))
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+	writeExport(c, batch, content)
+}
+
+func writeExport(c *gin.Context, batch *Batch, content []byte) {
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, batch.Filename))
+	c.Header("X-Export-ID", batch.ID)
+	c.Data(http.StatusOK, ContentType(batch.Format), content)
+}
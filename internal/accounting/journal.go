@@ -0,0 +1,392 @@
+package accounting
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// 科目用途，与 accounting_accounts.role 一致
+const (
+	AccountReceivable        = "accounts_receivable"
+	AccountBank              = "bank"
+	AccountDisputedFunds     = "disputed_funds"
+	AccountTaxPayable        = "tax_payable"
+	AccountCustomerCredit    = "customer_credit"
+	AccountRevenue           = "revenue"
+	AccountCreditAdjustments = "credit_adjustments"
+	AccountChargebackLosses  = "chargeback_losses"
+)
+
+// Roles 所有科目用途，顺序即科目表的展示顺序
+var Roles = []string{
+	AccountReceivable, AccountBank, AccountDisputedFunds, AccountTaxPayable,
+	AccountCustomerCredit, AccountRevenue, AccountCreditAdjustments, AccountChargebackLosses,
+}
+
+// 分录来源
+const (
+	SourceInvoice          = "invoice"
+	SourceInvoiceVoid      = "invoice_void"
+	SourcePayment          = "payment"
+	SourceRefund           = "refund"
+	SourceCreditNote       = "credit_note"
+	SourceCreditNoteVoid   = "credit_note_void"
+	SourceDispute          = "dispute"
+	SourceDisputeWon       = "dispute_won"
+	SourceDisputeLost      = "dispute_lost"
+	SourceCreditAdjustment = "credit_adjustment"
+)
+
+// Line 分录行，借方和贷方只有一个非零（分）
+type Line struct {
+	Account string
+	Debit   int64
+	Credit  int64
+}
+
+// Entry 一笔借贷平衡的日记账分录
+type Entry struct {
+	Date        time.Time
+	SourceType  string
+	SourceID    string
+	Reference   string
+	Description string
+	Customer    string
+	Currency    string
+	Lines       []Line
+}
+
+// TotalDebit 借方合计
+func (e Entry) TotalDebit() int64 {
+	var total int64
+	for _, l := range e.Lines {
+		total += l.Debit
+	}
+	return total
+}
+
+// Balanced 借贷是否相等
+func (e Entry) Balanced() bool {
+	var debit, credit int64
+	for _, l := range e.Lines {
+		debit += l.Debit
+		credit += l.Credit
+	}
+	return debit == credit
+}
+
+func (e *Entry) debit(account string, amount int64) {
+	if amount < 0 {
+		e.credit(account, -amount)
+		return
+	}
+	if amount > 0 {
+		e.Lines = append(e.Lines, Line{Account: account, Debit: amount})
+	}
+}
+
+func (e *Entry) credit(account string, amount int64) {
+	if amount < 0 {
+		e.debit(account, -amount)
+		return
+	}
+	if amount > 0 {
+		e.Lines = append(e.Lines, Line{Account: account, Credit: amount})
+	}
+}
+
+// reversal 以相反方向冲销原分录
+func (e Entry) reversal(date time.Time, sourceType, description string) Entry {
+	r := e
+	r.Date = date
+	r.SourceType = sourceType
+	r.Description = description
+	r.Lines = make([]Line, len(e.Lines))
+	for i, l := range e.Lines {
+		r.Lines[i] = Line{Account: l.Account, Debit: l.Credit, Credit: l.Debit}
+	}
+	return r
+}
+
+// InvoiceSource 已开具（有编号）的发票。金额均为分，Total 含税
+type InvoiceSource struct {
+	ID            string
+	Number        string
+	Customer      string
+	Currency      string
+	IssuedAt      time.Time
+	VoidedAt      *time.Time
+	Total         int64
+	Tax           int64
+	CreditApplied int64
+}
+
+// PaymentSource 成功到账的付款；没有关联发票的是余额充值
+type PaymentSource struct {
+	ID         string
+	Reference  string
+	InvoiceRef string
+	HasInvoice bool
+	Customer   string
+	Currency   string
+	PaidAt     time.Time
+	Amount     int64
+}
+
+// RefundSource 成功的退款
+type RefundSource struct {
+	ID         string
+	PaymentRef string
+	InvoiceRef string
+	HasInvoice bool
+	Customer   string
+	Currency   string
+	RefundedAt time.Time
+	Amount     int64
+}
+
+// CreditNoteSource 贷项通知单。税额按原发票税额占总额的比例拆分
+type CreditNoteSource struct {
+	ID           string
+	Number       string
+	InvoiceRef   string
+	Customer     string
+	Currency     string
+	Settlement   string
+	IssuedAt     time.Time
+	VoidedAt     *time.Time
+	Amount       int64
+	InvoiceTotal int64
+	InvoiceTax   int64
+}
+
+// DisputeSource 争议；ClosedAt 为胜诉或败诉的时间
+type DisputeSource struct {
+	ID         string
+	PaymentRef string
+	InvoiceRef string
+	Customer   string
+	Currency   string
+	Status     string
+	OpenedAt   time.Time
+	ClosedAt   *time.Time
+	Amount     int64
+}
+
+// CreditAdjustmentSource 不经过发票和付款的余额变动：管理员调整和降级退回的差价
+type CreditAdjustmentSource struct {
+	ID       string
+	Kind     string
+	Reason   string
+	Customer string
+	Currency string
+	PostedAt time.Time
+	Amount   int64
+}
+
+// Sources 生成日记账所需的全部业务单据
+type Sources struct {
+	Invoices          []InvoiceSource
+	Payments          []PaymentSource
+	Refunds           []RefundSource
+	CreditNotes       []CreditNoteSource
+	Disputes          []DisputeSource
+	CreditAdjustments []CreditAdjustmentSource
+}
+
+// invoiceEntries 开票：借应收账款（已用余额抵扣的部分借客户余额），贷收入和应交税费。
+// 作废时在作废日冲销
+func invoiceEntries(inv InvoiceSource) []Entry {
+	e := Entry{
+		Date:        inv.IssuedAt,
+		SourceType:  SourceInvoice,
+		SourceID:    inv.ID,
+		Reference:   inv.Number,
+		Description: "Invoice " + inv.Number,
+		Customer:    inv.Customer,
+		Currency:    inv.Currency,
+	}
+	e.debit(AccountReceivable, inv.Total-inv.CreditApplied)
+	e.debit(AccountCustomerCredit, inv.CreditApplied)
+	e.credit(AccountRevenue, inv.Total-inv.Tax)
+	e.credit(AccountTaxPayable, inv.Tax)
+
+	entries := []Entry{e}
+	if inv.VoidedAt != nil {
+		entries = append(entries, e.reversal(*inv.VoidedAt, SourceInvoiceVoid, "Void of invoice "+inv.Number))
+	}
+	return entries
+}
+
+// paymentEntry 收款：借收款清算账户，贷应收账款；余额充值贷客户余额
+func paymentEntry(p PaymentSource) Entry {
+	e := Entry{
+		Date:       p.PaidAt,
+		SourceType: SourcePayment,
+		SourceID:   p.ID,
+		Reference:  p.Reference,
+		Customer:   p.Customer,
+		Currency:   p.Currency,
+	}
+	e.debit(AccountBank, p.Amount)
+	if p.HasInvoice {
+		e.Description = "Payment for invoice " + p.InvoiceRef
+		e.credit(AccountReceivable, p.Amount)
+	} else {
+		e.Description = "Account credit top-up"
+		e.credit(AccountCustomerCredit, p.Amount)
+	}
+	return e
+}
+
+// refundEntry 退款：贷项通知单已冲减应收，这里借应收账款、贷收款清算账户
+func refundEntry(r RefundSource) Entry {
+	e := Entry{
+		Date:       r.RefundedAt,
+		SourceType: SourceRefund,
+		SourceID:   r.ID,
+		Reference:  r.PaymentRef,
+		Customer:   r.Customer,
+		Currency:   r.Currency,
+	}
+	if r.HasInvoice {
+		e.Description = "Refund for invoice " + r.InvoiceRef
+		e.debit(AccountReceivable, r.Amount)
+	} else {
+		e.Description = "Refund of account credit top-up"
+		e.debit(AccountCustomerCredit, r.Amount)
+	}
+	e.credit(AccountBank, r.Amount)
+	return e
+}
+
+// creditNoteEntries 贷项通知单：借收入和应交税费，贷应收账款；转为账户余额的贷客户余额。
+// 作废时在作废日冲销
+func creditNoteEntries(cn CreditNoteSource) []Entry {
+	var tax int64
+	if cn.InvoiceTotal > 0 && cn.InvoiceTax > 0 {
+		tax = (cn.Amount*cn.InvoiceTax + cn.InvoiceTotal/2) / cn.InvoiceTotal
+	}
+
+	e := Entry{
+		Date:        cn.IssuedAt,
+		SourceType:  SourceCreditNote,
+		SourceID:    cn.ID,
+		Reference:   cn.Number,
+		Description: fmt.Sprintf("Credit note %s for invoice %s", cn.Number, cn.InvoiceRef),
+		Customer:    cn.Customer,
+		Currency:    cn.Currency,
+	}
+	e.debit(AccountRevenue, cn.Amount-tax)
+	e.debit(AccountTaxPayable, tax)
+	if cn.Settlement == "account_credit" {
+		e.credit(AccountCustomerCredit, cn.Amount)
+	} else {
+		e.credit(AccountReceivable, cn.Amount)
+	}
+
+	entries := []Entry{e}
+	if cn.VoidedAt != nil {
+		entries = append(entries, e.reversal(*cn.VoidedAt, SourceCreditNoteVoid, "Void of credit note "+cn.Number))
+	}
+	return entries
+}
+
+// disputeEntries 争议发生时网关扣回款项，转入争议资金；胜诉后退回清算账户，败诉则计入拒付损失
+func disputeEntries(d DisputeSource) []Entry {
+	e := Entry{
+		Date:        d.OpenedAt,
+		SourceType:  SourceDispute,
+		SourceID:    d.ID,
+		Reference:   d.PaymentRef,
+		Description: "Dispute opened on payment " + d.PaymentRef,
+		Customer:    d.Customer,
+		Currency:    d.Currency,
+	}
+	e.debit(AccountDisputedFunds, d.Amount)
+	e.credit(AccountBank, d.Amount)
+	entries := []Entry{e}
+
+	if d.ClosedAt == nil {
+		return entries
+	}
+	switch d.Status {
+	case "won":
+		entries = append(entries, e.reversal(*d.ClosedAt, SourceDisputeWon, "Dispute won on payment "+d.PaymentRef))
+	case "lost":
+		closed := Entry{
+			Date:        *d.ClosedAt,
+			SourceType:  SourceDisputeLost,
+			SourceID:    d.ID,
+			Reference:   d.PaymentRef,
+			Description: "Dispute lost on payment " + d.PaymentRef,
+			Customer:    d.Customer,
+			Currency:    d.Currency,
+		}
+		closed.debit(AccountChargebackLosses, d.Amount)
+		closed.credit(AccountDisputedFunds, d.Amount)
+		entries = append(entries, closed)
+	}
+	return entries
+}
+
+// creditAdjustmentEntry 管理员调整计入余额调整费用，降级差价冲减收入；Amount 为正表示增加客户余额
+func creditAdjustmentEntry(a CreditAdjustmentSource) Entry {
+	e := Entry{
+		Date:        a.PostedAt,
+		SourceType:  SourceCreditAdjustment,
+		SourceID:    a.ID,
+		Description: a.Reason,
+		Customer:    a.Customer,
+		Currency:    a.Currency,
+	}
+	if e.Description == "" {
+		e.Description = "Account credit " + a.Kind
+	}
+	account := AccountCreditAdjustments
+	if a.Kind == "downgrade" {
+		account = AccountRevenue
+	}
+	e.debit(account, a.Amount)
+	e.credit(AccountCustomerCredit, a.Amount)
+	return e
+}
+
+// Journal 生成 [from, to) 期间的分录，按日期排序。单据日期不在期间内的分录（如此前开具、本期作废的发票）只保留期间内的部分
+func Journal(src Sources, from, to time.Time) []Entry {
+	var all []Entry
+	for _, inv := range src.Invoices {
+		all = append(all, invoiceEntries(inv)...)
+	}
+	for _, p := range src.Payments {
+		all = append(all, paymentEntry(p))
+	}
+	for _, r := range src.Refunds {
+		all = append(all, refundEntry(r))
+	}
+	for _, cn := range src.CreditNotes {
+		all = append(all, creditNoteEntries(cn)...)
+	}
+	for _, d := range src.Disputes {
+		all = append(all, disputeEntries(d)...)
+	}
+	for _, a := range src.CreditAdjustments {
+		all = append(all, creditAdjustmentEntry(a))
+	}
+
+	entries := make([]Entry, 0, len(all))
+	for _, e := range all {
+		if len(e.Lines) == 0 || e.Date.Before(from) || !e.Date.Before(to) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].Date.Equal(entries[j].Date) {
+			return entries[i].Date.Before(entries[j].Date)
+		}
+		return entries[i].SourceType < entries[j].SourceType
+	})
+	return entries
+}
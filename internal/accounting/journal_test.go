@@ -0,0 +1,191 @@
+package accounting
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func at(month time.Month, day int) time.Time {
+	return time.Date(2026, month, day, 12, 0, 0, 0, time.UTC)
+}
+
+func testSources() Sources {
+	voided := at(time.March, 2)
+	closed := at(time.March, 20)
+	return Sources{
+		Invoices: []InvoiceSource{
+			{ID: "inv-1", Number: "INV-1", Customer: "Acme", Currency: "EUR", IssuedAt: at(time.March, 1),
+				Total: 11900, Tax: 1900, CreditApplied: 1000},
+			// 二月开具、三月作废，只有冲销分录落在三月
+			{ID: "inv-2", Number: "INV-2", Customer: "Acme", Currency: "EUR", IssuedAt: at(time.February, 20),
+				VoidedAt: &voided, Total: 5000},
+		},
+		Payments: []PaymentSource{
+			{ID: "pay-1", Reference: "pi_1", InvoiceRef: "INV-1", HasInvoice: true, Customer: "Acme",
+				Currency: "EUR", PaidAt: at(time.March, 3), Amount: 10900},
+			{ID: "pay-2", Reference: "pi_2", Customer: "Acme", Currency: "EUR", PaidAt: at(time.March, 4), Amount: 2500},
+		},
+		Refunds: []RefundSource{
+			{ID: "ref-1", PaymentRef: "pi_1", InvoiceRef: "INV-1", HasInvoice: true, Customer: "Acme",
+				Currency: "EUR", RefundedAt: at(time.March, 10), Amount: 5950},
+		},
+		CreditNotes: []CreditNoteSource{
+			{ID: "cn-1", Number: "CN-1", InvoiceRef: "INV-1", Customer: "Acme", Currency: "EUR", Settlement: "refund",
+				IssuedAt: at(time.March, 10), Amount: 5950, InvoiceTotal: 11900, InvoiceTax: 1900},
+		},
+		Disputes: []DisputeSource{
+			{ID: "dp-1", PaymentRef: "pi_2", Customer: "Acme", Currency: "EUR", Status: "lost",
+				OpenedAt: at(time.March, 15), ClosedAt: &closed, Amount: 2500},
+		},
+		CreditAdjustments: []CreditAdjustmentSource{
+			{ID: "ct-1", Kind: "adjustment", Reason: "Goodwill", Customer: "Acme", Currency: "USD",
+				PostedAt: at(time.April, 2), Amount: 500},
+		},
+	}
+}
+
+func TestJournalBalances(t *testing.T) {
+	t.Parallel()
+
+	entries := Journal(testSources(), at(time.March, 1).Truncate(24*time.Hour), at(time.April, 1).Truncate(24*time.Hour))
+	if len(entries) != 8 {
+		t.Fatalf("got %d entries, want 8", len(entries))
+	}
+
+	balances := make(map[string]int64)
+	for _, e := range entries {
+		if !e.Balanced() {
+			t.Errorf("%s %s is not balanced: %+v", e.SourceType, e.SourceID, e.Lines)
+		}
+		for _, l := range e.Lines {
+			balances[l.Account] += l.Debit - l.Credit
+		}
+	}
+
+	// 发票 119.00（其中 10.00 用余额抵扣）已收款，退款一半并开具贷项通知单后不影响应收；
+	// 作废二月的发票冲减应收 50.00
+	if balances[AccountReceivable] != -5000 {
+		t.Errorf("accounts receivable = %d, want -5000", balances[AccountReceivable])
+	}
+	// 收入 100.00 减去贷项通知单中不含税的 50.00；二月的发票作废冲回 50.00
+	if balances[AccountRevenue] != -10000+5000+5000 {
+		t.Errorf("revenue = %d, want 0", balances[AccountRevenue])
+	}
+	if balances[AccountTaxPayable] != -1900+950 {
+		t.Errorf("tax payable = %d, want -950", balances[AccountTaxPayable])
+	}
+	// 收款 109.00 + 充值 25.00 - 退款 59.50 - 争议扣回 25.00
+	if balances[AccountBank] != 10900+2500-5950-2500 {
+		t.Errorf("bank = %d", balances[AccountBank])
+	}
+	if balances[AccountDisputedFunds] != 0 || balances[AccountChargebackLosses] != 2500 {
+		t.Errorf("disputed funds = %d, chargeback losses = %d", balances[AccountDisputedFunds], balances[AccountChargebackLosses])
+	}
+	if balances[AccountCustomerCredit] != 1000-2500 {
+		t.Errorf("customer credit = %d, want -1500", balances[AccountCustomerCredit])
+	}
+
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Date.Before(entries[i-1].Date) {
+			t.Fatal("entries should be sorted by date")
+		}
+	}
+}
+
+func TestCreditNoteSettledToAccountCredit(t *testing.T) {
+	t.Parallel()
+
+	entries := creditNoteEntries(CreditNoteSource{
+		ID: "cn-2", Number: "CN-2", Settlement: "account_credit", IssuedAt: at(time.May, 1),
+		Amount: 1190, InvoiceTotal: 11900, InvoiceTax: 1900,
+	})
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	want := []Line{
+		{Account: AccountRevenue, Debit: 1000},
+		{Account: AccountTaxPayable, Debit: 190},
+		{Account: AccountCustomerCredit, Credit: 1190},
+	}
+	for i, l := range entries[0].Lines {
+		if l != want[i] {
+			t.Errorf("line %d = %+v, want %+v", i, l, want[i])
+		}
+	}
+}
+
+func testChart() Chart {
+	chart := make(Chart)
+	for i, role := range Roles {
+		chart[role] = Account{Role: role, Code: string(rune('1'+i)) + "000", Name: strings.ReplaceAll(role, "_", " ")}
+	}
+	return chart
+}
+
+func TestRenderFormats(t *testing.T) {
+	t.Parallel()
+
+	entries := invoiceEntries(InvoiceSource{
+		ID: "inv-1", Number: "INV-1", Customer: "Acme\tGmbH", Currency: "EUR", IssuedAt: at(time.March, 1),
+		Total: 11900, Tax: 1900,
+	})
+	chart := testChart()
+
+	out, err := Render(FormatCSV, entries, chart)
+	if err != nil {
+		t.Fatalf("csv: %v", err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatalf("parse csv: %v", err)
+	}
+	if len(records) != 4 || records[1][9] != "119.00" || records[2][10] != "100.00" {
+		t.Fatalf("csv records = %v", records)
+	}
+
+	out, err = Render(FormatXero, entries, chart)
+	if err != nil {
+		t.Fatalf("xero: %v", err)
+	}
+	records, err = csv.NewReader(bytes.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatalf("parse xero csv: %v", err)
+	}
+	var sum float64
+	for _, r := range records[1:] {
+		if r[1] != "01/03/2026" {
+			t.Errorf("xero date = %q, want 01/03/2026", r[1])
+		}
+		amount, err := strconv.ParseFloat(r[5], 64)
+		if err != nil {
+			t.Fatalf("xero amount %q: %v", r[5], err)
+		}
+		sum += amount
+	}
+	if sum > 0.001 || sum < -0.001 {
+		t.Errorf("xero journal amounts should sum to zero, got %v", sum)
+	}
+
+	out, err = Render(FormatIIF, entries, chart)
+	if err != nil {
+		t.Fatalf("iif: %v", err)
+	}
+	iif := string(out)
+	if !strings.HasPrefix(iif, "!ACCNT\tNAME\tACCNTTYPE\tACCNUM\r\n") {
+		t.Errorf("iif should start with the account header: %q", iif[:40])
+	}
+	if !strings.Contains(iif, "TRNS\t\tGENERAL JOURNAL\t03/01/2026\taccounts receivable\tAcme GmbH\t119.00\tINV-1\t") {
+		t.Errorf("iif transaction line missing:\n%s", iif)
+	}
+	if strings.Count(iif, "\r\nENDTRNS\r\n") != 1 {
+		t.Errorf("iif should contain one transaction:\n%s", iif)
+	}
+
+	if _, err := Render("pdf", entries, chart); err == nil {
+		t.Fatal("expected error for an unknown format")
+	}
+}
@@ -0,0 +1,13 @@
+package accounting
+
+import "github.com/gin-gonic/gin"
+
+func RegisterRoutes(admin *gin.RouterGroup, h *Handler) {
+	exports := admin.Group("/exports/accounting")
+	exports.GET("", h.ListExports)
+	exports.POST("", h.CreateExport)
+	exports.GET("/journal", h.GetJournal)
+	exports.GET("/accounts", h.ListAccounts)
+	exports.PUT("/accounts/:role", h.UpdateAccount)
+	exports.GET("/:id/download", h.DownloadExport)
+}
@@ -0,0 +1,522 @@
+package accounting
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// customerName 分录上的客户名称：公司名、联系人、账户名，最后用邮箱
+const customerName = `COALESCE(NULLIF(cp.company_name, ''), NULLIF(cp.full_name, ''), NULLIF(u.name, ''), u.email)`
+
+// creditLedgerCurrency 账户余额只有一种币种，与充值使用的币种一致
+const creditLedgerCurrency = "USD"
+
+func cents(value string) (int64, error) {
+	amount, err := common.DecimalAmountToCents(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q: %w", value, err)
+	}
+	return amount, nil
+}
+
+// loadSources 读取日期落在 [from, to) 内的单据。作废、结案等后续事件可能发生在期间内，单据本身的日期可能更早，
+// 所以按任一相关日期过滤，再由 Journal 按分录日期筛选
+func (h *Handler) loadSources(ctx context.Context, from, to time.Time, currency string) (*Sources, error) {
+	var src Sources
+	var err error
+	if src.Invoices, err = h.loadInvoices(ctx, from, to, currency); err != nil {
+		return nil, fmt.Errorf("failed to load invoices: %w", err)
+	}
+	if src.Payments, err = h.loadPayments(ctx, from, to, currency); err != nil {
+		return nil, fmt.Errorf("failed to load payments: %w", err)
+	}
+	if src.Refunds, err = h.loadRefunds(ctx, from, to, currency); err != nil {
+		return nil, fmt.Errorf("failed to load refunds: %w", err)
+	}
+	if src.CreditNotes, err = h.loadCreditNotes(ctx, from, to, currency); err != nil {
+		return nil, fmt.Errorf("failed to load credit notes: %w", err)
+	}
+	if src.Disputes, err = h.loadDisputes(ctx, from, to, currency); err != nil {
+		return nil, fmt.Errorf("failed to load disputes: %w", err)
+	}
+	if currency == "" || currency == creditLedgerCurrency {
+		if src.CreditAdjustments, err = h.loadCreditAdjustments(ctx, from, to); err != nil {
+			return nil, fmt.Errorf("failed to load credit adjustments: %w", err)
+		}
+	}
+	return &src, nil
+}
+
+func (h *Handler) loadInvoices(ctx context.Context, from, to time.Time, currency string) ([]InvoiceSource, error) {
+	rows, err := h.pool.Query(ctx, `
+		SELECT i.id::text, i.invoice_number, `+customerName+`, i.currency,
+		       COALESCE(i.finalized_at, i.created_at),
+		       CASE WHEN i.status = 'void' THEN COALESCE(i.voided_at, i.updated_at) END,
+		       i.total::text, i.tax::text, i.credit_applied::text
+		FROM invoices i
+		JOIN users u ON u.id = i.user_id
+		LEFT JOIN customer_profiles cp ON cp.user_id = i.user_id
+		WHERE i.invoice_number IS NOT NULL
+		  AND ($3 = '' OR i.currency = $3)
+		  AND ((COALESCE(i.finalized_at, i.created_at) >= $1 AND COALESCE(i.finalized_at, i.created_at) < $2)
+		       OR (i.status = 'void' AND COALESCE(i.voided_at, i.updated_at) >= $1 AND COALESCE(i.voided_at, i.updated_at) < $2))
+	`, from, to, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []InvoiceSource
+	for rows.Next() {
+		var inv InvoiceSource
+		var total, tax, creditApplied string
+		if err := rows.Scan(&inv.ID, &inv.Number, &inv.Customer, &inv.Currency, &inv.IssuedAt, &inv.VoidedAt,
+			&total, &tax, &creditApplied); err != nil {
+			return nil, err
+		}
+		if inv.Total, err = cents(total); err != nil {
+			return nil, err
+		}
+		if inv.Tax, err = cents(tax); err != nil {
+			return nil, err
+		}
+		if inv.CreditApplied, err = cents(creditApplied); err != nil {
+			return nil, err
+		}
+		result = append(result, inv)
+	}
+	return result, rows.Err()
+}
+
+// loadPayments 成功到账（含之后退款）的付款，以创建时间为收款日期
+func (h *Handler) loadPayments(ctx context.Context, from, to time.Time, currency string) ([]PaymentSource, error) {
+	rows, err := h.pool.Query(ctx, `
+		SELECT p.id::text, COALESCE(p.transaction_reference, p.stripe_payment_intent_id, p.id::text),
+		       COALESCE(i.invoice_number, ''), p.invoice_id IS NOT NULL, `+customerName+`,
+		       UPPER(p.currency), p.created_at, p.amount::text
+		FROM payments p
+		JOIN users u ON u.id = p.user_id
+		LEFT JOIN customer_profiles cp ON cp.user_id = p.user_id
+		LEFT JOIN invoices i ON i.id = p.invoice_id
+		WHERE p.status IN ('succeeded', 'partially_refunded', 'refunded')
+		  AND ($3 = '' OR UPPER(p.currency) = $3)
+		  AND p.created_at >= $1 AND p.created_at < $2
+	`, from, to, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []PaymentSource
+	for rows.Next() {
+		var p PaymentSource
+		var amount string
+		if err := rows.Scan(&p.ID, &p.Reference, &p.InvoiceRef, &p.HasInvoice, &p.Customer,
+			&p.Currency, &p.PaidAt, &amount); err != nil {
+			return nil, err
+		}
+		if p.Amount, err = cents(amount); err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+func (h *Handler) loadRefunds(ctx context.Context, from, to time.Time, currency string) ([]RefundSource, error) {
+	rows, err := h.pool.Query(ctx, `
+		SELECT r.id::text, COALESCE(p.transaction_reference, p.stripe_payment_intent_id, p.id::text),
+		       COALESCE(i.invoice_number, ''), p.invoice_id IS NOT NULL, `+customerName+`,
+		       UPPER(p.currency), r.created_at, r.amount::text
+		FROM refunds r
+		JOIN payments p ON p.id = r.payment_id
+		JOIN users u ON u.id = p.user_id
+		LEFT JOIN customer_profiles cp ON cp.user_id = p.user_id
+		LEFT JOIN invoices i ON i.id = p.invoice_id
+		WHERE r.status = 'succeeded'
+		  AND ($3 = '' OR UPPER(p.currency) = $3)
+		  AND r.created_at >= $1 AND r.created_at < $2
+	`, from, to, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []RefundSource
+	for rows.Next() {
+		var r RefundSource
+		var amount string
+		if err := rows.Scan(&r.ID, &r.PaymentRef, &r.InvoiceRef, &r.HasInvoice, &r.Customer,
+			&r.Currency, &r.RefundedAt, &amount); err != nil {
+			return nil, err
+		}
+		if r.Amount, err = cents(amount); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+func (h *Handler) loadCreditNotes(ctx context.Context, from, to time.Time, currency string) ([]CreditNoteSource, error) {
+	rows, err := h.pool.Query(ctx, `
+		SELECT cn.id::text, cn.credit_note_number, COALESCE(i.invoice_number, ''), `+customerName+`,
+		       cn.currency, cn.settlement, cn.created_at,
+		       CASE WHEN cn.status = 'void' THEN COALESCE(cn.voided_at, cn.updated_at) END,
+		       cn.amount::text, COALESCE(i.total, 0)::text, COALESCE(i.tax, 0)::text
+		FROM credit_notes cn
+		JOIN users u ON u.id = cn.user_id
+		LEFT JOIN customer_profiles cp ON cp.user_id = cn.user_id
+		LEFT JOIN invoices i ON i.id = cn.invoice_id
+		WHERE ($3 = '' OR cn.currency = $3)
+		  AND ((cn.created_at >= $1 AND cn.created_at < $2)
+		       OR (cn.status = 'void' AND COALESCE(cn.voided_at, cn.updated_at) >= $1 AND COALESCE(cn.voided_at, cn.updated_at) < $2))
+	`, from, to, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []CreditNoteSource
+	for rows.Next() {
+		var cn CreditNoteSource
+		var amount, invoiceTotal, invoiceTax string
+		if err := rows.Scan(&cn.ID, &cn.Number, &cn.InvoiceRef, &cn.Customer, &cn.Currency, &cn.Settlement,
+			&cn.IssuedAt, &cn.VoidedAt, &amount, &invoiceTotal, &invoiceTax); err != nil {
+			return nil, err
+		}
+		if cn.Amount, err = cents(amount); err != nil {
+			return nil, err
+		}
+		if cn.InvoiceTotal, err = cents(invoiceTotal); err != nil {
+			return nil, err
+		}
+		if cn.InvoiceTax, err = cents(invoiceTax); err != nil {
+			return nil, err
+		}
+		result = append(result, cn)
+	}
+	return result, rows.Err()
+}
+
+// loadDisputes 争议没有单独的结案时间，胜诉或败诉时以最后更新时间为准
+func (h *Handler) loadDisputes(ctx context.Context, from, to time.Time, currency string) ([]DisputeSource, error) {
+	rows, err := h.pool.Query(ctx, `
+		SELECT d.id::text, COALESCE(p.transaction_reference, p.stripe_payment_intent_id, p.id::text),
+		       COALESCE(i.invoice_number, ''), `+customerName+`, UPPER(p.currency), d.status::text,
+		       d.created_at, CASE WHEN d.status IN ('won', 'lost') THEN d.updated_at END, d.amount::text
+		FROM disputes d
+		JOIN payments p ON p.id = d.payment_id
+		JOIN users u ON u.id = p.user_id
+		LEFT JOIN customer_profiles cp ON cp.user_id = p.user_id
+		LEFT JOIN invoices i ON i.id = p.invoice_id
+		WHERE ($3 = '' OR UPPER(p.currency) = $3)
+		  AND ((d.created_at >= $1 AND d.created_at < $2)
+		       OR (d.status IN ('won', 'lost') AND d.updated_at >= $1 AND d.updated_at < $2))
+	`, from, to, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []DisputeSource
+	for rows.Next() {
+		var d DisputeSource
+		var amount string
+		if err := rows.Scan(&d.ID, &d.PaymentRef, &d.InvoiceRef, &d.Customer, &d.Currency, &d.Status,
+			&d.OpenedAt, &d.ClosedAt, &amount); err != nil {
+			return nil, err
+		}
+		if d.Amount, err = cents(amount); err != nil {
+			return nil, err
+		}
+		result = append(result, d)
+	}
+	return result, rows.Err()
+}
+
+// loadCreditAdjustments 充值、抵扣、释放和贷项通知单入账已由对应单据记账，这里只取调整和降级差价
+func (h *Handler) loadCreditAdjustments(ctx context.Context, from, to time.Time) ([]CreditAdjustmentSource, error) {
+	rows, err := h.pool.Query(ctx, `
+		SELECT ct.id::text, ct.kind, ct.reason, `+customerName+`, ct.created_at, ct.amount::text
+		FROM credit_transactions ct
+		JOIN users u ON u.id = ct.user_id
+		LEFT JOIN customer_profiles cp ON cp.user_id = ct.user_id
+		WHERE ct.kind IN ('adjustment', 'downgrade')
+		  AND ct.created_at >= $1 AND ct.created_at < $2
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []CreditAdjustmentSource
+	for rows.Next() {
+		a := CreditAdjustmentSource{Currency: creditLedgerCurrency}
+		var amount string
+		if err := rows.Scan(&a.ID, &a.Kind, &a.Reason, &a.Customer, &a.PostedAt, &amount); err != nil {
+			return nil, err
+		}
+		if a.Amount, err = cents(amount); err != nil {
+			return nil, err
+		}
+		result = append(result, a)
+	}
+	return result, rows.Err()
+}
+
+// journal 生成期间内的分录，from 和 to 均为日期（含 to 当天）
+func (h *Handler) journal(ctx context.Context, from, to time.Time, currency string) ([]Entry, *common.ServiceError) {
+	end := to.AddDate(0, 0, 1)
+	src, err := h.loadSources(ctx, from, end, currency)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to load accounting records", err)
+	}
+	entries := Journal(*src, from, end)
+	for _, e := range entries {
+		if !e.Balanced() {
+			return nil, common.ErrInternal("Journal entry is not balanced", fmt.Errorf("%s %s", e.SourceType, e.SourceID))
+		}
+	}
+	return entries, nil
+}
+
+func (h *Handler) listAccounts(ctx context.Context) ([]Account, error) {
+	rows, err := h.pool.Query(ctx, `SELECT role, code, name, updated_at FROM accounting_accounts`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chart := make(Chart)
+	for rows.Next() {
+		var a Account
+		if err := rows.Scan(&a.Role, &a.Code, &a.Name, &a.UpdatedAt); err != nil {
+			return nil, err
+		}
+		chart[a.Role] = a
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	accounts := make([]Account, 0, len(Roles))
+	for _, role := range Roles {
+		accounts = append(accounts, chart.account(role))
+	}
+	return accounts, nil
+}
+
+func (h *Handler) loadChart(ctx context.Context) (Chart, error) {
+	accounts, err := h.listAccounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	chart := make(Chart, len(accounts))
+	for _, a := range accounts {
+		chart[a.Role] = a
+	}
+	return chart, nil
+}
+
+func validRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) updateAccount(ctx context.Context, role string, req UpdateAccountRequest) (*Account, *common.ServiceError) {
+	if !validRole(role) {
+		return nil, common.ErrNotFound("Account not found", nil)
+	}
+
+	a := Account{Role: role, Code: strings.TrimSpace(req.Code), Name: strings.TrimSpace(req.Name)}
+	if a.Code == "" || a.Name == "" {
+		return nil, common.ErrBadRequest("Account code and name are required", nil)
+	}
+	err := h.pool.QueryRow(ctx, `
+		INSERT INTO accounting_accounts (role, code, name, updated_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (role) DO UPDATE SET code = EXCLUDED.code, name = EXCLUDED.name, updated_at = EXCLUDED.updated_at
+		RETURNING updated_at
+	`, a.Role, a.Code, a.Name).Scan(&a.UpdatedAt)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to update account", err)
+	}
+	return &a, nil
+}
+
+const batchColumns = `id::text, period_start, period_end, format, COALESCE(currency, ''), entry_count,
+	total_debit::text, filename, created_by::text, created_at`
+
+func scanBatch(row pgx.Row) (*Batch, error) {
+	var b Batch
+	if err := row.Scan(&b.ID, &b.PeriodStart, &b.PeriodEnd, &b.Format, &b.Currency, &b.EntryCount,
+		&b.TotalDebit, &b.Filename, &b.CreatedBy, &b.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (h *Handler) listBatches(ctx context.Context, page, limit int) ([]Batch, int64, error) {
+	var total int64
+	if err := h.pool.QueryRow(ctx, `SELECT COUNT(*) FROM accounting_exports`).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := h.pool.Query(ctx,
+		`SELECT `+batchColumns+` FROM accounting_exports ORDER BY created_at DESC LIMIT $1 OFFSET $2`,
+		limit, (page-1)*limit,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	batches := []Batch{}
+	for rows.Next() {
+		b, err := scanBatch(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		batches = append(batches, *b)
+	}
+	return batches, total, rows.Err()
+}
+
+// createExport 生成并记录一个导出批次。与已有批次的期间重叠时拒绝，除非 force 为 true；
+// 在事务中锁表检查重叠，避免两个管理员同时导出同一期间
+func (h *Handler) createExport(ctx context.Context, adminID string, req ExportRequest, from, to time.Time, ip, userAgent string) (*Batch, []byte, *common.ServiceError) {
+	currency := strings.ToUpper(req.Currency)
+	entries, svcErr := h.journal(ctx, from, to, currency)
+	if svcErr != nil {
+		return nil, nil, svcErr
+	}
+	if req.Format != FormatCSV && currency == "" && len(currencies(entries)) > 1 {
+		return nil, nil, common.ErrBadRequest("Entries span several currencies; choose a currency for Xero and QuickBooks exports", nil)
+	}
+
+	chart, err := h.loadChart(ctx)
+	if err != nil {
+		return nil, nil, common.ErrInternal("Failed to load chart of accounts", err)
+	}
+	content, err := Render(req.Format, entries, chart)
+	if err != nil {
+		return nil, nil, common.ErrInternal("Failed to render export", err)
+	}
+
+	var totalDebit int64
+	for _, e := range entries {
+		totalDebit += e.TotalDebit()
+	}
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return nil, nil, common.ErrInternal("Failed to begin transaction", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `LOCK TABLE accounting_exports IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return nil, nil, common.ErrInternal("Failed to lock export batches", err)
+	}
+	if !req.Force {
+		existing, err := scanBatch(tx.QueryRow(ctx, `
+			SELECT `+batchColumns+`
+			FROM accounting_exports
+			WHERE period_start <= $2 AND period_end >= $1
+			  AND ($3 = '' OR currency IS NULL OR currency = $3)
+			ORDER BY created_at DESC
+			LIMIT 1
+		`, from, to, currency))
+		if err == nil {
+			return nil, nil, common.NewServiceError(http.StatusConflict, fmt.Sprintf(
+				"Period overlaps export %s (%s to %s) created on %s; set force to export it again",
+				existing.Filename, existing.PeriodStart.Format("2006-01-02"), existing.PeriodEnd.Format("2006-01-02"),
+				existing.CreatedAt.Format("2006-01-02")), nil)
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil, common.ErrInternal("Failed to check previous exports", err)
+		}
+	}
+
+	filename := fmt.Sprintf("journal-%s-%s-%s", from.Format("20060102"), to.Format("20060102"), req.Format)
+	if currency != "" {
+		filename += "-" + strings.ToLower(currency)
+	}
+	filename += "." + FileExtension(req.Format)
+
+	batch, err := scanBatch(tx.QueryRow(ctx, `
+		INSERT INTO accounting_exports (id, period_start, period_end, format, currency, entry_count, total_debit,
+			filename, content, created_by, created_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, $8, $9, $10, NOW())
+		RETURNING `+batchColumns,
+		uuid.New().String(), from, to, req.Format, currency, len(entries), common.CentsToDecimal(totalDebit),
+		filename, content, adminID,
+	))
+	if err != nil {
+		return nil, nil, common.ErrInternal("Failed to record export batch", err)
+	}
+
+	details, _ := json.Marshal(map[string]interface{}{
+		"period_start": from.Format("2006-01-02"),
+		"period_end":   to.Format("2006-01-02"),
+		"format":       req.Format,
+		"currency":     currency,
+		"entries":      len(entries),
+		"forced":       req.Force,
+	})
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO audit_logs (user_id, action, entity_type, entity_id, new_values, ip_address, user_agent, created_at)
+		 VALUES ($1, 'accounting_exported', 'accounting_export', $2, $3, $4, $5, NOW())`,
+		adminID, batch.ID, details, ip, userAgent,
+	); err != nil {
+		return nil, nil, common.ErrInternal("Failed to write audit log", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, common.ErrInternal("Failed to commit export batch", err)
+	}
+	return batch, content, nil
+}
+
+func (h *Handler) getBatchContent(ctx context.Context, id string) (*Batch, []byte, *common.ServiceError) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, nil, common.ErrNotFound("Export not found", nil)
+	}
+
+	var b Batch
+	var content []byte
+	err := h.pool.QueryRow(ctx, `
+		SELECT id::text, period_start, period_end, format, COALESCE(currency, ''), entry_count,
+		       total_debit::text, filename, created_by::text, created_at, content
+		FROM accounting_exports WHERE id = $1
+	`, id).Scan(&b.ID, &b.PeriodStart, &b.PeriodEnd, &b.Format, &b.Currency, &b.EntryCount,
+		&b.TotalDebit, &b.Filename, &b.CreatedBy, &b.CreatedAt, &content)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, common.ErrNotFound("Export not found", nil)
+	}
+	if err != nil {
+		return nil, nil, common.ErrInternal("Failed to load export", err)
+	}
+	return &b, content, nil
+}
+
+func currencies(entries []Entry) map[string]bool {
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		seen[e.Currency] = true
+	}
+	return seen
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/adiecho/echobilling/internal/app"
 	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/gateway"
 	"github.com/gin-gonic/gin"
 	"github.com/hibiken/asynq"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -14,17 +15,19 @@ import (
 
 type Handler struct {
 	pool        *pgxpool.Pool
-	stripeKey   string
 	redisAddr   string
 	asynqClient *asynq.Client
+	store       *app.SettingsStore
+	gateways    *gateway.Registry
 }
 
-func NewHandler(pool *pgxpool.Pool, cfg *app.Config, asynqClient *asynq.Client) *Handler {
+func NewHandler(pool *pgxpool.Pool, cfg *app.Config, asynqClient *asynq.Client, store *app.SettingsStore, gateways *gateway.Registry) *Handler {
 	return &Handler{
 		pool:        pool,
-		stripeKey:   cfg.StripeSecretKey,
 		redisAddr:   cfg.RedisAddr,
 		asynqClient: asynqClient,
+		store:       store,
+		gateways:    gateways,
 	}
 }
 
@@ -48,7 +51,10 @@ type Payment struct {
 	ID                    string    `json:"id"`
 	OrderID               string    `json:"order_id"`
 	StripePaymentIntentID string    `json:"stripe_payment_intent_id"`
+	Gateway               string    `json:"gateway"`
+	TransactionReference  string    `json:"transaction_reference"`
 	Amount                float64   `json:"amount"`
+	AmountRefunded        float64   `json:"amount_refunded"`
 	Currency              string    `json:"currency"`
 	Status                string    `json:"status"`
 	Method                string    `json:"method"`
@@ -58,8 +64,10 @@ type Payment struct {
 
 type CreateRefundRequest struct {
 	PaymentID string `json:"payment_id" binding:"required"`
-	Amount    int64  `json:"amount"` // 单位：分；0 表示全额退款
+	Amount    int64  `json:"amount"` // 单位：分；0 表示退还剩余的全部金额
 	Reason    string `json:"reason"`
+	// ServiceAction 对付款所支付服务的处理：空表示保留，cancel 停止续费并暂停，terminate 终止
+	ServiceAction string `json:"service_action"`
 }
 
 type QueueStats struct {
@@ -98,13 +106,20 @@ type SystemInfo struct {
 }
 
 type RefundResponse struct {
-	ID             string    `json:"id"`
-	PaymentID      string    `json:"payment_id"`
-	StripeRefundID string    `json:"stripe_refund_id"`
-	Amount         string    `json:"amount"`
-	Currency       string    `json:"currency"`
-	Status         string    `json:"status"`
-	CreatedAt      time.Time `json:"created_at"`
+	ID               string    `json:"id"`
+	PaymentID        string    `json:"payment_id"`
+	StripeRefundID   string    `json:"stripe_refund_id"`
+	Amount           string    `json:"amount"`
+	Currency         string    `json:"currency"`
+	Status           string    `json:"status"`
+	PaymentStatus    string    `json:"payment_status"`
+	AmountRefunded   string    `json:"amount_refunded"`
+	InvoiceStatus    string    `json:"invoice_status,omitempty"`
+	CreditNoteID     *string   `json:"credit_note_id"`
+	CreditNoteNumber *string   `json:"credit_note_number"`
+	ServiceAction    string    `json:"service_action,omitempty"`
+	ServiceIDs       []string  `json:"service_ids,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
 }
 
 type ProvisioningResult struct {
@@ -3,19 +3,21 @@ package admin
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/adiecho/echobilling/internal/billing"
 	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/gateway"
 	"github.com/adiecho/echobilling/internal/provisioning"
 	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
 	"github.com/jackc/pgx/v5"
 	"github.com/redis/go-redis/v9"
-	"github.com/stripe/stripe-go/v82"
-	"github.com/stripe/stripe-go/v82/refund"
 )
 
 func (h *Handler) getDashboardStats(ctx context.Context) (*DashboardStats, error) {
@@ -27,7 +29,7 @@ func (h *Handler) getDashboardStats(ctx context.Context) (*DashboardStats, error
 	if err := h.pool.QueryRow(ctx, `SELECT COUNT(*) FROM orders`).Scan(&stats.TotalOrders); err != nil {
 		return nil, err
 	}
-	if err := h.pool.QueryRow(ctx, `SELECT COALESCE(SUM(amount), 0)::text FROM payments WHERE status = 'succeeded'`).Scan(&stats.TotalRevenue); err != nil {
+	if err := h.pool.QueryRow(ctx, `SELECT COALESCE(SUM(amount - amount_refunded), 0)::text FROM payments WHERE status IN ('succeeded', 'partially_refunded')`).Scan(&stats.TotalRevenue); err != nil {
 		return nil, err
 	}
 	stats.Revenue, _ = strconv.ParseFloat(stats.TotalRevenue, 64)
@@ -119,7 +121,10 @@ func (h *Handler) listPayments(ctx context.Context, page, limit int) ([]Payment,
 		`SELECT p.id,
 		        COALESCE(i.order_id::text, '') AS order_id,
 		        COALESCE(p.stripe_payment_intent_id, ''),
+		        p.gateway,
+		        COALESCE(p.transaction_reference, ''),
 		        p.amount::text,
+		        p.amount_refunded::text,
 		        p.currency,
 		        p.status,
 		        COALESCE(p.method, ''),
@@ -138,17 +143,19 @@ func (h *Handler) listPayments(ctx context.Context, page, limit int) ([]Payment,
 	payments := make([]Payment, 0)
 	for rows.Next() {
 		var (
-			payment       Payment
-			amountDecimal string
+			payment         Payment
+			amountDecimal   string
+			refundedDecimal string
 		)
 		if err := rows.Scan(
-			&payment.ID, &payment.OrderID, &payment.StripePaymentIntentID,
-			&amountDecimal, &payment.Currency, &payment.Status, &payment.PaymentMethod, &payment.CreatedAt,
+			&payment.ID, &payment.OrderID, &payment.StripePaymentIntentID, &payment.Gateway, &payment.TransactionReference,
+			&amountDecimal, &refundedDecimal, &payment.Currency, &payment.Status, &payment.PaymentMethod, &payment.CreatedAt,
 		); err != nil {
 			return nil, 0, err
 		}
 
 		payment.Amount, _ = strconv.ParseFloat(amountDecimal, 64)
+		payment.AmountRefunded, _ = strconv.ParseFloat(refundedDecimal, 64)
 		payment.Status = mapAdminPaymentStatus(payment.Status)
 		payment.Method = payment.PaymentMethod
 		payments = append(payments, payment)
@@ -161,27 +168,58 @@ func (h *Handler) listPayments(ctx context.Context, page, limit int) ([]Payment,
 	return payments, total, nil
 }
 
+// createRefund 通过支付网关退款。累计退款金额不能超过付款金额，部分退款后付款和发票进入 partially_refunded，
+// 每笔退款签发一张贷项通知单；可选择同时取消或终止付款所支付的服务
 func (h *Handler) createRefund(ctx context.Context, createdBy string, req CreateRefundRequest) (*RefundResponse, *common.ServiceError) {
+	if !billing.ValidRefundServiceAction(req.ServiceAction) {
+		return nil, common.NewServiceError(http.StatusBadRequest, "Invalid service action", nil)
+	}
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return nil, common.NewServiceError(http.StatusInternalServerError, "Database error", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// 锁定付款，网关调用完成前同一付款的其他退款需要等待，避免累计超退
 	var (
+		gatewayName           string
 		stripePaymentIntentID string
+		status                string
 		amountDecimal         string
+		refundedDecimal       string
 		currency              string
 	)
-	err := h.pool.QueryRow(ctx,
-		`SELECT COALESCE(stripe_payment_intent_id, ''),
+	err = tx.QueryRow(ctx,
+		`SELECT gateway,
+		        COALESCE(stripe_payment_intent_id, ''),
+		        status::text,
 		        amount::text,
+		        (SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE payment_id = payments.id AND status <> 'failed')::text,
 		        currency
 		 FROM payments
-		 WHERE id = $1`,
+		 WHERE id = $1
+		 FOR UPDATE`,
 		req.PaymentID,
-	).Scan(&stripePaymentIntentID, &amountDecimal, &currency)
+	).Scan(&gatewayName, &stripePaymentIntentID, &status, &amountDecimal, &refundedDecimal, &currency)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, common.NewServiceError(http.StatusNotFound, "Payment not found", err)
 		}
 		return nil, common.NewServiceError(http.StatusInternalServerError, "Database error", err)
 	}
+	if status != "succeeded" && status != "partially_refunded" {
+		return nil, common.NewServiceError(http.StatusConflict, "Payment cannot be refunded in its current status", nil)
+	}
 
+	// 线下付款由管理员自行转账退回，网关无法原路退款
+	gw, err := h.gateways.Lookup(gatewayName)
+	if err != nil {
+		return nil, common.NewServiceError(http.StatusInternalServerError, "Unknown payment gateway", err)
+	}
+	if !gw.Capabilities().Refunds {
+		return nil, common.NewServiceError(http.StatusBadRequest, "Payment gateway does not support refunds", nil)
+	}
 	if stripePaymentIntentID == "" {
 		return nil, common.NewServiceError(http.StatusBadRequest, "Payment has no Stripe payment intent", nil)
 	}
@@ -190,82 +228,89 @@ func (h *Handler) createRefund(ctx context.Context, createdBy string, req Create
 	if err != nil {
 		return nil, common.NewServiceError(http.StatusInternalServerError, "Invalid payment amount", err)
 	}
+	refundedCents, err := common.DecimalAmountToCents(refundedDecimal)
+	if err != nil {
+		return nil, common.NewServiceError(http.StatusInternalServerError, "Invalid refunded amount", err)
+	}
+	refundable := billing.RefundableAmount(totalCents, refundedCents)
 
 	refundAmountCents := req.Amount
 	if refundAmountCents == 0 {
-		refundAmountCents = totalCents
+		refundAmountCents = refundable
 	}
-	if refundAmountCents <= 0 || refundAmountCents > totalCents {
-		return nil, common.NewServiceError(http.StatusBadRequest, "Invalid refund amount", nil)
-	}
-
-	params := &stripe.RefundParams{
-		PaymentIntent: stripe.String(stripePaymentIntentID),
-		Amount:        stripe.Int64(refundAmountCents),
+	if refundable == 0 {
+		return nil, common.NewServiceError(http.StatusConflict, "Payment has already been fully refunded", nil)
 	}
-	if req.Reason == "duplicate" || req.Reason == "fraudulent" || req.Reason == "requested_by_customer" {
-		params.Reason = stripe.String(req.Reason)
+	if refundAmountCents <= 0 || refundAmountCents > refundable {
+		return nil, common.NewServiceError(http.StatusBadRequest,
+			fmt.Sprintf("Invalid refund amount, at most %s %s can be refunded", common.CentsToDecimal(refundable), currency), nil)
 	}
 
-	stripeRefund, err := refund.New(params)
+	stripeRefund, err := gw.Refund(ctx, gateway.RefundRequest{
+		PaymentReference: stripePaymentIntentID,
+		Amount:           refundAmountCents,
+		Reason:           req.Reason,
+	})
 	if err != nil {
 		return nil, common.NewServiceError(http.StatusInternalServerError, "Failed to create refund in Stripe", err)
 	}
 
-	tx, err := h.pool.Begin(ctx)
+	now := time.Now()
+	refundStatus := common.MapRefundStatus(stripeRefund.Status)
+	refundID, err := billing.RecordRefund(ctx, tx, h.store, billing.Refund{
+		PaymentID:       req.PaymentID,
+		GatewayRefundID: stripeRefund.ID,
+		Amount:          common.CentsToDecimal(refundAmountCents),
+		Reason:          req.Reason,
+		Status:          refundStatus,
+		CreatedBy:       createdBy,
+	}, now)
 	if err != nil {
-		return nil, common.NewServiceError(http.StatusInternalServerError, "Database error", err)
+		return nil, common.NewServiceError(http.StatusInternalServerError, "Failed to create refund record", err)
 	}
-	defer tx.Rollback(ctx)
 
-	now := time.Now()
-	if _, err := tx.Exec(ctx,
-		`UPDATE payments SET status = 'refunded', updated_at = $2 WHERE id = $1`,
-		req.PaymentID, now,
-	); err != nil {
+	state, err := billing.SyncRefundState(ctx, tx, req.PaymentID, 0, now)
+	if err != nil {
 		return nil, common.NewServiceError(http.StatusInternalServerError, "Failed to update payment", err)
 	}
 
-	var createdByValue interface{}
-	if createdBy != "" {
-		createdByValue = createdBy
+	services, err := billing.ApplyRefundServiceAction(ctx, tx, req.PaymentID, req.ServiceAction, now)
+	if err != nil {
+		return nil, common.NewServiceError(http.StatusInternalServerError, "Failed to update refunded services", err)
 	}
 
-	refundID := uuid.New().String()
-	if _, err := tx.Exec(ctx,
-		`INSERT INTO refunds (
-			id, payment_id, stripe_refund_id, amount, reason, status, created_by, created_at, updated_at
-		)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
-		ON CONFLICT (stripe_refund_id) DO UPDATE SET
-		  amount = EXCLUDED.amount,
-		  reason = EXCLUDED.reason,
-		  status = EXCLUDED.status,
-		  updated_at = EXCLUDED.updated_at`,
+	var creditNoteID, creditNoteNumber *string
+	if err := tx.QueryRow(ctx,
+		`SELECT id::text, credit_note_number FROM credit_notes WHERE refund_id = $1 AND status = 'issued'`,
 		refundID,
-		req.PaymentID,
-		stripeRefund.ID,
-		common.CentsToDecimal(refundAmountCents),
-		req.Reason,
-		common.MapRefundStatus(string(stripeRefund.Status)),
-		createdByValue,
-		now,
-	); err != nil {
-		return nil, common.NewServiceError(http.StatusInternalServerError, "Failed to create refund record", err)
+	).Scan(&creditNoteID, &creditNoteNumber); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, common.NewServiceError(http.StatusInternalServerError, "Failed to read credit note", err)
 	}
 
 	if err := tx.Commit(ctx); err != nil {
 		return nil, common.NewServiceError(http.StatusInternalServerError, "Failed to commit transaction", err)
 	}
 
+	if err := billing.EnqueueRefundServiceAction(h.asynqClient, services); err != nil {
+		// 退款已完成，服务任务投递失败由管理员在服务页手动处理
+		log.Printf("[admin] refund %s: %v", refundID, err)
+	}
+
 	return &RefundResponse{
-		ID:             refundID,
-		PaymentID:      req.PaymentID,
-		StripeRefundID: stripeRefund.ID,
-		Amount:         common.CentsToDecimal(refundAmountCents),
-		Currency:       currency,
-		Status:         common.MapRefundStatus(string(stripeRefund.Status)),
-		CreatedAt:      now,
+		ID:               refundID,
+		PaymentID:        req.PaymentID,
+		StripeRefundID:   stripeRefund.ID,
+		Amount:           common.CentsToDecimal(refundAmountCents),
+		Currency:         currency,
+		Status:           refundStatus,
+		PaymentStatus:    state.PaymentStatus,
+		AmountRefunded:   state.AmountRefunded,
+		InvoiceStatus:    state.InvoiceStatus,
+		CreditNoteID:     creditNoteID,
+		CreditNoteNumber: creditNoteNumber,
+		ServiceAction:    req.ServiceAction,
+		ServiceIDs:       services.ServiceIDs,
+		CreatedAt:        now,
 	}, nil
 }
 
@@ -36,6 +36,8 @@ type RegisterRequest struct {
 	Email    string `json:"email" binding:"required"`
 	Password string `json:"password" binding:"required"`
 	Name     string `json:"name"`
+	// AcceptTerms 客户勾选同意服务条款，接受时间和 IP 会作为争议证据保留
+	AcceptTerms bool `json:"accept_terms"`
 }
 
 // LoginRequest 登录请求
@@ -93,6 +95,11 @@ func (h *Handler) Register(c *gin.Context) {
 		common.WriteServiceError(c, err)
 		return
 	}
+	if req.AcceptTerms {
+		h.recordAuthEvent(c, authResp.User.ID, ActionTermsAccepted, map[string]interface{}{
+			"terms_url": h.store.Get("terms_of_service_url"),
+		})
+	}
 
 	c.JSON(http.StatusCreated, authResp)
 }
@@ -116,6 +123,7 @@ func (h *Handler) Login(c *gin.Context) {
 		return
 	}
 
+	h.recordAuthEvent(c, authResp.User.ID, ActionLogin, map[string]interface{}{"method": "password"})
 	c.JSON(http.StatusOK, authResp)
 }
 
@@ -2,12 +2,15 @@ package auth
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/adiecho/echobilling/internal/common"
+	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/redis/go-redis/v9"
@@ -177,3 +180,22 @@ func (h *Handler) consume2FAToken(ctx context.Context, token string) {
 	key := fmt.Sprintf("2fa:token:%s", token)
 	h.rdb.Del(ctx, key)
 }
+
+// 写入 audit_logs 的认证事件，争议答辩时作为客户使用记录
+const (
+	ActionLogin         = "login"
+	ActionTermsAccepted = "terms_accepted"
+)
+
+// recordAuthEvent 记录登录或接受条款的时间、IP 和 User-Agent，写入失败不影响认证结果
+func (h *Handler) recordAuthEvent(c *gin.Context, userID, action string, details map[string]interface{}) {
+	payload, _ := json.Marshal(details)
+	_, err := h.pool.Exec(c.Request.Context(),
+		`INSERT INTO audit_logs (user_id, action, entity_type, entity_id, new_values, ip_address, user_agent, created_at)
+		 VALUES ($1, $2, 'user', $1, $3, $4, $5, $6)`,
+		userID, action, payload, c.ClientIP(), c.Request.UserAgent(), time.Now(),
+	)
+	if err != nil {
+		log.Printf("[auth] failed to record %s for user %s: %v", action, userID, err)
+	}
+}
@@ -135,6 +135,7 @@ func (h *Handler) Verify2FA(c *gin.Context) {
 		return
 	}
 
+	h.recordAuthEvent(c, userID, ActionLogin, map[string]interface{}{"method": "2fa_" + req.Method})
 	c.JSON(http.StatusOK, authResp)
 }
 
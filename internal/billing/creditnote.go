@@ -0,0 +1,234 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/gin-gonic/gin"
+)
+
+// 贷项通知单来源
+const (
+	CreditNoteKindRefund = "refund"
+	CreditNoteKindManual = "manual"
+)
+
+// 贷项通知单结算方式：refund 已原路退款，account_credit 计入账户余额，none 仅冲减账目
+const (
+	CreditNoteSettlementRefund        = "refund"
+	CreditNoteSettlementAccountCredit = "account_credit"
+	CreditNoteSettlementNone          = "none"
+)
+
+var (
+	ErrCreditNoteNotFound  = errors.New("credit note not found")
+	ErrCreditNoteForbidden = errors.New("credit note access forbidden")
+)
+
+// CreditNote 贷项通知单，冲减原发票的金额。Amount 为正数
+type CreditNote struct {
+	ID               string           `json:"id"`
+	UserID           string           `json:"user_id"`
+	CreditNoteNumber string           `json:"credit_note_number"`
+	InvoiceID        *string          `json:"invoice_id"`
+	InvoiceNumber    *string          `json:"invoice_number"`
+	RefundID         *string          `json:"refund_id,omitempty"`
+	Kind             string           `json:"kind"`
+	Settlement       string           `json:"settlement"`
+	Status           string           `json:"status"`
+	Amount           string           `json:"amount"`
+	Currency         string           `json:"currency"`
+	Reason           *string          `json:"reason"`
+	Items            []CreditNoteItem `json:"items,omitempty"`
+	VoidedAt         *time.Time       `json:"voided_at,omitempty"`
+	CreatedAt        time.Time        `json:"created_at"`
+}
+
+type CreditNoteItem struct {
+	ID            string  `json:"id"`
+	InvoiceItemID *string `json:"invoice_item_id,omitempty"`
+	Description   string  `json:"description"`
+	Quantity      int     `json:"quantity"`
+	UnitPrice     string  `json:"unit_price"`
+	Amount        string  `json:"amount"`
+	Kind          string  `json:"kind"`
+}
+
+type AdminCreditNoteSummary struct {
+	ID               string    `json:"id"`
+	CreditNoteNumber string    `json:"credit_note_number"`
+	InvoiceID        *string   `json:"invoice_id"`
+	InvoiceNumber    *string   `json:"invoice_number"`
+	CustomerName     string    `json:"customer_name"`
+	CustomerEmail    string    `json:"customer_email"`
+	Kind             string    `json:"kind"`
+	Settlement       string    `json:"settlement"`
+	Status           string    `json:"status"`
+	Amount           float64   `json:"amount"`
+	Currency         string    `json:"currency"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// CreateCreditNoteRequest 管理员手工开具贷项通知单
+type CreateCreditNoteRequest struct {
+	InvoiceID  string                  `json:"invoice_id" binding:"required,uuid"`
+	Reason     string                  `json:"reason" binding:"required,max=500"`
+	Settlement string                  `json:"settlement" binding:"required,oneof=account_credit none"`
+	Items      []CreditNoteItemRequest `json:"items" binding:"required,min=1,max=50,dive"`
+}
+
+// CreditNoteItemRequest 手工明细；quantity 缺省为 1，unit_price 为正数
+type CreditNoteItemRequest struct {
+	InvoiceItemID string `json:"invoice_item_id" binding:"omitempty,uuid"`
+	Description   string `json:"description" binding:"required,max=500"`
+	Quantity      int    `json:"quantity" binding:"omitempty,min=1,max=10000"`
+	UnitPrice     string `json:"unit_price" binding:"required"`
+}
+
+// ListCreditNotes 获取用户的贷项通知单列表
+func (h *Handler) ListCreditNotes(c *gin.Context) {
+	userID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	notes, total, err := h.listUserCreditNotes(c.Request.Context(), userID, page, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"credit_notes": notes,
+		"total":        total,
+		"page":         page,
+		"limit":        limit,
+	})
+}
+
+// GetCreditNote 获取单个贷项通知单详情
+func (h *Handler) GetCreditNote(c *gin.Context) {
+	userID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	note, err := h.getUserCreditNote(c.Request.Context(), userID, c.Param("id"))
+	if err != nil {
+		writeCreditNoteError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, note)
+}
+
+// GetCreditNotePDF 下载贷项通知单 PDF
+func (h *Handler) GetCreditNotePDF(c *gin.Context) {
+	userID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	if _, err := h.getUserCreditNote(c.Request.Context(), userID, c.Param("id")); err != nil {
+		writeCreditNoteError(c, err)
+		return
+	}
+
+	h.writeCreditNotePDF(c, c.Param("id"))
+}
+
+// AdminGetCreditNote 管理员查看任意贷项通知单
+func (h *Handler) AdminGetCreditNote(c *gin.Context) {
+	note, err := h.getCreditNote(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		writeCreditNoteError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, note)
+}
+
+// AdminGetCreditNotePDF 管理员下载任意贷项通知单 PDF
+func (h *Handler) AdminGetCreditNotePDF(c *gin.Context) {
+	h.writeCreditNotePDF(c, c.Param("id"))
+}
+
+func (h *Handler) writeCreditNotePDF(c *gin.Context, creditNoteID string) {
+	doc, err := h.loadCreditNoteDocument(c.Request.Context(), creditNoteID)
+	if err != nil {
+		writeCreditNoteError(c, err)
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, doc.CreditNote.CreditNoteNumber))
+	c.Data(http.StatusOK, "application/pdf", renderCreditNotePDF(doc))
+}
+
+func writeCreditNoteError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrCreditNoteNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Credit note not found"})
+	case errors.Is(err, ErrCreditNoteForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// AdminListCreditNotes 管理员查看所有贷项通知单，可按 user_id、invoice_id 过滤
+func (h *Handler) AdminListCreditNotes(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	notes, total, err := h.listAdminCreditNotes(c.Request.Context(), c.Query("user_id"), c.Query("invoice_id"), page, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+	c.Header("X-Page", strconv.Itoa(page))
+	c.Header("X-Limit", strconv.Itoa(limit))
+	c.JSON(http.StatusOK, notes)
+}
+
+// AdminCreateCreditNote 管理员针对已支付发票手工开具贷项通知单
+func (h *Handler) AdminCreateCreditNote(c *gin.Context) {
+	adminID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	var req CreateCreditNoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	note, svcErr := h.createManualCreditNote(c.Request.Context(), adminID, req, c.ClientIP(), c.Request.UserAgent())
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+
+	c.JSON(http.StatusCreated, note)
+}
@@ -0,0 +1,128 @@
+package billing
+
+import (
+	"context"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/pdf"
+)
+
+// CreditNoteDocument 渲染贷项通知单所需的全部数据
+type CreditNoteDocument struct {
+	CreditNote *CreditNote
+	Seller     Party
+	Buyer      Party
+}
+
+// loadCreditNoteDocument 读取贷项通知单。双方信息沿用原发票的快照，与被冲减的发票保持一致
+func (h *Handler) loadCreditNoteDocument(ctx context.Context, creditNoteID string) (*CreditNoteDocument, error) {
+	note, err := h.getCreditNote(ctx, creditNoteID)
+	if err != nil {
+		return nil, err
+	}
+
+	if note.InvoiceID != nil {
+		invoiceDoc, err := h.loadInvoiceDocument(ctx, *note.InvoiceID)
+		if err != nil {
+			return nil, err
+		}
+		return &CreditNoteDocument{CreditNote: note, Seller: invoiceDoc.Seller, Buyer: invoiceDoc.Buyer}, nil
+	}
+
+	buyer, err := h.buyerParty(ctx, note.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return &CreditNoteDocument{CreditNote: note, Seller: h.sellerParty(), Buyer: buyer}, nil
+}
+
+// renderCreditNotePDF 排版贷项通知单，版式与发票一致，合计以负数表示冲减
+func renderCreditNotePDF(doc *CreditNoteDocument) []byte {
+	note := doc.CreditNote
+	out := pdf.New("Credit note " + note.CreditNoteNumber)
+	out.AddPage()
+
+	y := drawDocumentHeader(out, doc.Seller, "CREDIT NOTE", creditNoteMetaRows(note))
+	y = drawBillTo(out, y, "CREDIT TO", doc.Buyer)
+
+	items := make([]InvoiceItem, 0, len(note.Items))
+	for _, item := range note.Items {
+		items = append(items, InvoiceItem{
+			Description: item.Description,
+			Quantity:    item.Quantity,
+			UnitPrice:   item.UnitPrice,
+			Amount:      item.Amount,
+			Kind:        item.Kind,
+		})
+	}
+	y = drawItemTable(out, y, items, note.Currency)
+
+	if y+90 > pdfBottom {
+		out.AddPage()
+		y = pdfMargin + 10
+	}
+	colUnit := pdfRight - 90
+	out.Line(pdfRight-240, y, pdfRight, y, 0.5)
+	y += 16
+	for _, row := range creditNoteTotalRows(note) {
+		bold := row[0] == "Total credit"
+		out.TextRight(colUnit, y, 10, bold, row[0])
+		out.TextRight(pdfRight-6, y, 10, bold, row[1])
+		y += 15
+	}
+
+	if note.Reason != nil && *note.Reason != "" {
+		y += 10
+		out.Text(pdfMargin, y, 9, true, "Reason")
+		y += 13
+		for _, line := range pdf.Wrap(*note.Reason, 9, false, pdfRight-pdfMargin) {
+			out.Text(pdfMargin, y, 9, false, line)
+			y += 12
+		}
+	}
+
+	if note.Status == "void" {
+		y += 20
+		out.Text(pdfMargin, y, 22, true, "VOID")
+	}
+
+	drawFooter(out, doc.Seller)
+	return out.Bytes()
+}
+
+func creditNoteMetaRows(note *CreditNote) [][2]string {
+	rows := [][2]string{
+		{"Credit note number", note.CreditNoteNumber},
+		{"Issue date", formatDate(&note.CreatedAt)},
+	}
+	if note.InvoiceNumber != nil {
+		rows = append(rows, [2]string{"Original invoice", *note.InvoiceNumber})
+	}
+	return rows
+}
+
+func creditNoteTotalRows(note *CreditNote) [][2]string {
+	var rows [][2]string
+	for _, item := range note.Items {
+		if item.Kind == itemKindTax {
+			rows = append(rows, [2]string{item.Description, formatMoney(negate(item.Amount), note.Currency)})
+		}
+	}
+	rows = append(rows, [2]string{"Total credit", formatMoney(negate(note.Amount), note.Currency)})
+
+	switch note.Settlement {
+	case CreditNoteSettlementRefund:
+		rows = append(rows, [2]string{"Settled by", "Refund"})
+	case CreditNoteSettlementAccountCredit:
+		rows = append(rows, [2]string{"Settled by", "Account credit"})
+	}
+	return rows
+}
+
+func negate(amount string) string {
+	cents, err := common.DecimalAmountToCents(amount)
+	if err != nil {
+		return amount
+	}
+	return common.CentsToDecimal(-cents)
+}
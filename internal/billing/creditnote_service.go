@@ -0,0 +1,515 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/app"
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/credit"
+	"github.com/adiecho/echobilling/internal/numbering"
+	"github.com/jackc/pgx/v5"
+)
+
+const creditNoteColumns = `cn.id, cn.user_id, cn.credit_note_number, cn.invoice_id::text, i.invoice_number, cn.refund_id::text,
+	cn.kind, cn.settlement, cn.status, cn.amount::text, cn.currency, cn.reason, cn.voided_at, cn.created_at`
+
+const creditNoteFrom = ` FROM credit_notes cn LEFT JOIN invoices i ON i.id = cn.invoice_id`
+
+func scanCreditNote(row pgx.Row, n *CreditNote) error {
+	if err := row.Scan(
+		&n.ID, &n.UserID, &n.CreditNoteNumber, &n.InvoiceID, &n.InvoiceNumber, &n.RefundID,
+		&n.Kind, &n.Settlement, &n.Status, &n.Amount, &n.Currency, &n.Reason, &n.VoidedAt, &n.CreatedAt,
+	); err != nil {
+		return err
+	}
+	n.Amount = common.NormalizeAmount(n.Amount)
+	return nil
+}
+
+// creditNoteLine 待写入的贷项通知单明细，金额单位为分
+type creditNoteLine struct {
+	InvoiceItemID string
+	Description   string
+	Quantity      int
+	UnitPrice     int64
+	Amount        int64
+}
+
+// CreditableAmount 发票还能开具贷项通知单的金额（分），已开具（未作废）的贷项通知单合计不超过发票总额
+func CreditableAmount(invoiceTotal, credited int64) int64 {
+	if credited >= invoiceTotal {
+		return 0
+	}
+	return invoiceTotal - credited
+}
+
+// creditsWholeInvoice 退款是否一次冲销了整张发票（此前没有其他贷项通知单）
+func creditsWholeInvoice(amount, invoiceTotal, otherCredited int64) bool {
+	return otherCredited == 0 && amount == invoiceTotal
+}
+
+// manualCreditNoteLines 校验手工明细并计算合计（分）
+func manualCreditNoteLines(items []CreditNoteItemRequest) ([]creditNoteLine, int64, error) {
+	lines := make([]creditNoteLine, 0, len(items))
+	var total int64
+	for i, item := range items {
+		description := strings.TrimSpace(item.Description)
+		if description == "" {
+			return nil, 0, fmt.Errorf("item %d: description is required", i+1)
+		}
+		quantity := item.Quantity
+		if quantity == 0 {
+			quantity = 1
+		}
+		if quantity < 0 {
+			return nil, 0, fmt.Errorf("item %d: quantity must be positive", i+1)
+		}
+		unitPrice, err := common.DecimalAmountToCents(item.UnitPrice)
+		if err != nil || unitPrice <= 0 {
+			return nil, 0, fmt.Errorf("item %d: unit_price must be a positive amount", i+1)
+		}
+		amount := unitPrice * int64(quantity)
+		lines = append(lines, creditNoteLine{
+			InvoiceItemID: item.InvoiceItemID,
+			Description:   description,
+			Quantity:      quantity,
+			UnitPrice:     unitPrice,
+			Amount:        amount,
+		})
+		total += amount
+	}
+	return lines, total, nil
+}
+
+// issueRefundCreditNote 为退款签发贷项通知单，每笔退款只签发一次。
+// 一笔退款冲销整张发票时逐行复制发票明细，否则只记一行退款金额
+func issueRefundCreditNote(ctx context.Context, tx pgx.Tx, store *app.SettingsStore, refundID string, now time.Time) error {
+	var exists bool
+	if err := tx.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM credit_notes WHERE refund_id = $1)`,
+		refundID,
+	).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check credit note: %w", err)
+	}
+	if exists {
+		return nil
+	}
+
+	number, err := numbering.Next(ctx, tx, store, numbering.SeriesCreditNote, now)
+	if err != nil {
+		return err
+	}
+
+	var (
+		creditNoteID string
+		invoiceID    *string
+		amount       string
+	)
+	if err := tx.QueryRow(ctx,
+		`INSERT INTO credit_notes (credit_note_number, user_id, invoice_id, refund_id, amount, currency, reason,
+		                           kind, settlement, created_by, created_at, updated_at)
+		 SELECT $2, p.user_id, p.invoice_id, r.id, r.amount, p.currency, r.reason, 'refund', 'refund', r.created_by, $3, $3
+		 FROM refunds r
+		 JOIN payments p ON p.id = r.payment_id
+		 WHERE r.id = $1
+		 RETURNING id, invoice_id::text, amount::text`,
+		refundID, number, now,
+	).Scan(&creditNoteID, &invoiceID, &amount); err != nil {
+		return fmt.Errorf("failed to issue credit note: %w", err)
+	}
+
+	if invoiceID == nil {
+		_, err := tx.Exec(ctx,
+			`INSERT INTO credit_note_items (credit_note_id, description, quantity, unit_price, amount, created_at)
+			 VALUES ($1, 'Refund', 1, $2, $2, $3)`,
+			creditNoteID, amount, now,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to add credit note item: %w", err)
+		}
+		return nil
+	}
+
+	var invoiceNumber, invoiceTotal, otherCredited string
+	if err := tx.QueryRow(ctx,
+		`SELECT i.invoice_number, i.total::text,
+		        COALESCE((SELECT SUM(amount) FROM credit_notes
+		                  WHERE invoice_id = i.id AND status = 'issued' AND id <> $2), 0)::text
+		 FROM invoices i
+		 WHERE i.id = $1`,
+		*invoiceID, creditNoteID,
+	).Scan(&invoiceNumber, &invoiceTotal, &otherCredited); err != nil {
+		return fmt.Errorf("failed to get invoice: %w", err)
+	}
+
+	amountCents, err := common.DecimalAmountToCents(amount)
+	if err != nil {
+		return fmt.Errorf("invalid credit note amount: %w", err)
+	}
+	totalCents, err := common.DecimalAmountToCents(invoiceTotal)
+	if err != nil {
+		return fmt.Errorf("invalid invoice total: %w", err)
+	}
+	otherCents, err := common.DecimalAmountToCents(otherCredited)
+	if err != nil {
+		return fmt.Errorf("invalid credited amount: %w", err)
+	}
+
+	if creditsWholeInvoice(amountCents, totalCents, otherCents) {
+		_, err = tx.Exec(ctx,
+			`INSERT INTO credit_note_items (credit_note_id, invoice_item_id, description, quantity, unit_price, amount, kind, created_at)
+			 SELECT $1, id, description, quantity, unit_price, amount, kind, $3
+			 FROM invoice_items
+			 WHERE invoice_id = $2`,
+			creditNoteID, *invoiceID, now,
+		)
+	} else {
+		_, err = tx.Exec(ctx,
+			`INSERT INTO credit_note_items (credit_note_id, description, quantity, unit_price, amount, created_at)
+			 VALUES ($1, $2, 1, $3, $3, $4)`,
+			creditNoteID, "Refund of invoice "+invoiceNumber, amount, now,
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add credit note items: %w", err)
+	}
+	return nil
+}
+
+// createManualCreditNote 为已支付的发票手工开具贷项通知单，account_credit 结算时同时计入客户余额
+func (h *Handler) createManualCreditNote(ctx context.Context, adminID string, req CreateCreditNoteRequest, ip, userAgent string) (*CreditNote, *common.ServiceError) {
+	lines, amount, err := manualCreditNoteLines(req.Items)
+	if err != nil {
+		return nil, common.ErrBadRequest(err.Error(), err)
+	}
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return nil, common.ErrInternal("Database error", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// 锁定发票，串行化同一发票上的贷项通知单，避免累计超额
+	var userID, invoiceNumber, status, total, currency, credited string
+	err = tx.QueryRow(ctx,
+		`SELECT user_id, COALESCE(invoice_number, ''), status::text, total::text, currency,
+		        COALESCE((SELECT SUM(amount) FROM credit_notes WHERE invoice_id = invoices.id AND status = 'issued'), 0)::text
+		 FROM invoices
+		 WHERE id = $1
+		 FOR UPDATE`,
+		req.InvoiceID,
+	).Scan(&userID, &invoiceNumber, &status, &total, &currency, &credited)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, common.ErrNotFound("Invoice not found", err)
+		}
+		return nil, common.ErrInternal("Database error", err)
+	}
+	if status != "paid" && status != "partially_refunded" && status != "refunded" {
+		// 未支付的发票直接作废，不开贷项通知单
+		return nil, common.NewServiceError(http.StatusConflict, "Credit notes can only be issued for paid invoices", nil)
+	}
+
+	if req.Settlement == CreditNoteSettlementAccountCredit && !credit.SameCurrency(currency) {
+		return nil, common.ErrBadRequest(
+			fmt.Sprintf("Account credit is held in %s and cannot settle a %s invoice", credit.Currency, currency), nil)
+	}
+
+	totalCents, err := common.DecimalAmountToCents(total)
+	if err != nil {
+		return nil, common.ErrInternal("Invalid invoice total", err)
+	}
+	creditedCents, err := common.DecimalAmountToCents(credited)
+	if err != nil {
+		return nil, common.ErrInternal("Invalid credited amount", err)
+	}
+	creditable := CreditableAmount(totalCents, creditedCents)
+	if creditable == 0 {
+		return nil, common.NewServiceError(http.StatusConflict, "Invoice has already been fully credited", nil)
+	}
+	if amount > creditable {
+		return nil, common.ErrBadRequest(
+			fmt.Sprintf("Credit note total exceeds the creditable amount of %s %s", common.CentsToDecimal(creditable), currency), nil)
+	}
+
+	for _, line := range lines {
+		if line.InvoiceItemID == "" {
+			continue
+		}
+		var belongs bool
+		if err := tx.QueryRow(ctx,
+			`SELECT EXISTS (SELECT 1 FROM invoice_items WHERE id = $1 AND invoice_id = $2)`,
+			line.InvoiceItemID, req.InvoiceID,
+		).Scan(&belongs); err != nil {
+			return nil, common.ErrInternal("Database error", err)
+		}
+		if !belongs {
+			return nil, common.ErrBadRequest("Invoice item does not belong to the invoice", nil)
+		}
+	}
+
+	now := time.Now()
+	number, err := numbering.Next(ctx, tx, h.store, numbering.SeriesCreditNote, now)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to allocate credit note number", err)
+	}
+
+	var creditNoteID string
+	err = tx.QueryRow(ctx,
+		`INSERT INTO credit_notes (credit_note_number, user_id, invoice_id, amount, currency, reason,
+		                           kind, settlement, created_by, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, 'manual', $7, $8, $9, $9)
+		 RETURNING id`,
+		number, userID, req.InvoiceID, common.CentsToDecimal(amount), currency, req.Reason,
+		req.Settlement, adminID, now,
+	).Scan(&creditNoteID)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to create credit note", err)
+	}
+
+	for _, line := range lines {
+		var invoiceItemID interface{}
+		if line.InvoiceItemID != "" {
+			invoiceItemID = line.InvoiceItemID
+		}
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO credit_note_items (credit_note_id, invoice_item_id, description, quantity, unit_price, amount, created_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			creditNoteID, invoiceItemID, line.Description, line.Quantity,
+			common.CentsToDecimal(line.UnitPrice), common.CentsToDecimal(line.Amount), now,
+		); err != nil {
+			return nil, common.ErrInternal("Failed to create credit note item", err)
+		}
+	}
+
+	if req.Settlement == CreditNoteSettlementAccountCredit {
+		if _, err := credit.Post(ctx, tx, credit.Entry{
+			UserID:       userID,
+			Kind:         credit.KindCreditNote,
+			Amount:       amount,
+			Reason:       "Credit note " + number + " for invoice " + invoiceNumber,
+			InvoiceID:    req.InvoiceID,
+			CreditNoteID: creditNoteID,
+			CreatedBy:    adminID,
+		}, now); err != nil {
+			return nil, common.ErrInternal("Failed to post account credit", err)
+		}
+	}
+
+	details, _ := json.Marshal(map[string]interface{}{
+		"credit_note_number": number,
+		"invoice_id":         req.InvoiceID,
+		"amount":             common.CentsToDecimal(amount),
+		"settlement":         req.Settlement,
+		"reason":             req.Reason,
+	})
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO audit_logs (user_id, action, entity_type, entity_id, new_values, ip_address, user_agent, created_at)
+		 VALUES ($1, 'credit_note_issued', 'credit_note', $2, $3, $4, $5, $6)`,
+		adminID, creditNoteID, details, ip, userAgent, now,
+	); err != nil {
+		return nil, common.ErrInternal("Failed to write audit log", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, common.ErrInternal("Failed to commit credit note", err)
+	}
+
+	note, err := h.getCreditNote(ctx, creditNoteID)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to load credit note", err)
+	}
+	return note, nil
+}
+
+func (h *Handler) listUserCreditNotes(ctx context.Context, userID string, page, limit int) ([]CreditNote, int64, error) {
+	offset := (page - 1) * limit
+
+	var total int64
+	if err := h.pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM credit_notes WHERE user_id = $1`,
+		userID,
+	).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := h.pool.Query(ctx,
+		`SELECT `+creditNoteColumns+creditNoteFrom+`
+		 WHERE cn.user_id = $1
+		 ORDER BY cn.created_at DESC
+		 LIMIT $2 OFFSET $3`,
+		userID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	notes := make([]CreditNote, 0)
+	for rows.Next() {
+		var n CreditNote
+		if err := scanCreditNote(rows, &n); err != nil {
+			return nil, 0, err
+		}
+		notes = append(notes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return notes, total, nil
+}
+
+// listInvoiceCreditNotes 发票上开具的贷项通知单，不含明细
+func (h *Handler) listInvoiceCreditNotes(ctx context.Context, invoiceID string) ([]CreditNote, error) {
+	rows, err := h.pool.Query(ctx,
+		`SELECT `+creditNoteColumns+creditNoteFrom+`
+		 WHERE cn.invoice_id = $1
+		 ORDER BY cn.created_at`,
+		invoiceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := make([]CreditNote, 0)
+	for rows.Next() {
+		var n CreditNote
+		if err := scanCreditNote(rows, &n); err != nil {
+			return nil, err
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+func (h *Handler) getUserCreditNote(ctx context.Context, userID, creditNoteID string) (*CreditNote, error) {
+	note, err := h.getCreditNote(ctx, creditNoteID)
+	if err != nil {
+		return nil, err
+	}
+	if note.UserID != userID {
+		return nil, ErrCreditNoteForbidden
+	}
+	return note, nil
+}
+
+// getCreditNote 读取贷项通知单及其明细，不做归属校验
+func (h *Handler) getCreditNote(ctx context.Context, creditNoteID string) (*CreditNote, error) {
+	var note CreditNote
+	err := scanCreditNote(h.pool.QueryRow(ctx,
+		`SELECT `+creditNoteColumns+creditNoteFrom+` WHERE cn.id = $1`,
+		creditNoteID,
+	), &note)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrCreditNoteNotFound
+		}
+		return nil, err
+	}
+
+	rows, err := h.pool.Query(ctx,
+		`SELECT id, invoice_item_id::text, description, quantity, unit_price::text, amount::text, kind
+		 FROM credit_note_items
+		 WHERE credit_note_id = $1
+		 ORDER BY created_at, id`,
+		creditNoteID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	note.Items = make([]CreditNoteItem, 0)
+	for rows.Next() {
+		var item CreditNoteItem
+		if err := rows.Scan(&item.ID, &item.InvoiceItemID, &item.Description, &item.Quantity, &item.UnitPrice, &item.Amount, &item.Kind); err != nil {
+			return nil, err
+		}
+		item.UnitPrice = common.NormalizeAmount(item.UnitPrice)
+		item.Amount = common.NormalizeAmount(item.Amount)
+		note.Items = append(note.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+func (h *Handler) listAdminCreditNotes(ctx context.Context, userID, invoiceID string, page, limit int) ([]AdminCreditNoteSummary, int64, error) {
+	offset := (page - 1) * limit
+
+	where := "WHERE TRUE"
+	args := []interface{}{}
+	if userID != "" {
+		args = append(args, userID)
+		where += " AND cn.user_id::text = $" + strconv.Itoa(len(args))
+	}
+	if invoiceID != "" {
+		args = append(args, invoiceID)
+		where += " AND cn.invoice_id::text = $" + strconv.Itoa(len(args))
+	}
+
+	var total int64
+	if err := h.pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM credit_notes cn `+where,
+		args...,
+	).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	args = append(args, limit, offset)
+	rows, err := h.pool.Query(ctx,
+		`SELECT cn.id,
+		        cn.credit_note_number,
+		        cn.invoice_id::text,
+		        i.invoice_number,
+		        COALESCE(NULLIF(u.name, ''), u.email) AS customer_name,
+		        u.email AS customer_email,
+		        cn.kind,
+		        cn.settlement,
+		        cn.status,
+		        cn.amount::text,
+		        cn.currency,
+		        cn.created_at
+		 FROM credit_notes cn
+		 JOIN users u ON u.id = cn.user_id
+		 LEFT JOIN invoices i ON i.id = cn.invoice_id
+		 `+where+`
+		 ORDER BY cn.created_at DESC
+		 LIMIT $`+strconv.Itoa(len(args)-1)+` OFFSET $`+strconv.Itoa(len(args)),
+		args...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	notes := make([]AdminCreditNoteSummary, 0)
+	for rows.Next() {
+		var (
+			n             AdminCreditNoteSummary
+			amountDecimal string
+		)
+		if err := rows.Scan(
+			&n.ID, &n.CreditNoteNumber, &n.InvoiceID, &n.InvoiceNumber,
+			&n.CustomerName, &n.CustomerEmail, &n.Kind, &n.Settlement, &n.Status,
+			&amountDecimal, &n.Currency, &n.CreatedAt,
+		); err != nil {
+			return nil, 0, err
+		}
+		n.Amount, _ = strconv.ParseFloat(amountDecimal, 64)
+		notes = append(notes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return notes, total, nil
+}
@@ -0,0 +1,88 @@
+package billing
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestManualCreditNoteLines(t *testing.T) {
+	t.Parallel()
+
+	lines, total, err := manualCreditNoteLines([]CreditNoteItemRequest{
+		{Description: "  Downtime compensation ", UnitPrice: "2.50", Quantity: 3},
+		{Description: "Goodwill credit", UnitPrice: "1.00"},
+	})
+	if err != nil {
+		t.Fatalf("manualCreditNoteLines: %v", err)
+	}
+	if total != 850 {
+		t.Fatalf("total = %d, want 850", total)
+	}
+	if lines[0].Description != "Downtime compensation" || lines[0].Amount != 750 {
+		t.Fatalf("first line = %+v", lines[0])
+	}
+	if lines[1].Quantity != 1 || lines[1].Amount != 100 {
+		t.Fatalf("quantity should default to 1: %+v", lines[1])
+	}
+
+	for _, bad := range []CreditNoteItemRequest{
+		{Description: "Zero", UnitPrice: "0.00"},
+		{Description: "Negative", UnitPrice: "-1.00"},
+		{Description: "Garbage", UnitPrice: "abc"},
+		{Description: "   ", UnitPrice: "1.00"},
+	} {
+		if _, _, err := manualCreditNoteLines([]CreditNoteItemRequest{bad}); err == nil {
+			t.Fatalf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestCreditableAmount(t *testing.T) {
+	t.Parallel()
+
+	if got := CreditableAmount(12000, 2000); got != 10000 {
+		t.Fatalf("CreditableAmount = %d, want 10000", got)
+	}
+	if got := CreditableAmount(12000, 12500); got != 0 {
+		t.Fatalf("CreditableAmount over-credited = %d, want 0", got)
+	}
+	if !creditsWholeInvoice(12000, 12000, 0) {
+		t.Fatal("full refund without earlier credit notes should copy invoice items")
+	}
+	if creditsWholeInvoice(12000, 12000, 500) || creditsWholeInvoice(5000, 12000, 0) {
+		t.Fatal("partial refunds should not copy invoice items")
+	}
+}
+
+func TestRenderCreditNotePDF(t *testing.T) {
+	t.Parallel()
+
+	invoiceNumber := "INV-2026-000042"
+	reason := "Service outage on 2026-02-10"
+	out := renderCreditNotePDF(&CreditNoteDocument{
+		CreditNote: &CreditNote{
+			CreditNoteNumber: "CN-2026-000007",
+			InvoiceNumber:    &invoiceNumber,
+			Kind:             CreditNoteKindManual,
+			Settlement:       CreditNoteSettlementAccountCredit,
+			Status:           "issued",
+			Amount:           "12.00",
+			Currency:         "eur",
+			Reason:           &reason,
+			CreatedAt:        time.Date(2026, 2, 15, 0, 0, 0, 0, time.UTC),
+			Items: []CreditNoteItem{
+				{Description: "Downtime compensation", Quantity: 1, UnitPrice: "10.00", Amount: "10.00", Kind: "line"},
+				{Description: "VAT 20%", Quantity: 1, UnitPrice: "2.00", Amount: "2.00", Kind: itemKindTax},
+			},
+		},
+		Seller: Party{Name: "EchoBilling"},
+		Buyer:  Party{Name: "Jane Doe", Country: "DE"},
+	})
+
+	for _, want := range []string{"(CREDIT NOTE) Tj", "(CN-2026-000007) Tj", "(INV-2026-000042) Tj", "(EUR -12.00) Tj", "(EUR -2.00) Tj", "(Account credit) Tj"} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Fatalf("rendered PDF missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Party 单据上的卖方或买方
+type Party struct {
+	Name         string `json:"name"`
+	LegalName    string `json:"legal_name,omitempty"`
+	CompanyName  string `json:"company_name,omitempty"`
+	Email        string `json:"email,omitempty"`
+	Website      string `json:"website,omitempty"`
+	AddressLine1 string `json:"address_line1,omitempty"`
+	AddressLine2 string `json:"address_line2,omitempty"`
+	City         string `json:"city,omitempty"`
+	State        string `json:"state,omitempty"`
+	PostalCode   string `json:"postal_code,omitempty"`
+	Country      string `json:"country,omitempty"`
+	TaxID        string `json:"tax_id,omitempty"`
+}
+
+// AddressLines 返回适合逐行打印的地址
+func (p Party) AddressLines() []string {
+	lines := make([]string, 0, 4)
+	for _, line := range []string{p.AddressLine1, p.AddressLine2} {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	cityLine := strings.TrimSpace(strings.Join(nonEmpty(p.PostalCode, p.City, p.State), " "))
+	if cityLine != "" {
+		lines = append(lines, cityLine)
+	}
+	if country := strings.TrimSpace(p.Country); country != "" {
+		lines = append(lines, country)
+	}
+	return lines
+}
+
+func nonEmpty(values ...string) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+type partySnapshot struct {
+	Seller Party `json:"seller"`
+	Buyer  Party `json:"buyer"`
+}
+
+// InvoiceDocument 渲染发票单据（PDF 等）所需的全部数据
+type InvoiceDocument struct {
+	Invoice *Invoice
+	Seller  Party
+	Buyer   Party
+}
+
+// loadInvoiceDocument 读取发票及双方信息。发票定稿（非草稿）后首次读取时冻结双方信息，
+// 之后始终使用快照，保证已开具单据的内容不随品牌设置或客户资料变化。
+func (h *Handler) loadInvoiceDocument(ctx context.Context, invoiceID string) (*InvoiceDocument, error) {
+	inv, err := h.getInvoice(ctx, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	if err := h.pool.QueryRow(ctx,
+		`SELECT party_snapshot FROM invoices WHERE id = $1`,
+		invoiceID,
+	).Scan(&raw); err != nil {
+		return nil, err
+	}
+
+	var snapshot partySnapshot
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &snapshot); err != nil {
+			return nil, err
+		}
+		return &InvoiceDocument{Invoice: inv, Seller: snapshot.Seller, Buyer: snapshot.Buyer}, nil
+	}
+
+	snapshot.Seller = h.sellerParty()
+	snapshot.Buyer, err = h.buyerParty(ctx, inv.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if inv.Status != "draft" {
+		encoded, _ := json.Marshal(snapshot)
+		// 并发请求时以先写入的快照为准
+		err := h.pool.QueryRow(ctx,
+			`UPDATE invoices
+			 SET party_snapshot = COALESCE(party_snapshot, $2::jsonb)
+			 WHERE id = $1
+			 RETURNING party_snapshot`,
+			invoiceID, encoded,
+		).Scan(&raw)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &snapshot); err != nil {
+			return nil, err
+		}
+	}
+
+	return &InvoiceDocument{Invoice: inv, Seller: snapshot.Seller, Buyer: snapshot.Buyer}, nil
+}
+
+func (h *Handler) sellerParty() Party {
+	if h.store == nil {
+		return Party{Name: "EchoBilling"}
+	}
+
+	seller := Party{
+		Name:         h.store.Get("site_name"),
+		LegalName:    h.store.Get("company_legal_name"),
+		Email:        h.store.Get("company_email"),
+		Website:      h.store.Get("site_domain"),
+		AddressLine1: h.store.Get("company_address_line1"),
+		AddressLine2: h.store.Get("company_address_line2"),
+		City:         h.store.Get("company_city"),
+		State:        h.store.Get("company_state"),
+		PostalCode:   h.store.Get("company_postal_code"),
+		Country:      h.store.Get("company_country"),
+		TaxID:        h.store.Get("company_tax_id"),
+	}
+	if seller.Country == "" {
+		seller.Country = h.store.Get("tax_home_country")
+	}
+	if seller.Name == "" {
+		seller.Name = seller.LegalName
+	}
+	if seller.Name == "" {
+		seller.Name = "EchoBilling"
+	}
+	return seller
+}
+
+func (h *Handler) buyerParty(ctx context.Context, userID string) (Party, error) {
+	var buyer Party
+	err := h.pool.QueryRow(ctx,
+		`SELECT COALESCE(NULLIF(cp.full_name, ''), NULLIF(u.name, ''), u.email),
+		        u.email,
+		        COALESCE(cp.company_name, ''),
+		        COALESCE(cp.address_line1, ''),
+		        COALESCE(cp.address_line2, ''),
+		        COALESCE(cp.city, ''),
+		        COALESCE(cp.state, ''),
+		        COALESCE(cp.postal_code, ''),
+		        COALESCE(cp.country, ''),
+		        COALESCE(cp.tax_id, '')
+		 FROM users u
+		 LEFT JOIN customer_profiles cp ON cp.user_id = u.id
+		 WHERE u.id = $1`,
+		userID,
+	).Scan(
+		&buyer.Name, &buyer.Email, &buyer.CompanyName,
+		&buyer.AddressLine1, &buyer.AddressLine2, &buyer.City, &buyer.State,
+		&buyer.PostalCode, &buyer.Country, &buyer.TaxID,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Party{}, nil
+	}
+	return buyer, err
+}
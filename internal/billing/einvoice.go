@@ -0,0 +1,424 @@
+package billing
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/invoicestatus"
+	"github.com/adiecho/echobilling/internal/tax"
+)
+
+// 电子发票格式，同时作为 invoice_documents 的缓存格式
+const (
+	EInvoiceUBL     = "ubl"
+	EInvoiceFacturX = "facturx"
+)
+
+// en16931CustomizationID 按 EN 16931 核心规范输出（BT-24）
+const en16931CustomizationID = "urn:cen.eu:en16931:2017"
+
+// ErrInvoiceNotIssued 草稿和已作废的发票不能导出电子发票
+var ErrInvoiceNotIssued = errors.New("invoice has not been issued")
+
+// eInvoice 两种电子发票格式共用的 EN 16931 语义模型，金额单位为分
+type eInvoice struct {
+	Number    string
+	IssueDate time.Time
+	DueDate   *time.Time
+	Currency  string
+	Note      string
+
+	PeriodStart *time.Time
+	PeriodEnd   *time.Time
+
+	Seller eParty
+	Buyer  eParty
+
+	Lines      []eLine
+	Allowances []eAllowance
+	Tax        eTax
+
+	LineTotal      int64 // BT-106
+	AllowanceTotal int64 // BT-107
+	TaxExclusive   int64 // BT-109
+	TaxAmount      int64 // BT-110
+	TaxInclusive   int64 // BT-112
+	Prepaid        int64 // BT-113
+	Payable        int64 // BT-115
+
+	// PaymentTerms 没有到期日但仍有应付金额时的付款条款（BR-CO-25）
+	PaymentTerms string
+}
+
+type eParty struct {
+	LegalName    string
+	TradingName  string
+	Email        string
+	AddressLine1 string
+	AddressLine2 string
+	City         string
+	State        string
+	PostalCode   string
+	Country      string
+	VATID        string
+}
+
+type eLine struct {
+	ID       string
+	Name     string
+	Quantity int
+	Net      int64
+	Price    string
+}
+
+type eAllowance struct {
+	Reason string
+	Amount int64
+}
+
+// eTax 发票只有一个税种：来自税费行，没有税费行时为不征税（O）
+type eTax struct {
+	Category        string
+	Rate            string
+	ExemptionReason string
+	ExemptionCode   string
+}
+
+// invoiceEInvoice 返回发票的电子发票 XML，按发票状态缓存，规则同 invoicePDF
+func (h *Handler) invoiceEInvoice(ctx context.Context, invoiceID, format string) ([]byte, *Invoice, error) {
+	doc, err := h.loadInvoiceDocument(ctx, invoiceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	inv := doc.Invoice
+	if inv.Status == invoicestatus.Draft || inv.Status == invoicestatus.Void {
+		return nil, nil, ErrInvoiceNotIssued
+	}
+
+	variant := documentVariant(inv)
+	cached, err := h.cachedDocument(ctx, invoiceID, format, variant)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cached != nil {
+		return cached, inv, nil
+	}
+
+	model, err := buildEInvoice(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	var content []byte
+	switch format {
+	case EInvoiceUBL:
+		content = renderUBL(model)
+	case EInvoiceFacturX:
+		content = renderFacturX(model)
+	default:
+		return nil, nil, fmt.Errorf("unknown e-invoice format %q", format)
+	}
+
+	stored, err := h.storeDocument(ctx, invoiceID, format, variant, content)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stored, inv, nil
+}
+
+// buildEInvoice 把发票换算为 EN 16931 模型。发票上的金额可能含税，
+// 明细行按比例折算为不含税金额，合计精确等于 total - tax
+func buildEInvoice(doc *InvoiceDocument) (*eInvoice, error) {
+	inv := doc.Invoice
+	total, err := common.DecimalAmountToCents(inv.Total)
+	if err != nil {
+		return nil, fmt.Errorf("invoice total: %w", err)
+	}
+	taxAmount, err := common.DecimalAmountToCents(inv.Tax)
+	if err != nil {
+		return nil, fmt.Errorf("invoice tax: %w", err)
+	}
+	creditApplied, err := common.DecimalAmountToCents(inv.CreditApplied)
+	if err != nil {
+		creditApplied = 0
+	}
+
+	out := &eInvoice{
+		Number:      inv.InvoiceNumber,
+		IssueDate:   inv.CreatedAt.UTC(),
+		DueDate:     inv.DueDate,
+		Currency:    strings.ToUpper(inv.Currency),
+		PeriodStart: inv.PeriodStart,
+		PeriodEnd:   inv.PeriodEnd,
+		TaxAmount:   taxAmount,
+		Tax:         invoiceTaxCategory(inv),
+	}
+	if inv.FinalizedAt != nil {
+		out.IssueDate = inv.FinalizedAt.UTC()
+	}
+	if inv.Notes != nil {
+		out.Note = strings.TrimSpace(*inv.Notes)
+	}
+
+	withVAT := out.Tax.Category != tax.CategoryNotSubject
+	out.Seller = eSellerParty(doc.Seller, withVAT)
+	out.Buyer = eBuyerParty(doc.Buyer, withVAT)
+
+	var items []InvoiceItem
+	var amounts []int64
+	for _, item := range inv.Items {
+		if item.Kind == itemKindTax {
+			continue
+		}
+		amount, err := common.DecimalAmountToCents(item.Amount)
+		if err != nil {
+			return nil, fmt.Errorf("invoice item %s: %w", item.ID, err)
+		}
+		items = append(items, item)
+		amounts = append(amounts, amount)
+	}
+
+	net := allocateNet(amounts, total-taxAmount)
+	for i, item := range items {
+		if net[i] < 0 {
+			// 折扣行作为单据级折让（BG-20）
+			out.Allowances = append(out.Allowances, eAllowance{Reason: item.Description, Amount: -net[i]})
+			out.AllowanceTotal -= net[i]
+			continue
+		}
+		qty := item.Quantity
+		if qty < 1 {
+			qty = 1
+		}
+		out.Lines = append(out.Lines, eLine{
+			ID:       strconv.Itoa(len(out.Lines) + 1),
+			Name:     item.Description,
+			Quantity: qty,
+			Net:      net[i],
+			Price:    unitPrice(net[i], qty),
+		})
+		out.LineTotal += net[i]
+	}
+
+	out.TaxExclusive = out.LineTotal - out.AllowanceTotal
+	out.TaxInclusive = out.TaxExclusive + out.TaxAmount
+
+	switch inv.Status {
+	case invoicestatus.Paid, invoicestatus.PartiallyRefunded, invoicestatus.Refunded:
+		out.Prepaid = out.TaxInclusive
+	default:
+		out.Prepaid = min(creditApplied, out.TaxInclusive)
+	}
+	out.Payable = out.TaxInclusive - out.Prepaid
+	if out.Payable > 0 && out.DueDate == nil {
+		out.PaymentTerms = "Payable on receipt"
+	}
+	return out, nil
+}
+
+// invoiceTaxCategory 从税费行读取税种类别和税率
+func invoiceTaxCategory(inv *Invoice) eTax {
+	category := ""
+	rate := ""
+	for _, item := range inv.Items {
+		if item.Kind != itemKindTax {
+			continue
+		}
+		category = item.TaxCategory
+		rate = item.TaxRate
+		if category == "" {
+			category = tax.CategoryStandard
+			if inv.ReverseCharge {
+				category = tax.CategoryReverseCharge
+			}
+		}
+		break
+	}
+	if category == "" && inv.ReverseCharge {
+		category = tax.CategoryReverseCharge
+	}
+
+	switch category {
+	case "":
+		return eTax{Category: tax.CategoryNotSubject, ExemptionReason: "Not subject to VAT", ExemptionCode: "VATEX-EU-O"}
+	case tax.CategoryReverseCharge:
+		return eTax{Category: category, Rate: "0", ExemptionReason: "Reverse charge", ExemptionCode: "VATEX-EU-AE"}
+	default:
+		return eTax{Category: category, Rate: formatPercent(rate)}
+	}
+}
+
+func eSellerParty(p Party, withVAT bool) eParty {
+	out := eParty{
+		LegalName:    strings.TrimSpace(p.LegalName),
+		Email:        strings.TrimSpace(p.Email),
+		AddressLine1: strings.TrimSpace(p.AddressLine1),
+		AddressLine2: strings.TrimSpace(p.AddressLine2),
+		City:         strings.TrimSpace(p.City),
+		State:        strings.TrimSpace(p.State),
+		PostalCode:   strings.TrimSpace(p.PostalCode),
+		Country:      tax.NormalizeCountry(p.Country),
+	}
+	name := strings.TrimSpace(p.Name)
+	if out.LegalName == "" {
+		out.LegalName = name
+	} else if name != "" && name != out.LegalName {
+		out.TradingName = name
+	}
+	if withVAT {
+		out.VATID = tax.NormalizeTaxID(p.TaxID)
+	}
+	return out
+}
+
+func eBuyerParty(p Party, withVAT bool) eParty {
+	out := eParty{
+		LegalName:    strings.TrimSpace(p.CompanyName),
+		Email:        strings.TrimSpace(p.Email),
+		AddressLine1: strings.TrimSpace(p.AddressLine1),
+		AddressLine2: strings.TrimSpace(p.AddressLine2),
+		City:         strings.TrimSpace(p.City),
+		State:        strings.TrimSpace(p.State),
+		PostalCode:   strings.TrimSpace(p.PostalCode),
+		Country:      tax.NormalizeCountry(p.Country),
+	}
+	if out.LegalName == "" {
+		out.LegalName = strings.TrimSpace(p.Name)
+	}
+	if withVAT {
+		out.VATID = tax.NormalizeTaxID(p.TaxID)
+	}
+	return out
+}
+
+// allocateNet 按比例把明细金额缩放到合计 net，舍入差额计入金额最大的一行
+func allocateNet(amounts []int64, net int64) []int64 {
+	out := make([]int64, len(amounts))
+	var gross int64
+	for _, a := range amounts {
+		gross += a
+	}
+	if gross == 0 || gross == net {
+		copy(out, amounts)
+		return out
+	}
+
+	var sum int64
+	largest := -1
+	for i, a := range amounts {
+		out[i] = divRound(a*net, gross)
+		sum += out[i]
+		if largest < 0 || a > amounts[largest] {
+			largest = i
+		}
+	}
+	if largest >= 0 {
+		out[largest] += net - sum
+	}
+	return out
+}
+
+// divRound 四舍五入的整数除法，b 必须非零
+func divRound(a, b int64) int64 {
+	if b < 0 {
+		a, b = -a, -b
+	}
+	if a >= 0 {
+		return (a + b/2) / b
+	}
+	return -((-a + b/2) / b)
+}
+
+// unitPrice 不含税单价（BT-146），最多保留四位小数
+func unitPrice(net int64, qty int) string {
+	scaled := divRound(net*100, int64(qty))
+	s := fmt.Sprintf("%d.%04d", scaled/10000, scaled%10000)
+	for strings.HasSuffix(s, "0") && len(s) > strings.Index(s, ".")+3 {
+		s = strings.TrimSuffix(s, "0")
+	}
+	return s
+}
+
+// formatPercent 去掉税率末尾多余的零，如 "19.000" -> "19"
+func formatPercent(rate string) string {
+	rate = strings.TrimSpace(rate)
+	if rate == "" {
+		return "0"
+	}
+	if strings.Contains(rate, ".") {
+		rate = strings.TrimRight(strings.TrimRight(rate, "0"), ".")
+	}
+	return rate
+}
+
+// eInvoiceFilename 下载文件名，Factur-X 内嵌 XML 按规范命名
+func eInvoiceFilename(inv *Invoice, format string) string {
+	if format == EInvoiceFacturX {
+		return inv.InvoiceNumber + "-factur-x.xml"
+	}
+	return inv.InvoiceNumber + ".xml"
+}
+
+// xmlWriter 按固定顺序输出带命名空间前缀的 XML。UBL 和 CII 的 schema 都要求严格的元素顺序，
+// 逐个写出比 encoding/xml 的结构体标签更直观，也能保留约定的前缀
+type xmlWriter struct {
+	buf   bytes.Buffer
+	depth int
+}
+
+func newXMLWriter() *xmlWriter {
+	w := &xmlWriter{}
+	w.buf.WriteString(xml.Header)
+	return w
+}
+
+// open 写出开始标签，attrs 为成对的属性名和值
+func (w *xmlWriter) open(name string, attrs ...string) {
+	w.indent()
+	w.startTag(name, attrs)
+	w.buf.WriteString(">\n")
+	w.depth++
+}
+
+func (w *xmlWriter) close(name string) {
+	w.depth--
+	w.indent()
+	w.buf.WriteString("</" + name + ">\n")
+}
+
+// leaf 写出只含文本的元素；值为空时跳过，可选元素不输出空标签
+func (w *xmlWriter) leaf(name, value string, attrs ...string) {
+	if value == "" {
+		return
+	}
+	w.indent()
+	w.startTag(name, attrs)
+	w.buf.WriteString(">")
+	_ = xml.EscapeText(&w.buf, []byte(value))
+	w.buf.WriteString("</" + name + ">\n")
+}
+
+func (w *xmlWriter) startTag(name string, attrs []string) {
+	w.buf.WriteString("<" + name)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		w.buf.WriteString(" " + attrs[i] + `="`)
+		_ = xml.EscapeText(&w.buf, []byte(attrs[i+1]))
+		w.buf.WriteString(`"`)
+	}
+}
+
+func (w *xmlWriter) indent() {
+	for i := 0; i < w.depth; i++ {
+		w.buf.WriteString("  ")
+	}
+}
+
+func (w *xmlWriter) bytes() []byte {
+	return w.buf.Bytes()
+}
@@ -0,0 +1,192 @@
+package billing
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+)
+
+// UN/CEFACT CII D16B 命名空间，Factur-X 1.0 / ZUGFeRD 2.x 使用
+const (
+	ciiRsmNS = "urn:un:unece:uncefact:data:standard:CrossIndustryInvoice:100"
+	ciiRamNS = "urn:un:unece:uncefact:data:standard:ReusableAggregateBusinessInformationEntity:100"
+	ciiUdtNS = "urn:un:unece:uncefact:data:standard:UnqualifiedDataType:100"
+	ciiQdtNS = "urn:un:unece:uncefact:data:standard:QualifiedDataType:100"
+)
+
+// renderFacturX 输出 Factur-X / ZUGFeRD EN 16931 配置的 CrossIndustryInvoice，
+// 即嵌入 PDF/A-3 的 factur-x.xml，元素顺序遵循 Factur-X EN16931 XSD
+func renderFacturX(e *eInvoice) []byte {
+	w := newXMLWriter()
+	w.open("rsm:CrossIndustryInvoice",
+		"xmlns:rsm", ciiRsmNS, "xmlns:ram", ciiRamNS, "xmlns:udt", ciiUdtNS, "xmlns:qdt", ciiQdtNS)
+
+	w.open("rsm:ExchangedDocumentContext")
+	w.open("ram:GuidelineSpecifiedDocumentContextParameter")
+	w.leaf("ram:ID", en16931CustomizationID)
+	w.close("ram:GuidelineSpecifiedDocumentContextParameter")
+	w.close("rsm:ExchangedDocumentContext")
+
+	w.open("rsm:ExchangedDocument")
+	w.leaf("ram:ID", e.Number)
+	w.leaf("ram:TypeCode", "380")
+	ciiDate(w, "ram:IssueDateTime", e.IssueDate)
+	if e.Note != "" {
+		w.open("ram:IncludedNote")
+		w.leaf("ram:Content", e.Note)
+		w.close("ram:IncludedNote")
+	}
+	w.close("rsm:ExchangedDocument")
+
+	w.open("rsm:SupplyChainTradeTransaction")
+	for _, line := range e.Lines {
+		w.open("ram:IncludedSupplyChainTradeLineItem")
+		w.open("ram:AssociatedDocumentLineDocument")
+		w.leaf("ram:LineID", line.ID)
+		w.close("ram:AssociatedDocumentLineDocument")
+		w.open("ram:SpecifiedTradeProduct")
+		w.leaf("ram:Name", line.Name)
+		w.close("ram:SpecifiedTradeProduct")
+		w.open("ram:SpecifiedLineTradeAgreement")
+		w.open("ram:NetPriceProductTradePrice")
+		w.leaf("ram:ChargeAmount", line.Price)
+		w.close("ram:NetPriceProductTradePrice")
+		w.close("ram:SpecifiedLineTradeAgreement")
+		w.open("ram:SpecifiedLineTradeDelivery")
+		w.leaf("ram:BilledQuantity", strconv.Itoa(line.Quantity), "unitCode", "C62")
+		w.close("ram:SpecifiedLineTradeDelivery")
+		w.open("ram:SpecifiedLineTradeSettlement")
+		ciiTax(w, "ram:ApplicableTradeTax", e.Tax)
+		w.open("ram:SpecifiedTradeSettlementLineMonetarySummation")
+		w.leaf("ram:LineTotalAmount", common.CentsToDecimal(line.Net))
+		w.close("ram:SpecifiedTradeSettlementLineMonetarySummation")
+		w.close("ram:SpecifiedLineTradeSettlement")
+		w.close("ram:IncludedSupplyChainTradeLineItem")
+	}
+
+	w.open("ram:ApplicableHeaderTradeAgreement")
+	ciiParty(w, "ram:SellerTradeParty", e.Seller)
+	ciiParty(w, "ram:BuyerTradeParty", e.Buyer)
+	w.close("ram:ApplicableHeaderTradeAgreement")
+
+	// 服务类发票没有交付信息，但该元素在 schema 中必填
+	w.open("ram:ApplicableHeaderTradeDelivery")
+	w.close("ram:ApplicableHeaderTradeDelivery")
+
+	w.open("ram:ApplicableHeaderTradeSettlement")
+	w.leaf("ram:InvoiceCurrencyCode", e.Currency)
+
+	w.open("ram:ApplicableTradeTax")
+	w.leaf("ram:CalculatedAmount", common.CentsToDecimal(e.TaxAmount))
+	w.leaf("ram:TypeCode", "VAT")
+	w.leaf("ram:ExemptionReason", e.Tax.ExemptionReason)
+	w.leaf("ram:BasisAmount", common.CentsToDecimal(e.TaxExclusive))
+	w.leaf("ram:CategoryCode", e.Tax.Category)
+	w.leaf("ram:ExemptionReasonCode", e.Tax.ExemptionCode)
+	w.leaf("ram:RateApplicablePercent", e.Tax.Rate)
+	w.close("ram:ApplicableTradeTax")
+
+	if e.PeriodStart != nil || e.PeriodEnd != nil {
+		w.open("ram:BillingSpecifiedPeriod")
+		if e.PeriodStart != nil {
+			ciiDate(w, "ram:StartDateTime", *e.PeriodStart)
+		}
+		if e.PeriodEnd != nil {
+			ciiDate(w, "ram:EndDateTime", *e.PeriodEnd)
+		}
+		w.close("ram:BillingSpecifiedPeriod")
+	}
+
+	for _, a := range e.Allowances {
+		w.open("ram:SpecifiedTradeAllowanceCharge")
+		w.open("ram:ChargeIndicator")
+		w.leaf("udt:Indicator", "false")
+		w.close("ram:ChargeIndicator")
+		w.leaf("ram:ActualAmount", common.CentsToDecimal(a.Amount))
+		w.leaf("ram:Reason", a.Reason)
+		ciiTax(w, "ram:CategoryTradeTax", e.Tax)
+		w.close("ram:SpecifiedTradeAllowanceCharge")
+	}
+
+	if e.PaymentTerms != "" || e.DueDate != nil {
+		w.open("ram:SpecifiedTradePaymentTerms")
+		w.leaf("ram:Description", e.PaymentTerms)
+		if e.DueDate != nil {
+			ciiDate(w, "ram:DueDateDateTime", *e.DueDate)
+		}
+		w.close("ram:SpecifiedTradePaymentTerms")
+	}
+
+	w.open("ram:SpecifiedTradeSettlementHeaderMonetarySummation")
+	w.leaf("ram:LineTotalAmount", common.CentsToDecimal(e.LineTotal))
+	if e.AllowanceTotal > 0 {
+		w.leaf("ram:AllowanceTotalAmount", common.CentsToDecimal(e.AllowanceTotal))
+	}
+	w.leaf("ram:TaxBasisTotalAmount", common.CentsToDecimal(e.TaxExclusive))
+	w.leaf("ram:TaxTotalAmount", common.CentsToDecimal(e.TaxAmount), "currencyID", e.Currency)
+	w.leaf("ram:GrandTotalAmount", common.CentsToDecimal(e.TaxInclusive))
+	if e.Prepaid > 0 {
+		w.leaf("ram:TotalPrepaidAmount", common.CentsToDecimal(e.Prepaid))
+	}
+	w.leaf("ram:DuePayableAmount", common.CentsToDecimal(e.Payable))
+	w.close("ram:SpecifiedTradeSettlementHeaderMonetarySummation")
+	w.close("ram:ApplicableHeaderTradeSettlement")
+
+	w.close("rsm:SupplyChainTradeTransaction")
+	w.close("rsm:CrossIndustryInvoice")
+	return w.bytes()
+}
+
+func ciiParty(w *xmlWriter, name string, p eParty) {
+	w.open(name)
+	w.leaf("ram:Name", p.LegalName)
+	if p.TradingName != "" {
+		w.open("ram:SpecifiedLegalOrganization")
+		w.leaf("ram:TradingBusinessName", p.TradingName)
+		w.close("ram:SpecifiedLegalOrganization")
+	}
+	if p.Email != "" {
+		w.open("ram:DefinedTradeContact")
+		w.open("ram:EmailURIUniversalCommunication")
+		w.leaf("ram:URIID", p.Email)
+		w.close("ram:EmailURIUniversalCommunication")
+		w.close("ram:DefinedTradeContact")
+	}
+
+	w.open("ram:PostalTradeAddress")
+	w.leaf("ram:PostcodeCode", p.PostalCode)
+	w.leaf("ram:LineOne", p.AddressLine1)
+	w.leaf("ram:LineTwo", p.AddressLine2)
+	w.leaf("ram:CityName", p.City)
+	w.leaf("ram:CountryID", p.Country)
+	w.leaf("ram:CountrySubDivisionName", p.State)
+	w.close("ram:PostalTradeAddress")
+
+	if p.Email != "" {
+		w.open("ram:URIUniversalCommunication")
+		w.leaf("ram:URIID", p.Email, "schemeID", "EM")
+		w.close("ram:URIUniversalCommunication")
+	}
+	if p.VATID != "" {
+		w.open("ram:SpecifiedTaxRegistration")
+		w.leaf("ram:ID", p.VATID, "schemeID", "VA")
+		w.close("ram:SpecifiedTaxRegistration")
+	}
+	w.close(name)
+}
+
+// ciiTax 明细行和折让上的税种，不含金额和免税原因
+func ciiTax(w *xmlWriter, name string, t eTax) {
+	w.open(name)
+	w.leaf("ram:TypeCode", "VAT")
+	w.leaf("ram:CategoryCode", t.Category)
+	w.leaf("ram:RateApplicablePercent", t.Rate)
+	w.close(name)
+}
+
+func ciiDate(w *xmlWriter, name string, t time.Time) {
+	w.open(name)
+	w.leaf("udt:DateTimeString", t.UTC().Format("20060102"), "format", "102")
+	w.close(name)
+}
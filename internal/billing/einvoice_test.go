@@ -0,0 +1,562 @@
+package billing
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/invoicestatus"
+)
+
+// xmlNode 通用 XML 树，严格解析后用于检查元素顺序和取值
+type xmlNode struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Children []xmlNode  `xml:",any"`
+	Text     string     `xml:",chardata"`
+}
+
+var testPrefixes = map[string]string{
+	ublInvoiceNS: "",
+	ublCacNS:     "cac:",
+	ublCbcNS:     "cbc:",
+	ciiRsmNS:     "rsm:",
+	ciiRamNS:     "ram:",
+	ciiUdtNS:     "udt:",
+}
+
+func (n xmlNode) name() string {
+	return testPrefixes[n.XMLName.Space] + n.XMLName.Local
+}
+
+// find 按路径查找第一个匹配的后代元素
+func (n xmlNode) find(path ...string) *xmlNode {
+	cur := &n
+	for _, p := range path {
+		var next *xmlNode
+		for i := range cur.Children {
+			if cur.Children[i].name() == p {
+				next = &cur.Children[i]
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		cur = next
+	}
+	return cur
+}
+
+func (n xmlNode) text(path ...string) string {
+	if found := n.find(path...); found != nil {
+		return strings.TrimSpace(found.Text)
+	}
+	return ""
+}
+
+func (n xmlNode) all(name string) []xmlNode {
+	var out []xmlNode
+	for _, c := range n.Children {
+		if c.name() == name {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// ublSequences 摘自 UBL-Invoice-2.1.xsd 和 UBL-CommonAggregateComponents-2.1.xsd 的 xsd:sequence，
+// 只用于检查元素顺序；完整的 XSD 校验见 TestEInvoiceXSD
+var ublSequences = map[string][]string{
+	"Invoice": {
+		"cbc:UBLVersionID", "cbc:CustomizationID", "cbc:ProfileID", "cbc:ProfileExecutionID", "cbc:ID",
+		"cbc:CopyIndicator", "cbc:UUID", "cbc:IssueDate", "cbc:IssueTime", "cbc:DueDate", "cbc:InvoiceTypeCode",
+		"cbc:Note", "cbc:TaxPointDate", "cbc:DocumentCurrencyCode", "cbc:TaxCurrencyCode", "cbc:PricingCurrencyCode",
+		"cbc:PaymentCurrencyCode", "cbc:PaymentAlternativeCurrencyCode", "cbc:AccountingCostCode", "cbc:AccountingCost",
+		"cbc:LineCountNumeric", "cbc:BuyerReference", "cac:InvoicePeriod", "cac:OrderReference", "cac:BillingReference",
+		"cac:DespatchDocumentReference", "cac:ReceiptDocumentReference", "cac:StatementDocumentReference",
+		"cac:OriginatorDocumentReference", "cac:ContractDocumentReference", "cac:AdditionalDocumentReference",
+		"cac:ProjectReference", "cac:Signature", "cac:AccountingSupplierParty", "cac:AccountingCustomerParty",
+		"cac:PayeeParty", "cac:BuyerCustomerParty", "cac:SellerSupplierParty", "cac:TaxRepresentativeParty",
+		"cac:Delivery", "cac:DeliveryTerms", "cac:PaymentMeans", "cac:PaymentTerms", "cac:PrepaidPayment",
+		"cac:AllowanceCharge", "cac:TaxExchangeRate", "cac:PricingExchangeRate", "cac:PaymentExchangeRate",
+		"cac:PaymentAlternativeExchangeRate", "cac:TaxTotal", "cac:WithholdingTaxTotal", "cac:LegalMonetaryTotal",
+		"cac:InvoiceLine",
+	},
+	"cac:InvoicePeriod":           {"cbc:StartDate", "cbc:StartTime", "cbc:EndDate", "cbc:EndTime", "cbc:DurationMeasure", "cbc:DescriptionCode", "cbc:Description"},
+	"cac:AccountingSupplierParty": {"cbc:CustomerAssignedAccountID", "cbc:AdditionalAccountID", "cbc:DataSendingCapability", "cac:Party", "cac:DespatchContact", "cac:AccountingContact", "cac:SellerContact"},
+	"cac:AccountingCustomerParty": {"cbc:CustomerAssignedAccountID", "cbc:SupplierAssignedAccountID", "cbc:AdditionalAccountID", "cac:Party", "cac:DeliveryContact", "cac:AccountingContact", "cac:BuyerContact"},
+	"cac:Party": {
+		"cbc:MarkCareIndicator", "cbc:MarkAttentionIndicator", "cbc:WebsiteURI", "cbc:LogoReferenceID", "cbc:EndpointID",
+		"cbc:IndustryClassificationCode", "cac:PartyIdentification", "cac:PartyName", "cac:Language", "cac:PostalAddress",
+		"cac:PhysicalLocation", "cac:PartyTaxScheme", "cac:PartyLegalEntity", "cac:Contact", "cac:Person", "cac:AgentParty",
+		"cac:ServiceProviderParty", "cac:PowerOfAttorney", "cac:FinancialAccount",
+	},
+	"cac:PostalAddress": {
+		"cbc:ID", "cbc:AddressTypeCode", "cbc:AddressFormatCode", "cbc:Postbox", "cbc:Floor", "cbc:Room", "cbc:StreetName",
+		"cbc:AdditionalStreetName", "cbc:BlockName", "cbc:BuildingName", "cbc:BuildingNumber", "cbc:InhouseMail",
+		"cbc:Department", "cbc:MarkAttention", "cbc:MarkCare", "cbc:PlotIdentification", "cbc:CitySubdivisionName",
+		"cbc:CityName", "cbc:PostalZone", "cbc:CountrySubentityCode", "cbc:CountrySubentity", "cac:AddressLine",
+		"cac:Country", "cac:LocationCoordinate",
+	},
+	"cac:PartyTaxScheme":   {"cbc:RegistrationName", "cbc:CompanyID", "cbc:TaxLevelCode", "cbc:ExemptionReasonCode", "cbc:ExemptionReason", "cac:RegistrationAddress", "cac:TaxScheme"},
+	"cac:PartyLegalEntity": {"cbc:RegistrationName", "cbc:CompanyID", "cbc:RegistrationDate", "cbc:RegistrationExpirationDate", "cbc:CompanyLegalFormCode", "cbc:CompanyLegalForm", "cbc:SoleProprietorshipIndicator", "cbc:CompanyLiquidationStatusCode", "cbc:CorporateStockAmount", "cbc:FullyPaidSharesIndicator", "cac:RegistrationAddress", "cac:CorporateRegistrationScheme", "cac:HeadOfficeParty", "cac:ShareholderParty"},
+	"cac:Contact":          {"cbc:ID", "cbc:Name", "cbc:Telephone", "cbc:Telefax", "cbc:ElectronicMail", "cbc:Note", "cac:OtherCommunication"},
+	"cac:PaymentTerms":     {"cbc:ID", "cbc:PaymentMeansID", "cbc:PrepaidPaymentReferenceID", "cbc:Note", "cbc:ReferenceEventCode", "cbc:SettlementDiscountPercent", "cbc:PenaltySurchargePercent", "cbc:PaymentPercent", "cbc:Amount"},
+	"cac:AllowanceCharge": {
+		"cbc:ID", "cbc:ChargeIndicator", "cbc:AllowanceChargeReasonCode", "cbc:AllowanceChargeReason",
+		"cbc:MultiplierFactorNumeric", "cbc:PrepaidIndicator", "cbc:SequenceNumeric", "cbc:Amount", "cbc:BaseAmount",
+		"cbc:AccountingCostCode", "cbc:AccountingCost", "cbc:PerUnitAmount", "cac:TaxCategory", "cac:TaxTotal", "cac:PaymentMeans",
+	},
+	"cac:TaxTotal":    {"cbc:TaxAmount", "cbc:RoundingAmount", "cbc:TaxEvidenceIndicator", "cbc:TaxIncludedIndicator", "cac:TaxSubtotal"},
+	"cac:TaxSubtotal": {"cbc:TaxableAmount", "cbc:TaxAmount", "cbc:CalculationSequenceNumeric", "cbc:TransactionCurrencyTaxAmount", "cbc:Percent", "cbc:BaseUnitMeasure", "cbc:PerUnitAmount", "cbc:TierRange", "cbc:TierRatePercent", "cac:TaxCategory"},
+	"cac:TaxCategory": {"cbc:ID", "cbc:Name", "cbc:Percent", "cbc:BaseUnitMeasure", "cbc:PerUnitAmount", "cbc:TaxExemptionReasonCode", "cbc:TaxExemptionReason", "cbc:TierRange", "cbc:TierRatePercent", "cac:TaxScheme"},
+	"cac:LegalMonetaryTotal": {
+		"cbc:LineExtensionAmount", "cbc:TaxExclusiveAmount", "cbc:TaxInclusiveAmount", "cbc:AllowanceTotalAmount",
+		"cbc:ChargeTotalAmount", "cbc:PrepaidAmount", "cbc:PayableRoundingAmount", "cbc:PayableAmount",
+	},
+	"cac:InvoiceLine": {
+		"cbc:ID", "cbc:UUID", "cbc:Note", "cbc:InvoicedQuantity", "cbc:LineExtensionAmount", "cbc:TaxPointDate",
+		"cbc:AccountingCostCode", "cbc:AccountingCost", "cbc:PaymentPurposeCode", "cbc:FreeOfChargeIndicator",
+		"cac:InvoicePeriod", "cac:OrderLineReference", "cac:DespatchLineReference", "cac:ReceiptLineReference",
+		"cac:BillingReference", "cac:DocumentReference", "cac:PricingReference", "cac:OriginatorParty", "cac:Delivery",
+		"cac:PaymentTerms", "cac:AllowanceCharge", "cac:TaxTotal", "cac:WithholdingTaxTotal", "cac:Item", "cac:Price",
+		"cac:DeliveryTerms", "cac:SubInvoiceLine", "cac:ItemPriceExtension",
+	},
+	"cac:Item": {
+		"cbc:Description", "cbc:PackQuantity", "cbc:PackSizeNumeric", "cbc:CatalogueIndicator", "cbc:Name",
+		"cbc:HazardousRiskIndicator", "cbc:AdditionalInformation", "cbc:Keyword", "cbc:BrandName", "cbc:ModelName",
+		"cac:BuyersItemIdentification", "cac:SellersItemIdentification", "cac:ManufacturersItemIdentification",
+		"cac:StandardItemIdentification", "cac:CatalogueItemIdentification", "cac:AdditionalItemIdentification",
+		"cac:CatalogueDocumentReference", "cac:ItemSpecificationDocumentReference", "cac:OriginCountry",
+		"cac:CommodityClassification", "cac:TransactionConditions", "cac:HazardousItem", "cac:ClassifiedTaxCategory",
+		"cac:AdditionalItemProperty", "cac:ManufacturerParty", "cac:InformationContentProviderParty",
+		"cac:OriginAddress", "cac:ItemInstance", "cac:Certificate", "cac:Dimension",
+	},
+	"cac:Price": {"cbc:PriceAmount", "cbc:BaseQuantity", "cbc:PriceChangeReason", "cbc:PriceTypeCode", "cbc:PriceType", "cbc:OrginatorQuantity", "cbc:OrderableUnitFactorRate", "cac:ValidityPeriod", "cac:PriceList", "cac:AllowanceCharge", "cac:PricingExchangeRate"},
+}
+
+// ciiSequences 摘自 Factur-X 1.0 EN16931 XSD（CrossIndustryInvoice D16B 子集）
+var ciiSequences = map[string][]string{
+	"rsm:CrossIndustryInvoice":     {"rsm:ExchangedDocumentContext", "rsm:ExchangedDocument", "rsm:SupplyChainTradeTransaction"},
+	"rsm:ExchangedDocumentContext": {"ram:BusinessProcessSpecifiedDocumentContextParameter", "ram:GuidelineSpecifiedDocumentContextParameter"},
+	"rsm:ExchangedDocument":        {"ram:ID", "ram:TypeCode", "ram:IssueDateTime", "ram:IncludedNote"},
+	"rsm:SupplyChainTradeTransaction": {
+		"ram:IncludedSupplyChainTradeLineItem", "ram:ApplicableHeaderTradeAgreement",
+		"ram:ApplicableHeaderTradeDelivery", "ram:ApplicableHeaderTradeSettlement",
+	},
+	"ram:IncludedSupplyChainTradeLineItem": {
+		"ram:AssociatedDocumentLineDocument", "ram:SpecifiedTradeProduct", "ram:SpecifiedLineTradeAgreement",
+		"ram:SpecifiedLineTradeDelivery", "ram:SpecifiedLineTradeSettlement",
+	},
+	"ram:SpecifiedTradeProduct":        {"ram:GlobalID", "ram:SellerAssignedID", "ram:BuyerAssignedID", "ram:Name", "ram:Description", "ram:ApplicableProductCharacteristic", "ram:DesignatedProductClassification", "ram:OriginTradeCountry"},
+	"ram:SpecifiedLineTradeAgreement":  {"ram:BuyerOrderReferencedDocument", "ram:GrossPriceProductTradePrice", "ram:NetPriceProductTradePrice"},
+	"ram:SpecifiedLineTradeSettlement": {"ram:ApplicableTradeTax", "ram:BillingSpecifiedPeriod", "ram:SpecifiedTradeAllowanceCharge", "ram:SpecifiedTradeSettlementLineMonetarySummation", "ram:AdditionalReferencedDocument", "ram:ReceivableSpecifiedTradeAccountingAccount"},
+	"ram:ApplicableHeaderTradeAgreement": {
+		"ram:BuyerReference", "ram:SellerTradeParty", "ram:BuyerTradeParty", "ram:SellerTaxRepresentativeTradeParty",
+		"ram:BuyerOrderReferencedDocument", "ram:ContractReferencedDocument", "ram:AdditionalReferencedDocument",
+		"ram:SpecifiedProcuringProject",
+	},
+	"ram:SellerTradeParty":           {"ram:ID", "ram:GlobalID", "ram:Name", "ram:Description", "ram:SpecifiedLegalOrganization", "ram:DefinedTradeContact", "ram:PostalTradeAddress", "ram:URIUniversalCommunication", "ram:SpecifiedTaxRegistration"},
+	"ram:BuyerTradeParty":            {"ram:ID", "ram:GlobalID", "ram:Name", "ram:SpecifiedLegalOrganization", "ram:DefinedTradeContact", "ram:PostalTradeAddress", "ram:URIUniversalCommunication", "ram:SpecifiedTaxRegistration"},
+	"ram:SpecifiedLegalOrganization": {"ram:ID", "ram:TradingBusinessName"},
+	"ram:PostalTradeAddress":         {"ram:PostcodeCode", "ram:LineOne", "ram:LineTwo", "ram:LineThree", "ram:CityName", "ram:CountryID", "ram:CountrySubDivisionName"},
+	"ram:ApplicableHeaderTradeSettlement": {
+		"ram:CreditorReferenceID", "ram:PaymentReference", "ram:TaxCurrencyCode", "ram:InvoiceCurrencyCode",
+		"ram:PayeeTradeParty", "ram:SpecifiedTradeSettlementPaymentMeans", "ram:ApplicableTradeTax",
+		"ram:BillingSpecifiedPeriod", "ram:SpecifiedTradeAllowanceCharge", "ram:SpecifiedTradePaymentTerms",
+		"ram:SpecifiedTradeSettlementHeaderMonetarySummation", "ram:InvoiceReferencedDocument",
+		"ram:ReceivableSpecifiedTradeAccountingAccount",
+	},
+	"ram:ApplicableTradeTax": {
+		"ram:CalculatedAmount", "ram:TypeCode", "ram:ExemptionReason", "ram:BasisAmount", "ram:CategoryCode",
+		"ram:ExemptionReasonCode", "ram:TaxPointDate", "ram:DueDateTypeCode", "ram:RateApplicablePercent",
+	},
+	"ram:SpecifiedTradeAllowanceCharge": {"ram:ChargeIndicator", "ram:CalculationPercent", "ram:BasisAmount", "ram:ActualAmount", "ram:ReasonCode", "ram:Reason", "ram:CategoryTradeTax"},
+	"ram:CategoryTradeTax":              {"ram:TypeCode", "ram:CategoryCode", "ram:RateApplicablePercent"},
+	"ram:SpecifiedTradePaymentTerms":    {"ram:Description", "ram:DueDateDateTime", "ram:DirectDebitMandateID"},
+	"ram:SpecifiedTradeSettlementHeaderMonetarySummation": {
+		"ram:LineTotalAmount", "ram:ChargeTotalAmount", "ram:AllowanceTotalAmount", "ram:TaxBasisTotalAmount",
+		"ram:TaxTotalAmount", "ram:RoundingAmount", "ram:GrandTotalAmount", "ram:TotalPrepaidAmount", "ram:DuePayableAmount",
+	},
+}
+
+// checkElementOrder 按摘录的 xsd:sequence 检查子元素：只允许出现已列出的元素，且顺序不能倒退。
+// 这不是 XSD 校验，不检查基数、类型和取值
+func checkElementOrder(t *testing.T, n xmlNode, sequences map[string][]string) {
+	t.Helper()
+	if _, ok := testPrefixes[n.XMLName.Space]; !ok {
+		t.Errorf("element %s uses unexpected namespace %q", n.XMLName.Local, n.XMLName.Space)
+	}
+	order, ok := sequences[n.name()]
+	if ok {
+		pos := make(map[string]int, len(order))
+		for i, name := range order {
+			pos[name] = i
+		}
+		last := -1
+		for _, c := range n.Children {
+			i, known := pos[c.name()]
+			if !known {
+				t.Errorf("%s: unexpected child %s", n.name(), c.name())
+				continue
+			}
+			if i < last {
+				t.Errorf("%s: child %s is out of sequence order", n.name(), c.name())
+			}
+			last = i
+		}
+	}
+	for _, c := range n.Children {
+		checkElementOrder(t, c, sequences)
+	}
+}
+
+func parseXML(t *testing.T, content []byte) xmlNode {
+	t.Helper()
+	if !bytes.HasPrefix(content, []byte(xml.Header)) {
+		t.Fatalf("missing XML declaration")
+	}
+	var root xmlNode
+	dec := xml.NewDecoder(bytes.NewReader(content))
+	dec.Strict = true
+	if err := dec.Decode(&root); err != nil {
+		t.Fatalf("invalid XML: %v\n%s", err, content)
+	}
+	return root
+}
+
+func cents(t *testing.T, value string) int64 {
+	t.Helper()
+	v, err := common.DecimalAmountToCents(value)
+	if err != nil {
+		t.Fatalf("amount %q: %v", value, err)
+	}
+	return v
+}
+
+// testEInvoiceDocument 德国客户、含税价 19%，带一行折扣，已用余额抵扣 10.00
+func testEInvoiceDocument() *InvoiceDocument {
+	issued := time.Date(2026, 3, 1, 9, 30, 0, 0, time.UTC)
+	due := issued.AddDate(0, 0, 14)
+	periodEnd := issued.AddDate(0, 1, 0)
+	notes := "Thank you for your business & support"
+	return &InvoiceDocument{
+		Invoice: &Invoice{
+			ID:            "inv-1",
+			InvoiceNumber: "INV-20260301-ABCD1234",
+			Status:        invoicestatus.Pending,
+			Subtotal:      "119.00",
+			Tax:           "19.00",
+			Total:         "119.00",
+			CreditApplied: "10.00",
+			Currency:      "eur",
+			TaxInclusive:  true,
+			PeriodStart:   &issued,
+			PeriodEnd:     &periodEnd,
+			DueDate:       &due,
+			FinalizedAt:   &issued,
+			CreatedAt:     issued.AddDate(0, 0, -1),
+			Notes:         &notes,
+			Items: []InvoiceItem{
+				{ID: "1", Description: "vps-01.example.com - Standard (monthly)", Quantity: 3, UnitPrice: "33.33", Amount: "100.00"},
+				{ID: "2", Description: "Backup add-on", Quantity: 1, UnitPrice: "29.00", Amount: "29.00"},
+				{ID: "3", Description: "Coupon SPRING10", Quantity: 1, UnitPrice: "-10.00", Amount: "-10.00"},
+				{ID: "4", Description: "VAT 19% (DE) included", Quantity: 1, UnitPrice: "19.00", Amount: "19.00",
+					Kind: itemKindTax, TaxCategory: "S", TaxRate: "19.000"},
+			},
+		},
+		Seller: Party{
+			Name: "EchoBilling", LegalName: "Echo Hosting GmbH", Email: "billing@example.com",
+			AddressLine1: "Hauptstraße 1", City: "Berlin", PostalCode: "10115", Country: "de", TaxID: "DE 123 456 789",
+		},
+		Buyer: Party{
+			Name: "Jane Doe", CompanyName: "Acme AG", Email: "jane@acme.example",
+			AddressLine1: "Marktplatz 5", City: "München", PostalCode: "80331", Country: "DE", TaxID: "DE987654321",
+		},
+	}
+}
+
+func TestBuildEInvoiceTotals(t *testing.T) {
+	t.Parallel()
+
+	e, err := buildEInvoice(testEInvoiceDocument())
+	if err != nil {
+		t.Fatalf("buildEInvoice: %v", err)
+	}
+
+	// 含税明细 100 + 29 - 10 = 119 按比例折算为不含税 100
+	var lines int64
+	for _, l := range e.Lines {
+		lines += l.Net
+	}
+	if len(e.Lines) != 2 || len(e.Allowances) != 1 {
+		t.Fatalf("lines = %+v, allowances = %+v", e.Lines, e.Allowances)
+	}
+	// BR-CO-10、BR-CO-13、BR-CO-15、BR-CO-16
+	if lines != e.LineTotal {
+		t.Errorf("sum of lines %d != line total %d", lines, e.LineTotal)
+	}
+	if e.TaxExclusive != e.LineTotal-e.AllowanceTotal || e.TaxExclusive != 10000 {
+		t.Errorf("tax exclusive = %d, want 10000", e.TaxExclusive)
+	}
+	if e.TaxInclusive != e.TaxExclusive+e.TaxAmount || e.TaxInclusive != 11900 {
+		t.Errorf("tax inclusive = %d, want 11900", e.TaxInclusive)
+	}
+	if e.Prepaid != 1000 || e.Payable != 10900 {
+		t.Errorf("prepaid = %d, payable = %d", e.Prepaid, e.Payable)
+	}
+	if e.Tax.Category != "S" || e.Tax.Rate != "19" {
+		t.Errorf("tax = %+v", e.Tax)
+	}
+	if e.Seller.VATID != "DE123456789" || e.Seller.TradingName != "EchoBilling" || e.Seller.Country != "DE" {
+		t.Errorf("seller = %+v", e.Seller)
+	}
+	if e.Buyer.LegalName != "Acme AG" || e.Buyer.VATID != "DE987654321" {
+		t.Errorf("buyer = %+v", e.Buyer)
+	}
+	if e.Currency != "EUR" || !e.IssueDate.Equal(*testEInvoiceDocument().Invoice.FinalizedAt) {
+		t.Errorf("currency = %q, issue date = %v", e.Currency, e.IssueDate)
+	}
+}
+
+func TestBuildEInvoiceTaxCategories(t *testing.T) {
+	t.Parallel()
+
+	reverse := testEInvoiceDocument()
+	reverse.Invoice.Status = invoicestatus.Paid
+	reverse.Invoice.ReverseCharge = true
+	reverse.Invoice.Tax = "0.00"
+	reverse.Invoice.Total = "119.00"
+	reverse.Invoice.Items[3] = InvoiceItem{Description: "VAT reverse charge (FR)", Quantity: 1, UnitPrice: "0.00",
+		Amount: "0.00", Kind: itemKindTax, TaxCategory: "AE", TaxRate: "0.000"}
+	e, err := buildEInvoice(reverse)
+	if err != nil {
+		t.Fatalf("buildEInvoice: %v", err)
+	}
+	if e.Tax.Category != "AE" || e.Tax.Rate != "0" || e.Tax.ExemptionCode != "VATEX-EU-AE" || e.Tax.ExemptionReason == "" {
+		t.Errorf("reverse charge tax = %+v", e.Tax)
+	}
+	if e.Buyer.VATID == "" {
+		t.Error("reverse charge requires the buyer VAT identifier")
+	}
+	if e.Prepaid != e.TaxInclusive || e.Payable != 0 {
+		t.Errorf("paid invoice prepaid = %d, payable = %d", e.Prepaid, e.Payable)
+	}
+
+	untaxed := testEInvoiceDocument()
+	untaxed.Invoice.Tax = "0.00"
+	untaxed.Invoice.DueDate = nil
+	untaxed.Invoice.Items = untaxed.Invoice.Items[:3]
+	e, err = buildEInvoice(untaxed)
+	if err != nil {
+		t.Fatalf("buildEInvoice: %v", err)
+	}
+	if e.Tax.Category != "O" || e.Tax.Rate != "" || e.Seller.VATID != "" || e.Buyer.VATID != "" {
+		t.Errorf("not subject to VAT: tax = %+v, seller = %q, buyer = %q", e.Tax, e.Seller.VATID, e.Buyer.VATID)
+	}
+	if e.PaymentTerms == "" {
+		t.Error("payment terms are required when there is no due date and an amount is payable")
+	}
+}
+
+func TestRenderUBL(t *testing.T) {
+	t.Parallel()
+
+	e, err := buildEInvoice(testEInvoiceDocument())
+	if err != nil {
+		t.Fatalf("buildEInvoice: %v", err)
+	}
+	root := parseXML(t, renderUBL(e))
+	if root.XMLName.Space != ublInvoiceNS || root.XMLName.Local != "Invoice" {
+		t.Fatalf("root element = %v", root.XMLName)
+	}
+	checkElementOrder(t, root, ublSequences)
+
+	// EN 16931 必填项
+	for _, path := range [][]string{
+		{"cbc:CustomizationID"}, {"cbc:ID"}, {"cbc:IssueDate"}, {"cbc:InvoiceTypeCode"}, {"cbc:DocumentCurrencyCode"},
+		{"cac:AccountingSupplierParty", "cac:Party", "cac:PartyLegalEntity", "cbc:RegistrationName"},
+		{"cac:AccountingSupplierParty", "cac:Party", "cac:PostalAddress", "cac:Country", "cbc:IdentificationCode"},
+		{"cac:AccountingCustomerParty", "cac:Party", "cac:PartyLegalEntity", "cbc:RegistrationName"},
+		{"cac:AccountingCustomerParty", "cac:Party", "cac:PostalAddress", "cac:Country", "cbc:IdentificationCode"},
+		{"cac:TaxTotal", "cac:TaxSubtotal", "cac:TaxCategory", "cbc:ID"},
+		{"cac:LegalMonetaryTotal", "cbc:PayableAmount"},
+	} {
+		if root.text(path...) == "" {
+			t.Errorf("missing %s", strings.Join(path, "/"))
+		}
+	}
+
+	if got := root.text("cbc:CustomizationID"); got != en16931CustomizationID {
+		t.Errorf("CustomizationID = %q", got)
+	}
+	if got := root.text("cbc:IssueDate"); got != "2026-03-01" {
+		t.Errorf("IssueDate = %q", got)
+	}
+	if got := root.text("cbc:Note"); got != "Thank you for your business & support" {
+		t.Errorf("Note = %q", got)
+	}
+	if got := root.text("cac:AccountingSupplierParty", "cac:Party", "cac:PartyTaxScheme", "cbc:CompanyID"); got != "DE123456789" {
+		t.Errorf("seller VAT = %q", got)
+	}
+	if got := root.text("cac:AccountingCustomerParty", "cac:Party", "cac:PostalAddress", "cbc:CityName"); got != "München" {
+		t.Errorf("buyer city = %q", got)
+	}
+
+	var lineSum int64
+	for _, line := range root.all("cac:InvoiceLine") {
+		lineSum += cents(t, line.text("cbc:LineExtensionAmount"))
+		if got := line.text("cac:Item", "cac:ClassifiedTaxCategory", "cbc:ID"); got != "S" {
+			t.Errorf("line tax category = %q", got)
+		}
+		if got := line.text("cac:Item", "cac:ClassifiedTaxCategory", "cbc:Percent"); got != "19" {
+			t.Errorf("line tax rate = %q", got)
+		}
+	}
+	totals := root.find("cac:LegalMonetaryTotal")
+	if lineSum != cents(t, totals.text("cbc:LineExtensionAmount")) {
+		t.Errorf("BR-CO-10: sum of lines %d != %s", lineSum, totals.text("cbc:LineExtensionAmount"))
+	}
+	if cents(t, totals.text("cbc:TaxInclusiveAmount")) != cents(t, totals.text("cbc:TaxExclusiveAmount"))+cents(t, root.text("cac:TaxTotal", "cbc:TaxAmount")) {
+		t.Error("BR-CO-15: tax inclusive amount does not add up")
+	}
+	if cents(t, totals.text("cbc:PayableAmount")) != cents(t, totals.text("cbc:TaxInclusiveAmount"))-cents(t, totals.text("cbc:PrepaidAmount")) {
+		t.Error("BR-CO-16: payable amount does not add up")
+	}
+	for _, n := range []*xmlNode{totals.find("cbc:PayableAmount"), root.find("cac:TaxTotal", "cbc:TaxAmount")} {
+		if len(n.Attrs) != 1 || n.Attrs[0].Name.Local != "currencyID" || n.Attrs[0].Value != "EUR" {
+			t.Errorf("%s attrs = %v", n.name(), n.Attrs)
+		}
+	}
+}
+
+func TestRenderFacturX(t *testing.T) {
+	t.Parallel()
+
+	doc := testEInvoiceDocument()
+	doc.Invoice.ReverseCharge = true
+	doc.Invoice.Tax = "0.00"
+	doc.Invoice.Total = "119.00"
+	doc.Invoice.Items[3] = InvoiceItem{Description: "VAT reverse charge (FR)", Quantity: 1, UnitPrice: "0.00",
+		Amount: "0.00", Kind: itemKindTax, TaxCategory: "AE", TaxRate: "0.000"}
+	e, err := buildEInvoice(doc)
+	if err != nil {
+		t.Fatalf("buildEInvoice: %v", err)
+	}
+	root := parseXML(t, renderFacturX(e))
+	if root.name() != "rsm:CrossIndustryInvoice" {
+		t.Fatalf("root element = %v", root.XMLName)
+	}
+	checkElementOrder(t, root, ciiSequences)
+
+	if got := root.text("rsm:ExchangedDocumentContext", "ram:GuidelineSpecifiedDocumentContextParameter", "ram:ID"); got != en16931CustomizationID {
+		t.Errorf("guideline = %q", got)
+	}
+	if got := root.text("rsm:ExchangedDocument", "ram:IssueDateTime", "udt:DateTimeString"); got != "20260301" {
+		t.Errorf("issue date = %q", got)
+	}
+
+	settlement := root.find("rsm:SupplyChainTradeTransaction", "ram:ApplicableHeaderTradeSettlement")
+	if settlement == nil {
+		t.Fatal("missing header trade settlement")
+	}
+	if got := settlement.text("ram:ApplicableTradeTax", "ram:CategoryCode"); got != "AE" {
+		t.Errorf("tax category = %q", got)
+	}
+	if got := settlement.text("ram:ApplicableTradeTax", "ram:ExemptionReasonCode"); got != "VATEX-EU-AE" {
+		t.Errorf("exemption reason code = %q", got)
+	}
+	if got := settlement.text("ram:SpecifiedTradeAllowanceCharge", "ram:ActualAmount"); got == "" {
+		t.Error("missing document level allowance")
+	}
+
+	sums := settlement.find("ram:SpecifiedTradeSettlementHeaderMonetarySummation")
+	var lineSum int64
+	for _, line := range root.find("rsm:SupplyChainTradeTransaction").all("ram:IncludedSupplyChainTradeLineItem") {
+		lineSum += cents(t, line.text("ram:SpecifiedLineTradeSettlement", "ram:SpecifiedTradeSettlementLineMonetarySummation", "ram:LineTotalAmount"))
+	}
+	if lineSum != cents(t, sums.text("ram:LineTotalAmount")) {
+		t.Errorf("BR-CO-10: sum of lines %d != %s", lineSum, sums.text("ram:LineTotalAmount"))
+	}
+	if cents(t, sums.text("ram:TaxBasisTotalAmount")) != cents(t, sums.text("ram:LineTotalAmount"))-cents(t, sums.text("ram:AllowanceTotalAmount")) {
+		t.Error("BR-CO-13: tax basis does not add up")
+	}
+	if got := sums.text("ram:DuePayableAmount"); got != "109.00" {
+		t.Errorf("due payable = %q, want 109.00", got)
+	}
+	if tt := sums.find("ram:TaxTotalAmount"); tt == nil || len(tt.Attrs) != 1 || tt.Attrs[0].Value != "EUR" {
+		t.Error("TaxTotalAmount requires a currencyID")
+	}
+}
+
+// TestEInvoiceXSD 用 xmllint 按官方 XSD 校验生成的文档。EINVOICE_XSD_DIR 指向解压后的 schema 目录：
+// UBL 2.1 发布包中的 xsd/maindoc/UBL-Invoice-2.1.xsd，以及 Factur-X 发布包中的
+// facturx/FACTUR-X_EN16931.xsd。未设置或没有 xmllint 时跳过
+func TestEInvoiceXSD(t *testing.T) {
+	dir := os.Getenv("EINVOICE_XSD_DIR")
+	if dir == "" {
+		t.Skip("EINVOICE_XSD_DIR is not set")
+	}
+	xmllint, err := exec.LookPath("xmllint")
+	if err != nil {
+		t.Skip("xmllint is not installed")
+	}
+
+	e, err := buildEInvoice(testEInvoiceDocument())
+	if err != nil {
+		t.Fatalf("buildEInvoice: %v", err)
+	}
+	tests := []struct {
+		name   string
+		schema string
+		doc    []byte
+	}{
+		{"UBL", filepath.Join(dir, "xsd", "maindoc", "UBL-Invoice-2.1.xsd"), renderUBL(e)},
+		{"Factur-X", filepath.Join(dir, "facturx", "FACTUR-X_EN16931.xsd"), renderFacturX(e)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := os.Stat(tt.schema); err != nil {
+				t.Fatalf("schema not found: %v", err)
+			}
+			path := filepath.Join(t.TempDir(), "invoice.xml")
+			if err := os.WriteFile(path, tt.doc, 0o600); err != nil {
+				t.Fatalf("write document: %v", err)
+			}
+			out, err := exec.Command(xmllint, "--noout", "--nonet", "--schema", tt.schema, path).CombinedOutput()
+			if err != nil {
+				t.Fatalf("document does not validate against %s: %v\n%s", filepath.Base(tt.schema), err, out)
+			}
+		})
+	}
+}
+
+func TestAllocateNet(t *testing.T) {
+	t.Parallel()
+
+	// 每行 66.67 舍入后合计多 1 分，差额计入第一行最大的金额
+	got := allocateNet([]int64{100, 100, 100}, 200)
+	var sum int64
+	for _, v := range got {
+		sum += v
+	}
+	if sum != 200 || got[0] != 66 || got[1] != 67 {
+		t.Fatalf("allocateNet = %v", got)
+	}
+	if got := allocateNet([]int64{1000, -100}, 900); got[0] != 1000 || got[1] != -100 {
+		t.Fatalf("allocateNet without tax = %v", got)
+	}
+	if got := unitPrice(10000, 3); got != "33.3333" {
+		t.Fatalf("unitPrice = %q", got)
+	}
+	if got := unitPrice(1000, 4); got != "2.50" {
+		t.Fatalf("unitPrice = %q", got)
+	}
+}
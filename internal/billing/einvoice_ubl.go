@@ -0,0 +1,165 @@
+package billing
+
+import (
+	"strconv"
+
+	"github.com/adiecho/echobilling/internal/common"
+)
+
+// UBL 2.1 命名空间
+const (
+	ublInvoiceNS = "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2"
+	ublCacNS     = "urn:oasis:names:specification:ubl:schema:xsd:CommonAggregateComponents-2"
+	ublCbcNS     = "urn:oasis:names:specification:ubl:schema:xsd:CommonBasicComponents-2"
+)
+
+// renderUBL 输出 UBL 2.1 Invoice，元素顺序遵循 UBL-Invoice-2.1.xsd
+func renderUBL(e *eInvoice) []byte {
+	w := newXMLWriter()
+	w.open("Invoice", "xmlns", ublInvoiceNS, "xmlns:cac", ublCacNS, "xmlns:cbc", ublCbcNS)
+
+	w.leaf("cbc:CustomizationID", en16931CustomizationID)
+	w.leaf("cbc:ID", e.Number)
+	w.leaf("cbc:IssueDate", e.IssueDate.Format("2006-01-02"))
+	if e.DueDate != nil {
+		w.leaf("cbc:DueDate", e.DueDate.UTC().Format("2006-01-02"))
+	}
+	w.leaf("cbc:InvoiceTypeCode", "380")
+	w.leaf("cbc:Note", e.Note)
+	w.leaf("cbc:DocumentCurrencyCode", e.Currency)
+
+	if e.PeriodStart != nil || e.PeriodEnd != nil {
+		w.open("cac:InvoicePeriod")
+		if e.PeriodStart != nil {
+			w.leaf("cbc:StartDate", e.PeriodStart.UTC().Format("2006-01-02"))
+		}
+		if e.PeriodEnd != nil {
+			w.leaf("cbc:EndDate", e.PeriodEnd.UTC().Format("2006-01-02"))
+		}
+		w.close("cac:InvoicePeriod")
+	}
+
+	w.open("cac:AccountingSupplierParty")
+	ublParty(w, e.Seller)
+	w.close("cac:AccountingSupplierParty")
+	w.open("cac:AccountingCustomerParty")
+	ublParty(w, e.Buyer)
+	w.close("cac:AccountingCustomerParty")
+
+	if e.PaymentTerms != "" {
+		w.open("cac:PaymentTerms")
+		w.leaf("cbc:Note", e.PaymentTerms)
+		w.close("cac:PaymentTerms")
+	}
+
+	for _, a := range e.Allowances {
+		w.open("cac:AllowanceCharge")
+		w.leaf("cbc:ChargeIndicator", "false")
+		w.leaf("cbc:AllowanceChargeReason", a.Reason)
+		ublAmount(w, "cbc:Amount", a.Amount, e.Currency)
+		ublTaxCategory(w, "cac:TaxCategory", e.Tax, false)
+		w.close("cac:AllowanceCharge")
+	}
+
+	w.open("cac:TaxTotal")
+	ublAmount(w, "cbc:TaxAmount", e.TaxAmount, e.Currency)
+	w.open("cac:TaxSubtotal")
+	ublAmount(w, "cbc:TaxableAmount", e.TaxExclusive, e.Currency)
+	ublAmount(w, "cbc:TaxAmount", e.TaxAmount, e.Currency)
+	ublTaxCategory(w, "cac:TaxCategory", e.Tax, true)
+	w.close("cac:TaxSubtotal")
+	w.close("cac:TaxTotal")
+
+	w.open("cac:LegalMonetaryTotal")
+	ublAmount(w, "cbc:LineExtensionAmount", e.LineTotal, e.Currency)
+	ublAmount(w, "cbc:TaxExclusiveAmount", e.TaxExclusive, e.Currency)
+	ublAmount(w, "cbc:TaxInclusiveAmount", e.TaxInclusive, e.Currency)
+	if e.AllowanceTotal > 0 {
+		ublAmount(w, "cbc:AllowanceTotalAmount", e.AllowanceTotal, e.Currency)
+	}
+	if e.Prepaid > 0 {
+		ublAmount(w, "cbc:PrepaidAmount", e.Prepaid, e.Currency)
+	}
+	ublAmount(w, "cbc:PayableAmount", e.Payable, e.Currency)
+	w.close("cac:LegalMonetaryTotal")
+
+	for _, line := range e.Lines {
+		w.open("cac:InvoiceLine")
+		w.leaf("cbc:ID", line.ID)
+		w.leaf("cbc:InvoicedQuantity", strconv.Itoa(line.Quantity), "unitCode", "C62")
+		ublAmount(w, "cbc:LineExtensionAmount", line.Net, e.Currency)
+		w.open("cac:Item")
+		w.leaf("cbc:Name", line.Name)
+		ublTaxCategory(w, "cac:ClassifiedTaxCategory", e.Tax, false)
+		w.close("cac:Item")
+		w.open("cac:Price")
+		w.leaf("cbc:PriceAmount", line.Price, "currencyID", e.Currency)
+		w.close("cac:Price")
+		w.close("cac:InvoiceLine")
+	}
+
+	w.close("Invoice")
+	return w.bytes()
+}
+
+func ublParty(w *xmlWriter, p eParty) {
+	w.open("cac:Party")
+	w.leaf("cbc:EndpointID", p.Email, "schemeID", "EM")
+	if p.TradingName != "" {
+		w.open("cac:PartyName")
+		w.leaf("cbc:Name", p.TradingName)
+		w.close("cac:PartyName")
+	}
+
+	w.open("cac:PostalAddress")
+	w.leaf("cbc:StreetName", p.AddressLine1)
+	w.leaf("cbc:AdditionalStreetName", p.AddressLine2)
+	w.leaf("cbc:CityName", p.City)
+	w.leaf("cbc:PostalZone", p.PostalCode)
+	w.leaf("cbc:CountrySubentity", p.State)
+	if p.Country != "" {
+		w.open("cac:Country")
+		w.leaf("cbc:IdentificationCode", p.Country)
+		w.close("cac:Country")
+	}
+	w.close("cac:PostalAddress")
+
+	if p.VATID != "" {
+		w.open("cac:PartyTaxScheme")
+		w.leaf("cbc:CompanyID", p.VATID)
+		w.open("cac:TaxScheme")
+		w.leaf("cbc:ID", "VAT")
+		w.close("cac:TaxScheme")
+		w.close("cac:PartyTaxScheme")
+	}
+
+	w.open("cac:PartyLegalEntity")
+	w.leaf("cbc:RegistrationName", p.LegalName)
+	w.close("cac:PartyLegalEntity")
+
+	if p.Email != "" {
+		w.open("cac:Contact")
+		w.leaf("cbc:ElectronicMail", p.Email)
+		w.close("cac:Contact")
+	}
+	w.close("cac:Party")
+}
+
+// ublTaxCategory 输出税种；免税原因只出现在税额汇总（BG-23）中
+func ublTaxCategory(w *xmlWriter, name string, t eTax, withReason bool) {
+	w.open(name)
+	w.leaf("cbc:ID", t.Category)
+	w.leaf("cbc:Percent", t.Rate)
+	if withReason {
+		w.leaf("cbc:TaxExemptionReasonCode", t.ExemptionCode)
+		w.leaf("cbc:TaxExemptionReason", t.ExemptionReason)
+	}
+	w.open("cac:TaxScheme")
+	w.leaf("cbc:ID", "VAT")
+	w.close("cac:TaxScheme")
+	w.close(name)
+}
+
+func ublAmount(w *xmlWriter, name string, cents int64, currency string) {
+	w.leaf(name, common.CentsToDecimal(cents), "currencyID", currency)
+}
@@ -3,38 +3,55 @@ package billing
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/adiecho/echobilling/internal/app"
 	"github.com/adiecho/echobilling/internal/common"
 	"github.com/gin-gonic/gin"
+	"github.com/hibiken/asynq"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type Handler struct {
-	pool *pgxpool.Pool
+	pool        *pgxpool.Pool
+	asynqClient *asynq.Client
+	store       *app.SettingsStore
 }
 
-func NewHandler(pool *pgxpool.Pool) *Handler {
-	return &Handler{pool: pool}
+func NewHandler(pool *pgxpool.Pool, asynqClient *asynq.Client, store *app.SettingsStore) *Handler {
+	return &Handler{pool: pool, asynqClient: asynqClient, store: store}
 }
 
 type Invoice struct {
-	ID            string          `json:"id"`
-	UserID        string          `json:"user_id"`
-	OrderID       string          `json:"order_id"`
-	InvoiceNumber string          `json:"invoice_number"`
-	Status        string          `json:"status"`
-	Subtotal      string          `json:"subtotal"`
-	Tax           string          `json:"tax"`
-	Total         string          `json:"total"`
-	Currency      string          `json:"currency"`
-	DueDate       *time.Time      `json:"due_date"`
-	PaidAt        *time.Time      `json:"paid_at"`
-	Items         []InvoiceItem   `json:"items,omitempty"`
-	CreatedAt     time.Time       `json:"created_at"`
-	Metadata      json.RawMessage `json:"metadata,omitempty"`
+	ID             string          `json:"id"`
+	UserID         string          `json:"user_id"`
+	OrderID        *string         `json:"order_id"`
+	InvoiceNumber  string          `json:"invoice_number"`
+	Status         string          `json:"status"`
+	Subtotal       string          `json:"subtotal"`
+	Tax            string          `json:"tax"`
+	Total          string          `json:"total"`
+	CreditApplied  string          `json:"credit_applied"`
+	AmountRefunded string          `json:"amount_refunded"`
+	Currency       string          `json:"currency"`
+	TaxInclusive   bool            `json:"tax_inclusive"`
+	ReverseCharge  bool            `json:"reverse_charge"`
+	ServiceID      *string         `json:"service_id,omitempty"`
+	PeriodStart    *time.Time      `json:"billing_period_start,omitempty"`
+	PeriodEnd      *time.Time      `json:"billing_period_end,omitempty"`
+	DueDate        *time.Time      `json:"due_date"`
+	PaidAt         *time.Time      `json:"paid_at"`
+	FinalizedAt    *time.Time      `json:"finalized_at,omitempty"`
+	VoidedAt       *time.Time      `json:"voided_at,omitempty"`
+	VoidReason     *string         `json:"void_reason,omitempty"`
+	Notes          *string         `json:"notes,omitempty"`
+	Items          []InvoiceItem   `json:"items,omitempty"`
+	CreditNotes    []CreditNote    `json:"credit_notes,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	Metadata       json.RawMessage `json:"metadata,omitempty"`
 }
 
 type InvoiceItem struct {
@@ -43,6 +60,10 @@ type InvoiceItem struct {
 	Quantity    int    `json:"quantity"`
 	UnitPrice   string `json:"unit_price"`
 	Amount      string `json:"amount"`
+	Kind        string `json:"kind"`
+	// 税费行的税种类别（UNCL 5305）和税率
+	TaxCategory string `json:"tax_category,omitempty"`
+	TaxRate     string `json:"tax_rate,omitempty"`
 }
 
 type AdminInvoiceSummary struct {
@@ -94,21 +115,114 @@ func (h *Handler) GetInvoice(c *gin.Context) {
 
 	invoice, err := h.getUserInvoice(c.Request.Context(), userID, c.Param("id"))
 	if err != nil {
-		switch {
-		case errors.Is(err, ErrInvoiceNotFound):
-			c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
-		case errors.Is(err, ErrInvoiceForbidden):
-			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
-		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-		}
+		writeInvoiceError(c, err)
+		return
+	}
+
+	invoice.CreditNotes, err = h.listInvoiceCreditNotes(c.Request.Context(), invoice.ID)
+	if err != nil {
+		writeInvoiceError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, invoice)
 }
 
-// AdminListInvoices 管理员查看所有发票
+// GetInvoicePDF 下载发票 PDF
+func (h *Handler) GetInvoicePDF(c *gin.Context) {
+	userID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	if _, err := h.getUserInvoice(ctx, userID, c.Param("id")); err != nil {
+		writeInvoiceError(c, err)
+		return
+	}
+
+	h.writeInvoicePDF(c, c.Param("id"))
+}
+
+// AdminGetInvoicePDF 管理员下载任意发票 PDF
+func (h *Handler) AdminGetInvoicePDF(c *gin.Context) {
+	h.writeInvoicePDF(c, c.Param("id"))
+}
+
+func (h *Handler) writeInvoicePDF(c *gin.Context, invoiceID string) {
+	content, inv, err := h.invoicePDF(c.Request.Context(), invoiceID)
+	if err != nil {
+		writeInvoiceError(c, err)
+		return
+	}
+
+	filename := inv.InvoiceNumber
+	if filename == "" {
+		filename = "draft-" + inv.ID
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, filename))
+	c.Data(http.StatusOK, "application/pdf", content)
+}
+
+// GetInvoiceUBL 下载 UBL 2.1 电子发票
+func (h *Handler) GetInvoiceUBL(c *gin.Context) {
+	h.writeUserEInvoice(c, EInvoiceUBL)
+}
+
+// GetInvoiceFacturX 下载 Factur-X / ZUGFeRD（EN 16931）电子发票 XML
+func (h *Handler) GetInvoiceFacturX(c *gin.Context) {
+	h.writeUserEInvoice(c, EInvoiceFacturX)
+}
+
+// AdminGetInvoiceUBL 管理员下载任意发票的 UBL 2.1 电子发票
+func (h *Handler) AdminGetInvoiceUBL(c *gin.Context) {
+	h.writeEInvoice(c, c.Param("id"), EInvoiceUBL)
+}
+
+// AdminGetInvoiceFacturX 管理员下载任意发票的 Factur-X 电子发票 XML
+func (h *Handler) AdminGetInvoiceFacturX(c *gin.Context) {
+	h.writeEInvoice(c, c.Param("id"), EInvoiceFacturX)
+}
+
+func (h *Handler) writeUserEInvoice(c *gin.Context, format string) {
+	userID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	if _, err := h.getUserInvoice(c.Request.Context(), userID, c.Param("id")); err != nil {
+		writeInvoiceError(c, err)
+		return
+	}
+
+	h.writeEInvoice(c, c.Param("id"), format)
+}
+
+func (h *Handler) writeEInvoice(c *gin.Context, invoiceID, format string) {
+	content, inv, err := h.invoiceEInvoice(c.Request.Context(), invoiceID, format)
+	if err != nil {
+		writeInvoiceError(c, err)
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, eInvoiceFilename(inv, format)))
+	c.Data(http.StatusOK, "application/xml", content)
+}
+
+func writeInvoiceError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrInvoiceNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+	case errors.Is(err, ErrInvoiceForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	case errors.Is(err, ErrInvoiceNotIssued):
+		c.JSON(http.StatusConflict, gin.H{"error": "E-invoices are only available for issued invoices"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// AdminListInvoices 管理员查看所有发票，可按 user_id、status 过滤
 func (h *Handler) AdminListInvoices(c *gin.Context) {
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
@@ -119,7 +233,7 @@ func (h *Handler) AdminListInvoices(c *gin.Context) {
 		limit = 20
 	}
 
-	invoices, total, err := h.listAdminInvoices(c.Request.Context(), page, limit)
+	invoices, total, err := h.listAdminInvoices(c.Request.Context(), c.Query("user_id"), c.Query("status"), page, limit)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
@@ -0,0 +1,125 @@
+package billing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/gin-gonic/gin"
+)
+
+// ManualInvoiceRequest 管理员创建或修改草稿发票。due_date 为空时定稿后 30 天到期
+type ManualInvoiceRequest struct {
+	UserID   string                     `json:"user_id" binding:"required,uuid"`
+	Currency string                     `json:"currency" binding:"omitempty,len=3,alpha"`
+	DueDate  *time.Time                 `json:"due_date"`
+	Notes    string                     `json:"notes" binding:"max=2000"`
+	Items    []ManualInvoiceItemRequest `json:"items" binding:"required,min=1,max=100,dive"`
+}
+
+// ManualInvoiceItemRequest 自定义明细；unit_price 为负数时作为折扣行
+type ManualInvoiceItemRequest struct {
+	Description string `json:"description" binding:"required,max=500"`
+	Quantity    int    `json:"quantity" binding:"omitempty,min=1,max=10000"`
+	UnitPrice   string `json:"unit_price" binding:"required"`
+}
+
+// VoidInvoiceRequest 作废发票必须填写原因
+type VoidInvoiceRequest struct {
+	Reason string `json:"reason" binding:"required,max=500"`
+}
+
+// AdminGetInvoice - GET /api/v1/admin/invoices/:id
+func (h *Handler) AdminGetInvoice(c *gin.Context) {
+	ctx := c.Request.Context()
+	invoice, err := h.getInvoice(ctx, c.Param("id"))
+	if err != nil {
+		writeInvoiceError(c, err)
+		return
+	}
+
+	invoice.CreditNotes, err = h.listInvoiceCreditNotes(ctx, invoice.ID)
+	if err != nil {
+		writeInvoiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, invoice)
+}
+
+// AdminCreateInvoice - POST /api/v1/admin/invoices
+// 为客户创建草稿发票，草稿可以反复修改，定稿前客户不可见
+func (h *Handler) AdminCreateInvoice(c *gin.Context) {
+	adminID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	var req ManualInvoiceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	invoice, svcErr := h.createDraftInvoice(c.Request.Context(), adminID, req)
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+	c.JSON(http.StatusCreated, invoice)
+}
+
+// AdminUpdateInvoice - PUT /api/v1/admin/invoices/:id
+// 整体替换草稿的客户、币种、到期日、备注和明细
+func (h *Handler) AdminUpdateInvoice(c *gin.Context) {
+	var req ManualInvoiceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	invoice, svcErr := h.updateDraftInvoice(c.Request.Context(), c.Param("id"), req)
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+	c.JSON(http.StatusOK, invoice)
+}
+
+// AdminFinalizeInvoice - POST /api/v1/admin/invoices/:id/finalize
+// 按当前税率重新计税、分配编号并冻结发票，之后客户可以查看和支付
+func (h *Handler) AdminFinalizeInvoice(c *gin.Context) {
+	adminID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	invoice, svcErr := h.finalizeInvoice(c.Request.Context(), adminID, c.Param("id"), c.ClientIP(), c.Request.UserAgent())
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+	c.JSON(http.StatusOK, invoice)
+}
+
+// AdminVoidInvoice - POST /api/v1/admin/invoices/:id/void
+// 作废草稿或待支付的发票，退回已抵扣的余额
+func (h *Handler) AdminVoidInvoice(c *gin.Context) {
+	adminID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	var req VoidInvoiceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Void reason is required"})
+		return
+	}
+
+	invoice, svcErr := h.voidInvoice(c.Request.Context(), adminID, c.Param("id"), req.Reason, c.ClientIP(), c.Request.UserAgent())
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+	c.JSON(http.StatusOK, invoice)
+}
@@ -0,0 +1,419 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/credit"
+	"github.com/adiecho/echobilling/internal/invoicestatus"
+	"github.com/adiecho/echobilling/internal/numbering"
+	"github.com/adiecho/echobilling/internal/tax"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// 手工发票未指定到期日时，定稿后的付款期限，与订单发票一致
+const manualInvoiceDueDays = 30
+
+// invoiceLine 待写入的发票明细，金额单位为分
+type invoiceLine struct {
+	Description string
+	Quantity    int
+	UnitPrice   int64
+	Amount      int64
+	Kind        string
+}
+
+// manualInvoiceLines 校验自定义明细并计算合计（分）。负单价的行作为折扣，合计必须为正数
+func manualInvoiceLines(items []ManualInvoiceItemRequest) ([]invoiceLine, int64, error) {
+	lines := make([]invoiceLine, 0, len(items))
+	var total int64
+	for i, item := range items {
+		description := strings.TrimSpace(item.Description)
+		if description == "" {
+			return nil, 0, fmt.Errorf("item %d: description is required", i+1)
+		}
+		quantity := item.Quantity
+		if quantity == 0 {
+			quantity = 1
+		}
+		if quantity < 0 {
+			return nil, 0, fmt.Errorf("item %d: quantity must be positive", i+1)
+		}
+		unitPrice, err := common.DecimalAmountToCents(item.UnitPrice)
+		if err != nil || unitPrice == 0 {
+			return nil, 0, fmt.Errorf("item %d: unit_price must be a non-zero amount", i+1)
+		}
+
+		line := invoiceLine{
+			Description: description,
+			Quantity:    quantity,
+			UnitPrice:   unitPrice,
+			Amount:      unitPrice * int64(quantity),
+			Kind:        "line",
+		}
+		if unitPrice < 0 {
+			line.Kind = "discount"
+		}
+		lines = append(lines, line)
+		total += line.Amount
+	}
+	if total <= 0 {
+		return nil, 0, errors.New("invoice total must be positive")
+	}
+	return lines, total, nil
+}
+
+// lockInvoice 锁定发票并返回当前状态和客户
+func lockInvoice(ctx context.Context, tx pgx.Tx, invoiceID string) (status, userID string, svcErr *common.ServiceError) {
+	err := tx.QueryRow(ctx,
+		`SELECT status::text, user_id::text FROM invoices WHERE id = $1 FOR UPDATE`,
+		invoiceID,
+	).Scan(&status, &userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", "", common.ErrNotFound("Invoice not found", err)
+		}
+		return "", "", common.ErrInternal("Database error", err)
+	}
+	return status, userID, nil
+}
+
+// transitionError 状态机拒绝的变化返回 409
+func transitionError(from, to string) *common.ServiceError {
+	if err := invoicestatus.Check(from, to); err != nil {
+		return common.NewServiceError(http.StatusConflict, fmt.Sprintf("Invoice cannot be changed from %s to %s", from, to), err)
+	}
+	return nil
+}
+
+func (h *Handler) createDraftInvoice(ctx context.Context, adminID string, req ManualInvoiceRequest) (*Invoice, *common.ServiceError) {
+	lines, _, err := manualInvoiceLines(req.Items)
+	if err != nil {
+		return nil, common.ErrBadRequest(err.Error(), err)
+	}
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return nil, common.ErrInternal("Database error", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if svcErr := checkCustomer(ctx, tx, req.UserID); svcErr != nil {
+		return nil, svcErr
+	}
+
+	now := time.Now()
+	invoiceID := uuid.New().String()
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO invoices (id, user_id, status, subtotal, tax, total, currency, due_date, notes, created_by, created_at, updated_at)
+		 VALUES ($1, $2, 'draft', 0, 0, 0, $3, $4, $5, $6, $7, $7)`,
+		invoiceID, req.UserID, invoiceCurrency(req.Currency), req.DueDate, nullableText(req.Notes), adminID, now,
+	); err != nil {
+		return nil, common.ErrInternal("Failed to create invoice", err)
+	}
+	if err := h.priceInvoice(ctx, tx, invoiceID, req.UserID, lines, now); err != nil {
+		return nil, common.ErrInternal("Failed to price invoice", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, common.ErrInternal("Failed to commit invoice", err)
+	}
+	return h.adminInvoice(ctx, invoiceID)
+}
+
+func (h *Handler) updateDraftInvoice(ctx context.Context, invoiceID string, req ManualInvoiceRequest) (*Invoice, *common.ServiceError) {
+	lines, _, err := manualInvoiceLines(req.Items)
+	if err != nil {
+		return nil, common.ErrBadRequest(err.Error(), err)
+	}
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return nil, common.ErrInternal("Database error", err)
+	}
+	defer tx.Rollback(ctx)
+
+	status, _, svcErr := lockInvoice(ctx, tx, invoiceID)
+	if svcErr != nil {
+		return nil, svcErr
+	}
+	if status != invoicestatus.Draft {
+		return nil, common.NewServiceError(http.StatusConflict, "Only draft invoices can be edited", nil)
+	}
+	if svcErr := checkCustomer(ctx, tx, req.UserID); svcErr != nil {
+		return nil, svcErr
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec(ctx,
+		`UPDATE invoices
+		 SET user_id = $2, currency = $3, due_date = $4, notes = $5, updated_at = $6
+		 WHERE id = $1`,
+		invoiceID, req.UserID, invoiceCurrency(req.Currency), req.DueDate, nullableText(req.Notes), now,
+	); err != nil {
+		return nil, common.ErrInternal("Failed to update invoice", err)
+	}
+	if err := h.priceInvoice(ctx, tx, invoiceID, req.UserID, lines, now); err != nil {
+		return nil, common.ErrInternal("Failed to price invoice", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, common.ErrInternal("Failed to commit invoice", err)
+	}
+	return h.adminInvoice(ctx, invoiceID)
+}
+
+// finalizeInvoice 草稿 -> 待支付：按客户当前的税务信息重新计税，分配编号，之后发票内容不再修改
+func (h *Handler) finalizeInvoice(ctx context.Context, adminID, invoiceID, ip, userAgent string) (*Invoice, *common.ServiceError) {
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return nil, common.ErrInternal("Database error", err)
+	}
+	defer tx.Rollback(ctx)
+
+	status, userID, svcErr := lockInvoice(ctx, tx, invoiceID)
+	if svcErr != nil {
+		return nil, svcErr
+	}
+	if svcErr := transitionError(status, invoicestatus.Pending); svcErr != nil {
+		return nil, svcErr
+	}
+
+	lines, err := draftLines(ctx, tx, invoiceID)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to load invoice items", err)
+	}
+	if len(lines) == 0 {
+		return nil, common.ErrBadRequest("Invoice has no items", nil)
+	}
+
+	now := time.Now()
+	if err := h.priceInvoice(ctx, tx, invoiceID, userID, lines, now); err != nil {
+		return nil, common.ErrInternal("Failed to price invoice", err)
+	}
+
+	number, err := numbering.Next(ctx, tx, h.store, numbering.SeriesInvoice, now)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to allocate invoice number", err)
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE invoices
+		 SET status = 'pending', invoice_number = $2, finalized_at = $3,
+		     due_date = COALESCE(due_date, $4), updated_at = $3
+		 WHERE id = $1`,
+		invoiceID, number, now, now.AddDate(0, 0, manualInvoiceDueDays),
+	); err != nil {
+		return nil, common.ErrInternal("Failed to finalize invoice", err)
+	}
+
+	if err := writeInvoiceAudit(ctx, tx, adminID, "invoice_finalized", invoiceID, map[string]interface{}{
+		"invoice_number": number,
+	}, ip, userAgent, now); err != nil {
+		return nil, common.ErrInternal("Failed to write audit log", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, common.ErrInternal("Failed to commit invoice", err)
+	}
+	return h.adminInvoice(ctx, invoiceID)
+}
+
+// voidInvoice 草稿或待支付 -> 作废：退回发票上抵扣的余额，取消等待该发票的套餐变更和线下付款订单
+func (h *Handler) voidInvoice(ctx context.Context, adminID, invoiceID, reason, ip, userAgent string) (*Invoice, *common.ServiceError) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return nil, common.ErrBadRequest("Void reason is required", nil)
+	}
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return nil, common.ErrInternal("Database error", err)
+	}
+	defer tx.Rollback(ctx)
+
+	status, userID, svcErr := lockInvoice(ctx, tx, invoiceID)
+	if svcErr != nil {
+		return nil, svcErr
+	}
+	if svcErr := transitionError(status, invoicestatus.Void); svcErr != nil {
+		return nil, svcErr
+	}
+
+	now := time.Now()
+	voided, err := invoicestatus.MarkVoid(ctx, tx, invoiceID, reason, now)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to void invoice", err)
+	}
+
+	if _, err := tx.Exec(ctx,
+		`UPDATE plan_changes
+		 SET status = 'cancelled', updated_at = $2
+		 WHERE invoice_id = $1 AND status = 'pending'`,
+		invoiceID, now,
+	); err != nil {
+		return nil, common.ErrInternal("Failed to cancel plan change", err)
+	}
+
+	// 线下付款的订单以发票等待到账，发票作废后订单不会再被支付
+	if voided.OrderID != nil {
+		tag, err := tx.Exec(ctx,
+			`UPDATE orders
+			 SET status = 'cancelled', credit_applied = 0, updated_at = $2
+			 WHERE id = $1 AND status = 'pending_payment'`,
+			*voided.OrderID, now,
+		)
+		if err != nil {
+			return nil, common.ErrInternal("Failed to cancel order", err)
+		}
+		if tag.RowsAffected() > 0 {
+			if err := credit.ReleaseOrder(ctx, tx, userID, *voided.OrderID, now); err != nil {
+				return nil, common.ErrInternal("Failed to release account credit", err)
+			}
+		}
+	}
+
+	if err := writeInvoiceAudit(ctx, tx, adminID, "invoice_voided", invoiceID, map[string]interface{}{
+		"previous_status": status,
+		"reason":          reason,
+	}, ip, userAgent, now); err != nil {
+		return nil, common.ErrInternal("Failed to write audit log", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, common.ErrInternal("Failed to commit invoice", err)
+	}
+	return h.adminInvoice(ctx, invoiceID)
+}
+
+// priceInvoice 按客户的税务信息对明细整体计税，重写明细和税费行并更新发票金额
+func (h *Handler) priceInvoice(ctx context.Context, tx pgx.Tx, invoiceID, userID string, lines []invoiceLine, now time.Time) error {
+	var amount int64
+	for _, line := range lines {
+		amount += line.Amount
+	}
+
+	decision, err := tax.ForUser(ctx, tx, h.store, userID)
+	if err != nil {
+		return fmt.Errorf("failed to resolve tax: %w", err)
+	}
+	breakdown, err := decision.Apply([]int64{amount})
+	if err != nil {
+		return fmt.Errorf("failed to calculate tax: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM invoice_items WHERE invoice_id = $1`, invoiceID); err != nil {
+		return fmt.Errorf("failed to clear invoice items: %w", err)
+	}
+	for i, line := range lines {
+		// 按顺序写入，读取时按 created_at 排序
+		createdAt := now.Add(time.Duration(i) * time.Microsecond)
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO invoice_items (id, invoice_id, kind, description, quantity, unit_price, amount, created_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			uuid.New().String(), invoiceID, line.Kind, line.Description, line.Quantity,
+			common.CentsToDecimal(line.UnitPrice), common.CentsToDecimal(line.Amount), createdAt,
+		); err != nil {
+			return fmt.Errorf("failed to create invoice item: %w", err)
+		}
+	}
+	if err := tax.InsertInvoiceLine(ctx, tx, invoiceID, breakdown, now.Add(time.Duration(len(lines))*time.Microsecond)); err != nil {
+		return fmt.Errorf("failed to create invoice tax line: %w", err)
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE invoices
+		 SET subtotal = $2, tax = $3, total = $4, tax_inclusive = $5, reverse_charge = $6, updated_at = $7
+		 WHERE id = $1`,
+		invoiceID, common.CentsToDecimal(breakdown.Priced()), common.CentsToDecimal(breakdown.Tax),
+		common.CentsToDecimal(breakdown.Total), decision.Inclusive, decision.ReverseCharge, now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update invoice totals: %w", err)
+	}
+	return nil
+}
+
+// draftLines 读取草稿的自定义明细，税费行在计税时重新生成
+func draftLines(ctx context.Context, tx pgx.Tx, invoiceID string) ([]invoiceLine, error) {
+	rows, err := tx.Query(ctx,
+		`SELECT description, quantity, unit_price::text, amount::text, kind
+		 FROM invoice_items
+		 WHERE invoice_id = $1 AND kind <> 'tax'
+		 ORDER BY created_at, id`,
+		invoiceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := make([]invoiceLine, 0)
+	for rows.Next() {
+		var line invoiceLine
+		var unitPrice, amount string
+		if err := rows.Scan(&line.Description, &line.Quantity, &unitPrice, &amount, &line.Kind); err != nil {
+			return nil, err
+		}
+		if line.UnitPrice, err = common.DecimalAmountToCents(unitPrice); err != nil {
+			return nil, err
+		}
+		if line.Amount, err = common.DecimalAmountToCents(amount); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+func checkCustomer(ctx context.Context, tx pgx.Tx, userID string) *common.ServiceError {
+	var exists bool
+	if err := tx.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`,
+		userID,
+	).Scan(&exists); err != nil {
+		return common.ErrInternal("Database error", err)
+	}
+	if !exists {
+		return common.ErrNotFound("Customer not found", nil)
+	}
+	return nil
+}
+
+func (h *Handler) adminInvoice(ctx context.Context, invoiceID string) (*Invoice, *common.ServiceError) {
+	inv, err := h.getInvoice(ctx, invoiceID)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to load invoice", err)
+	}
+	return inv, nil
+}
+
+func writeInvoiceAudit(ctx context.Context, tx pgx.Tx, adminID, action, invoiceID string, values map[string]interface{}, ip, userAgent string, now time.Time) error {
+	details, _ := json.Marshal(values)
+	_, err := tx.Exec(ctx,
+		`INSERT INTO audit_logs (user_id, action, entity_type, entity_id, new_values, ip_address, user_agent, created_at)
+		 VALUES ($1, $2, 'invoice', $3, $4, $5, $6, $7)`,
+		adminID, action, invoiceID, details, ip, userAgent, now,
+	)
+	return err
+}
+
+func invoiceCurrency(currency string) string {
+	if currency == "" {
+		return "USD"
+	}
+	return strings.ToUpper(currency)
+}
+
+func nullableText(s string) interface{} {
+	if s = strings.TrimSpace(s); s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,32 @@
+package billing
+
+import "testing"
+
+func TestManualInvoiceLines(t *testing.T) {
+	t.Parallel()
+
+	lines, total, err := manualInvoiceLines([]ManualInvoiceItemRequest{
+		{Description: "Server migration", UnitPrice: "150.00"},
+		{Description: "Additional IPv4 address", UnitPrice: "3.50", Quantity: 4},
+		{Description: "Loyalty discount", UnitPrice: "-20.00"},
+	})
+	if err != nil {
+		t.Fatalf("manualInvoiceLines: %v", err)
+	}
+	if total != 14400 {
+		t.Fatalf("total = %d, want 14400", total)
+	}
+	if lines[1].Amount != 1400 || lines[1].Kind != "line" {
+		t.Fatalf("second line = %+v", lines[1])
+	}
+	if lines[2].Kind != "discount" || lines[2].Amount != -2000 {
+		t.Fatalf("negative line should be a discount: %+v", lines[2])
+	}
+
+	if _, _, err := manualInvoiceLines([]ManualInvoiceItemRequest{{Description: "Credit only", UnitPrice: "-5.00"}}); err == nil {
+		t.Fatal("expected error for a non-positive invoice total")
+	}
+	if _, _, err := manualInvoiceLines([]ManualInvoiceItemRequest{{Description: "Free", UnitPrice: "0"}}); err == nil {
+		t.Fatal("expected error for a zero unit price")
+	}
+}
@@ -0,0 +1,349 @@
+package billing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/pdf"
+	"github.com/jackc/pgx/v5"
+)
+
+// itemKindTax 税费明细行，与普通商品行分开展示
+const itemKindTax = "tax"
+
+const (
+	pdfMargin     = 50.0
+	pdfRight      = pdf.PageWidth - pdfMargin
+	pdfBottom     = pdf.PageHeight - 70
+	pdfLineHeight = 14.0
+)
+
+// invoicePDF 返回发票 PDF。草稿每次实时渲染；定稿后按发票状态缓存，同一状态下的单据内容不再变化。
+// 部分退款可能发生多次，缓存按累计退款金额区分
+func (h *Handler) invoicePDF(ctx context.Context, invoiceID string) ([]byte, *Invoice, error) {
+	doc, err := h.loadInvoiceDocument(ctx, invoiceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	inv := doc.Invoice
+
+	if inv.Status == "draft" {
+		return renderInvoicePDF(doc), inv, nil
+	}
+
+	variant := documentVariant(inv)
+	cached, err := h.cachedDocument(ctx, invoiceID, "pdf", variant)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cached != nil {
+		return cached, inv, nil
+	}
+
+	content := renderInvoicePDF(doc)
+	stored, err := h.storeDocument(ctx, invoiceID, "pdf", variant, content)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stored, inv, nil
+}
+
+// documentVariant 定稿单据的缓存键：按发票状态区分，部分退款再按累计退款金额区分
+func documentVariant(inv *Invoice) string {
+	if inv.Status == "partially_refunded" {
+		return inv.Status + ":" + inv.AmountRefunded
+	}
+	return inv.Status
+}
+
+func (h *Handler) cachedDocument(ctx context.Context, invoiceID, format, variant string) ([]byte, error) {
+	var content []byte
+	err := h.pool.QueryRow(ctx,
+		`SELECT content
+		 FROM invoice_documents
+		 WHERE invoice_id = $1 AND format = $2 AND variant = $3`,
+		invoiceID, format, variant,
+	).Scan(&content)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return content, err
+}
+
+// storeDocument 写入缓存；并发渲染时以先写入的内容为准并返回它
+func (h *Handler) storeDocument(ctx context.Context, invoiceID, format, variant string, content []byte) ([]byte, error) {
+	sum := sha256.Sum256(content)
+	tag, err := h.pool.Exec(ctx,
+		`INSERT INTO invoice_documents (invoice_id, format, variant, content, checksum, created_at)
+		 VALUES ($1, $2, $3, $4, $5, NOW())
+		 ON CONFLICT (invoice_id, format, variant) DO NOTHING`,
+		invoiceID, format, variant, content, hex.EncodeToString(sum[:]),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 1 {
+		return content, nil
+	}
+	return h.cachedDocument(ctx, invoiceID, format, variant)
+}
+
+// renderInvoicePDF 排版发票：抬头、双方信息、明细表、合计和付款状态
+func renderInvoicePDF(doc *InvoiceDocument) []byte {
+	inv := doc.Invoice
+	out := pdf.New("Invoice " + inv.InvoiceNumber)
+	out.AddPage()
+
+	title := "INVOICE"
+	if inv.Status == "draft" {
+		title = "DRAFT INVOICE"
+	}
+	y := drawDocumentHeader(out, doc.Seller, title, invoiceMetaRows(inv))
+	y = drawBillTo(out, y, "BILL TO", doc.Buyer)
+	y = drawItemTable(out, y, inv.Items, inv.Currency)
+
+	// 合计
+	if y+90 > pdfBottom {
+		out.AddPage()
+		y = pdfMargin + 10
+	}
+	colUnit := pdfRight - 90
+	out.Line(pdfRight-240, y, pdfRight, y, 0.5)
+	y += 16
+	for _, row := range invoiceTotalRows(inv) {
+		bold := row[0] == "Total" || row[0] == "Balance due"
+		out.TextRight(colUnit, y, 10, bold, row[0])
+		out.TextRight(pdfRight-6, y, 10, bold, row[1])
+		y += 15
+	}
+
+	if inv.ReverseCharge {
+		y += 6
+		out.Text(pdfMargin, y, 9, false, "Reverse charge: VAT to be accounted for by the recipient.")
+		y += 12
+	}
+
+	if inv.Notes != nil && strings.TrimSpace(*inv.Notes) != "" {
+		y += 10
+		out.Text(pdfMargin, y, 9, true, "Notes")
+		y += 13
+		for _, line := range pdf.Wrap(*inv.Notes, 9, false, pdfRight-pdfMargin) {
+			out.Text(pdfMargin, y, 9, false, line)
+			y += 12
+		}
+	}
+
+	if stamp := statusStamp(inv.Status); stamp != "" {
+		y += 20
+		out.Text(pdfMargin, y, 22, true, stamp)
+	}
+
+	drawFooter(out, doc.Seller)
+	return out.Bytes()
+}
+
+// drawDocumentHeader 绘制抬头：左侧卖方，右侧单据标题和信息，返回分隔线下方的纵坐标
+func drawDocumentHeader(out *pdf.Document, seller Party, title string, meta [][2]string) float64 {
+	y := pdfMargin + 10
+	out.Text(pdfMargin, y, 18, true, seller.Name)
+	sellerY := y + 18
+	if seller.LegalName != "" && seller.LegalName != seller.Name {
+		out.Text(pdfMargin, sellerY, 9, false, seller.LegalName)
+		sellerY += 12
+	}
+	for _, line := range seller.AddressLines() {
+		out.Text(pdfMargin, sellerY, 9, false, line)
+		sellerY += 12
+	}
+	if seller.TaxID != "" {
+		out.Text(pdfMargin, sellerY, 9, false, "Tax ID: "+seller.TaxID)
+		sellerY += 12
+	}
+	if seller.Website != "" {
+		out.Text(pdfMargin, sellerY, 9, false, seller.Website)
+		sellerY += 12
+	}
+
+	out.TextRight(pdfRight, y, 20, true, title)
+	metaY := y + 20
+	for _, row := range meta {
+		out.TextRight(pdfRight-90, metaY, 9, false, row[0])
+		out.TextRight(pdfRight, metaY, 9, true, row[1])
+		metaY += 13
+	}
+
+	y = maxFloat(sellerY, metaY) + 20
+	out.Line(pdfMargin, y, pdfRight, y, 0.5)
+	return y + 20
+}
+
+func drawBillTo(out *pdf.Document, y float64, label string, buyer Party) float64 {
+	out.Text(pdfMargin, y, 9, true, label)
+	y += 14
+	for _, line := range buyerLines(buyer) {
+		out.Text(pdfMargin, y, 10, false, line)
+		y += 13
+	}
+	return y + 16
+}
+
+// drawItemTable 绘制明细表，税费行留给合计区展示；明细过多时自动分页并重复表头
+func drawItemTable(out *pdf.Document, y float64, items []InvoiceItem, currency string) float64 {
+	colQty := pdfRight - 200
+	colUnit := pdfRight - 90
+	descWidth := colQty - pdfMargin - 40
+	drawHeader := func() {
+		out.FillRect(pdfMargin, y-11, pdfRight-pdfMargin, 18, 0.92)
+		out.Text(pdfMargin+6, y+2, 9, true, "Description")
+		out.TextRight(colQty, y+2, 9, true, "Qty")
+		out.TextRight(colUnit, y+2, 9, true, "Unit price")
+		out.TextRight(pdfRight-6, y+2, 9, true, "Amount")
+		y += 22
+	}
+	drawHeader()
+
+	for _, item := range items {
+		if item.Kind == itemKindTax {
+			continue
+		}
+		lines := pdf.Wrap(item.Description, 10, false, descWidth)
+		if y+float64(len(lines))*pdfLineHeight > pdfBottom {
+			out.AddPage()
+			y = pdfMargin + 10
+			drawHeader()
+		}
+		out.TextRight(colQty, y, 10, false, fmt.Sprintf("%d", item.Quantity))
+		out.TextRight(colUnit, y, 10, false, formatMoney(item.UnitPrice, currency))
+		out.TextRight(pdfRight-6, y, 10, false, formatMoney(item.Amount, currency))
+		for _, line := range lines {
+			out.Text(pdfMargin+6, y, 10, false, line)
+			y += pdfLineHeight
+		}
+		y += 4
+	}
+	return y
+}
+
+func drawFooter(out *pdf.Document, seller Party) {
+	footer := "Thank you for your business."
+	if seller.Website != "" {
+		footer += " " + seller.Website
+	}
+	out.Line(pdfMargin, pdf.PageHeight-50, pdfRight, pdf.PageHeight-50, 0.5)
+	out.Text(pdfMargin, pdf.PageHeight-36, 8, false, footer)
+}
+
+func invoiceMetaRows(inv *Invoice) [][2]string {
+	// 草稿没有编号；手工发票以定稿日期为开票日期
+	var rows [][2]string
+	if inv.InvoiceNumber != "" {
+		rows = append(rows, [2]string{"Invoice number", inv.InvoiceNumber})
+	}
+	issued := inv.CreatedAt
+	if inv.FinalizedAt != nil {
+		issued = *inv.FinalizedAt
+	}
+	rows = append(rows, [2]string{"Issue date", formatDate(&issued)})
+	if inv.DueDate != nil {
+		rows = append(rows, [2]string{"Due date", formatDate(inv.DueDate)})
+	}
+	if inv.PeriodStart != nil && inv.PeriodEnd != nil {
+		rows = append(rows, [2]string{"Service period", formatDate(inv.PeriodStart) + " - " + formatDate(inv.PeriodEnd)})
+	}
+	if inv.PaidAt != nil && (inv.Status == "paid" || inv.Status == "partially_refunded" || inv.Status == "refunded") {
+		rows = append(rows, [2]string{"Paid on", formatDate(inv.PaidAt)})
+	}
+	return rows
+}
+
+func invoiceTotalRows(inv *Invoice) [][2]string {
+	rows := [][2]string{{"Subtotal", formatMoney(inv.Subtotal, inv.Currency)}}
+	taxLines := 0
+	for _, item := range inv.Items {
+		if item.Kind == itemKindTax {
+			rows = append(rows, [2]string{item.Description, formatMoney(item.Amount, inv.Currency)})
+			taxLines++
+		}
+	}
+	if taxLines == 0 {
+		rows = append(rows, [2]string{"Tax", formatMoney(inv.Tax, inv.Currency)})
+	}
+	rows = append(rows, [2]string{"Total", formatMoney(inv.Total, inv.Currency)})
+
+	due := inv.Total
+	if credit, err := common.DecimalAmountToCents(inv.CreditApplied); err == nil && credit > 0 {
+		rows = append(rows, [2]string{"Account credit applied", formatMoney(common.CentsToDecimal(-credit), inv.Currency)})
+		if total, err := common.DecimalAmountToCents(inv.Total); err == nil {
+			due = common.CentsToDecimal(total - credit)
+		}
+	}
+
+	switch inv.Status {
+	case "paid":
+		rows = append(rows,
+			[2]string{"Amount paid", formatMoney(due, inv.Currency)},
+			[2]string{"Balance due", formatMoney("0.00", inv.Currency)},
+		)
+	case "partially_refunded", "refunded":
+		rows = append(rows, [2]string{"Amount paid", formatMoney(due, inv.Currency)})
+		if refunded, err := common.DecimalAmountToCents(inv.AmountRefunded); err == nil && refunded > 0 {
+			rows = append(rows, [2]string{"Refunded", formatMoney(common.CentsToDecimal(-refunded), inv.Currency)})
+		}
+	case "pending", "draft":
+		rows = append(rows, [2]string{"Balance due", formatMoney(due, inv.Currency)})
+	}
+	return rows
+}
+
+func buyerLines(buyer Party) []string {
+	lines := nonEmpty(buyer.Name, buyer.CompanyName)
+	lines = append(lines, buyer.AddressLines()...)
+	if buyer.TaxID != "" {
+		lines = append(lines, "Tax ID: "+buyer.TaxID)
+	}
+	if buyer.Email != "" {
+		lines = append(lines, buyer.Email)
+	}
+	return lines
+}
+
+func statusStamp(status string) string {
+	switch status {
+	case "paid":
+		return "PAID"
+	case "pending":
+		return "PAYMENT DUE"
+	case "void":
+		return "VOID"
+	case "refunded":
+		return "REFUNDED"
+	case "partially_refunded":
+		return "PARTIALLY REFUNDED"
+	default:
+		return ""
+	}
+}
+
+func formatMoney(amount, currency string) string {
+	return strings.ToUpper(currency) + " " + amount
+}
+
+func formatDate(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,48 @@
+package billing
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRenderInvoicePDF(t *testing.T) {
+	t.Parallel()
+
+	due := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	inv := &Invoice{
+		InvoiceNumber: "INV-20260215-ABCD1234",
+		Status:        "pending",
+		Subtotal:      "100.00",
+		Tax:           "20.00",
+		Total:         "120.00",
+		Currency:      "eur",
+		DueDate:       &due,
+		CreatedAt:     due.AddDate(0, 0, -14),
+	}
+	// 足够多的明细行以触发分页
+	for i := 0; i < 60; i++ {
+		inv.Items = append(inv.Items, InvoiceItem{
+			Description: fmt.Sprintf("vps-%02d.example.com - Standard renewal (monthly)", i),
+			Quantity:    1,
+			UnitPrice:   "1.00",
+			Amount:      "1.00",
+		})
+	}
+
+	out := renderInvoicePDF(&InvoiceDocument{
+		Invoice: inv,
+		Seller:  Party{Name: "EchoBilling", LegalName: "Echo Hosting Ltd", Website: "https://billing.example.com"},
+		Buyer:   Party{Name: "Jane Doe", City: "Berlin", Country: "DE", TaxID: "DE123456789"},
+	})
+
+	for _, want := range []string{"%PDF-", "(INV-20260215-ABCD1234) Tj", "(Tax ID: DE123456789) Tj", "(EUR 120.00) Tj", "(PAYMENT DUE) Tj"} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Fatalf("rendered PDF missing %q", want)
+		}
+	}
+	if !bytes.Contains(out, []byte("/Count 2")) {
+		t.Fatalf("expected line items to overflow onto a second page")
+	}
+}
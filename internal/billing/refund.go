@@ -0,0 +1,379 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/app"
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/db"
+	"github.com/adiecho/echobilling/internal/invoicestatus"
+	"github.com/adiecho/echobilling/internal/provisioning"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
+)
+
+// 退款时对关联服务的处理方式
+const (
+	RefundServiceKeep      = ""
+	RefundServiceCancel    = "cancel"
+	RefundServiceTerminate = "terminate"
+)
+
+// RefundSuspendReason 因退款取消而暂停的服务记录的 suspend_reason，付款后不会被自动恢复
+const RefundSuspendReason = "refunded"
+
+// Refund 网关退款记录，GatewayRefundID 为网关退款 ID
+type Refund struct {
+	PaymentID       string
+	GatewayRefundID string
+	Amount          string
+	Reason          string
+	Status          string
+	CreatedBy       string
+}
+
+// RefundState 退款后付款和发票的累计状态
+type RefundState struct {
+	PaymentID      string
+	PaymentStatus  string
+	AmountRefunded string
+	InvoiceID      *string
+	InvoiceStatus  string
+}
+
+// RecordRefund 在事务内按网关退款 ID 幂等地登记退款，并签发（退款失败时作废）对应的贷项通知单，返回退款记录 ID
+func RecordRefund(ctx context.Context, tx pgx.Tx, store *app.SettingsStore, r Refund, now time.Time) (string, error) {
+	var createdBy interface{}
+	if r.CreatedBy != "" {
+		createdBy = r.CreatedBy
+	}
+
+	var refundID string
+	err := tx.QueryRow(ctx,
+		`INSERT INTO refunds (id, payment_id, stripe_refund_id, amount, reason, status, created_by, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+		 ON CONFLICT (stripe_refund_id) DO UPDATE SET
+		   amount = EXCLUDED.amount,
+		   reason = COALESCE(NULLIF(EXCLUDED.reason, ''), refunds.reason),
+		   status = EXCLUDED.status,
+		   created_by = COALESCE(refunds.created_by, EXCLUDED.created_by),
+		   updated_at = EXCLUDED.updated_at
+		 RETURNING id`,
+		uuid.New().String(), r.PaymentID, r.GatewayRefundID, r.Amount, r.Reason, r.Status, createdBy, now,
+	).Scan(&refundID)
+	if err != nil {
+		return "", fmt.Errorf("failed to upsert refund: %w", err)
+	}
+
+	if r.Status == "failed" {
+		if _, err := tx.Exec(ctx,
+			`UPDATE credit_notes
+			 SET status = 'void', voided_at = $2, updated_at = $2
+			 WHERE refund_id = $1 AND status = 'issued'`,
+			refundID, now,
+		); err != nil {
+			return "", fmt.Errorf("failed to void credit note: %w", err)
+		}
+		return refundID, nil
+	}
+
+	if err := issueRefundCreditNote(ctx, tx, store, refundID, now); err != nil {
+		return "", err
+	}
+	return refundID, nil
+}
+
+// SyncRefundState 按有效退款（不含失败的退款）重新计算付款和发票的累计退款金额与状态。
+// reported 为网关报告的累计退款金额（分），网关事件未携带完整退款明细时作为下限，没有时传 0
+func SyncRefundState(ctx context.Context, tx pgx.Tx, paymentID string, reported int64, now time.Time) (*RefundState, error) {
+	var (
+		status, amount, refunded string
+		invoiceID                *string
+		disputeLost              bool
+	)
+	err := tx.QueryRow(ctx,
+		`SELECT p.status::text, p.amount::text, p.invoice_id::text,
+		        COALESCE((SELECT SUM(amount) FROM refunds WHERE payment_id = p.id AND status <> 'failed'), 0)::text,
+		        EXISTS (SELECT 1 FROM disputes WHERE payment_id = p.id AND status = 'lost')
+		 FROM payments p
+		 WHERE p.id = $1
+		 FOR UPDATE OF p`,
+		paymentID,
+	).Scan(&status, &amount, &invoiceID, &refunded, &disputeLost)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("payment %s not found", paymentID)
+		}
+		return nil, fmt.Errorf("failed to get payment: %w", err)
+	}
+
+	paidCents, err := common.DecimalAmountToCents(amount)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payment amount: %w", err)
+	}
+	refundedCents, err := common.DecimalAmountToCents(refunded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid refund amount: %w", err)
+	}
+	if reported > refundedCents {
+		refundedCents = reported
+	}
+	if refundedCents > paidCents {
+		refundedCents = paidCents
+	}
+
+	state := &RefundState{
+		PaymentID:      paymentID,
+		PaymentStatus:  paymentRefundStatus(status, paidCents, refundedCents, disputeLost),
+		AmountRefunded: common.CentsToDecimal(refundedCents),
+		InvoiceID:      invoiceID,
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE payments
+		 SET status = $2, amount_refunded = $3, updated_at = $4
+		 WHERE id = $1`,
+		paymentID, state.PaymentStatus, state.AmountRefunded, now,
+	); err != nil {
+		return nil, fmt.Errorf("failed to update payment refund state: %w", err)
+	}
+
+	if invoiceID == nil {
+		return state, nil
+	}
+
+	var invoiceStatus, due, invoiceRefunded string
+	err = tx.QueryRow(ctx,
+		`SELECT i.status::text, (i.total - i.credit_applied)::text,
+		        COALESCE((SELECT SUM(amount_refunded) FROM payments WHERE invoice_id = i.id), 0)::text
+		 FROM invoices i
+		 WHERE i.id = $1
+		 FOR UPDATE OF i`,
+		*invoiceID,
+	).Scan(&invoiceStatus, &due, &invoiceRefunded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invoice: %w", err)
+	}
+	dueCents, err := common.DecimalAmountToCents(due)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invoice amount: %w", err)
+	}
+	invoiceRefundedCents, err := common.DecimalAmountToCents(invoiceRefunded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invoice refund amount: %w", err)
+	}
+
+	state.InvoiceStatus = invoiceRefundStatus(invoiceStatus, dueCents, invoiceRefundedCents)
+	if _, err := tx.Exec(ctx,
+		`UPDATE invoices
+		 SET status = $2, amount_refunded = $3, updated_at = $4
+		 WHERE id = $1`,
+		*invoiceID, state.InvoiceStatus, common.CentsToDecimal(invoiceRefundedCents), now,
+	); err != nil {
+		return nil, fmt.Errorf("failed to update invoice refund state: %w", err)
+	}
+	return state, nil
+}
+
+// paymentRefundStatus 按累计退款金额推导付款状态，未完成或失败的付款保持原状态。
+// 败诉的争议等同于全额退款
+func paymentRefundStatus(current string, paid, refunded int64, disputeLost bool) string {
+	switch current {
+	case "succeeded", "partially_refunded", "refunded":
+	default:
+		return current
+	}
+	switch {
+	case refunded > 0 && refunded >= paid:
+		return "refunded"
+	case refunded > 0:
+		return "partially_refunded"
+	case disputeLost && current == "refunded":
+		return "refunded"
+	default:
+		return "succeeded"
+	}
+}
+
+// invoiceRefundStatus 按累计退款金额推导发票状态，只调整已支付的发票。
+// due 为客户实际支付的金额（总额减去余额抵扣）
+func invoiceRefundStatus(current string, due, refunded int64) string {
+	switch current {
+	case invoicestatus.Paid, invoicestatus.PartiallyRefunded, invoicestatus.Refunded:
+	default:
+		return current
+	}
+	next := invoicestatus.Paid
+	switch {
+	case refunded > 0 && refunded >= due:
+		next = invoicestatus.Refunded
+	case refunded > 0:
+		next = invoicestatus.PartiallyRefunded
+	}
+	if next != current && !invoicestatus.CanTransition(current, next) {
+		return current
+	}
+	return next
+}
+
+// RefundableAmount 付款还可以退款的金额（分）
+func RefundableAmount(paid, refunded int64) int64 {
+	if refunded >= paid {
+		return 0
+	}
+	return paid - refunded
+}
+
+// ValidRefundServiceAction 校验退款时对服务的处理方式
+func ValidRefundServiceAction(action string) bool {
+	switch action {
+	case RefundServiceKeep, RefundServiceCancel, RefundServiceTerminate:
+		return true
+	}
+	return false
+}
+
+// RefundServiceAction 退款后需要调用方在事务提交后投递的服务任务
+type RefundServiceAction struct {
+	Action     string
+	ServiceIDs []string
+}
+
+// ApplyRefundServiceAction 在事务内取消退款付款所支付的服务：停止续费、作废待付的续费发票并退回已抵扣的余额。
+// 续费发票只对应 service_id 指向的服务，同一订单的其他单元不受影响；没有 service_id 的新购发票对应订单创建的全部服务。
+// cancel 暂停实例并保留数据，terminate 终止实例；暂停和终止任务由 EnqueueRefundServiceAction 在提交后投递
+func ApplyRefundServiceAction(ctx context.Context, tx pgx.Tx, paymentID, action string, now time.Time) (*RefundServiceAction, error) {
+	result := &RefundServiceAction{Action: action}
+	if action == RefundServiceKeep {
+		return result, nil
+	}
+
+	paid, err := PaymentServices(ctx, tx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	if len(paid) == 0 {
+		return result, nil
+	}
+
+	rows, err := tx.Query(ctx,
+		`UPDATE services
+		 SET cancelled_at = COALESCE(cancelled_at, $2),
+		     metadata = COALESCE(metadata, '{}'::jsonb) || jsonb_build_object('cancel_reason', 'refunded', 'refund_payment_id', $1::text),
+		     updated_at = $2
+		 WHERE status NOT IN ('cancelled', 'terminated')
+		   AND id = ANY($3::uuid[])
+		 RETURNING id`,
+		paymentID, now, paid,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel refunded services: %w", err)
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan service: %w", err)
+		}
+		result.ServiceIDs = append(result.ServiceIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to cancel refunded services: %w", err)
+	}
+	if len(result.ServiceIDs) == 0 {
+		return result, nil
+	}
+
+	// 已取消服务的待支付续费发票不会再被支付
+	rows, err = tx.Query(ctx,
+		`SELECT id FROM invoices
+		 WHERE service_id = ANY($1::uuid[]) AND status = 'pending'
+		 FOR UPDATE`,
+		result.ServiceIDs,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query renewal invoices: %w", err)
+	}
+	var invoiceIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan invoice: %w", err)
+		}
+		invoiceIDs = append(invoiceIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query renewal invoices: %w", err)
+	}
+	for _, id := range invoiceIDs {
+		if _, err := invoicestatus.MarkVoid(ctx, tx, id, "Service cancelled after refund", now); err != nil {
+			return nil, fmt.Errorf("failed to void renewal invoice: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// PaymentServices 返回付款所支付的服务：续费发票只对应 service_id 指向的单元，
+// 没有 service_id 的新购发票对应订单创建的全部服务。退款和争议按同一范围处理服务
+func PaymentServices(ctx context.Context, q db.DBTX, paymentID string) ([]string, error) {
+	rows, err := q.Query(ctx,
+		`SELECT s.id
+		 FROM payments p
+		 JOIN invoices i ON i.id = p.invoice_id
+		 JOIN services s ON (i.service_id IS NOT NULL AND s.id = i.service_id)
+		    OR (i.service_id IS NULL AND s.order_item_id IN (SELECT id FROM order_items WHERE order_id = i.order_id))
+		 WHERE p.id = $1
+		 ORDER BY s.created_at, s.id`,
+		paymentID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query paid services: %w", err)
+	}
+	defer rows.Close()
+	serviceIDs := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan service: %w", err)
+		}
+		serviceIDs = append(serviceIDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query paid services: %w", err)
+	}
+	return serviceIDs, nil
+}
+
+// EnqueueRefundServiceAction 投递退款后的暂停或终止任务
+func EnqueueRefundServiceAction(client *asynq.Client, action *RefundServiceAction) error {
+	if client == nil || action == nil {
+		return nil
+	}
+	for _, id := range action.ServiceIDs {
+		var (
+			task *asynq.Task
+			err  error
+		)
+		switch action.Action {
+		case RefundServiceCancel:
+			task, err = provisioning.NewSuspendVPSTask(provisioning.SuspendVPSPayload{ServiceID: id, Reason: RefundSuspendReason})
+		case RefundServiceTerminate:
+			task, err = provisioning.NewTerminateVPSTask(provisioning.TerminateVPSPayload{ServiceID: id})
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := client.Enqueue(task, asynq.Queue("critical"), asynq.MaxRetry(5)); err != nil {
+			return fmt.Errorf("failed to enqueue %s for service %s: %w", action.Action, id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package billing
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/testdb"
+	"github.com/jackc/pgx/v5"
+)
+
+// seedTwoUnitOrder 写入一个数量为 2 的订单及其两个服务单元，返回订单 ID 和两个服务 ID
+func seedTwoUnitOrder(t *testing.T, ctx context.Context, tx pgx.Tx) (userID, orderID string, serviceIDs []string) {
+	t.Helper()
+
+	err := tx.QueryRow(ctx,
+		`INSERT INTO users (email, password_hash)
+		 VALUES ('refund-' || uuid_generate_v4() || '@example.com', 'x')
+		 RETURNING id`,
+	).Scan(&userID)
+	if err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+
+	var planID string
+	err = tx.QueryRow(ctx,
+		`WITH product AS (
+		     INSERT INTO products (name, slug, category)
+		     VALUES ('VPS', 'vps-' || uuid_generate_v4(), 'vps')
+		     RETURNING id
+		 )
+		 INSERT INTO plans (product_id, name, slug, price_monthly)
+		 SELECT id, 'Standard', 'standard-' || uuid_generate_v4(), 10 FROM product
+		 RETURNING id`,
+	).Scan(&planID)
+	if err != nil {
+		t.Fatalf("insert plan: %v", err)
+	}
+
+	var itemID string
+	err = tx.QueryRow(ctx,
+		`WITH o AS (
+		     INSERT INTO orders (user_id, status, total_amount)
+		     VALUES ($1, 'active', 20)
+		     RETURNING id
+		 )
+		 INSERT INTO order_items (order_id, plan_id, plan_snapshot, quantity, unit_price, billing_cycle)
+		 SELECT id, $2, '{}', 2, 10, 'monthly' FROM o
+		 RETURNING order_id, id`,
+		userID, planID,
+	).Scan(&orderID, &itemID)
+	if err != nil {
+		t.Fatalf("insert order: %v", err)
+	}
+
+	for unit := 0; unit < 2; unit++ {
+		var id string
+		err := tx.QueryRow(ctx,
+			`INSERT INTO services (user_id, order_item_id, plan_id, status, unit_index)
+			 VALUES ($1, $2, $3, 'active', $4)
+			 RETURNING id`,
+			userID, itemID, planID, unit,
+		).Scan(&id)
+		if err != nil {
+			t.Fatalf("insert service: %v", err)
+		}
+		serviceIDs = append(serviceIDs, id)
+	}
+	return userID, orderID, serviceIDs
+}
+
+// seedPaidInvoice 写入一张已支付的发票及其付款；serviceID 为空表示新购发票
+func seedPaidInvoice(t *testing.T, ctx context.Context, tx pgx.Tx, userID, orderID, serviceID string) string {
+	t.Helper()
+
+	var service *string
+	if serviceID != "" {
+		service = &serviceID
+	}
+	var paymentID string
+	err := tx.QueryRow(ctx,
+		`WITH inv AS (
+		     INSERT INTO invoices (user_id, order_id, service_id, invoice_number, status, subtotal, total, paid_at)
+		     VALUES ($1, $2, $3, 'TEST-' || uuid_generate_v4(), 'paid', 10, 10, NOW())
+		     RETURNING id
+		 )
+		 INSERT INTO payments (user_id, invoice_id, amount, status)
+		 SELECT $1, id, 10, 'succeeded' FROM inv
+		 RETURNING id`,
+		userID, orderID, service,
+	).Scan(&paymentID)
+	if err != nil {
+		t.Fatalf("insert invoice: %v", err)
+	}
+	return paymentID
+}
+
+func TestApplyRefundServiceActionScopesRenewalToItsUnit(t *testing.T) {
+	pool := testdb.Pool(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		renewal bool
+	}{
+		{"renewal invoice cancels only its unit", true},
+		{"order invoice cancels every unit", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx, err := pool.Begin(ctx)
+			if err != nil {
+				t.Fatalf("begin: %v", err)
+			}
+			defer tx.Rollback(ctx)
+
+			userID, orderID, services := seedTwoUnitOrder(t, ctx, tx)
+			want := services
+			invoiceService := ""
+			if tt.renewal {
+				// 续费发票同时带有 order_id 和 service_id
+				invoiceService = services[1]
+				want = services[1:]
+			}
+			paymentID := seedPaidInvoice(t, ctx, tx, userID, orderID, invoiceService)
+
+			result, err := ApplyRefundServiceAction(ctx, tx, paymentID, RefundServiceCancel, time.Now())
+			if err != nil {
+				t.Fatalf("ApplyRefundServiceAction: %v", err)
+			}
+			got := slices.Clone(result.ServiceIDs)
+			slices.Sort(got)
+			want = slices.Clone(want)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Fatalf("cancelled services = %v, want %v", got, want)
+			}
+
+			var cancelled int
+			if err := tx.QueryRow(ctx,
+				`SELECT COUNT(*) FROM services WHERE id = ANY($1::uuid[]) AND cancelled_at IS NOT NULL`,
+				services,
+			).Scan(&cancelled); err != nil {
+				t.Fatalf("count cancelled: %v", err)
+			}
+			if cancelled != len(want) {
+				t.Fatalf("%d services cancelled, want %d", cancelled, len(want))
+			}
+		})
+	}
+}
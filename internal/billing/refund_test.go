@@ -0,0 +1,80 @@
+package billing
+
+import "testing"
+
+func TestPaymentRefundStatus(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		current     string
+		paid        int64
+		refunded    int64
+		disputeLost bool
+		want        string
+	}{
+		{"succeeded", 2000, 0, false, "succeeded"},
+		{"succeeded", 2000, 500, false, "partially_refunded"},
+		{"partially_refunded", 2000, 2000, false, "refunded"},
+		// 退款失败后恢复
+		{"partially_refunded", 2000, 0, false, "succeeded"},
+		{"refunded", 2000, 500, false, "partially_refunded"},
+		// 败诉的争议保持已退款
+		{"refunded", 2000, 0, true, "refunded"},
+		{"processing", 2000, 0, false, "processing"},
+		{"failed", 2000, 500, false, "failed"},
+	}
+	for _, tt := range tests {
+		if got := paymentRefundStatus(tt.current, tt.paid, tt.refunded, tt.disputeLost); got != tt.want {
+			t.Errorf("paymentRefundStatus(%s, %d, %d, %v) = %s, want %s", tt.current, tt.paid, tt.refunded, tt.disputeLost, got, tt.want)
+		}
+	}
+}
+
+func TestInvoiceRefundStatus(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		current  string
+		due      int64
+		refunded int64
+		want     string
+	}{
+		{"paid", 1000, 0, "paid"},
+		{"paid", 1000, 300, "partially_refunded"},
+		{"partially_refunded", 1000, 1000, "refunded"},
+		{"refunded", 1000, 0, "paid"},
+		// 全额用余额抵扣的发票没有可退的付款
+		{"paid", 0, 0, "paid"},
+		{"pending", 1000, 300, "pending"},
+		{"void", 1000, 0, "void"},
+	}
+	for _, tt := range tests {
+		if got := invoiceRefundStatus(tt.current, tt.due, tt.refunded); got != tt.want {
+			t.Errorf("invoiceRefundStatus(%s, %d, %d) = %s, want %s", tt.current, tt.due, tt.refunded, got, tt.want)
+		}
+	}
+}
+
+func TestRefundableAmount(t *testing.T) {
+	t.Parallel()
+
+	if got := RefundableAmount(2000, 500); got != 1500 {
+		t.Fatalf("RefundableAmount = %d, want 1500", got)
+	}
+	if got := RefundableAmount(2000, 2500); got != 0 {
+		t.Fatalf("RefundableAmount over-refunded = %d, want 0", got)
+	}
+}
+
+func TestValidRefundServiceAction(t *testing.T) {
+	t.Parallel()
+
+	for _, action := range []string{RefundServiceKeep, RefundServiceCancel, RefundServiceTerminate} {
+		if !ValidRefundServiceAction(action) {
+			t.Fatalf("%q should be valid", action)
+		}
+	}
+	if ValidRefundServiceAction("suspend") {
+		t.Fatal("suspend is not a refund service action")
+	}
+}
@@ -7,10 +7,36 @@ func RegisterRoutes(portal *gin.RouterGroup, admin *gin.RouterGroup, h *Handler)
 	{
 		invoices.GET("", h.ListInvoices)
 		invoices.GET("/:id", h.GetInvoice)
+		invoices.GET("/:id/pdf", h.GetInvoicePDF)
+		invoices.GET("/:id/ubl", h.GetInvoiceUBL)
+		invoices.GET("/:id/facturx", h.GetInvoiceFacturX)
+	}
+
+	creditNotes := portal.Group("/credit-notes")
+	{
+		creditNotes.GET("", h.ListCreditNotes)
+		creditNotes.GET("/:id", h.GetCreditNote)
+		creditNotes.GET("/:id/pdf", h.GetCreditNotePDF)
 	}
 
 	adminInvoices := admin.Group("/invoices")
 	{
 		adminInvoices.GET("", h.AdminListInvoices)
+		adminInvoices.POST("", h.AdminCreateInvoice)
+		adminInvoices.GET("/:id", h.AdminGetInvoice)
+		adminInvoices.PUT("/:id", h.AdminUpdateInvoice)
+		adminInvoices.POST("/:id/finalize", h.AdminFinalizeInvoice)
+		adminInvoices.POST("/:id/void", h.AdminVoidInvoice)
+		adminInvoices.GET("/:id/pdf", h.AdminGetInvoicePDF)
+		adminInvoices.GET("/:id/ubl", h.AdminGetInvoiceUBL)
+		adminInvoices.GET("/:id/facturx", h.AdminGetInvoiceFacturX)
+	}
+
+	adminCreditNotes := admin.Group("/credit-notes")
+	{
+		adminCreditNotes.GET("", h.AdminListCreditNotes)
+		adminCreditNotes.POST("", h.AdminCreateCreditNote)
+		adminCreditNotes.GET("/:id", h.AdminGetCreditNote)
+		adminCreditNotes.GET("/:id/pdf", h.AdminGetCreditNotePDF)
 	}
 }
@@ -6,6 +6,7 @@ import (
 	"strconv"
 
 	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/invoicestatus"
 	"github.com/jackc/pgx/v5"
 )
 
@@ -19,7 +20,7 @@ func (h *Handler) listUserInvoices(ctx context.Context, userID string, page, lim
 
 	var total int64
 	err := h.pool.QueryRow(ctx,
-		`SELECT COUNT(*) FROM invoices WHERE user_id = $1`,
+		`SELECT COUNT(*) FROM invoices WHERE user_id = $1 AND status <> 'draft'`,
 		userID,
 	).Scan(&total)
 	if err != nil {
@@ -27,9 +28,11 @@ func (h *Handler) listUserInvoices(ctx context.Context, userID string, page, lim
 	}
 
 	rows, err := h.pool.Query(ctx,
-		`SELECT id, user_id, order_id, invoice_number, status, subtotal, tax, total, currency, due_date, paid_at, created_at
+		`SELECT id, user_id, order_id::text, COALESCE(invoice_number, ''), status, subtotal, tax, total, credit_applied::text, amount_refunded::text, currency,
+		        tax_inclusive, reverse_charge, service_id::text, billing_period_start, billing_period_end, due_date, paid_at, created_at,
+		        notes, finalized_at, voided_at, void_reason
 		 FROM invoices
-		 WHERE user_id = $1
+		 WHERE user_id = $1 AND status <> 'draft'
 		 ORDER BY created_at DESC
 		 LIMIT $2 OFFSET $3`,
 		userID, limit, offset,
@@ -42,10 +45,12 @@ func (h *Handler) listUserInvoices(ctx context.Context, userID string, page, lim
 	invoices := make([]Invoice, 0)
 	for rows.Next() {
 		var inv Invoice
-		var subtotal, tax, totalAmount string
+		var subtotal, tax, totalAmount, creditApplied, amountRefunded string
 		if err := rows.Scan(
 			&inv.ID, &inv.UserID, &inv.OrderID, &inv.InvoiceNumber, &inv.Status,
-			&subtotal, &tax, &totalAmount, &inv.Currency, &inv.DueDate, &inv.PaidAt, &inv.CreatedAt,
+			&subtotal, &tax, &totalAmount, &creditApplied, &amountRefunded, &inv.Currency,
+			&inv.TaxInclusive, &inv.ReverseCharge, &inv.ServiceID, &inv.PeriodStart, &inv.PeriodEnd, &inv.DueDate, &inv.PaidAt, &inv.CreatedAt,
+			&inv.Notes, &inv.FinalizedAt, &inv.VoidedAt, &inv.VoidReason,
 		); err != nil {
 			return nil, 0, err
 		}
@@ -53,6 +58,8 @@ func (h *Handler) listUserInvoices(ctx context.Context, userID string, page, lim
 		inv.Subtotal = common.NormalizeAmount(subtotal)
 		inv.Tax = common.NormalizeAmount(tax)
 		inv.Total = common.NormalizeAmount(totalAmount)
+		inv.CreditApplied = common.NormalizeAmount(creditApplied)
+		inv.AmountRefunded = common.NormalizeAmount(amountRefunded)
 		invoices = append(invoices, inv)
 	}
 
@@ -64,16 +71,36 @@ func (h *Handler) listUserInvoices(ctx context.Context, userID string, page, lim
 }
 
 func (h *Handler) getUserInvoice(ctx context.Context, userID, invoiceID string) (*Invoice, error) {
+	inv, err := h.getInvoice(ctx, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	if inv.UserID != userID {
+		return nil, ErrInvoiceForbidden
+	}
+	// 草稿只对管理员可见
+	if inv.Status == invoicestatus.Draft {
+		return nil, ErrInvoiceNotFound
+	}
+	return inv, nil
+}
+
+// getInvoice 读取发票及其明细，不做归属校验
+func (h *Handler) getInvoice(ctx context.Context, invoiceID string) (*Invoice, error) {
 	var inv Invoice
-	var subtotal, tax, totalAmount string
+	var subtotal, tax, totalAmount, creditApplied, amountRefunded string
 	err := h.pool.QueryRow(ctx,
-		`SELECT id, user_id, order_id, invoice_number, status, subtotal, tax, total, currency, due_date, paid_at, created_at
+		`SELECT id, user_id, order_id::text, COALESCE(invoice_number, ''), status, subtotal, tax, total, credit_applied::text, amount_refunded::text, currency,
+		        tax_inclusive, reverse_charge, service_id::text, billing_period_start, billing_period_end, due_date, paid_at, created_at,
+		        notes, finalized_at, voided_at, void_reason
 		 FROM invoices
 		 WHERE id = $1`,
 		invoiceID,
 	).Scan(
 		&inv.ID, &inv.UserID, &inv.OrderID, &inv.InvoiceNumber, &inv.Status,
-		&subtotal, &tax, &totalAmount, &inv.Currency, &inv.DueDate, &inv.PaidAt, &inv.CreatedAt,
+		&subtotal, &tax, &totalAmount, &creditApplied, &amountRefunded, &inv.Currency,
+		&inv.TaxInclusive, &inv.ReverseCharge, &inv.ServiceID, &inv.PeriodStart, &inv.PeriodEnd, &inv.DueDate, &inv.PaidAt, &inv.CreatedAt,
+		&inv.Notes, &inv.FinalizedAt, &inv.VoidedAt, &inv.VoidReason,
 	)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -82,16 +109,15 @@ func (h *Handler) getUserInvoice(ctx context.Context, userID, invoiceID string)
 		return nil, err
 	}
 
-	if inv.UserID != userID {
-		return nil, ErrInvoiceForbidden
-	}
-
 	inv.Subtotal = common.NormalizeAmount(subtotal)
 	inv.Tax = common.NormalizeAmount(tax)
 	inv.Total = common.NormalizeAmount(totalAmount)
+	inv.CreditApplied = common.NormalizeAmount(creditApplied)
+	inv.AmountRefunded = common.NormalizeAmount(amountRefunded)
 
 	rows, err := h.pool.Query(ctx,
-		`SELECT id, description, quantity, unit_price, amount
+		`SELECT id, description, quantity, unit_price, amount, kind,
+		        COALESCE(tax_category, ''), COALESCE(tax_rate::text, '')
 		 FROM invoice_items
 		 WHERE invoice_id = $1
 		 ORDER BY created_at`,
@@ -106,7 +132,8 @@ func (h *Handler) getUserInvoice(ctx context.Context, userID, invoiceID string)
 	for rows.Next() {
 		var item InvoiceItem
 		var unitPrice, amount string
-		if err := rows.Scan(&item.ID, &item.Description, &item.Quantity, &unitPrice, &amount); err != nil {
+		if err := rows.Scan(&item.ID, &item.Description, &item.Quantity, &unitPrice, &amount, &item.Kind,
+			&item.TaxCategory, &item.TaxRate); err != nil {
 			return nil, err
 		}
 
@@ -123,18 +150,30 @@ func (h *Handler) getUserInvoice(ctx context.Context, userID, invoiceID string)
 	return &inv, nil
 }
 
-func (h *Handler) listAdminInvoices(ctx context.Context, page, limit int) ([]AdminInvoiceSummary, int64, error) {
+func (h *Handler) listAdminInvoices(ctx context.Context, userID, status string, page, limit int) ([]AdminInvoiceSummary, int64, error) {
 	offset := (page - 1) * limit
 
+	where := "WHERE TRUE"
+	args := []interface{}{}
+	if userID != "" {
+		args = append(args, userID)
+		where += " AND i.user_id::text = $" + strconv.Itoa(len(args))
+	}
+	if status != "" {
+		args = append(args, status)
+		where += " AND i.status::text = $" + strconv.Itoa(len(args))
+	}
+
 	var total int64
-	err := h.pool.QueryRow(ctx, `SELECT COUNT(*) FROM invoices`).Scan(&total)
+	err := h.pool.QueryRow(ctx, `SELECT COUNT(*) FROM invoices i `+where, args...).Scan(&total)
 	if err != nil {
 		return nil, 0, err
 	}
 
+	args = append(args, limit, offset)
 	rows, err := h.pool.Query(ctx,
 		`SELECT i.id,
-		        i.invoice_number,
+		        COALESCE(i.invoice_number, ''),
 		        COALESCE(NULLIF(u.name, ''), u.email) AS customer_name,
 		        u.email AS customer_email,
 		        i.status::text,
@@ -142,9 +181,10 @@ func (h *Handler) listAdminInvoices(ctx context.Context, page, limit int) ([]Adm
 		        i.created_at
 		 FROM invoices i
 		 JOIN users u ON u.id = i.user_id
+		 `+where+`
 		 ORDER BY i.created_at DESC
-		 LIMIT $1 OFFSET $2`,
-		limit, offset,
+		 LIMIT $`+strconv.Itoa(len(args)-1)+` OFFSET $`+strconv.Itoa(len(args)),
+		args...,
 	)
 	if err != nil {
 		return nil, 0, err
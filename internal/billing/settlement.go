@@ -0,0 +1,151 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/invoicestatus"
+	"github.com/adiecho/echobilling/internal/provisioning"
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrInvoiceNotPayable 发票尚未定稿、已作废或已退款，不能标记为已支付
+var ErrInvoiceNotPayable = errors.New("invoice is not payable")
+
+// Settlement 描述发票结清的结果，Unsuspend 和 PlanChangeID 需要调用方在事务提交后处理
+type Settlement struct {
+	InvoiceID    string
+	ServiceID    string
+	AlreadyPaid  bool
+	ExpiresAt    *time.Time
+	Unsuspend    bool
+	PlanChangeID string
+}
+
+// SettleInvoice 在事务内将发票标记为已支付。
+// 续费发票会把关联服务的到期时间延长到计费周期末；到期时间只前移不回退，重复调用是幂等的。
+func SettleInvoice(ctx context.Context, tx pgx.Tx, invoiceID string, paidAt time.Time) (*Settlement, error) {
+	var (
+		status    string
+		serviceID *string
+		periodEnd *time.Time
+	)
+	err := tx.QueryRow(ctx,
+		`SELECT status::text, service_id::text, billing_period_end
+		 FROM invoices
+		 WHERE id = $1
+		 FOR UPDATE`,
+		invoiceID,
+	).Scan(&status, &serviceID, &periodEnd)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrInvoiceNotFound
+		}
+		return nil, err
+	}
+
+	result := &Settlement{InvoiceID: invoiceID}
+	switch {
+	case status == invoicestatus.Paid:
+		result.AlreadyPaid = true
+	// 退款回退到已支付只由 SyncRefundState 处理，付款只能结清待支付的发票
+	case status == invoicestatus.Pending && invoicestatus.CanTransition(status, invoicestatus.Paid):
+		if _, err := tx.Exec(ctx,
+			`UPDATE invoices
+			 SET status = 'paid', paid_at = $2, updated_at = $2
+			 WHERE id = $1`,
+			invoiceID, paidAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to mark invoice paid: %w", err)
+		}
+	default:
+		return nil, ErrInvoiceNotPayable
+	}
+
+	// 套餐变更的差价发票结清后，变更进入待执行状态
+	err = tx.QueryRow(ctx,
+		`UPDATE plan_changes
+		 SET status = 'paid', updated_at = $2
+		 WHERE invoice_id = $1 AND status = 'pending'
+		 RETURNING id::text, service_id::text`,
+		invoiceID, paidAt,
+	).Scan(&result.PlanChangeID, &result.ServiceID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("failed to mark plan change paid: %w", err)
+	}
+
+	if serviceID == nil || periodEnd == nil {
+		return result, nil
+	}
+	result.ServiceID = *serviceID
+
+	var (
+		serviceStatus string
+		expiresAt     time.Time
+		suspendReason string
+	)
+	err = tx.QueryRow(ctx,
+		`UPDATE services
+		 SET expires_at = GREATEST(COALESCE(expires_at, $2), $2),
+		     metadata = COALESCE(metadata, '{}'::jsonb) || jsonb_build_object(
+		         'last_renewed_at', $3::timestamptz,
+		         'last_renewal_invoice_id', $4::text
+		     ),
+		     updated_at = $3
+		 WHERE id = $1 AND status NOT IN ('cancelled', 'terminated')
+		 RETURNING status::text, expires_at, COALESCE(metadata->>'suspend_reason', '')`,
+		*serviceID, *periodEnd, paidAt, invoiceID,
+	).Scan(&serviceStatus, &expiresAt, &suspendReason)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// 服务已取消或终止，发票照常结清但不再续期
+		return result, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to extend service: %w", err)
+	}
+
+	result.ExpiresAt = &expiresAt
+	result.Unsuspend = serviceStatus == "suspended" && isBillingSuspension(suspendReason) && expiresAt.After(paidAt)
+	return result, nil
+}
+
+// isBillingSuspension 只有因到期或欠费导致的暂停才会在付款后自动恢复，人工暂停需要管理员处理
+func isBillingSuspension(reason string) bool {
+	return reason == "" || reason == "expired" || reason == "overdue"
+}
+
+// EnqueueUnsuspend 为结清后需要恢复的服务投递恢复任务
+func EnqueueUnsuspend(client *asynq.Client, settlement *Settlement) error {
+	if client == nil || settlement == nil || !settlement.Unsuspend {
+		return nil
+	}
+
+	task, err := provisioning.NewUnsuspendVPSTask(provisioning.UnsuspendVPSPayload{
+		ServiceID: settlement.ServiceID,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.Enqueue(task, asynq.Queue("critical"), asynq.MaxRetry(5))
+	return err
+}
+
+// EnqueuePlanChange 为结清后待执行的套餐变更投递调整规格任务
+func EnqueuePlanChange(client *asynq.Client, settlement *Settlement) error {
+	if client == nil || settlement == nil || settlement.PlanChangeID == "" {
+		return nil
+	}
+
+	task, err := provisioning.NewResizeVPSTask(provisioning.ResizeVPSPayload{
+		ServiceID:    settlement.ServiceID,
+		PlanChangeID: settlement.PlanChangeID,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.Enqueue(task, asynq.Queue("critical"), asynq.MaxRetry(5))
+	return err
+}
@@ -61,56 +61,60 @@ type ProductWithPlans struct {
 }
 
 type CreateProductRequest struct {
-	Name        string `json:"name" binding:"required"`
-	Slug        string `json:"slug" binding:"required"`
-	Description string `json:"description"`
-	Category    string `json:"category"`
-	IsActive    bool   `json:"is_active"`
-	SortOrder   int    `json:"sort_order"`
+	Name               string `json:"name" binding:"required"`
+	Slug               string `json:"slug" binding:"required"`
+	Description        string `json:"description"`
+	Category           string `json:"category"`
+	IsActive           bool   `json:"is_active"`
+	SortOrder          int    `json:"sort_order"`
+	ProvisioningDriver string `json:"provisioning_driver" binding:"omitempty,oneof=mock proxmox"`
 }
 
 type UpdateProductRequest struct {
-	Name        string `json:"name"`
-	Slug        string `json:"slug"`
-	Description string `json:"description"`
-	Category    string `json:"category"`
-	IsActive    *bool  `json:"is_active"`
-	SortOrder   *int   `json:"sort_order"`
+	Name               string `json:"name"`
+	Slug               string `json:"slug"`
+	Description        string `json:"description"`
+	Category           string `json:"category"`
+	IsActive           *bool  `json:"is_active"`
+	SortOrder          *int   `json:"sort_order"`
+	ProvisioningDriver string `json:"provisioning_driver" binding:"omitempty,oneof=mock proxmox"`
 }
 
 type CreatePlanRequest struct {
-	ProductID      string          `json:"product_id" binding:"required"`
-	Name           string          `json:"name" binding:"required"`
-	Slug           string          `json:"slug"`
-	Description    string          `json:"description"`
-	CPUCores       int             `json:"cpu_cores"`
-	MemoryMB       int             `json:"memory_mb"`
-	DiskGB         int             `json:"disk_gb"`
-	BandwidthTB    float64         `json:"bandwidth_tb"`
-	PriceMonthly   float64         `json:"price_monthly" binding:"required"`
-	PriceQuarterly float64         `json:"price_quarterly"`
-	PriceAnnually  float64         `json:"price_annually"`
-	SetupFee       float64         `json:"setup_fee"`
-	IsActive       bool            `json:"is_active"`
-	SortOrder      int             `json:"sort_order"`
-	Features       json.RawMessage `json:"features"`
+	ProductID          string          `json:"product_id" binding:"required"`
+	Name               string          `json:"name" binding:"required"`
+	Slug               string          `json:"slug"`
+	Description        string          `json:"description"`
+	CPUCores           int             `json:"cpu_cores"`
+	MemoryMB           int             `json:"memory_mb"`
+	DiskGB             int             `json:"disk_gb"`
+	BandwidthTB        float64         `json:"bandwidth_tb"`
+	PriceMonthly       float64         `json:"price_monthly" binding:"required"`
+	PriceQuarterly     float64         `json:"price_quarterly"`
+	PriceAnnually      float64         `json:"price_annually"`
+	SetupFee           float64         `json:"setup_fee"`
+	IsActive           bool            `json:"is_active"`
+	SortOrder          int             `json:"sort_order"`
+	Features           json.RawMessage `json:"features"`
+	ProvisioningDriver string          `json:"provisioning_driver" binding:"omitempty,oneof=mock proxmox"`
 }
 
 type UpdatePlanRequest struct {
-	Name           string          `json:"name"`
-	Slug           string          `json:"slug"`
-	Description    string          `json:"description"`
-	CPUCores       *int            `json:"cpu_cores"`
-	MemoryMB       *int            `json:"memory_mb"`
-	DiskGB         *int            `json:"disk_gb"`
-	BandwidthTB    *float64        `json:"bandwidth_tb"`
-	PriceMonthly   *float64        `json:"price_monthly"`
-	PriceQuarterly *float64        `json:"price_quarterly"`
-	PriceAnnually  *float64        `json:"price_annually"`
-	SetupFee       *float64        `json:"setup_fee"`
-	IsActive       *bool           `json:"is_active"`
-	SortOrder      *int            `json:"sort_order"`
-	Features       json.RawMessage `json:"features"`
+	Name               string          `json:"name"`
+	Slug               string          `json:"slug"`
+	Description        string          `json:"description"`
+	CPUCores           *int            `json:"cpu_cores"`
+	MemoryMB           *int            `json:"memory_mb"`
+	DiskGB             *int            `json:"disk_gb"`
+	BandwidthTB        *float64        `json:"bandwidth_tb"`
+	PriceMonthly       *float64        `json:"price_monthly"`
+	PriceQuarterly     *float64        `json:"price_quarterly"`
+	PriceAnnually      *float64        `json:"price_annually"`
+	SetupFee           *float64        `json:"setup_fee"`
+	IsActive           *bool           `json:"is_active"`
+	SortOrder          *int            `json:"sort_order"`
+	Features           json.RawMessage `json:"features"`
+	ProvisioningDriver string          `json:"provisioning_driver" binding:"omitempty,oneof=mock proxmox"`
 }
 
 // ListProducts - GET /api/v1/products - list active products with their active plans
@@ -129,9 +129,9 @@ func (h *Handler) createProduct(ctx context.Context, req CreateProductRequest) (
 	now := time.Now()
 
 	_, err := h.pool.Exec(ctx, `
-		INSERT INTO products (id, name, slug, description, category, is_active, sort_order, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-	`, id, req.Name, req.Slug, req.Description, req.Category, req.IsActive, req.SortOrder, now, now)
+		INSERT INTO products (id, name, slug, description, category, is_active, sort_order, provisioning_driver, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9, $10)
+	`, id, req.Name, req.Slug, req.Description, req.Category, req.IsActive, req.SortOrder, req.ProvisioningDriver, now, now)
 	if err != nil {
 		return "", err
 	}
@@ -147,9 +147,10 @@ func (h *Handler) updateProduct(ctx context.Context, id string, req UpdateProduc
 			category = COALESCE(NULLIF($5, ''), category),
 			is_active = COALESCE($6, is_active),
 			sort_order = COALESCE($7, sort_order),
-			updated_at = $8
+			provisioning_driver = COALESCE(NULLIF($8, ''), provisioning_driver),
+			updated_at = $9
 		WHERE id = $1
-	`, id, req.Name, req.Slug, req.Description, req.Category, req.IsActive, req.SortOrder, time.Now())
+	`, id, req.Name, req.Slug, req.Description, req.Category, req.IsActive, req.SortOrder, req.ProvisioningDriver, time.Now())
 	if err != nil {
 		return false, err
 	}
@@ -171,11 +172,11 @@ func (h *Handler) createPlan(ctx context.Context, req CreatePlanRequest) (string
 	_, err := h.pool.Exec(ctx, `
 		INSERT INTO plans (id, product_id, name, slug, description, cpu_cores, memory_mb, disk_gb,
 						   bandwidth_tb, price_monthly, price_quarterly, price_annually, setup_fee,
-						   is_active, sort_order, features, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
+						   is_active, sort_order, features, provisioning_driver, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, NULLIF($17, ''), $18, $19)
 	`, id, req.ProductID, req.Name, req.Slug, req.Description, req.CPUCores, req.MemoryMB, req.DiskGB,
 		req.BandwidthTB, req.PriceMonthly, req.PriceQuarterly, req.PriceAnnually, req.SetupFee,
-		req.IsActive, req.SortOrder, req.Features, now, now)
+		req.IsActive, req.SortOrder, req.Features, req.ProvisioningDriver, now, now)
 	if err != nil {
 		return "", err
 	}
@@ -199,11 +200,12 @@ func (h *Handler) updatePlan(ctx context.Context, id string, req UpdatePlanReque
 			is_active = COALESCE($13, is_active),
 			sort_order = COALESCE($14, sort_order),
 			features = COALESCE($15, features),
-			updated_at = $16
+			provisioning_driver = COALESCE(NULLIF($16, ''), provisioning_driver),
+			updated_at = $17
 		WHERE id = $1
 	`, id, req.Name, req.Slug, req.Description, req.CPUCores, req.MemoryMB, req.DiskGB,
 		req.BandwidthTB, req.PriceMonthly, req.PriceQuarterly, req.PriceAnnually, req.SetupFee,
-		req.IsActive, req.SortOrder, req.Features, time.Now())
+		req.IsActive, req.SortOrder, req.Features, req.ProvisioningDriver, time.Now())
 	if err != nil {
 		return false, err
 	}
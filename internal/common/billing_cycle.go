@@ -0,0 +1,27 @@
+package common
+
+import "time"
+
+// AddBillingCycle 返回从 start 起经过一个计费周期后的时间，未知周期按月计算
+func AddBillingCycle(start time.Time, billingCycle string) time.Time {
+	switch billingCycle {
+	case "quarterly":
+		return start.AddDate(0, 3, 0)
+	case "annually":
+		return start.AddDate(1, 0, 0)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+// BillingCycleStart 返回在 end 结束的计费周期的起始时间，与 AddBillingCycle 互逆
+func BillingCycleStart(end time.Time, billingCycle string) time.Time {
+	switch billingCycle {
+	case "quarterly":
+		return end.AddDate(0, -3, 0)
+	case "annually":
+		return end.AddDate(-1, 0, 0)
+	default:
+		return end.AddDate(0, -1, 0)
+	}
+}
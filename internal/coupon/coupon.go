@@ -0,0 +1,120 @@
+package coupon
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+)
+
+const (
+	TypePercent = "percent"
+	TypeFixed   = "fixed"
+
+	// DurationOnce 只优惠首个计费周期；DurationForever 续费时持续优惠
+	DurationOnce    = "once"
+	DurationForever = "forever"
+)
+
+var (
+	ErrNotFound      = errors.New("coupon not found")
+	ErrInactive      = errors.New("coupon is not active")
+	ErrExpired       = errors.New("coupon has expired")
+	ErrExhausted     = errors.New("coupon usage limit reached")
+	ErrUserLimit     = errors.New("coupon already used by this customer")
+	ErrNotApplicable = errors.New("coupon does not apply to any item in the cart")
+)
+
+// IsRejection 判断错误是否为优惠券不可用（应作为客户端错误返回），而非数据库等内部错误
+func IsRejection(err error) bool {
+	for _, target := range []error{ErrNotFound, ErrInactive, ErrExpired, ErrExhausted, ErrUserLimit, ErrNotApplicable} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Coupon 优惠券。折扣按单位计算：百分比按单价折算，固定金额从每个单位的单价中扣减
+type Coupon struct {
+	ID                    string     `json:"id"`
+	Code                  string     `json:"code"`
+	Description           string     `json:"description"`
+	DiscountType          string     `json:"discount_type"`
+	DiscountValue         string     `json:"discount_value"`
+	PlanIDs               []string   `json:"plan_ids"`
+	BillingCycles         []string   `json:"billing_cycles"`
+	Duration              string     `json:"duration"`
+	MaxRedemptions        *int       `json:"max_redemptions"`
+	MaxRedemptionsPerUser *int       `json:"max_redemptions_per_user"`
+	RedemptionCount       int        `json:"redemption_count"`
+	StartsAt              *time.Time `json:"starts_at"`
+	ExpiresAt             *time.Time `json:"expires_at"`
+	IsActive              bool       `json:"is_active"`
+	CreatedAt             time.Time  `json:"created_at"`
+	UpdatedAt             time.Time  `json:"updated_at"`
+}
+
+// NormalizeCode 优惠码不区分大小写，统一保存为大写
+func NormalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Usable 检查优惠券当前能否被新订单使用（不含按用户的次数限制）
+func (c *Coupon) Usable(now time.Time) error {
+	if !c.IsActive {
+		return ErrInactive
+	}
+	if c.StartsAt != nil && now.Before(*c.StartsAt) {
+		return ErrInactive
+	}
+	if c.ExpiresAt != nil && !now.Before(*c.ExpiresAt) {
+		return ErrExpired
+	}
+	if c.MaxRedemptions != nil && c.RedemptionCount >= *c.MaxRedemptions {
+		return ErrExhausted
+	}
+	return nil
+}
+
+// AppliesTo 优惠券是否适用于指定套餐和计费周期，限制列表为空表示不限
+func (c *Coupon) AppliesTo(planID, billingCycle string) bool {
+	return matches(c.PlanIDs, planID) && matches(c.BillingCycles, billingCycle)
+}
+
+func matches(allowed []string, value string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, v := range allowed {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnitDiscount 计算单个单位的折扣金额（分），不超过单价
+func (c *Coupon) UnitDiscount(unitCents int64) int64 {
+	if unitCents <= 0 {
+		return 0
+	}
+	value, err := common.DecimalAmountToCents(c.DiscountValue)
+	if err != nil || value <= 0 {
+		return 0
+	}
+
+	var discount int64
+	switch c.DiscountType {
+	case TypePercent:
+		// value 为百分比 ×100（15.5% => 1550）
+		discount = (unitCents*value + 5000) / 10000
+	case TypeFixed:
+		discount = value
+	}
+	if discount > unitCents {
+		discount = unitCents
+	}
+	return discount
+}
@@ -0,0 +1,84 @@
+package coupon
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUnitDiscount(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		c     Coupon
+		unit  int64
+		wants int64
+	}{
+		{"percent", Coupon{DiscountType: TypePercent, DiscountValue: "15"}, 1000, 150},
+		{"percent rounds half up", Coupon{DiscountType: TypePercent, DiscountValue: "12.5"}, 999, 125},
+		{"fixed", Coupon{DiscountType: TypeFixed, DiscountValue: "3.00"}, 1000, 300},
+		{"fixed capped at unit price", Coupon{DiscountType: TypeFixed, DiscountValue: "25"}, 1000, 1000},
+		{"free item", Coupon{DiscountType: TypePercent, DiscountValue: "50"}, 0, 0},
+		{"invalid value", Coupon{DiscountType: TypeFixed, DiscountValue: "abc"}, 1000, 0},
+	}
+	for _, tc := range cases {
+		if got := tc.c.UnitDiscount(tc.unit); got != tc.wants {
+			t.Errorf("%s: UnitDiscount(%d) = %d, want %d", tc.name, tc.unit, got, tc.wants)
+		}
+	}
+}
+
+func TestUsable(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	limit := 5
+
+	cases := []struct {
+		name string
+		c    Coupon
+		want error
+	}{
+		{"active", Coupon{IsActive: true}, nil},
+		{"disabled", Coupon{IsActive: false}, ErrInactive},
+		{"not started", Coupon{IsActive: true, StartsAt: &future}, ErrInactive},
+		{"expired", Coupon{IsActive: true, ExpiresAt: &past}, ErrExpired},
+		{"within window", Coupon{IsActive: true, StartsAt: &past, ExpiresAt: &future}, nil},
+		{"exhausted", Coupon{IsActive: true, MaxRedemptions: &limit, RedemptionCount: 5}, ErrExhausted},
+	}
+	for _, tc := range cases {
+		if err := tc.c.Usable(now); !errors.Is(err, tc.want) {
+			t.Errorf("%s: Usable() = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestAppliesTo(t *testing.T) {
+	t.Parallel()
+
+	open := Coupon{}
+	if !open.AppliesTo("plan-a", "monthly") {
+		t.Fatalf("coupon without restrictions should apply to every plan")
+	}
+
+	limited := Coupon{PlanIDs: []string{"plan-a"}, BillingCycles: []string{"annually"}}
+	if !limited.AppliesTo("plan-a", "annually") {
+		t.Fatalf("coupon should apply to plan-a annually")
+	}
+	if limited.AppliesTo("plan-a", "monthly") || limited.AppliesTo("plan-b", "annually") {
+		t.Fatalf("coupon applied outside its plan or billing cycle limits")
+	}
+}
+
+func TestNormalizeCodeAndRejection(t *testing.T) {
+	t.Parallel()
+
+	if got := NormalizeCode("  spring25 "); got != "SPRING25" {
+		t.Fatalf("NormalizeCode = %q", got)
+	}
+	if !IsRejection(ErrUserLimit) || IsRejection(errors.New("connection reset")) {
+		t.Fatalf("IsRejection misclassified errors")
+	}
+}
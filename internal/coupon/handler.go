@@ -0,0 +1,126 @@
+package coupon
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type Handler struct {
+	pool *pgxpool.Pool
+}
+
+func NewHandler(pool *pgxpool.Pool) *Handler {
+	return &Handler{pool: pool}
+}
+
+// Redemption 优惠券使用记录
+type Redemption struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	UserEmail string    `json:"user_email"`
+	OrderID   string    `json:"order_id"`
+	InvoiceID *string   `json:"invoice_id"`
+	Amount    string    `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateCouponRequest struct {
+	Code                  string     `json:"code" binding:"required,max=50"`
+	Description           string     `json:"description"`
+	DiscountType          string     `json:"discount_type" binding:"required,oneof=percent fixed"`
+	DiscountValue         string     `json:"discount_value" binding:"required"`
+	PlanIDs               []string   `json:"plan_ids" binding:"omitempty,dive,uuid"`
+	BillingCycles         []string   `json:"billing_cycles" binding:"omitempty,dive,oneof=monthly quarterly annually"`
+	Duration              string     `json:"duration" binding:"omitempty,oneof=once forever"`
+	MaxRedemptions        *int       `json:"max_redemptions" binding:"omitempty,min=1"`
+	MaxRedemptionsPerUser *int       `json:"max_redemptions_per_user" binding:"omitempty,min=1"`
+	StartsAt              *time.Time `json:"starts_at"`
+	ExpiresAt             *time.Time `json:"expires_at"`
+	IsActive              *bool      `json:"is_active"`
+}
+
+// UpdateCouponRequest 折扣类型和金额在创建后不可修改；次数限制传 0 表示取消限制
+type UpdateCouponRequest struct {
+	Description           *string    `json:"description"`
+	PlanIDs               *[]string  `json:"plan_ids" binding:"omitempty,dive,uuid"`
+	BillingCycles         *[]string  `json:"billing_cycles" binding:"omitempty,dive,oneof=monthly quarterly annually"`
+	MaxRedemptions        *int       `json:"max_redemptions" binding:"omitempty,min=0"`
+	MaxRedemptionsPerUser *int       `json:"max_redemptions_per_user" binding:"omitempty,min=0"`
+	StartsAt              *time.Time `json:"starts_at"`
+	ExpiresAt             *time.Time `json:"expires_at"`
+	IsActive              *bool      `json:"is_active"`
+}
+
+// ListCoupons - GET /api/v1/admin/coupons
+func (h *Handler) ListCoupons(c *gin.Context) {
+	coupons, err := h.listCoupons(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query coupons"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"coupons": coupons})
+}
+
+// GetCoupon - GET /api/v1/admin/coupons/:id
+func (h *Handler) GetCoupon(c *gin.Context) {
+	coupon, err := h.getCoupon(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, coupon)
+}
+
+// CreateCoupon - POST /api/v1/admin/coupons
+func (h *Handler) CreateCoupon(c *gin.Context) {
+	var req CreateCouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	coupon, err := h.createCoupon(c.Request.Context(), req)
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, coupon)
+}
+
+// UpdateCoupon - PUT /api/v1/admin/coupons/:id
+func (h *Handler) UpdateCoupon(c *gin.Context) {
+	var req UpdateCouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.updateCoupon(c.Request.Context(), c.Param("id"), req); err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Coupon updated"})
+}
+
+// DeleteCoupon - DELETE /api/v1/admin/coupons/:id
+func (h *Handler) DeleteCoupon(c *gin.Context) {
+	if err := h.deleteCoupon(c.Request.Context(), c.Param("id")); err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Coupon deleted"})
+}
+
+// ListRedemptions - GET /api/v1/admin/coupons/:id/redemptions
+func (h *Handler) ListRedemptions(c *gin.Context) {
+	redemptions, err := h.listRedemptions(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"redemptions": redemptions})
+}
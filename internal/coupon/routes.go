@@ -0,0 +1,13 @@
+package coupon
+
+import "github.com/gin-gonic/gin"
+
+func RegisterRoutes(admin *gin.RouterGroup, h *Handler) {
+	coupons := admin.Group("/coupons")
+	coupons.GET("", h.ListCoupons)
+	coupons.POST("", h.CreateCoupon)
+	coupons.GET("/:id", h.GetCoupon)
+	coupons.PUT("/:id", h.UpdateCoupon)
+	coupons.DELETE("/:id", h.DeleteCoupon)
+	coupons.GET("/:id/redemptions", h.ListRedemptions)
+}
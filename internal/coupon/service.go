@@ -0,0 +1,172 @@
+package coupon
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/adiecho/echobilling/internal/common"
+)
+
+func (h *Handler) listCoupons(ctx context.Context) ([]Coupon, error) {
+	rows, err := h.pool.Query(ctx, `SELECT `+couponColumns+` FROM coupons ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	coupons := make([]Coupon, 0)
+	for rows.Next() {
+		c, err := scanCoupon(rows)
+		if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, *c)
+	}
+	return coupons, rows.Err()
+}
+
+func (h *Handler) getCoupon(ctx context.Context, id string) (*Coupon, *common.ServiceError) {
+	c, err := Get(ctx, h.pool, id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, common.ErrNotFound("Coupon not found", err)
+		}
+		return nil, common.ErrInternal("Failed to query coupon", err)
+	}
+	return c, nil
+}
+
+func validateDiscount(discountType, value string) *common.ServiceError {
+	cents, err := common.DecimalAmountToCents(value)
+	if err != nil || cents <= 0 {
+		return common.ErrBadRequest("Discount value must be a positive amount", err)
+	}
+	if discountType == TypePercent && cents > 100*100 {
+		return common.ErrBadRequest("Percentage discount cannot exceed 100", nil)
+	}
+	return nil
+}
+
+func (h *Handler) createCoupon(ctx context.Context, req CreateCouponRequest) (*Coupon, *common.ServiceError) {
+	if svcErr := validateDiscount(req.DiscountType, req.DiscountValue); svcErr != nil {
+		return nil, svcErr
+	}
+	code := NormalizeCode(req.Code)
+	if code == "" {
+		return nil, common.ErrBadRequest("Coupon code is required", nil)
+	}
+
+	duration := req.Duration
+	if duration == "" {
+		duration = DurationOnce
+	}
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+	planIDs, cycles := req.PlanIDs, req.BillingCycles
+	if planIDs == nil {
+		planIDs = []string{}
+	}
+	if cycles == nil {
+		cycles = []string{}
+	}
+
+	c, err := scanCoupon(h.pool.QueryRow(ctx, `
+		INSERT INTO coupons (
+			code, description, discount_type, discount_value, plan_ids, billing_cycles, duration,
+			max_redemptions, max_redemptions_per_user, starts_at, expires_at, is_active
+		)
+		VALUES ($1, $2, $3, $4, $5::uuid[], $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (code) DO NOTHING
+		RETURNING `+couponColumns,
+		code, strings.TrimSpace(req.Description), req.DiscountType, req.DiscountValue, planIDs, cycles, duration,
+		req.MaxRedemptions, req.MaxRedemptionsPerUser, req.StartsAt, req.ExpiresAt, isActive,
+	))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, common.NewServiceError(http.StatusConflict, "Coupon code already exists", nil)
+		}
+		return nil, common.ErrInternal("Failed to create coupon", err)
+	}
+	return c, nil
+}
+
+func (h *Handler) updateCoupon(ctx context.Context, id string, req UpdateCouponRequest) *common.ServiceError {
+	tag, err := h.pool.Exec(ctx, `
+		UPDATE coupons
+		SET description = COALESCE($2, description),
+		    plan_ids = COALESCE($3::uuid[], plan_ids),
+		    billing_cycles = COALESCE($4::text[], billing_cycles),
+		    max_redemptions = CASE WHEN $5::int IS NULL THEN max_redemptions ELSE NULLIF($5::int, 0) END,
+		    max_redemptions_per_user = CASE WHEN $6::int IS NULL THEN max_redemptions_per_user ELSE NULLIF($6::int, 0) END,
+		    starts_at = COALESCE($7, starts_at),
+		    expires_at = COALESCE($8, expires_at),
+		    is_active = COALESCE($9, is_active),
+		    updated_at = NOW()
+		WHERE id = $1
+	`, id, req.Description, req.PlanIDs, req.BillingCycles, req.MaxRedemptions, req.MaxRedemptionsPerUser,
+		req.StartsAt, req.ExpiresAt, req.IsActive)
+	if err != nil {
+		return common.ErrInternal("Failed to update coupon", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return common.ErrNotFound("Coupon not found", nil)
+	}
+	return nil
+}
+
+// deleteCoupon 已被使用过的优惠券需保留使用记录，只能停用
+func (h *Handler) deleteCoupon(ctx context.Context, id string) *common.ServiceError {
+	var redeemed int64
+	if err := h.pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM coupon_redemptions WHERE coupon_id = $1`, id,
+	).Scan(&redeemed); err != nil {
+		return common.ErrInternal("Failed to query coupon usage", err)
+	}
+	if redeemed > 0 {
+		return common.NewServiceError(http.StatusConflict, "Coupon has been redeemed; deactivate it instead", nil)
+	}
+
+	tag, err := h.pool.Exec(ctx, `DELETE FROM coupons WHERE id = $1`, id)
+	if err != nil {
+		return common.ErrInternal("Failed to delete coupon", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return common.ErrNotFound("Coupon not found", nil)
+	}
+	return nil
+}
+
+func (h *Handler) listRedemptions(ctx context.Context, couponID string) ([]Redemption, *common.ServiceError) {
+	if _, svcErr := h.getCoupon(ctx, couponID); svcErr != nil {
+		return nil, svcErr
+	}
+
+	rows, err := h.pool.Query(ctx, `
+		SELECT r.id, r.user_id, COALESCE(u.email, ''), r.order_id, r.invoice_id::text, r.amount::text, r.created_at
+		FROM coupon_redemptions r
+		LEFT JOIN users u ON u.id = r.user_id
+		WHERE r.coupon_id = $1
+		ORDER BY r.created_at DESC
+	`, couponID)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to query redemptions", err)
+	}
+	defer rows.Close()
+
+	redemptions := make([]Redemption, 0)
+	for rows.Next() {
+		var r Redemption
+		if err := rows.Scan(&r.ID, &r.UserID, &r.UserEmail, &r.OrderID, &r.InvoiceID, &r.Amount, &r.CreatedAt); err != nil {
+			return nil, common.ErrInternal("Failed to read redemptions", err)
+		}
+		redemptions = append(redemptions, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, common.ErrInternal("Failed to read redemptions", err)
+	}
+	return redemptions, nil
+}
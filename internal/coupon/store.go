@@ -0,0 +1,88 @@
+package coupon
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/db"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const couponColumns = `
+	id, code, description, discount_type, discount_value::text,
+	plan_ids::text[], billing_cycles, duration,
+	max_redemptions, max_redemptions_per_user, redemption_count,
+	starts_at, expires_at, is_active, created_at, updated_at`
+
+func scanCoupon(row pgx.Row) (*Coupon, error) {
+	var c Coupon
+	err := row.Scan(
+		&c.ID, &c.Code, &c.Description, &c.DiscountType, &c.DiscountValue,
+		&c.PlanIDs, &c.BillingCycles, &c.Duration,
+		&c.MaxRedemptions, &c.MaxRedemptionsPerUser, &c.RedemptionCount,
+		&c.StartsAt, &c.ExpiresAt, &c.IsActive, &c.CreatedAt, &c.UpdatedAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Get 按 ID 读取优惠券
+func Get(ctx context.Context, q db.DBTX, id string) (*Coupon, error) {
+	return scanCoupon(q.QueryRow(ctx, `SELECT `+couponColumns+` FROM coupons WHERE id = $1`, id))
+}
+
+// GetByCode 按优惠码读取优惠券
+func GetByCode(ctx context.Context, q db.DBTX, code string) (*Coupon, error) {
+	return scanCoupon(q.QueryRow(ctx, `SELECT `+couponColumns+` FROM coupons WHERE code = $1`, NormalizeCode(code)))
+}
+
+// CheckRedeemable 检查优惠券对该客户是否可用，包括全局和按用户的使用次数限制
+func CheckRedeemable(ctx context.Context, q db.DBTX, c *Coupon, userID string, now time.Time) error {
+	if err := c.Usable(now); err != nil {
+		return err
+	}
+	if c.MaxRedemptionsPerUser == nil {
+		return nil
+	}
+
+	var used int
+	if err := q.QueryRow(ctx,
+		`SELECT COUNT(*) FROM coupon_redemptions WHERE coupon_id = $1 AND user_id = $2`,
+		c.ID, userID,
+	).Scan(&used); err != nil {
+		return err
+	}
+	if used >= *c.MaxRedemptionsPerUser {
+		return ErrUserLimit
+	}
+	return nil
+}
+
+// Redeem 在订单支付的事务内登记使用记录；同一订单重复登记（Webhook 重投）不会重复计数
+func Redeem(ctx context.Context, q db.DBTX, couponID, userID, orderID string, invoiceID *string, amount string, now time.Time) error {
+	tag, err := q.Exec(ctx,
+		`INSERT INTO coupon_redemptions (id, coupon_id, user_id, order_id, invoice_id, amount, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 ON CONFLICT (coupon_id, order_id) DO NOTHING`,
+		uuid.New().String(), couponID, userID, orderID, invoiceID, amount, now,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+
+	_, err = q.Exec(ctx,
+		`UPDATE coupons SET redemption_count = redemption_count + 1, updated_at = $2 WHERE id = $1`,
+		couponID, now,
+	)
+	return err
+}
@@ -0,0 +1,76 @@
+package credit
+
+import (
+	"net/http"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type Handler struct {
+	pool *pgxpool.Pool
+}
+
+func NewHandler(pool *pgxpool.Pool) *Handler {
+	return &Handler{pool: pool}
+}
+
+// Account 余额及最近的流水
+type Account struct {
+	UserID       string        `json:"user_id"`
+	Balance      string        `json:"balance"`
+	Transactions []Transaction `json:"transactions"`
+}
+
+// AdjustmentRequest 管理员调整余额，amount 可为负数
+type AdjustmentRequest struct {
+	Amount string `json:"amount" binding:"required"`
+	Reason string `json:"reason" binding:"required,max=500"`
+}
+
+// GetAccount - GET /api/v1/portal/credit
+func (h *Handler) GetAccount(c *gin.Context) {
+	userID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	account, err := h.getAccount(c.Request.Context(), userID)
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, account)
+}
+
+// AdminGetAccount - GET /api/v1/admin/customers/:id/credit
+func (h *Handler) AdminGetAccount(c *gin.Context) {
+	account, err := h.getAccount(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, account)
+}
+
+// AdminPostAdjustment - POST /api/v1/admin/customers/:id/credit
+func (h *Handler) AdminPostAdjustment(c *gin.Context) {
+	adminID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	var req AdjustmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.WriteServiceError(c, common.ErrBadRequest("Invalid request body", err))
+		return
+	}
+
+	account, err := h.postAdjustment(c.Request.Context(), c.Param("id"), adminID, req)
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, account)
+}
@@ -0,0 +1,190 @@
+package credit
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/db"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	KindAdjustment = "adjustment"
+	KindTopUp      = "top_up"
+	KindDowngrade  = "downgrade"
+	KindApplied    = "applied"
+	KindReleased   = "released"
+	KindCreditNote = "credit_note"
+	KindUnapplied  = "unapplied_payment"
+)
+
+// Currency 账户余额的记账币种。余额不做汇率换算，只能抵扣同币种的订单和发票
+const Currency = "USD"
+
+// SameCurrency 单据币种与余额币种是否一致
+func SameCurrency(currency string) bool {
+	return strings.EqualFold(strings.TrimSpace(currency), Currency)
+}
+
+// Transaction 一条余额流水。Amount 为正表示增加余额，为负表示扣减
+type Transaction struct {
+	ID           string    `json:"id"`
+	Kind         string    `json:"kind"`
+	Amount       string    `json:"amount"`
+	Reason       string    `json:"reason"`
+	OrderID      *string   `json:"order_id,omitempty"`
+	InvoiceID    *string   `json:"invoice_id,omitempty"`
+	PlanChangeID *string   `json:"plan_change_id,omitempty"`
+	CreditNoteID *string   `json:"credit_note_id,omitempty"`
+	PaymentID    *string   `json:"payment_id,omitempty"`
+	CreatedBy    *string   `json:"created_by,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Entry 待写入的流水，可选字段为空时写入 NULL
+type Entry struct {
+	UserID            string
+	Kind              string
+	Amount            int64
+	Reason            string
+	OrderID           string
+	InvoiceID         string
+	PlanChangeID      string
+	CheckoutSessionID string
+	CreditNoteID      string
+	PaymentID         string
+	CreatedBy         string
+}
+
+// Post 追加一条流水。充值、降级、贷项通知单和未结清的付款按唯一索引去重，重复写入时返回 false
+func Post(ctx context.Context, q db.DBTX, e Entry, now time.Time) (bool, error) {
+	tag, err := q.Exec(ctx,
+		`INSERT INTO credit_transactions (
+			id, user_id, kind, amount, reason, order_id, invoice_id, plan_change_id,
+			stripe_checkout_session_id, credit_note_id, payment_id, created_by, created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT DO NOTHING`,
+		uuid.New().String(), e.UserID, e.Kind, common.CentsToDecimal(e.Amount), e.Reason,
+		nullable(e.OrderID), nullable(e.InvoiceID), nullable(e.PlanChangeID),
+		nullable(e.CheckoutSessionID), nullable(e.CreditNoteID), nullable(e.PaymentID), nullable(e.CreatedBy), now,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Balance 返回用户当前可用余额（分），已抵扣到未完成订单上的部分不计入
+func Balance(ctx context.Context, q db.DBTX, userID string) (int64, error) {
+	var balance string
+	if err := q.QueryRow(ctx,
+		`SELECT COALESCE((SELECT balance FROM credit_balances WHERE user_id = $1), 0)::text`,
+		userID,
+	).Scan(&balance); err != nil {
+		return 0, err
+	}
+	return common.DecimalAmountToCents(balance)
+}
+
+// ApplyToOrder 用余额抵扣订单应付金额，返回抵扣金额（分）
+func ApplyToOrder(ctx context.Context, tx pgx.Tx, userID, orderID string, due int64, now time.Time) (int64, error) {
+	return apply(ctx, tx, userID, "order_id", orderID, due, now)
+}
+
+// ApplyToInvoice 用余额抵扣发票应付金额，返回抵扣金额（分）
+func ApplyToInvoice(ctx context.Context, tx pgx.Tx, userID, invoiceID string, due int64, now time.Time) (int64, error) {
+	return apply(ctx, tx, userID, "invoice_id", invoiceID, due, now)
+}
+
+// ReleaseOrder 订单取消时退回已抵扣的余额
+func ReleaseOrder(ctx context.Context, tx pgx.Tx, userID, orderID string, now time.Time) error {
+	_, err := apply(ctx, tx, userID, "order_id", orderID, 0, now)
+	return err
+}
+
+// ReleaseInvoice 发票作废时退回已抵扣的余额
+func ReleaseInvoice(ctx context.Context, tx pgx.Tx, userID, invoiceID string, now time.Time) error {
+	_, err := apply(ctx, tx, userID, "invoice_id", invoiceID, 0, now)
+	return err
+}
+
+// apply 将单据上的抵扣额调整为 min(可用余额, due)。
+// 每次只按与已抵扣金额的差额追加 applied/released 流水，重复创建支付会话不会重复扣减。
+// 单据币种与余额币种不同时不抵扣，已占用的余额全部退回
+func apply(ctx context.Context, tx pgx.Tx, userID, column, id string, due int64, now time.Time) (int64, error) {
+	// 锁定用户行，串行化同一用户的余额占用
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+		return 0, err
+	}
+
+	table := "invoices"
+	if column == "order_id" {
+		table = "orders"
+	}
+	var currency string
+	if err := tx.QueryRow(ctx, `SELECT currency FROM `+table+` WHERE id = $1`, id).Scan(&currency); err != nil {
+		return 0, err
+	}
+	if !SameCurrency(currency) {
+		due = 0
+	}
+
+	var heldDecimal string
+	if err := tx.QueryRow(ctx,
+		`SELECT COALESCE(-SUM(amount), 0)::text
+		 FROM credit_transactions
+		 WHERE user_id = $1 AND `+column+` = $2 AND kind IN ('applied', 'released')`,
+		userID, id,
+	).Scan(&heldDecimal); err != nil {
+		return 0, err
+	}
+	held, err := common.DecimalAmountToCents(heldDecimal)
+	if err != nil {
+		return 0, err
+	}
+
+	balance, err := Balance(ctx, tx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	want := Applicable(balance+held, due)
+	if delta := held - want; delta != 0 {
+		e := Entry{UserID: userID, Kind: KindApplied, Amount: delta, Reason: "Applied to payment"}
+		if delta > 0 {
+			e.Kind = KindReleased
+			e.Reason = "Released from payment"
+		}
+		if column == "order_id" {
+			e.OrderID = id
+		} else {
+			e.InvoiceID = id
+		}
+		if _, err := Post(ctx, tx, e, now); err != nil {
+			return 0, err
+		}
+	}
+	return want, nil
+}
+
+// Applicable 可用于抵扣的金额：不超过应付金额，余额为负时不抵扣
+func Applicable(available, due int64) int64 {
+	if available <= 0 || due <= 0 {
+		return 0
+	}
+	if available < due {
+		return available
+	}
+	return due
+}
+
+func nullable(v string) interface{} {
+	if v == "" {
+		return nil
+	}
+	return v
+}
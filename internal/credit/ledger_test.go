@@ -0,0 +1,41 @@
+package credit
+
+import "testing"
+
+func TestApplicable(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		available int64
+		due       int64
+		want      int64
+	}{
+		{"balance covers amount due", 5000, 1999, 1999},
+		{"partial balance", 1200, 1999, 1200},
+		{"exact balance", 1999, 1999, 1999},
+		{"no balance", 0, 1999, 0},
+		{"negative balance", -500, 1999, 0},
+		{"nothing due", 5000, 0, 0},
+	}
+	for _, tc := range cases {
+		if got := Applicable(tc.available, tc.due); got != tc.want {
+			t.Errorf("%s: Applicable(%d, %d) = %d, want %d", tc.name, tc.available, tc.due, got, tc.want)
+		}
+	}
+}
+
+func TestSameCurrency(t *testing.T) {
+	t.Parallel()
+
+	for _, currency := range []string{"USD", "usd", " Usd "} {
+		if !SameCurrency(currency) {
+			t.Errorf("SameCurrency(%q) = false", currency)
+		}
+	}
+	for _, currency := range []string{"EUR", "", "US"} {
+		if SameCurrency(currency) {
+			t.Errorf("SameCurrency(%q) = true", currency)
+		}
+	}
+}
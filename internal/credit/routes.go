@@ -0,0 +1,10 @@
+package credit
+
+import "github.com/gin-gonic/gin"
+
+func RegisterRoutes(portal *gin.RouterGroup, admin *gin.RouterGroup, h *Handler) {
+	portal.GET("/credit", h.GetAccount)
+
+	admin.GET("/customers/:id/credit", h.AdminGetAccount)
+	admin.POST("/customers/:id/credit", h.AdminPostAdjustment)
+}
@@ -0,0 +1,110 @@
+package credit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/jackc/pgx/v5"
+)
+
+// transactionLimit 账户页只展示最近的流水
+const transactionLimit = 100
+
+func (h *Handler) getAccount(ctx context.Context, userID string) (*Account, *common.ServiceError) {
+	var exists bool
+	if err := h.pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists); err != nil {
+		return nil, common.ErrInternal("Failed to query user", err)
+	}
+	if !exists {
+		return nil, common.ErrNotFound("User not found", nil)
+	}
+
+	balance, err := Balance(ctx, h.pool, userID)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to query credit balance", err)
+	}
+
+	rows, err := h.pool.Query(ctx,
+		`SELECT id, kind, amount::text, reason, order_id::text, invoice_id::text,
+		        plan_change_id::text, credit_note_id::text, payment_id::text, created_by::text, created_at
+		 FROM credit_transactions
+		 WHERE user_id = $1
+		 ORDER BY created_at DESC
+		 LIMIT $2`,
+		userID, transactionLimit,
+	)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to query credit transactions", err)
+	}
+	defer rows.Close()
+
+	account := &Account{
+		UserID:       userID,
+		Balance:      common.CentsToDecimal(balance),
+		Transactions: make([]Transaction, 0),
+	}
+	for rows.Next() {
+		var t Transaction
+		if err := rows.Scan(
+			&t.ID, &t.Kind, &t.Amount, &t.Reason, &t.OrderID, &t.InvoiceID,
+			&t.PlanChangeID, &t.CreditNoteID, &t.PaymentID, &t.CreatedBy, &t.CreatedAt,
+		); err != nil {
+			return nil, common.ErrInternal("Failed to read credit transaction", err)
+		}
+		t.Amount = common.NormalizeAmount(t.Amount)
+		account.Transactions = append(account.Transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, common.ErrInternal("Failed to iterate credit transactions", err)
+	}
+	return account, nil
+}
+
+func (h *Handler) postAdjustment(ctx context.Context, userID, adminID string, req AdjustmentRequest) (*Account, *common.ServiceError) {
+	amount, err := common.DecimalAmountToCents(req.Amount)
+	if err != nil || amount == 0 {
+		return nil, common.ErrBadRequest("Invalid amount", err)
+	}
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to start transaction", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// 锁定用户行，与抵扣支付串行执行
+	var locked string
+	err = tx.QueryRow(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&locked)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, common.ErrNotFound("User not found", err)
+		}
+		return nil, common.ErrInternal("Failed to query user", err)
+	}
+
+	balance, err := Balance(ctx, tx, userID)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to query credit balance", err)
+	}
+	if balance+amount < 0 {
+		return nil, common.ErrBadRequest("Adjustment would make the credit balance negative", nil)
+	}
+
+	if _, err := Post(ctx, tx, Entry{
+		UserID:    userID,
+		Kind:      KindAdjustment,
+		Amount:    amount,
+		Reason:    req.Reason,
+		CreatedBy: adminID,
+	}, time.Now()); err != nil {
+		return nil, common.ErrInternal("Failed to post credit adjustment", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, common.ErrInternal("Failed to commit credit adjustment", err)
+	}
+
+	return h.getAccount(ctx, userID)
+}
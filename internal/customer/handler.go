@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/ipam"
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -22,6 +23,7 @@ type StatsResponse struct {
 	PendingOrders  int64   `json:"pending_orders"`
 	UnpaidInvoices int64   `json:"unpaid_invoices"`
 	TotalSpent     float64 `json:"total_spent"`
+	CreditBalance  float64 `json:"credit_balance"`
 }
 
 type ServiceSummary struct {
@@ -34,6 +36,13 @@ type ServiceSummary struct {
 	CreatedAt time.Time  `json:"created_at"`
 }
 
+// ServiceDetail 服务详情，附带 IPAM 分配的地址及网关、掩码、反向解析信息
+type ServiceDetail struct {
+	ServiceSummary
+	IPv6Address string            `json:"ipv6_address"`
+	Addresses   []ipam.Assignment `json:"addresses"`
+}
+
 type ChangePasswordRequest struct {
 	CurrentPassword string `json:"current_password" binding:"required"`
 	NewPassword     string `json:"new_password" binding:"required"`
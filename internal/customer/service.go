@@ -9,6 +9,7 @@ import (
 
 	"github.com/adiecho/echobilling/internal/auth"
 	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/ipam"
 	"github.com/jackc/pgx/v5"
 )
 
@@ -38,7 +39,7 @@ func (h *Handler) getStats(ctx context.Context, userID string) (*StatsResponse,
 		`SELECT COUNT(*)
 		 FROM invoices
 		 WHERE user_id = $1
-		   AND status IN ('draft', 'pending')`,
+		   AND status = 'pending'`,
 		userID,
 	).Scan(&stats.UnpaidInvoices); err != nil {
 		return nil, err
@@ -46,15 +47,24 @@ func (h *Handler) getStats(ctx context.Context, userID string) (*StatsResponse,
 
 	var totalSpent string
 	if err := h.pool.QueryRow(ctx,
-		`SELECT COALESCE(SUM(amount), 0)::text
+		`SELECT COALESCE(SUM(amount - amount_refunded), 0)::text
 		 FROM payments
-		 WHERE user_id = $1 AND status = 'succeeded'`,
+		 WHERE user_id = $1 AND status IN ('succeeded', 'partially_refunded')`,
 		userID,
 	).Scan(&totalSpent); err != nil {
 		return nil, err
 	}
 	stats.TotalSpent, _ = strconv.ParseFloat(totalSpent, 64)
 
+	var creditBalance string
+	if err := h.pool.QueryRow(ctx,
+		`SELECT COALESCE((SELECT balance FROM credit_balances WHERE user_id = $1), 0)::text`,
+		userID,
+	).Scan(&creditBalance); err != nil {
+		return nil, err
+	}
+	stats.CreditBalance, _ = strconv.ParseFloat(creditBalance, 64)
+
 	return &stats, nil
 }
 
@@ -102,12 +112,13 @@ func (h *Handler) listServices(ctx context.Context, userID string) ([]ServiceSum
 	return services, nil
 }
 
-func (h *Handler) getService(ctx context.Context, userID, serviceID string) (*ServiceSummary, *common.ServiceError) {
-	var service ServiceSummary
+func (h *Handler) getService(ctx context.Context, userID, serviceID string) (*ServiceDetail, *common.ServiceError) {
+	var service ServiceDetail
 	err := h.pool.QueryRow(ctx,
 		`SELECT s.id,
 		        COALESCE(s.hostname, ''),
 		        COALESCE(s.ip_address, ''),
+		        COALESCE(s.ipv6_address, ''),
 		        p.name,
 		        s.status::text,
 		        s.expires_at,
@@ -120,6 +131,7 @@ func (h *Handler) getService(ctx context.Context, userID, serviceID string) (*Se
 		&service.ID,
 		&service.Hostname,
 		&service.IPAddress,
+		&service.IPv6Address,
 		&service.PlanName,
 		&service.Status,
 		&service.ExpiresAt,
@@ -132,6 +144,11 @@ func (h *Handler) getService(ctx context.Context, userID, serviceID string) (*Se
 		return nil, common.NewServiceError(http.StatusInternalServerError, "Failed to query service", err)
 	}
 
+	service.Addresses, err = ipam.ServiceAddresses(ctx, h.pool, service.ID)
+	if err != nil {
+		return nil, common.NewServiceError(http.StatusInternalServerError, "Failed to query service addresses", err)
+	}
+
 	return &service, nil
 }
 
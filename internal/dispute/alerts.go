@@ -0,0 +1,221 @@
+package dispute
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/email"
+	"github.com/adiecho/echobilling/internal/provisioning"
+	"github.com/hibiken/asynq"
+)
+
+// 已发送的提醒记录在 audit_logs（entity_type = 'dispute'）
+const disputeAlertSent = "dispute_alert_sent"
+
+// nextAlert 返回本次应发送的提醒档位：距截止日剩余天数所在的最小档位。
+// 每个档位只发送一次，已发送过更近档位的提醒后不再补发较远的档位
+func nextAlert(thresholds []int, daysLeft int, sent map[int]bool) (int, bool) {
+	due := 0
+	for _, d := range thresholds {
+		if d >= daysLeft {
+			due = d
+			break
+		}
+	}
+	if due == 0 || sent[due] {
+		return 0, false
+	}
+	for d := range sent {
+		if d < due {
+			return 0, false
+		}
+	}
+	return due, true
+}
+
+// daysLeft 距证据截止时间剩余的整天数
+func daysLeft(dueBy, now time.Time) int {
+	if !dueBy.After(now) {
+		return 0
+	}
+	return int(dueBy.Sub(now) / (24 * time.Hour))
+}
+
+type pendingDispute struct {
+	ID               string
+	GatewayDisputeID string
+	PaymentID        string
+	UserEmail        string
+	Amount           string
+	Currency         string
+	Reason           string
+	DueBy            time.Time
+}
+
+// HandleDisputeAlerts 定时检查未提交证据的争议，在截止日前按 dispute_alert_days 提醒管理员
+func (h *Handler) HandleDisputeAlerts(ctx context.Context, t *asynq.Task) error {
+	thresholds := provisioning.ParseDays(h.store.Get("dispute_alert_days"))
+	if len(thresholds) == 0 {
+		return nil
+	}
+
+	rows, err := h.pool.Query(ctx, `
+		SELECT d.id, d.stripe_dispute_id, d.payment_id, u.email, d.amount::text, p.currency,
+		       COALESCE(d.reason, ''), d.evidence_due_by
+		FROM disputes d
+		JOIN payments p ON p.id = d.payment_id
+		JOIN users u ON u.id = p.user_id
+		WHERE d.status = 'needs_response'
+		  AND d.evidence_submitted_at IS NULL
+		  AND d.evidence_due_by > NOW()
+		ORDER BY d.evidence_due_by
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to query open disputes: %w", err)
+	}
+
+	disputes := make([]pendingDispute, 0)
+	for rows.Next() {
+		var d pendingDispute
+		if err := rows.Scan(&d.ID, &d.GatewayDisputeID, &d.PaymentID, &d.UserEmail, &d.Amount, &d.Currency, &d.Reason, &d.DueBy); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan dispute: %w", err)
+		}
+		disputes = append(disputes, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate disputes: %w", err)
+	}
+	if len(disputes) == 0 {
+		return nil
+	}
+
+	recipients, err := h.alertRecipients(ctx)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]string, 0)
+	now := time.Now()
+	for _, d := range disputes {
+		sent, err := h.sentAlerts(ctx, d.ID)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", d.ID, err))
+			continue
+		}
+		day, ok := nextAlert(thresholds, daysLeft(d.DueBy, now), sent)
+		if !ok {
+			continue
+		}
+		if err := h.sendAlert(ctx, d, day, recipients); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", d.ID, err))
+		}
+	}
+
+	log.Printf("[dispute] alert check finished: open_disputes=%d", len(disputes))
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// alertRecipients 优先使用 dispute_alert_email，未配置时发送给所有管理员
+func (h *Handler) alertRecipients(ctx context.Context) ([]string, error) {
+	if to := strings.TrimSpace(h.store.Get("dispute_alert_email")); to != "" {
+		return []string{to}, nil
+	}
+
+	rows, err := h.pool.Query(ctx, `SELECT email FROM users WHERE role = 'admin' ORDER BY created_at`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query admins: %w", err)
+	}
+	defer rows.Close()
+
+	recipients := make([]string, 0)
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address); err != nil {
+			return nil, fmt.Errorf("failed to scan admin: %w", err)
+		}
+		recipients = append(recipients, address)
+	}
+	return recipients, rows.Err()
+}
+
+func (h *Handler) sentAlerts(ctx context.Context, disputeID string) (map[int]bool, error) {
+	rows, err := h.pool.Query(ctx, `
+		SELECT COALESCE((new_values->>'days_before')::int, 0)
+		FROM audit_logs
+		WHERE entity_type = 'dispute' AND entity_id = $1 AND action = $2
+	`, disputeID, disputeAlertSent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sent alerts: %w", err)
+	}
+	defer rows.Close()
+
+	sent := make(map[int]bool)
+	for rows.Next() {
+		var days int
+		if err := rows.Scan(&days); err != nil {
+			return nil, fmt.Errorf("failed to scan sent alert: %w", err)
+		}
+		sent[days] = true
+	}
+	return sent, rows.Err()
+}
+
+// sendAlert 发送提醒并记录档位。部分收件人发送失败时仍记录已发送，避免每次检查重复打扰其他管理员
+func (h *Handler) sendAlert(ctx context.Context, d pendingDispute, day int, recipients []string) error {
+	subject, body := disputeAlertEmail(h.store.Get("site_name"), d)
+
+	channel := email.ChannelAuditLogOnly
+	failed := make([]string, 0)
+	for _, to := range recipients {
+		c, err := email.Send(h.store.SMTPConfig(), to, subject, body)
+		channel = c
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", to, err))
+		}
+	}
+	if len(recipients) > 0 && len(failed) == len(recipients) {
+		return fmt.Errorf("failed to send dispute alert: %s", strings.Join(failed, "; "))
+	}
+
+	details, _ := json.Marshal(map[string]interface{}{
+		"days_before": day,
+		"due_by":      d.DueBy,
+		"recipients":  recipients,
+		"channel":     channel,
+	})
+	if _, err := h.pool.Exec(ctx, `
+		INSERT INTO audit_logs (action, entity_type, entity_id, new_values, ip_address, user_agent, created_at)
+		VALUES ($1, 'dispute', $2, $3, 'worker', 'asynq-worker', $4)
+	`, disputeAlertSent, d.ID, details, time.Now()); err != nil {
+		return fmt.Errorf("failed to record dispute alert: %w", err)
+	}
+
+	log.Printf("[dispute] alert sent for %s: days_before=%d", d.GatewayDisputeID, day)
+	return nil
+}
+
+func disputeAlertEmail(siteName string, d pendingDispute) (string, string) {
+	if siteName == "" {
+		siteName = "EchoBilling"
+	}
+	subject := fmt.Sprintf("[%s] Dispute %s needs a response by %s", siteName, d.GatewayDisputeID, formatDate(d.DueBy))
+	body := fmt.Sprintf(
+		"A payment dispute is still waiting for evidence.\n\n"+
+			"Dispute: %s\nCustomer: %s\nAmount: %s %s\nReason: %s\nEvidence due: %s\n\n"+
+			"Review and submit the evidence from the admin dispute workspace before the deadline, "+
+			"otherwise the dispute will be decided in the customer's favour.\n",
+		d.GatewayDisputeID, d.UserEmail, d.Amount, d.Currency, d.Reason, formatTime(d.DueBy),
+	)
+	return subject, body
+}
@@ -0,0 +1,145 @@
+package dispute
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func strPtr(s string) *string { return &s }
+
+func TestBuildEvidence(t *testing.T) {
+	t.Parallel()
+
+	paidAt := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	activatedAt := paidAt.Add(5 * time.Minute)
+	periodStart := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	periodEnd := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	facts := &evidenceFacts{
+		CustomerName:   "Jane Doe",
+		CustomerEmail:  "jane@example.com",
+		BillingAddress: []string{"Acme Ltd", "1 Main St", "Berlin 10115", "DE"},
+		PaymentAmount:  "19.99",
+		Currency:       "EUR",
+		PaidAt:         paidAt,
+		Invoice: &invoiceFacts{
+			Number:      "INV-2025-0042",
+			Total:       "19.99",
+			Currency:    "EUR",
+			IssuedAt:    paidAt.Add(-time.Hour),
+			PaidAt:      &paidAt,
+			PeriodStart: &periodStart,
+			PeriodEnd:   &periodEnd,
+			Items:       []string{"VPS Small x1 (19.99 EUR)"},
+		},
+		Services: []Service{{
+			ID:          "svc-1",
+			Hostname:    strPtr("web1.example.com"),
+			IPAddress:   strPtr("203.0.113.10"),
+			PlanName:    "Small",
+			ActivatedAt: &activatedAt,
+		}},
+		// 按时间倒序：付款后登录、付款前登录
+		Logins: []loginRecord{
+			{At: paidAt.Add(48 * time.Hour), IP: "198.51.100.7", Method: "password"},
+			{At: paidAt.Add(-10 * time.Minute), IP: "198.51.100.5", UserAgent: "Mozilla/5.0", Method: "password"},
+		},
+		TermsURL:      "https://example.com/terms",
+		TermsAccepted: &loginRecord{At: paidAt.AddDate(0, -1, 0), IP: "198.51.100.5"},
+	}
+
+	ev := buildEvidence(facts)
+
+	if ev.CustomerName != "Jane Doe" || ev.CustomerEmail != "jane@example.com" {
+		t.Fatalf("customer = %q / %q", ev.CustomerName, ev.CustomerEmail)
+	}
+	if ev.BillingAddress != "Acme Ltd, 1 Main St, Berlin 10115, DE" {
+		t.Fatalf("BillingAddress = %q", ev.BillingAddress)
+	}
+	if ev.CustomerPurchaseIP != "198.51.100.5" {
+		t.Fatalf("CustomerPurchaseIP = %q, want IP of last login before payment", ev.CustomerPurchaseIP)
+	}
+	if ev.ServiceDate != "2025-03-01 to 2025-04-01" {
+		t.Fatalf("ServiceDate = %q", ev.ServiceDate)
+	}
+	if !strings.Contains(ev.ProductDescription, "VPS Small x1") || !strings.Contains(ev.ProductDescription, "web1.example.com / 203.0.113.10") {
+		t.Fatalf("ProductDescription = %q", ev.ProductDescription)
+	}
+	if !strings.Contains(ev.AccessActivityLog, "2025-03-01 12:05 UTC  service web1.example.com / 203.0.113.10 activated") {
+		t.Fatalf("AccessActivityLog missing activation: %q", ev.AccessActivityLog)
+	}
+	if !strings.Contains(ev.AccessActivityLog, "login from 198.51.100.5 via password (Mozilla/5.0)") {
+		t.Fatalf("AccessActivityLog missing login: %q", ev.AccessActivityLog)
+	}
+	if !strings.Contains(ev.RefundPolicyDisclosure, "2025-02-01 12:00 UTC from IP 198.51.100.5") ||
+		!strings.HasSuffix(ev.RefundPolicyDisclosure, "https://example.com/terms") {
+		t.Fatalf("RefundPolicyDisclosure = %q", ev.RefundPolicyDisclosure)
+	}
+	if !strings.Contains(ev.UncategorizedText, "Invoice INV-2025-0042") {
+		t.Fatalf("UncategorizedText = %q", ev.UncategorizedText)
+	}
+}
+
+func TestBuildEvidenceWithoutInvoice(t *testing.T) {
+	t.Parallel()
+
+	activatedAt := time.Date(2025, 3, 2, 8, 0, 0, 0, time.UTC)
+	ev := buildEvidence(&evidenceFacts{
+		CustomerEmail: "jane@example.com",
+		PaymentAmount: "5.00",
+		Currency:      "USD",
+		PaidAt:        activatedAt.Add(-time.Hour),
+		Services:      []Service{{ID: "svc-1", PlanName: "Nano", ActivatedAt: &activatedAt}},
+		Logins:        []loginRecord{{At: activatedAt, IP: "198.51.100.9"}},
+	})
+
+	if ev.CustomerPurchaseIP != "" {
+		t.Fatalf("CustomerPurchaseIP = %q, want empty without a login before payment", ev.CustomerPurchaseIP)
+	}
+	if ev.ServiceDate != "2025-03-02" {
+		t.Fatalf("ServiceDate = %q, want activation date", ev.ServiceDate)
+	}
+	if ev.BillingAddress != "" || ev.RefundPolicyDisclosure != "" {
+		t.Fatalf("unexpected address/terms: %q / %q", ev.BillingAddress, ev.RefundPolicyDisclosure)
+	}
+}
+
+func TestNextAlert(t *testing.T) {
+	t.Parallel()
+
+	thresholds := []int{1, 3, 7}
+	tests := []struct {
+		name     string
+		daysLeft int
+		sent     map[int]bool
+		want     int
+		wantOK   bool
+	}{
+		{"too early", 10, map[int]bool{}, 0, false},
+		{"first alert", 6, map[int]bool{}, 7, true},
+		{"already sent", 5, map[int]bool{7: true}, 0, false},
+		{"next threshold", 3, map[int]bool{7: true}, 3, true},
+		{"skips missed earlier threshold", 2, map[int]bool{}, 3, true},
+		{"last day", 0, map[int]bool{7: true, 3: true}, 1, true},
+		{"no earlier alert after later one", 5, map[int]bool{1: true}, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := nextAlert(thresholds, tt.daysLeft, tt.sent)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: nextAlert(%d) = %d, %v; want %d, %v", tt.name, tt.daysLeft, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestDaysLeft(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	if got := daysLeft(now.Add(71*time.Hour), now); got != 2 {
+		t.Fatalf("daysLeft = %d, want 2", got)
+	}
+	if got := daysLeft(now.Add(-time.Hour), now); got != 0 {
+		t.Fatalf("daysLeft past due = %d, want 0", got)
+	}
+}
@@ -0,0 +1,302 @@
+package dispute
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/billing"
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/gateway"
+)
+
+// 登录记录最多引用的条数
+const maxLoginRecords = 50
+
+type invoiceFacts struct {
+	Number      string
+	Total       string
+	Currency    string
+	IssuedAt    time.Time
+	PaidAt      *time.Time
+	PeriodStart *time.Time
+	PeriodEnd   *time.Time
+	Items       []string
+}
+
+type loginRecord struct {
+	At        time.Time
+	IP        string
+	UserAgent string
+	Method    string
+}
+
+// evidenceFacts 从账单、服务和审计日志中收集的争议证据素材
+type evidenceFacts struct {
+	CustomerName   string
+	CustomerEmail  string
+	BillingAddress []string
+	PaymentAmount  string
+	Currency       string
+	PaidAt         time.Time
+	Invoice        *invoiceFacts
+	Services       []Service
+	Logins         []loginRecord
+	TermsURL       string
+	TermsAccepted  *loginRecord
+}
+
+// loadFacts 收集争议付款对应的客户、发票、服务、登录和条款接受记录
+func (h *Handler) loadFacts(ctx context.Context, d *Detail) (*evidenceFacts, *common.ServiceError) {
+	facts := &evidenceFacts{
+		CustomerEmail: d.UserEmail,
+		PaymentAmount: d.Amount,
+		Currency:      d.Currency,
+		TermsURL:      h.store.Get("terms_of_service_url"),
+		Services:      []Service{},
+	}
+
+	var name, company, line1, line2, city, state, postal, country *string
+	err := h.pool.QueryRow(ctx,
+		`SELECT COALESCE(cp.full_name, u.name), cp.company_name, cp.address_line1, cp.address_line2,
+		        cp.city, cp.state, cp.postal_code, cp.country, p.created_at
+		 FROM payments p
+		 JOIN users u ON u.id = p.user_id
+		 LEFT JOIN customer_profiles cp ON cp.user_id = p.user_id
+		 WHERE p.id = $1`,
+		d.PaymentID,
+	).Scan(&name, &company, &line1, &line2, &city, &state, &postal, &country, &facts.PaidAt)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to load customer details", err)
+	}
+	facts.CustomerName = deref(name)
+	locality := strings.TrimSpace(strings.Join(nonEmpty(deref(city), deref(state), deref(postal)), " "))
+	facts.BillingAddress = nonEmpty(deref(company), deref(line1), deref(line2), locality, deref(country))
+
+	if d.InvoiceID != nil {
+		if err := h.loadInvoiceFacts(ctx, d.PaymentID, *d.InvoiceID, facts); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := h.pool.Query(ctx,
+		`SELECT created_at, COALESCE(ip_address, ''), COALESCE(user_agent, ''),
+		        action, COALESCE(new_values->>'method', '')
+		 FROM audit_logs
+		 WHERE user_id = $1 AND entity_type = 'user' AND action IN ('login', 'terms_accepted')
+		 ORDER BY created_at DESC`,
+		d.UserID,
+	)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to load login history", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec loginRecord
+		var action string
+		if err := rows.Scan(&rec.At, &rec.IP, &rec.UserAgent, &action, &rec.Method); err != nil {
+			return nil, common.ErrInternal("Failed to scan login history", err)
+		}
+		if action == "terms_accepted" {
+			// 只保留最早的一次接受记录
+			r := rec
+			facts.TermsAccepted = &r
+			continue
+		}
+		if len(facts.Logins) < maxLoginRecords {
+			facts.Logins = append(facts.Logins, rec)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, common.ErrInternal("Failed to load login history", err)
+	}
+
+	return facts, nil
+}
+
+// loadInvoiceFacts 读取发票明细和付款对应的服务，服务范围与退款一致
+func (h *Handler) loadInvoiceFacts(ctx context.Context, paymentID, invoiceID string, facts *evidenceFacts) *common.ServiceError {
+	inv := &invoiceFacts{}
+	err := h.pool.QueryRow(ctx,
+		`SELECT invoice_number, total::text, currency, created_at, paid_at, billing_period_start, billing_period_end
+		 FROM invoices WHERE id = $1`,
+		invoiceID,
+	).Scan(&inv.Number, &inv.Total, &inv.Currency, &inv.IssuedAt, &inv.PaidAt, &inv.PeriodStart, &inv.PeriodEnd)
+	if err != nil {
+		return common.ErrInternal("Failed to load invoice", err)
+	}
+
+	rows, err := h.pool.Query(ctx,
+		`SELECT description, quantity, amount::text
+		 FROM invoice_items
+		 WHERE invoice_id = $1
+		 ORDER BY created_at, id`,
+		invoiceID,
+	)
+	if err != nil {
+		return common.ErrInternal("Failed to load invoice items", err)
+	}
+	for rows.Next() {
+		var description, amount string
+		var quantity int
+		if err := rows.Scan(&description, &quantity, &amount); err != nil {
+			rows.Close()
+			return common.ErrInternal("Failed to scan invoice item", err)
+		}
+		inv.Items = append(inv.Items, fmt.Sprintf("%s x%d (%s %s)", description, quantity, amount, inv.Currency))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return common.ErrInternal("Failed to load invoice items", err)
+	}
+	facts.Invoice = inv
+
+	serviceIDs, err := billing.PaymentServices(ctx, h.pool, paymentID)
+	if err != nil {
+		return common.ErrInternal("Failed to load services", err)
+	}
+	rows, err = h.pool.Query(ctx,
+		`SELECT s.id, s.hostname, s.ip_address, pl.name, s.status::text, s.created_at,
+		        (s.metadata->>'activated_at')::timestamptz
+		 FROM services s
+		 JOIN plans pl ON pl.id = s.plan_id
+		 WHERE s.id = ANY($1::uuid[])
+		 ORDER BY s.created_at`,
+		serviceIDs,
+	)
+	if err != nil {
+		return common.ErrInternal("Failed to load services", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s Service
+		if err := rows.Scan(&s.ID, &s.Hostname, &s.IPAddress, &s.PlanName, &s.Status, &s.CreatedAt, &s.ActivatedAt); err != nil {
+			return common.ErrInternal("Failed to scan service", err)
+		}
+		facts.Services = append(facts.Services, s)
+	}
+	if err := rows.Err(); err != nil {
+		return common.ErrInternal("Failed to load services", err)
+	}
+	return nil
+}
+
+// buildEvidence 将收集到的素材整理为网关证据字段
+func buildEvidence(f *evidenceFacts) gateway.DisputeEvidence {
+	ev := gateway.DisputeEvidence{
+		CustomerName:   f.CustomerName,
+		CustomerEmail:  f.CustomerEmail,
+		BillingAddress: strings.Join(f.BillingAddress, ", "),
+	}
+
+	// 付款前最后一次登录的 IP 即下单 IP
+	for _, l := range f.Logins {
+		if !l.At.After(f.PaidAt) {
+			ev.CustomerPurchaseIP = l.IP
+			break
+		}
+	}
+
+	var product []string
+	if f.Invoice != nil {
+		product = append(product, f.Invoice.Items...)
+	}
+	for _, s := range f.Services {
+		product = append(product, fmt.Sprintf("Virtual server %s (%s plan)", serviceLabel(s), s.PlanName))
+	}
+	ev.ProductDescription = strings.Join(product, "\n")
+
+	if f.Invoice != nil && f.Invoice.PeriodStart != nil && f.Invoice.PeriodEnd != nil {
+		ev.ServiceDate = fmt.Sprintf("%s to %s", formatDate(*f.Invoice.PeriodStart), formatDate(*f.Invoice.PeriodEnd))
+	} else if first := firstActivation(f.Services); first != nil {
+		ev.ServiceDate = formatDate(*first)
+	}
+
+	var activity []string
+	for _, s := range f.Services {
+		if s.ActivatedAt != nil {
+			activity = append(activity, fmt.Sprintf("%s  service %s activated and delivered", formatTime(*s.ActivatedAt), serviceLabel(s)))
+		}
+	}
+	for _, l := range f.Logins {
+		line := fmt.Sprintf("%s  customer login from %s", formatTime(l.At), l.IP)
+		if l.Method != "" {
+			line += " via " + l.Method
+		}
+		if l.UserAgent != "" {
+			line += " (" + l.UserAgent + ")"
+		}
+		activity = append(activity, line)
+	}
+	ev.AccessActivityLog = strings.Join(activity, "\n")
+
+	if f.TermsAccepted != nil {
+		disclosure := fmt.Sprintf("The customer accepted the terms of service at registration on %s from IP %s.",
+			formatTime(f.TermsAccepted.At), f.TermsAccepted.IP)
+		if f.TermsURL != "" {
+			disclosure += " Terms: " + f.TermsURL
+		}
+		ev.RefundPolicyDisclosure = disclosure
+	} else if f.TermsURL != "" {
+		ev.RefundPolicyDisclosure = "Terms of service: " + f.TermsURL
+	}
+
+	summary := fmt.Sprintf("Payment of %s %s received on %s.", f.PaymentAmount, f.Currency, formatTime(f.PaidAt))
+	if f.Invoice != nil {
+		summary += fmt.Sprintf(" Invoice %s issued on %s, total %s %s", f.Invoice.Number, formatDate(f.Invoice.IssuedAt), f.Invoice.Total, f.Invoice.Currency)
+		if f.Invoice.PaidAt != nil {
+			summary += ", paid on " + formatDate(*f.Invoice.PaidAt)
+		}
+		summary += "."
+	}
+	ev.UncategorizedText = summary
+
+	return ev
+}
+
+func serviceLabel(s Service) string {
+	label := s.ID
+	if s.Hostname != nil && *s.Hostname != "" {
+		label = *s.Hostname
+	}
+	if s.IPAddress != nil && *s.IPAddress != "" {
+		label += " / " + *s.IPAddress
+	}
+	return label
+}
+
+func firstActivation(services []Service) *time.Time {
+	var first *time.Time
+	for _, s := range services {
+		if s.ActivatedAt != nil && (first == nil || s.ActivatedAt.Before(*first)) {
+			first = s.ActivatedAt
+		}
+	}
+	return first
+}
+
+func formatDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04 UTC")
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return strings.TrimSpace(*s)
+}
+
+func nonEmpty(values ...string) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,158 @@
+package dispute
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/app"
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/gin-gonic/gin"
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type Handler struct {
+	pool        *pgxpool.Pool
+	asynqClient *asynq.Client
+	store       *app.SettingsStore
+	gateways    *gateway.Registry
+}
+
+func NewHandler(pool *pgxpool.Pool, asynqClient *asynq.Client, store *app.SettingsStore, gateways *gateway.Registry) *Handler {
+	return &Handler{
+		pool:        pool,
+		asynqClient: asynqClient,
+		store:       store,
+		gateways:    gateways,
+	}
+}
+
+// Dispute 争议列表项
+type Dispute struct {
+	ID                  string     `json:"id"`
+	GatewayDisputeID    string     `json:"gateway_dispute_id"`
+	PaymentID           string     `json:"payment_id"`
+	Gateway             string     `json:"gateway"`
+	UserID              string     `json:"user_id"`
+	UserEmail           string     `json:"user_email"`
+	Amount              string     `json:"amount"`
+	Currency            string     `json:"currency"`
+	Reason              *string    `json:"reason"`
+	Status              string     `json:"status"`
+	EvidenceDueBy       *time.Time `json:"evidence_due_by"`
+	EvidenceSubmittedAt *time.Time `json:"evidence_submitted_at"`
+	ServicesSuspendedAt *time.Time `json:"services_suspended_at"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+}
+
+// Detail 争议详情，Evidence 为已保存的草稿，没有草稿时按现有数据自动生成
+type Detail struct {
+	Dispute
+	InvoiceID           *string                 `json:"invoice_id"`
+	InvoiceNumber       *string                 `json:"invoice_number"`
+	PaymentStatus       string                  `json:"payment_status"`
+	Services            []Service               `json:"services"`
+	Evidence            gateway.DisputeEvidence `json:"evidence"`
+	EvidenceDraft       bool                    `json:"evidence_draft"`
+	EvidenceSubmittedBy *string                 `json:"evidence_submitted_by"`
+}
+
+// Service 争议付款对应的服务
+type Service struct {
+	ID          string     `json:"id"`
+	Hostname    *string    `json:"hostname"`
+	IPAddress   *string    `json:"ip_address"`
+	PlanName    string     `json:"plan_name"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ActivatedAt *time.Time `json:"activated_at"`
+}
+
+// AdminListDisputes - GET /api/v1/admin/disputes
+// status 可选 needs_response、under_review、won、lost，或 open 表示尚未结案
+func (h *Handler) AdminListDisputes(c *gin.Context) {
+	status := c.Query("status")
+	switch status {
+	case "", "open", "needs_response", "under_review", "won", "lost":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status filter"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	disputes, total, err := h.listDisputes(c.Request.Context(), status, page, limit)
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+	c.Header("X-Page", strconv.Itoa(page))
+	c.Header("X-Limit", strconv.Itoa(limit))
+	c.JSON(http.StatusOK, disputes)
+}
+
+// AdminGetDispute - GET /api/v1/admin/disputes/:id
+func (h *Handler) AdminGetDispute(c *gin.Context) {
+	detail, err := h.getDispute(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, detail)
+}
+
+// AdminSaveEvidence - PUT /api/v1/admin/disputes/:id/evidence
+// 保存管理员修改后的证据草稿，提交前可以多次修改
+func (h *Handler) AdminSaveEvidence(c *gin.Context) {
+	var evidence gateway.DisputeEvidence
+	if err := c.ShouldBindJSON(&evidence); err != nil {
+		common.WriteServiceError(c, common.ErrBadRequest("Invalid request body", err))
+		return
+	}
+
+	detail, err := h.saveEvidence(c.Request.Context(), c.Param("id"), evidence)
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, detail)
+}
+
+// AdminResetEvidence - DELETE /api/v1/admin/disputes/:id/evidence
+// 丢弃草稿，重新按现有数据生成证据
+func (h *Handler) AdminResetEvidence(c *gin.Context) {
+	detail, err := h.resetEvidence(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, detail)
+}
+
+// AdminSubmitEvidence - POST /api/v1/admin/disputes/:id/submit
+// 将证据（草稿或自动生成的内容）提交给支付网关，提交后不能再修改
+func (h *Handler) AdminSubmitEvidence(c *gin.Context) {
+	adminID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	detail, err := h.submitEvidence(c.Request.Context(), c.Param("id"), adminID)
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, detail)
+}
@@ -0,0 +1,148 @@
+package dispute
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/app"
+	"github.com/adiecho/echobilling/internal/billing"
+	"github.com/adiecho/echobilling/internal/provisioning"
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// SuspendReason 争议期间暂停服务时记录的 suspend_reason，付款后不会被自动恢复
+const SuspendReason = "dispute"
+
+// ApplyServiceHold 在争议状态变化后调整相关服务：
+// 开启 dispute_auto_suspend 时，未结案的争议暂停仍在运行的服务（每个争议只暂停一次）；
+// 争议胜诉后恢复因该争议暂停的服务。败诉时保持暂停，由管理员决定后续处理
+func ApplyServiceHold(ctx context.Context, pool *pgxpool.Pool, client *asynq.Client, store *app.SettingsStore, disputeID, status string) error {
+	if client == nil {
+		return nil
+	}
+	switch status {
+	case "needs_response", "under_review":
+		if enabled, _ := strconv.ParseBool(store.Get("dispute_auto_suspend")); !enabled {
+			return nil
+		}
+		return suspendDisputedServices(ctx, pool, client, disputeID)
+	case "won":
+		return releaseDisputedServices(ctx, pool, client, disputeID)
+	}
+	return nil
+}
+
+func suspendDisputedServices(ctx context.Context, pool *pgxpool.Pool, client *asynq.Client, disputeID string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	var paymentID string
+	err = tx.QueryRow(ctx,
+		`UPDATE disputes SET services_suspended_at = $2, updated_at = $2
+		 WHERE id = $1 AND services_suspended_at IS NULL
+		 RETURNING payment_id::text`,
+		disputeID, now,
+	).Scan(&paymentID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mark dispute services: %w", err)
+	}
+	// 与退款使用同一范围：续费发票只对应 service_id 指向的单元
+	disputed, err := billing.PaymentServices(ctx, tx, paymentID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(ctx,
+		`UPDATE services
+		 SET metadata = COALESCE(metadata, '{}'::jsonb) || jsonb_build_object('dispute_id', $1::text),
+		     updated_at = $2
+		 WHERE id = ANY($3::uuid[]) AND status = 'active'
+		 RETURNING id`,
+		disputeID, now, disputed,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to mark disputed services: %w", err)
+	}
+	serviceIDs := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan service: %w", err)
+		}
+		serviceIDs = append(serviceIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to mark disputed services: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit dispute hold: %w", err)
+	}
+
+	for _, id := range serviceIDs {
+		task, err := provisioning.NewSuspendVPSTask(provisioning.SuspendVPSPayload{ServiceID: id, Reason: SuspendReason})
+		if err != nil {
+			return err
+		}
+		if _, err := client.Enqueue(task, asynq.Queue("critical"), asynq.MaxRetry(5)); err != nil {
+			return fmt.Errorf("failed to enqueue suspension for %s: %w", id, err)
+		}
+		log.Printf("[dispute] service %s suspended for dispute %s", id, disputeID)
+	}
+	return nil
+}
+
+func releaseDisputedServices(ctx context.Context, pool *pgxpool.Pool, client *asynq.Client, disputeID string) error {
+	rows, err := pool.Query(ctx,
+		`UPDATE services
+		 SET metadata = metadata - 'dispute_id', updated_at = NOW()
+		 WHERE metadata->>'dispute_id' = $1::text
+		   AND status = 'suspended'
+		   AND metadata->>'suspend_reason' = $2
+		 RETURNING id`,
+		disputeID, SuspendReason,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to release disputed services: %w", err)
+	}
+	serviceIDs := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan service: %w", err)
+		}
+		serviceIDs = append(serviceIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to release disputed services: %w", err)
+	}
+
+	for _, id := range serviceIDs {
+		task, err := provisioning.NewUnsuspendVPSTask(provisioning.UnsuspendVPSPayload{ServiceID: id})
+		if err != nil {
+			return err
+		}
+		if _, err := client.Enqueue(task, asynq.Queue("critical"), asynq.MaxRetry(5)); err != nil {
+			return fmt.Errorf("failed to enqueue unsuspension for %s: %w", id, err)
+		}
+		log.Printf("[dispute] service %s released after dispute %s was won", id, disputeID)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+package dispute
+
+import "github.com/gin-gonic/gin"
+
+func RegisterRoutes(admin *gin.RouterGroup, h *Handler) {
+	admin.GET("/disputes", h.AdminListDisputes)
+	admin.GET("/disputes/:id", h.AdminGetDispute)
+	admin.PUT("/disputes/:id/evidence", h.AdminSaveEvidence)
+	admin.DELETE("/disputes/:id/evidence", h.AdminResetEvidence)
+	admin.POST("/disputes/:id/submit", h.AdminSubmitEvidence)
+}
@@ -0,0 +1,237 @@
+package dispute
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/jackc/pgx/v5"
+)
+
+const disputeColumns = `d.id, d.stripe_dispute_id, d.payment_id, p.gateway, p.user_id, u.email,
+	d.amount::text, p.currency, d.reason, d.status::text, d.evidence_due_by,
+	d.evidence_submitted_at, d.services_suspended_at, d.created_at, d.updated_at`
+
+const disputeFrom = `FROM disputes d
+	JOIN payments p ON p.id = d.payment_id
+	JOIN users u ON u.id = p.user_id`
+
+func scanDispute(row pgx.Row, d *Dispute, extra ...any) error {
+	dest := []any{
+		&d.ID, &d.GatewayDisputeID, &d.PaymentID, &d.Gateway, &d.UserID, &d.UserEmail,
+		&d.Amount, &d.Currency, &d.Reason, &d.Status, &d.EvidenceDueBy,
+		&d.EvidenceSubmittedAt, &d.ServicesSuspendedAt, &d.CreatedAt, &d.UpdatedAt,
+	}
+	return row.Scan(append(dest, extra...)...)
+}
+
+func (h *Handler) listDisputes(ctx context.Context, status string, page, limit int) ([]Dispute, int64, *common.ServiceError) {
+	filter := `WHERE ($1 = '' OR d.status::text = $1 OR ($1 = 'open' AND d.status IN ('needs_response', 'under_review')))`
+
+	var total int64
+	if err := h.pool.QueryRow(ctx, `SELECT COUNT(*) `+disputeFrom+` `+filter, status).Scan(&total); err != nil {
+		return nil, 0, common.ErrInternal("Failed to count disputes", err)
+	}
+
+	rows, err := h.pool.Query(ctx,
+		`SELECT `+disputeColumns+` `+disputeFrom+` `+filter+`
+		 ORDER BY d.evidence_due_by ASC NULLS LAST, d.created_at DESC
+		 LIMIT $2 OFFSET $3`,
+		status, limit, (page-1)*limit,
+	)
+	if err != nil {
+		return nil, 0, common.ErrInternal("Failed to list disputes", err)
+	}
+	defer rows.Close()
+
+	disputes := []Dispute{}
+	for rows.Next() {
+		var d Dispute
+		if err := scanDispute(rows, &d); err != nil {
+			return nil, 0, common.ErrInternal("Failed to scan dispute", err)
+		}
+		disputes = append(disputes, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, common.ErrInternal("Failed to list disputes", err)
+	}
+	return disputes, total, nil
+}
+
+func (h *Handler) getDispute(ctx context.Context, id string) (*Detail, *common.ServiceError) {
+	var detail Detail
+	var draft []byte
+	err := scanDispute(h.pool.QueryRow(ctx,
+		`SELECT `+disputeColumns+`, p.invoice_id, i.invoice_number, p.status::text, d.evidence, d.evidence_submitted_by
+		 `+disputeFrom+`
+		 LEFT JOIN invoices i ON i.id = p.invoice_id
+		 WHERE d.id = $1`,
+		id,
+	), &detail.Dispute, &detail.InvoiceID, &detail.InvoiceNumber, &detail.PaymentStatus, &draft, &detail.EvidenceSubmittedBy)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, common.ErrNotFound("Dispute not found", nil)
+		}
+		return nil, common.ErrInternal("Failed to get dispute", err)
+	}
+
+	facts, svcErr := h.loadFacts(ctx, &detail)
+	if svcErr != nil {
+		return nil, svcErr
+	}
+	detail.Services = facts.Services
+
+	if len(draft) > 0 {
+		if err := json.Unmarshal(draft, &detail.Evidence); err != nil {
+			return nil, common.ErrInternal("Failed to parse saved evidence", err)
+		}
+		detail.EvidenceDraft = true
+	} else {
+		detail.Evidence = buildEvidence(facts)
+	}
+	return &detail, nil
+}
+
+// lockOpenDispute 锁定尚未提交证据且未结案的争议
+func lockOpenDispute(ctx context.Context, tx pgx.Tx, id string) *common.ServiceError {
+	var status string
+	var submittedAt *time.Time
+	err := tx.QueryRow(ctx,
+		`SELECT status::text, evidence_submitted_at FROM disputes WHERE id = $1 FOR UPDATE`,
+		id,
+	).Scan(&status, &submittedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return common.ErrNotFound("Dispute not found", nil)
+		}
+		return common.ErrInternal("Failed to get dispute", err)
+	}
+	if submittedAt != nil {
+		return common.NewServiceError(http.StatusConflict, "Evidence has already been submitted", nil)
+	}
+	if status == "won" || status == "lost" {
+		return common.NewServiceError(http.StatusConflict, "Dispute is already closed", nil)
+	}
+	return nil
+}
+
+func (h *Handler) saveEvidence(ctx context.Context, id string, evidence gateway.DisputeEvidence) (*Detail, *common.ServiceError) {
+	if err := h.updateDraft(ctx, id, &evidence); err != nil {
+		return nil, err
+	}
+	return h.getDispute(ctx, id)
+}
+
+func (h *Handler) resetEvidence(ctx context.Context, id string) (*Detail, *common.ServiceError) {
+	if err := h.updateDraft(ctx, id, nil); err != nil {
+		return nil, err
+	}
+	return h.getDispute(ctx, id)
+}
+
+// updateDraft 保存或清除证据草稿，evidence 为 nil 时清除
+func (h *Handler) updateDraft(ctx context.Context, id string, evidence *gateway.DisputeEvidence) *common.ServiceError {
+	var data []byte
+	if evidence != nil {
+		var err error
+		if data, err = json.Marshal(evidence); err != nil {
+			return common.ErrInternal("Failed to encode evidence", err)
+		}
+	}
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return common.ErrInternal("Failed to begin transaction", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockOpenDispute(ctx, tx, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE disputes SET evidence = $2, updated_at = $3 WHERE id = $1`,
+		id, data, time.Now(),
+	); err != nil {
+		return common.ErrInternal("Failed to save evidence", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return common.ErrInternal("Failed to save evidence", err)
+	}
+	return nil
+}
+
+// submitEvidence 提交证据。网关调用放在事务内，调用失败时不会留下已提交的记录；
+// 争议行被锁定，同一争议不会被重复提交
+func (h *Handler) submitEvidence(ctx context.Context, id, adminID string) (*Detail, *common.ServiceError) {
+	detail, svcErr := h.getDispute(ctx, id)
+	if svcErr != nil {
+		return nil, svcErr
+	}
+
+	disputes, err := h.gateways.Disputes(detail.Gateway)
+	if err != nil {
+		if errors.Is(err, gateway.ErrNotSupported) {
+			return nil, common.ErrBadRequest(fmt.Sprintf("Gateway %s does not support dispute evidence", detail.Gateway), err)
+		}
+		return nil, common.ErrBadRequest("Payment gateway is not available", err)
+	}
+
+	data, err := json.Marshal(detail.Evidence)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to encode evidence", err)
+	}
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to begin transaction", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockOpenDispute(ctx, tx, id); err != nil {
+		return nil, err
+	}
+
+	if err := disputes.SubmitDisputeEvidence(ctx, detail.GatewayDisputeID, detail.Evidence); err != nil {
+		return nil, common.NewServiceError(http.StatusBadGateway, "Failed to submit evidence to payment gateway", err)
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec(ctx,
+		`UPDATE disputes
+		 SET evidence = $2, evidence_submitted_at = $3, evidence_submitted_by = $4,
+		     status = CASE WHEN status = 'needs_response' THEN 'under_review' ELSE status END,
+		     updated_at = $3
+		 WHERE id = $1`,
+		id, data, now, adminID,
+	); err != nil {
+		return nil, common.ErrInternal("Failed to record evidence submission", err)
+	}
+
+	details, _ := json.Marshal(map[string]interface{}{
+		"gateway":    detail.Gateway,
+		"dispute_id": detail.GatewayDisputeID,
+		"payment_id": detail.PaymentID,
+	})
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO audit_logs (user_id, action, entity_type, entity_id, new_values, created_at)
+		 VALUES ($1, 'dispute_evidence_submitted', 'dispute', $2, $3, $4)`,
+		adminID, id, details, now,
+	); err != nil {
+		return nil, common.ErrInternal("Failed to record evidence submission", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		// 网关已经收到证据，本地记录失败只能人工核对
+		log.Printf("[dispute] evidence for %s submitted but not recorded: %v", detail.GatewayDisputeID, err)
+		return nil, common.ErrInternal("Failed to record evidence submission", err)
+	}
+
+	log.Printf("[dispute] evidence for %s submitted by %s", detail.GatewayDisputeID, adminID)
+	return h.getDispute(ctx, id)
+}
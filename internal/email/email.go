@@ -0,0 +1,34 @@
+// Package email 发送纯文本通知邮件
+package email
+
+import (
+	"fmt"
+	"net/smtp"
+
+	"github.com/adiecho/echobilling/internal/app"
+)
+
+// 通知渠道，写入审计日志的 channel 字段
+const (
+	ChannelEmail        = "email"
+	ChannelAuditLogOnly = "audit_log_only"
+)
+
+// Send 通过 SMTP 发送通知邮件。未配置 SMTP（cfg 为 nil）时不发送，返回 audit_log_only，
+// 由调用方只记录审计日志
+func Send(cfg *app.SMTPSettings, to, subject, body string) (string, error) {
+	if cfg == nil {
+		return ChannelAuditLogOnly, nil
+	}
+
+	msg := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		cfg.From, to, subject, body,
+	)
+	addr := fmt.Sprintf("%s:%s", cfg.Host, cfg.Port)
+	auth := smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	if err := smtp.SendMail(addr, auth, cfg.From, []string{to}, []byte(msg)); err != nil {
+		return ChannelEmail, err
+	}
+	return ChannelEmail, nil
+}
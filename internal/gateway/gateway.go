@@ -0,0 +1,280 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/adiecho/echobilling/internal/app"
+)
+
+const (
+	Stripe  = "stripe"
+	Manual  = "manual"
+	Sandbox = "sandbox"
+)
+
+var (
+	ErrNotSupported   = errors.New("operation not supported by payment gateway")
+	ErrUnknownGateway = errors.New("unknown payment gateway")
+	ErrDisabled       = errors.New("payment gateway is not enabled")
+)
+
+// Capabilities 网关支持的能力，调用方据此决定走哪条支付流程
+type Capabilities struct {
+	// HostedCheckout 客户跳转到网关托管的支付页，付款结果通过 Webhook 回传
+	HostedCheckout bool `json:"hosted_checkout"`
+	// Refunds 可以通过网关 API 原路退款
+	Refunds bool `json:"refunds"`
+	// Webhooks 网关会推送签名的事件通知
+	Webhooks bool `json:"webhooks"`
+	// SavedMethods 可以保存支付方式并离线扣款，实现 SavedMethods 接口
+	SavedMethods bool `json:"saved_methods"`
+	// ManualConfirmation 付款由管理员核对后登记
+	ManualConfirmation bool `json:"manual_confirmation"`
+	// Disputes 可以通过网关 API 提交争议证据，实现 Disputes 接口
+	Disputes bool `json:"disputes"`
+}
+
+type LineItem struct {
+	Name       string
+	UnitAmount int64
+	Quantity   int64
+}
+
+// CheckoutRequest 发起一次付款。金额均为分
+type CheckoutRequest struct {
+	UserID string
+	// Reference 付款参考号，线下转账时客户需要在附言中填写
+	Reference         string
+	Currency          string
+	Amount            int64
+	LineItems         []LineItem
+	ClientReferenceID string
+	Metadata          map[string]string
+	SuccessURL        string
+	CancelURL         string
+	// CustomerID 网关侧的客户 ID；SaveMethod 为 true 时付款后保存支付方式
+	CustomerID string
+	SaveMethod bool
+}
+
+// Checkout 托管支付返回跳转地址，线下支付返回付款说明
+type Checkout struct {
+	Gateway      string        `json:"gateway"`
+	SessionID    string        `json:"session_id,omitempty"`
+	URL          string        `json:"session_url,omitempty"`
+	Instructions *Instructions `json:"instructions,omitempty"`
+}
+
+// Instructions 线下付款说明
+type Instructions struct {
+	Reference string `json:"reference"`
+	Amount    string `json:"amount"`
+	Currency  string `json:"currency"`
+	Details   string `json:"details"`
+}
+
+type RefundRequest struct {
+	// PaymentReference 网关侧的付款 ID（Stripe 为 PaymentIntent ID）
+	PaymentReference string
+	Amount           int64
+	Reason           string
+}
+
+type Refund struct {
+	ID     string
+	Status string
+}
+
+// Event 验签后的网关事件，Data 为事件对象的原始 JSON
+type Event struct {
+	// Gateway 事件来源网关，登记付款时写入 payments.gateway
+	Gateway string
+	ID      string
+	Type    string
+	Data    json.RawMessage
+}
+
+// Gateway 支付网关
+type Gateway interface {
+	Name() string
+	Capabilities() Capabilities
+	CreateCheckout(ctx context.Context, req CheckoutRequest) (*Checkout, error)
+	Refund(ctx context.Context, req RefundRequest) (*Refund, error)
+	VerifyWebhook(payload []byte, signature string) (*Event, error)
+}
+
+// OffSessionCharge 使用已保存的支付方式在客户不在场时扣款
+type OffSessionCharge struct {
+	CustomerID      string
+	PaymentMethodID string
+	Amount          int64
+	Currency        string
+	Description     string
+	Metadata        map[string]string
+	IdempotencyKey  string
+}
+
+type Charge struct {
+	ID        string
+	Status    string
+	Succeeded bool
+}
+
+// DeclinedError 网关明确拒绝了扣款（卡被拒、需要客户验证等），重试不会成功
+type DeclinedError struct {
+	PaymentID string
+	Reason    string
+}
+
+func (e *DeclinedError) Error() string {
+	return "payment declined: " + e.Reason
+}
+
+// SavedMethods 支持保存支付方式和离线扣款的网关
+type SavedMethods interface {
+	CreateCustomer(ctx context.Context, userID, email, name string) (string, error)
+	DetachPaymentMethod(ctx context.Context, paymentMethodID string) error
+	ChargeOffSession(ctx context.Context, req OffSessionCharge) (*Charge, error)
+}
+
+// CheckoutExpirer 可以主动使未完成的托管支付会话失效的网关，发票作废后避免客户继续付款
+type CheckoutExpirer interface {
+	// ExpireCheckout 使会话失效；会话已完成或已过期时直接返回 nil
+	ExpireCheckout(ctx context.Context, sessionID string) error
+}
+
+// DisputeEvidence 争议答辩材料，字段对应 Stripe 的文本类证据
+type DisputeEvidence struct {
+	CustomerName       string `json:"customer_name"`
+	CustomerEmail      string `json:"customer_email"`
+	CustomerPurchaseIP string `json:"customer_purchase_ip"`
+	BillingAddress     string `json:"billing_address"`
+	ProductDescription string `json:"product_description"`
+	// ServiceDate 开始提供服务的日期
+	ServiceDate string `json:"service_date"`
+	// AccessActivityLog 服务开通和客户登录记录，包含时间和 IP
+	AccessActivityLog string `json:"access_activity_log"`
+	// RefundPolicyDisclosure 客户接受服务条款的时间和方式
+	RefundPolicyDisclosure string `json:"refund_policy_disclosure"`
+	UncategorizedText      string `json:"uncategorized_text"`
+}
+
+// Disputes 支持在线提交争议证据的网关
+type Disputes interface {
+	SubmitDisputeEvidence(ctx context.Context, disputeID string, evidence DisputeEvidence) error
+}
+
+// Registry 按名称查找网关，启用列表见 payment_gateways_enabled 设置，第一个为默认网关
+type Registry struct {
+	store    *app.SettingsStore
+	gateways map[string]Gateway
+}
+
+// NewRegistry 注册内置网关；沙箱网关只在明确的开发或测试环境注册，其他环境即使在设置中启用也不可用
+func NewRegistry(cfg *app.Config, store *app.SettingsStore) *Registry {
+	r := &Registry{store: store, gateways: make(map[string]Gateway)}
+	r.Register(NewStripe(store))
+	r.Register(NewManual(store))
+	if SandboxAllowed(cfg.Environment) {
+		r.Register(NewSandbox(store, cfg.FrontendURL))
+	}
+	return r
+}
+
+// SandboxAllowed 沙箱网关只允许在开发和测试环境使用，未知的环境名一律视为生产环境
+func SandboxAllowed(environment string) bool {
+	switch strings.ToLower(strings.TrimSpace(environment)) {
+	case "dev", "development", "local", "test":
+		return true
+	}
+	return false
+}
+
+func (r *Registry) Register(g Gateway) {
+	r.gateways[g.Name()] = g
+}
+
+// Enabled 返回已启用的网关名称，未配置时只启用 Stripe
+func (r *Registry) Enabled() []string {
+	names := make([]string, 0, len(r.gateways))
+	for _, part := range strings.Split(r.store.Get("payment_gateways_enabled"), ",") {
+		name := strings.ToLower(strings.TrimSpace(part))
+		if _, ok := r.gateways[name]; ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, Stripe)
+	}
+	return names
+}
+
+// Get 返回客户可以选择的网关，name 为空时返回默认网关
+func (r *Registry) Get(name string) (Gateway, error) {
+	enabled := r.Enabled()
+	if name == "" {
+		name = enabled[0]
+	}
+	g, err := r.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range enabled {
+		if n == g.Name() {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrDisabled, name)
+}
+
+// Lookup 按名称返回网关，不检查是否启用；用于处理已有付款的退款和 Webhook
+func (r *Registry) Lookup(name string) (Gateway, error) {
+	g, ok := r.gateways[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownGateway, name)
+	}
+	return g, nil
+}
+
+// Disputes 返回可以提交争议证据的网关
+func (r *Registry) Disputes(name string) (Disputes, error) {
+	g, err := r.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	disputes, ok := g.(Disputes)
+	if !ok || !g.Capabilities().Disputes {
+		return nil, ErrNotSupported
+	}
+	return disputes, nil
+}
+
+// CheckoutExpirer 返回可以使托管支付会话失效的网关
+func (r *Registry) CheckoutExpirer(name string) (CheckoutExpirer, error) {
+	g, err := r.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	expirer, ok := g.(CheckoutExpirer)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return expirer, nil
+}
+
+// SavedMethods 返回支持离线扣款的网关
+func (r *Registry) SavedMethods() (SavedMethods, error) {
+	g, err := r.Lookup(Stripe)
+	if err != nil {
+		return nil, err
+	}
+	saved, ok := g.(SavedMethods)
+	if !ok || !g.Capabilities().SavedMethods {
+		return nil, ErrNotSupported
+	}
+	return saved, nil
+}
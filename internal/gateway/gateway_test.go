@@ -0,0 +1,104 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/adiecho/echobilling/internal/app"
+)
+
+func newTestRegistry(environment string, settings map[string]string) *Registry {
+	return NewRegistry(&app.Config{Environment: environment, FrontendURL: "http://localhost:5173"}, app.NewSettingsStore(nil, settings))
+}
+
+func TestRegistryDefaultsToStripe(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRegistry("prod", map[string]string{"payment_gateways_enabled": "paypal"})
+	enabled := r.Enabled()
+	if len(enabled) != 1 || enabled[0] != Stripe {
+		t.Fatalf("Enabled() = %v, want [stripe]", enabled)
+	}
+
+	g, err := r.Get("")
+	if err != nil {
+		t.Fatalf("Get(\"\") returned error: %v", err)
+	}
+	if g.Name() != Stripe {
+		t.Fatalf("Get(\"\") = %s, want stripe", g.Name())
+	}
+}
+
+func TestRegistryRejectsDisabledGateway(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRegistry("prod", map[string]string{"payment_gateways_enabled": " Manual "})
+	g, err := r.Get("")
+	if err != nil || g.Name() != Manual {
+		t.Fatalf("Get(\"\") = %v, %v; want manual", g, err)
+	}
+
+	if _, err := r.Get(Stripe); !errors.Is(err, ErrDisabled) {
+		t.Fatalf("Get(stripe) error = %v, want ErrDisabled", err)
+	}
+	if _, err := r.Get("paypal"); !errors.Is(err, ErrUnknownGateway) {
+		t.Fatalf("Get(paypal) error = %v, want ErrUnknownGateway", err)
+	}
+
+	// 已有付款的退款和回调不受启用列表限制
+	if _, err := r.Lookup(Stripe); err != nil {
+		t.Fatalf("Lookup(stripe) returned error: %v", err)
+	}
+}
+
+func TestManualCheckoutReturnsInstructions(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRegistry("dev", map[string]string{
+		"payment_gateways_enabled":    "manual",
+		"manual_payment_instructions": "IBAN DE00 0000 0000 0000",
+	})
+	g, err := r.Get(Manual)
+	if err != nil {
+		t.Fatalf("Get(manual) returned error: %v", err)
+	}
+	if caps := g.Capabilities(); caps.HostedCheckout || caps.Refunds || !caps.ManualConfirmation {
+		t.Fatalf("Capabilities() = %+v", caps)
+	}
+
+	checkout, err := g.CreateCheckout(context.Background(), CheckoutRequest{
+		Reference: "INV-2026-000042",
+		Currency:  "eur",
+		Amount:    12345,
+	})
+	if err != nil {
+		t.Fatalf("CreateCheckout returned error: %v", err)
+	}
+	if checkout.URL != "" || checkout.Instructions == nil {
+		t.Fatalf("CreateCheckout = %+v, want instructions only", checkout)
+	}
+	want := Instructions{Reference: "INV-2026-000042", Amount: "123.45", Currency: "EUR", Details: "IBAN DE00 0000 0000 0000"}
+	if *checkout.Instructions != want {
+		t.Fatalf("Instructions = %+v, want %+v", *checkout.Instructions, want)
+	}
+
+	if _, err := g.Refund(context.Background(), RefundRequest{}); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("Refund error = %v, want ErrNotSupported", err)
+	}
+}
+
+func TestCustomerIdempotencyKeyScopedToKeyAndEmail(t *testing.T) {
+	t.Parallel()
+
+	base := customerIdempotencyKey("sk_test_a", "user-1", "a@example.com")
+	if base != customerIdempotencyKey("sk_test_a", "user-1", " A@example.com") {
+		t.Fatal("key changed for the same normalised email")
+	}
+	if base == customerIdempotencyKey("sk_test_b", "user-1", "a@example.com") {
+		t.Fatal("key not scoped to the API key")
+	}
+	if base == customerIdempotencyKey("sk_test_a", "user-1", "b@example.com") {
+		t.Fatal("key not scoped to the email")
+	}
+}
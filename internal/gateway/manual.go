@@ -0,0 +1,46 @@
+package gateway
+
+import (
+	"context"
+	"strings"
+
+	"github.com/adiecho/echobilling/internal/app"
+	"github.com/adiecho/echobilling/internal/common"
+)
+
+// ManualGateway 线下银行转账。客户按付款说明转账并在附言中填写参考号，
+// 管理员核对到账后在后台登记付款
+type ManualGateway struct {
+	store *app.SettingsStore
+}
+
+func NewManual(store *app.SettingsStore) *ManualGateway {
+	return &ManualGateway{store: store}
+}
+
+func (g *ManualGateway) Name() string { return Manual }
+
+func (g *ManualGateway) Capabilities() Capabilities {
+	return Capabilities{ManualConfirmation: true}
+}
+
+func (g *ManualGateway) CreateCheckout(_ context.Context, req CheckoutRequest) (*Checkout, error) {
+	return &Checkout{
+		Gateway: Manual,
+		Instructions: &Instructions{
+			Reference: req.Reference,
+			Amount:    common.CentsToDecimal(req.Amount),
+			Currency:  strings.ToUpper(req.Currency),
+			Details:   g.store.Get("manual_payment_instructions"),
+		},
+	}, nil
+}
+
+// Refund 线下付款需要管理员自行转账退回
+func (g *ManualGateway) Refund(context.Context, RefundRequest) (*Refund, error) {
+	return nil, ErrNotSupported
+}
+
+func (g *ManualGateway) VerifyWebhook([]byte, string) (*Event, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,316 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/app"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+// 沙箱支付页可选的付款结果
+const (
+	OutcomeSucceed = "succeed"
+	OutcomeFail    = "fail"
+	OutcomeDispute = "dispute"
+	OutcomeRefund  = "refund"
+)
+
+// sandboxSessionTTL 未完成的沙箱 Session 保留时间，与 Stripe Checkout Session 的默认有效期一致
+const sandboxSessionTTL = 24 * time.Hour
+
+var (
+	ErrSessionNotFound = errors.New("sandbox checkout session not found")
+	ErrUnknownOutcome  = errors.New("unknown sandbox outcome")
+)
+
+// SandboxSession 沙箱 Checkout Session，只保存在进程内存中
+type SandboxSession struct {
+	ID                string
+	PaymentIntentID   string
+	Currency          string
+	Amount            int64
+	LineItems         []LineItem
+	Metadata          map[string]string
+	ClientReferenceID string
+	SuccessURL        string
+	CancelURL         string
+	CreatedAt         time.Time
+}
+
+// SignedEvent 已签名的沙箱事件，Signature 与 Stripe-Signature 头格式相同
+type SignedEvent struct {
+	Payload   []byte
+	Signature string
+}
+
+// SandboxGateway 本地沙箱网关，用于开发和端到端测试。
+// 提供模拟的托管支付页，按选择的结果生成与 Stripe 格式一致的签名事件，交给同一套 Webhook 流程处理
+type SandboxGateway struct {
+	store   *app.SettingsStore
+	baseURL string
+	// secret 未配置 sandbox_webhook_secret 时使用的进程内随机密钥
+	secret string
+
+	mu       sync.Mutex
+	sessions map[string]*SandboxSession
+}
+
+func NewSandbox(store *app.SettingsStore, baseURL string) *SandboxGateway {
+	return &SandboxGateway{
+		store:    store,
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		secret:   "whsec_sandbox_" + randomID(),
+		sessions: make(map[string]*SandboxSession),
+	}
+}
+
+func (g *SandboxGateway) Name() string { return Sandbox }
+
+func (g *SandboxGateway) Capabilities() Capabilities {
+	return Capabilities{
+		HostedCheckout: true,
+		Refunds:        true,
+		Webhooks:       true,
+		Disputes:       true,
+	}
+}
+
+func (g *SandboxGateway) webhookSecret() string {
+	if secret := g.store.Get("sandbox_webhook_secret"); secret != "" {
+		return secret
+	}
+	return g.secret
+}
+
+func (g *SandboxGateway) CreateCheckout(_ context.Context, req CheckoutRequest) (*Checkout, error) {
+	sess := &SandboxSession{
+		ID:                "cs_sandbox_" + randomID(),
+		PaymentIntentID:   "pi_sandbox_" + randomID(),
+		Currency:          strings.ToLower(req.Currency),
+		Amount:            req.Amount,
+		LineItems:         req.LineItems,
+		Metadata:          req.Metadata,
+		ClientReferenceID: req.ClientReferenceID,
+		SuccessURL:        req.SuccessURL,
+		CancelURL:         req.CancelURL,
+		CreatedAt:         time.Now(),
+	}
+
+	g.mu.Lock()
+	g.pruneLocked(sess.CreatedAt)
+	g.sessions[sess.ID] = sess
+	g.mu.Unlock()
+
+	return &Checkout{
+		Gateway:   Sandbox,
+		SessionID: sess.ID,
+		URL:       g.baseURL + "/api/v1/sandbox/checkout/" + sess.ID,
+	}, nil
+}
+
+// Session 返回尚未完成且未过期的沙箱 Session
+func (g *SandboxGateway) Session(id string) (*SandboxSession, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pruneLocked(time.Now())
+	sess, ok := g.sessions[id]
+	return sess, ok
+}
+
+// ExpireCheckout 删除尚未完成的沙箱 Session，之后打开支付页会提示 Session 不存在
+func (g *SandboxGateway) ExpireCheckout(_ context.Context, sessionID string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.sessions, sessionID)
+	return nil
+}
+
+// pruneLocked 删除过期的 Session，避免未完成的 Session 无限累积；调用方需持有 mu
+func (g *SandboxGateway) pruneLocked(now time.Time) {
+	for id, sess := range g.sessions {
+		if now.Sub(sess.CreatedAt) > sandboxSessionTTL {
+			delete(g.sessions, id)
+		}
+	}
+}
+
+// Complete 按选择的结果结束 Session，返回需要按顺序投递的签名事件。
+// 争议和退款会先生成付款成功事件，再生成对应的后续事件
+func (g *SandboxGateway) Complete(id, outcome string) (*SandboxSession, []SignedEvent, error) {
+	g.mu.Lock()
+	g.pruneLocked(time.Now())
+	sess, ok := g.sessions[id]
+	if ok {
+		delete(g.sessions, id)
+	}
+	g.mu.Unlock()
+	if !ok {
+		return nil, nil, ErrSessionNotFound
+	}
+
+	var objects []sandboxObject
+	switch outcome {
+	case OutcomeSucceed:
+		objects = append(objects, sess.completedObject())
+	case OutcomeFail:
+		objects = append(objects, sess.failedObject())
+	case OutcomeDispute:
+		objects = append(objects, sess.completedObject(), sess.disputeObject())
+	case OutcomeRefund:
+		objects = append(objects, sess.completedObject(), sess.refundedObject())
+	default:
+		// 结果无效时保留 Session，客户可以重新选择
+		g.mu.Lock()
+		g.sessions[id] = sess
+		g.mu.Unlock()
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnknownOutcome, outcome)
+	}
+
+	events := make([]SignedEvent, 0, len(objects))
+	for _, obj := range objects {
+		event, err := g.sign(obj)
+		if err != nil {
+			return nil, nil, err
+		}
+		events = append(events, event)
+	}
+	return sess, events, nil
+}
+
+func (g *SandboxGateway) sign(obj sandboxObject) (SignedEvent, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":          "evt_sandbox_" + randomID(),
+		"object":      "event",
+		"type":        obj.eventType,
+		"api_version": stripe.APIVersion,
+		"created":     time.Now().Unix(),
+		"livemode":    false,
+		"data":        map[string]interface{}{"object": obj.data},
+	})
+	if err != nil {
+		return SignedEvent{}, err
+	}
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payload,
+		Secret:  g.webhookSecret(),
+	})
+	return SignedEvent{Payload: payload, Signature: signed.Header}, nil
+}
+
+// Refund 沙箱退款立即成功，不会生成 charge.refunded 事件
+func (g *SandboxGateway) Refund(_ context.Context, req RefundRequest) (*Refund, error) {
+	if !strings.HasPrefix(req.PaymentReference, "pi_sandbox_") {
+		return nil, errors.New("payment was not made through the sandbox gateway")
+	}
+	return &Refund{ID: "re_sandbox_" + randomID(), Status: "succeeded"}, nil
+}
+
+// SubmitDisputeEvidence 沙箱争议证据直接视为已提交，不会生成后续事件
+func (g *SandboxGateway) SubmitDisputeEvidence(_ context.Context, disputeID string, _ DisputeEvidence) error {
+	if !strings.HasPrefix(disputeID, "dp_sandbox_") {
+		return errors.New("dispute was not opened through the sandbox gateway")
+	}
+	return nil
+}
+
+func (g *SandboxGateway) VerifyWebhook(payload []byte, signature string) (*Event, error) {
+	event, err := webhook.ConstructEvent(payload, signature, g.webhookSecret())
+	if err != nil {
+		return nil, err
+	}
+	e := &Event{Gateway: Sandbox, ID: event.ID, Type: string(event.Type)}
+	if event.Data != nil {
+		e.Data = event.Data.Raw
+	}
+	return e, nil
+}
+
+type sandboxObject struct {
+	eventType string
+	data      map[string]interface{}
+}
+
+func (s *SandboxSession) completedObject() sandboxObject {
+	return sandboxObject{eventType: "checkout.session.completed", data: map[string]interface{}{
+		"id":                  s.ID,
+		"object":              "checkout.session",
+		"amount_total":        s.Amount,
+		"currency":            s.Currency,
+		"client_reference_id": s.ClientReferenceID,
+		"metadata":            s.Metadata,
+		"mode":                "payment",
+		"payment_intent":      s.PaymentIntentID,
+		"payment_status":      "paid",
+		"status":              "complete",
+	}}
+}
+
+func (s *SandboxSession) failedObject() sandboxObject {
+	return sandboxObject{eventType: "payment_intent.payment_failed", data: map[string]interface{}{
+		"id":       s.PaymentIntentID,
+		"object":   "payment_intent",
+		"amount":   s.Amount,
+		"currency": s.Currency,
+		"metadata": s.Metadata,
+		"status":   "requires_payment_method",
+		"last_payment_error": map[string]interface{}{
+			"type":    "card_error",
+			"code":    "card_declined",
+			"message": "Your card was declined.",
+		},
+	}}
+}
+
+func (s *SandboxSession) disputeObject() sandboxObject {
+	return sandboxObject{eventType: "charge.dispute.created", data: map[string]interface{}{
+		"id":             "dp_sandbox_" + randomID(),
+		"object":         "dispute",
+		"amount":         s.Amount,
+		"currency":       s.Currency,
+		"payment_intent": s.PaymentIntentID,
+		"reason":         "fraudulent",
+		"status":         "needs_response",
+		"evidence_details": map[string]interface{}{
+			"due_by": time.Now().AddDate(0, 0, 7).Unix(),
+		},
+	}}
+}
+
+func (s *SandboxSession) refundedObject() sandboxObject {
+	return sandboxObject{eventType: "charge.refunded", data: map[string]interface{}{
+		"id":              "ch_sandbox_" + randomID(),
+		"object":          "charge",
+		"amount":          s.Amount,
+		"amount_refunded": s.Amount,
+		"currency":        s.Currency,
+		"payment_intent":  s.PaymentIntentID,
+		"refunded":        true,
+		"refunds": map[string]interface{}{
+			"object": "list",
+			"data": []map[string]interface{}{{
+				"id":             "re_sandbox_" + randomID(),
+				"object":         "refund",
+				"amount":         s.Amount,
+				"currency":       s.Currency,
+				"payment_intent": s.PaymentIntentID,
+				"reason":         "requested_by_customer",
+				"status":         "succeeded",
+			}},
+		},
+	}}
+}
+
+func randomID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
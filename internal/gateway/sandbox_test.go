@@ -0,0 +1,148 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/app"
+)
+
+func TestSandboxOnlyInDevelopment(t *testing.T) {
+	t.Parallel()
+
+	settings := map[string]string{"payment_gateways_enabled": "sandbox"}
+	for _, env := range []string{"prod", "production", "staging", ""} {
+		if _, err := newTestRegistry(env, settings).Get(Sandbox); !errors.Is(err, ErrUnknownGateway) {
+			t.Fatalf("Get(sandbox) in %q error = %v, want ErrUnknownGateway", env, err)
+		}
+	}
+	for _, env := range []string{"dev", "development", "test"} {
+		if _, err := newTestRegistry(env, settings).Get(Sandbox); err != nil {
+			t.Fatalf("Get(sandbox) in %q returned error: %v", env, err)
+		}
+	}
+}
+
+func TestSandboxPrunesExpiredSessions(t *testing.T) {
+	t.Parallel()
+
+	sandbox := NewSandbox(app.NewSettingsStore(nil, nil), "http://localhost:5173")
+	stale, err := sandbox.CreateCheckout(context.Background(), CheckoutRequest{Currency: "USD", Amount: 100})
+	if err != nil {
+		t.Fatalf("CreateCheckout returned error: %v", err)
+	}
+	sandbox.mu.Lock()
+	sandbox.sessions[stale.SessionID].CreatedAt = time.Now().Add(-sandboxSessionTTL - time.Minute)
+	sandbox.mu.Unlock()
+
+	if _, err := sandbox.CreateCheckout(context.Background(), CheckoutRequest{Currency: "USD", Amount: 100}); err != nil {
+		t.Fatalf("CreateCheckout returned error: %v", err)
+	}
+	if _, ok := sandbox.Session(stale.SessionID); ok {
+		t.Fatal("expired session was not pruned")
+	}
+	if n := len(sandbox.sessions); n != 1 {
+		t.Fatalf("%d sessions kept, want 1", n)
+	}
+}
+
+func TestSandboxExpireCheckout(t *testing.T) {
+	t.Parallel()
+
+	registry := &Registry{gateways: make(map[string]Gateway)}
+	sandbox := NewSandbox(app.NewSettingsStore(nil, nil), "http://localhost:5173")
+	registry.Register(sandbox)
+	registry.Register(NewManual(app.NewSettingsStore(nil, nil)))
+
+	checkout, err := sandbox.CreateCheckout(context.Background(), CheckoutRequest{Currency: "USD", Amount: 100})
+	if err != nil {
+		t.Fatalf("CreateCheckout returned error: %v", err)
+	}
+	expirer, err := registry.CheckoutExpirer(Sandbox)
+	if err != nil {
+		t.Fatalf("CheckoutExpirer(sandbox) returned error: %v", err)
+	}
+	if err := expirer.ExpireCheckout(context.Background(), checkout.SessionID); err != nil {
+		t.Fatalf("ExpireCheckout returned error: %v", err)
+	}
+	if _, _, err := sandbox.Complete(checkout.SessionID, OutcomeSucceed); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("Complete after expiry error = %v, want ErrSessionNotFound", err)
+	}
+	if _, err := registry.CheckoutExpirer(Manual); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("CheckoutExpirer(manual) error = %v, want ErrNotSupported", err)
+	}
+}
+
+func TestSandboxCompleteSignsStripeEvents(t *testing.T) {
+	t.Parallel()
+
+	g, err := newTestRegistry("dev", map[string]string{"payment_gateways_enabled": "sandbox"}).Get(Sandbox)
+	if err != nil {
+		t.Fatalf("Get(sandbox) returned error: %v", err)
+	}
+	sandbox := g.(*SandboxGateway)
+
+	checkout, err := sandbox.CreateCheckout(context.Background(), CheckoutRequest{
+		Currency:   "USD",
+		Amount:     2500,
+		LineItems:  []LineItem{{Name: "VPS S", UnitAmount: 2500, Quantity: 1}},
+		Metadata:   map[string]string{"order_id": "order-1"},
+		SuccessURL: "http://localhost:5173/checkout/success",
+	})
+	if err != nil {
+		t.Fatalf("CreateCheckout returned error: %v", err)
+	}
+	if !strings.HasSuffix(checkout.URL, "/api/v1/sandbox/checkout/"+checkout.SessionID) {
+		t.Fatalf("checkout URL = %s", checkout.URL)
+	}
+
+	if _, _, err := sandbox.Complete(checkout.SessionID, "explode"); !errors.Is(err, ErrUnknownOutcome) {
+		t.Fatalf("Complete(explode) error = %v, want ErrUnknownOutcome", err)
+	}
+	if _, ok := sandbox.Session(checkout.SessionID); !ok {
+		t.Fatal("session removed after an invalid outcome")
+	}
+
+	sess, events, err := sandbox.Complete(checkout.SessionID, OutcomeDispute)
+	if err != nil {
+		t.Fatalf("Complete(dispute) returned error: %v", err)
+	}
+	wantTypes := []string{"checkout.session.completed", "charge.dispute.created"}
+	if len(events) != len(wantTypes) {
+		t.Fatalf("Complete(dispute) returned %d events, want %d", len(events), len(wantTypes))
+	}
+	for i, signed := range events {
+		event, err := sandbox.VerifyWebhook(signed.Payload, signed.Signature)
+		if err != nil {
+			t.Fatalf("VerifyWebhook(event %d) returned error: %v", i, err)
+		}
+		if event.Type != wantTypes[i] || event.Gateway != Sandbox {
+			t.Fatalf("event %d = %s from %s, want %s from sandbox", i, event.Type, event.Gateway, wantTypes[i])
+		}
+
+		var data struct {
+			PaymentIntent string            `json:"payment_intent"`
+			Metadata      map[string]string `json:"metadata"`
+		}
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			t.Fatalf("event %d data: %v", i, err)
+		}
+		if data.PaymentIntent != sess.PaymentIntentID {
+			t.Fatalf("event %d payment_intent = %s, want %s", i, data.PaymentIntent, sess.PaymentIntentID)
+		}
+		if i == 0 && data.Metadata["order_id"] != "order-1" {
+			t.Fatalf("session metadata = %v", data.Metadata)
+		}
+	}
+
+	if _, err := sandbox.VerifyWebhook(events[0].Payload, "t=1,v1=deadbeef"); err == nil {
+		t.Fatal("VerifyWebhook accepted a forged signature")
+	}
+	if _, _, err := sandbox.Complete(checkout.SessionID, OutcomeSucceed); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("second Complete error = %v, want ErrSessionNotFound", err)
+	}
+}
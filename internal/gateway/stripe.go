@@ -0,0 +1,228 @@
+package gateway
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/adiecho/echobilling/internal/app"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+// StripeGateway 通过 Stripe Checkout 收款。每次调用按当前设置创建客户端，密钥修改后立即生效
+type StripeGateway struct {
+	store *app.SettingsStore
+}
+
+func NewStripe(store *app.SettingsStore) *StripeGateway {
+	return &StripeGateway{store: store}
+}
+
+func (g *StripeGateway) Name() string { return Stripe }
+
+func (g *StripeGateway) Capabilities() Capabilities {
+	return Capabilities{
+		HostedCheckout: true,
+		Refunds:        true,
+		Webhooks:       true,
+		SavedMethods:   true,
+		Disputes:       true,
+	}
+}
+
+func (g *StripeGateway) client() *stripe.Client {
+	return stripe.NewClient(g.store.StripeSecretKey())
+}
+
+func (g *StripeGateway) CreateCheckout(ctx context.Context, req CheckoutRequest) (*Checkout, error) {
+	lineItems := make([]*stripe.CheckoutSessionCreateLineItemParams, 0, len(req.LineItems))
+	for _, item := range req.LineItems {
+		lineItems = append(lineItems, &stripe.CheckoutSessionCreateLineItemParams{
+			PriceData: &stripe.CheckoutSessionCreateLineItemPriceDataParams{
+				Currency: stripe.String(strings.ToLower(req.Currency)),
+				ProductData: &stripe.CheckoutSessionCreateLineItemPriceDataProductDataParams{
+					Name: stripe.String(item.Name),
+				},
+				UnitAmount: stripe.Int64(item.UnitAmount),
+			},
+			Quantity: stripe.Int64(item.Quantity),
+		})
+	}
+
+	params := &stripe.CheckoutSessionCreateParams{
+		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+		LineItems:          lineItems,
+		Mode:               stripe.String(string(stripe.CheckoutSessionModePayment)),
+		SuccessURL:         stripe.String(req.SuccessURL),
+		CancelURL:          stripe.String(req.CancelURL),
+		Metadata:           req.Metadata,
+		PaymentIntentData: &stripe.CheckoutSessionCreatePaymentIntentDataParams{
+			Metadata: req.Metadata,
+		},
+	}
+	if req.ClientReferenceID != "" {
+		params.ClientReferenceID = stripe.String(req.ClientReferenceID)
+	}
+	if req.CustomerID != "" {
+		params.Customer = stripe.String(req.CustomerID)
+		if req.SaveMethod {
+			params.PaymentIntentData.SetupFutureUsage = stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession))
+		}
+	}
+
+	sess, err := g.client().V1CheckoutSessions.Create(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return &Checkout{Gateway: Stripe, SessionID: sess.ID, URL: sess.URL}, nil
+}
+
+func (g *StripeGateway) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	if req.PaymentReference == "" {
+		return nil, errors.New("payment has no Stripe payment intent")
+	}
+	params := &stripe.RefundCreateParams{
+		PaymentIntent: stripe.String(req.PaymentReference),
+		Amount:        stripe.Int64(req.Amount),
+	}
+	if req.Reason == "duplicate" || req.Reason == "fraudulent" || req.Reason == "requested_by_customer" {
+		params.Reason = stripe.String(req.Reason)
+	}
+
+	r, err := g.client().V1Refunds.Create(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return &Refund{ID: r.ID, Status: string(r.Status)}, nil
+}
+
+func (g *StripeGateway) ExpireCheckout(ctx context.Context, sessionID string) error {
+	client := g.client()
+	sess, err := client.V1CheckoutSessions.Retrieve(ctx, sessionID, nil)
+	if err != nil {
+		return err
+	}
+	if sess.Status != stripe.CheckoutSessionStatusOpen {
+		return nil
+	}
+	_, err = client.V1CheckoutSessions.Expire(ctx, sessionID, nil)
+	return err
+}
+
+func (g *StripeGateway) VerifyWebhook(payload []byte, signature string) (*Event, error) {
+	event, err := webhook.ConstructEvent(payload, signature, g.store.StripeWebhookSecret())
+	if err != nil {
+		return nil, err
+	}
+	e := &Event{Gateway: Stripe, ID: event.ID, Type: string(event.Type)}
+	if event.Data != nil {
+		e.Data = event.Data.Raw
+	}
+	return e, nil
+}
+
+func (g *StripeGateway) CreateCustomer(ctx context.Context, userID, email, name string) (string, error) {
+	params := &stripe.CustomerCreateParams{
+		Email:    stripe.String(email),
+		Metadata: map[string]string{"user_id": userID},
+	}
+	if name != "" {
+		params.Name = stripe.String(name)
+	}
+	// 同一用户并发结账时复用同一个 Customer
+	secretKey := g.store.StripeSecretKey()
+	params.SetIdempotencyKey(customerIdempotencyKey(secretKey, userID, email))
+
+	cus, err := stripe.NewClient(secretKey).V1Customers.Create(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return cus.ID, nil
+}
+
+// customerIdempotencyKey 创建 Customer 的幂等键。Stripe 会保留幂等键 24 小时，
+// 键中加入密钥和邮箱的摘要，轮换密钥或修改邮箱后不会重放旧的响应
+func customerIdempotencyKey(secretKey, userID, email string) string {
+	sum := sha256.Sum256([]byte(secretKey + "\x00" + strings.ToLower(strings.TrimSpace(email))))
+	return "customer-" + userID + "-" + hex.EncodeToString(sum[:8])
+}
+
+// DetachPaymentMethod 从 Customer 上解绑支付方式，Stripe 侧已不存在时视为成功
+func (g *StripeGateway) DetachPaymentMethod(ctx context.Context, paymentMethodID string) error {
+	_, err := g.client().V1PaymentMethods.Detach(ctx, paymentMethodID, nil)
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeResourceMissing {
+		return nil
+	}
+	return err
+}
+
+// ChargeOffSession 创建并确认离线 PaymentIntent；卡被拒或需要验证时返回 *DeclinedError
+func (g *StripeGateway) ChargeOffSession(ctx context.Context, req OffSessionCharge) (*Charge, error) {
+	params := &stripe.PaymentIntentCreateParams{
+		Amount:        stripe.Int64(req.Amount),
+		Currency:      stripe.String(strings.ToLower(req.Currency)),
+		Customer:      stripe.String(req.CustomerID),
+		PaymentMethod: stripe.String(req.PaymentMethodID),
+		OffSession:    stripe.Bool(true),
+		Confirm:       stripe.Bool(true),
+		Description:   stripe.String(req.Description),
+		Metadata:      req.Metadata,
+	}
+	if req.IdempotencyKey != "" {
+		params.SetIdempotencyKey(req.IdempotencyKey)
+	}
+
+	intent, err := g.client().V1PaymentIntents.Create(ctx, params)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.Type != stripe.ErrorTypeAPI {
+			declined := &DeclinedError{Reason: stripeErr.Msg}
+			if stripeErr.PaymentIntent != nil {
+				declined.PaymentID = stripeErr.PaymentIntent.ID
+			}
+			return nil, declined
+		}
+		// 网络错误和 Stripe 服务端错误可以重试
+		return nil, err
+	}
+
+	charge := &Charge{
+		ID:        intent.ID,
+		Status:    string(intent.Status),
+		Succeeded: intent.Status == stripe.PaymentIntentStatusSucceeded,
+	}
+	if !charge.Succeeded {
+		return nil, &DeclinedError{PaymentID: intent.ID, Reason: "payment intent status " + charge.Status}
+	}
+	return charge, nil
+}
+
+// SubmitDisputeEvidence 提交争议证据，空字段不会覆盖 Dashboard 中已填写的内容
+func (g *StripeGateway) SubmitDisputeEvidence(ctx context.Context, disputeID string, e DisputeEvidence) error {
+	_, err := g.client().V1Disputes.Update(ctx, disputeID, &stripe.DisputeUpdateParams{
+		Evidence: &stripe.DisputeUpdateEvidenceParams{
+			CustomerName:           optionalString(e.CustomerName),
+			CustomerEmailAddress:   optionalString(e.CustomerEmail),
+			CustomerPurchaseIP:     optionalString(e.CustomerPurchaseIP),
+			BillingAddress:         optionalString(e.BillingAddress),
+			ProductDescription:     optionalString(e.ProductDescription),
+			ServiceDate:            optionalString(e.ServiceDate),
+			AccessActivityLog:      optionalString(e.AccessActivityLog),
+			RefundPolicyDisclosure: optionalString(e.RefundPolicyDisclosure),
+			UncategorizedText:      optionalString(e.UncategorizedText),
+		},
+		Submit: stripe.Bool(true),
+	})
+	return err
+}
+
+func optionalString(v string) *string {
+	if v == "" {
+		return nil
+	}
+	return stripe.String(v)
+}
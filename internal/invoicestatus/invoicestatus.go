@@ -0,0 +1,90 @@
+// Package invoicestatus 发票状态机，以及所有发票作废路径共用的作废操作
+package invoicestatus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/credit"
+	"github.com/jackc/pgx/v5"
+)
+
+// 发票状态，与 invoice_status 枚举一致
+const (
+	Draft             = "draft"
+	Pending           = "pending"
+	Paid              = "paid"
+	PartiallyRefunded = "partially_refunded"
+	Refunded          = "refunded"
+	Void              = "void"
+)
+
+// ErrInvalidTransition 发票当前状态不允许目标状态
+var ErrInvalidTransition = errors.New("invalid invoice status transition")
+
+// transitions 发票状态机：草稿定稿后待支付，待支付的发票结清或作废，
+// 已支付的发票随累计退款在已支付、部分退款和已退款之间变化（退款失败时回退）。作废是终态
+var transitions = map[string][]string{
+	Draft:             {Pending, Void},
+	Pending:           {Paid, Void},
+	Paid:              {PartiallyRefunded, Refunded},
+	PartiallyRefunded: {Paid, Refunded},
+	Refunded:          {Paid, PartiallyRefunded},
+}
+
+// CanTransition 发票能否从 from 变为 to；状态不变不算变化
+func CanTransition(from, to string) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Check 校验状态变化，不允许时返回包装了 ErrInvalidTransition 的错误
+func Check(from, to string) error {
+	if !CanTransition(from, to) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, to)
+	}
+	return nil
+}
+
+// Voided 作废前的发票信息，调用方据此处理关联的订单
+type Voided struct {
+	PreviousStatus string
+	UserID         string
+	OrderID        *string
+}
+
+// MarkVoid 在事务内作废发票：按状态机校验，记录作废时间和原因，并退回发票上抵扣的余额。
+// 发票仍未完成的托管支付会话由 billing:expire_checkouts 定时任务在网关侧使其失效。
+// 发票不存在时返回 pgx.ErrNoRows，已支付或已作废的发票返回包装了 ErrInvalidTransition 的错误
+func MarkVoid(ctx context.Context, tx pgx.Tx, invoiceID, reason string, now time.Time) (*Voided, error) {
+	v := &Voided{}
+	err := tx.QueryRow(ctx,
+		`SELECT status::text, user_id::text, order_id::text FROM invoices WHERE id = $1 FOR UPDATE`,
+		invoiceID,
+	).Scan(&v.PreviousStatus, &v.UserID, &v.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	if err := Check(v.PreviousStatus, Void); err != nil {
+		return nil, err
+	}
+
+	if err := credit.ReleaseInvoice(ctx, tx, v.UserID, invoiceID, now); err != nil {
+		return nil, fmt.Errorf("failed to release invoice credit: %w", err)
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE invoices
+		 SET status = 'void', credit_applied = 0, voided_at = $2, void_reason = $3, updated_at = $2
+		 WHERE id = $1`,
+		invoiceID, now, reason,
+	); err != nil {
+		return nil, fmt.Errorf("failed to void invoice: %w", err)
+	}
+	return v, nil
+}
@@ -0,0 +1,98 @@
+package invoicestatus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/testdb"
+)
+
+func TestInvoiceTransitions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{Draft, Pending, true},
+		{Draft, Void, true},
+		// 草稿必须先定稿才能付款
+		{Draft, Paid, false},
+		{Pending, Paid, true},
+		{Pending, Void, true},
+		{Pending, Draft, false},
+		{Paid, Void, false},
+		{Paid, PartiallyRefunded, true},
+		{Refunded, Paid, true},
+		{Void, Pending, false},
+		{Void, Void, false},
+	}
+	for _, tt := range tests {
+		if got := CanTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+
+	if err := Check(Paid, Void); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("Check(paid, void) = %v, want ErrInvalidTransition", err)
+	}
+}
+
+func TestMarkVoid(t *testing.T) {
+	pool := testdb.Pool(t)
+	ctx := context.Background()
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID, invoiceID string
+	if err := tx.QueryRow(ctx,
+		`INSERT INTO users (email, password_hash)
+		 VALUES ('void-' || uuid_generate_v4() || '@example.com', 'x')
+		 RETURNING id`,
+	).Scan(&userID); err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	if err := tx.QueryRow(ctx,
+		`INSERT INTO invoices (user_id, invoice_number, status, subtotal, total)
+		 VALUES ($1, 'TEST-' || uuid_generate_v4(), 'pending', 10, 10)
+		 RETURNING id`,
+		userID,
+	).Scan(&invoiceID); err != nil {
+		t.Fatalf("insert invoice: %v", err)
+	}
+
+	now := time.Now()
+	voided, err := MarkVoid(ctx, tx, invoiceID, "Superseded", now)
+	if err != nil {
+		t.Fatalf("MarkVoid: %v", err)
+	}
+	if voided.PreviousStatus != Pending || voided.UserID != userID {
+		t.Fatalf("voided = %+v", voided)
+	}
+
+	var (
+		status string
+		reason *string
+		at     *time.Time
+	)
+	if err := tx.QueryRow(ctx,
+		`SELECT status::text, void_reason, voided_at FROM invoices WHERE id = $1`,
+		invoiceID,
+	).Scan(&status, &reason, &at); err != nil {
+		t.Fatalf("query invoice: %v", err)
+	}
+	if status != Void || reason == nil || *reason != "Superseded" || at == nil {
+		t.Fatalf("status = %s, void_reason = %v, voided_at = %v", status, reason, at)
+	}
+
+	// 作废是终态，重复作废由状态机拒绝
+	if _, err := MarkVoid(ctx, tx, invoiceID, "Again", now); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("second MarkVoid = %v, want ErrInvalidTransition", err)
+	}
+}
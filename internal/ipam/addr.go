@@ -0,0 +1,108 @@
+package ipam
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"net/netip"
+	"strings"
+)
+
+// minIPv4PrefixBits 限制 IPv4 子网大小，避免误录入超大网段
+const minIPv4PrefixBits = 16
+
+// parseSubnet 校验 CIDR 与网关，返回规范化后的网段和地址族
+func parseSubnet(cidr, gateway string) (netip.Prefix, netip.Addr, string, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil {
+		return netip.Prefix{}, netip.Addr{}, "", fmt.Errorf("invalid cidr %q", cidr)
+	}
+	if prefix != prefix.Masked() {
+		return netip.Prefix{}, netip.Addr{}, "", fmt.Errorf("cidr %q has host bits set, use %s", cidr, prefix.Masked())
+	}
+
+	family := "ipv6"
+	if prefix.Addr().Is4() {
+		family = "ipv4"
+		if prefix.Bits() < minIPv4PrefixBits || prefix.Bits() > 30 {
+			return netip.Prefix{}, netip.Addr{}, "", fmt.Errorf("ipv4 subnets must be between /%d and /30", minIPv4PrefixBits)
+		}
+	} else if prefix.Bits() > 126 {
+		return netip.Prefix{}, netip.Addr{}, "", fmt.Errorf("ipv6 subnets must be /126 or larger")
+	}
+
+	var gw netip.Addr
+	if gateway = strings.TrimSpace(gateway); gateway != "" {
+		gw, err = netip.ParseAddr(gateway)
+		if err != nil {
+			return netip.Prefix{}, netip.Addr{}, "", fmt.Errorf("invalid gateway %q", gateway)
+		}
+		if !prefix.Contains(gw) {
+			return netip.Prefix{}, netip.Addr{}, "", fmt.Errorf("gateway %s is outside %s", gw, prefix)
+		}
+	}
+
+	return prefix, gw, family, nil
+}
+
+// hostCount 返回网段内可分配的主机偏移上限（不含网络地址，IPv4 另外排除广播地址）
+func hostCount(prefix netip.Prefix) uint64 {
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits >= 63 {
+		return math.MaxInt64
+	}
+	size := uint64(1) << hostBits
+	if prefix.Addr().Is4() {
+		return size - 2
+	}
+	return size - 1
+}
+
+// addrAtOffset 返回网段内第 offset 个地址
+func addrAtOffset(prefix netip.Prefix, offset uint64) netip.Addr {
+	raw := prefix.Addr().As16()
+	hi := uint64(raw[0])<<56 | uint64(raw[1])<<48 | uint64(raw[2])<<40 | uint64(raw[3])<<32 |
+		uint64(raw[4])<<24 | uint64(raw[5])<<16 | uint64(raw[6])<<8 | uint64(raw[7])
+	lo := uint64(raw[8])<<56 | uint64(raw[9])<<48 | uint64(raw[10])<<40 | uint64(raw[11])<<32 |
+		uint64(raw[12])<<24 | uint64(raw[13])<<16 | uint64(raw[14])<<8 | uint64(raw[15])
+
+	var carry uint64
+	lo, carry = bits.Add64(lo, offset, 0)
+	hi += carry
+
+	for i := 0; i < 8; i++ {
+		raw[7-i] = byte(hi >> (8 * i))
+		raw[15-i] = byte(lo >> (8 * i))
+	}
+
+	addr := netip.AddrFrom16(raw)
+	if prefix.Addr().Is4() {
+		return addr.Unmap()
+	}
+	return addr
+}
+
+// nextHost 从 offset 开始寻找下一个可分配地址，跳过网关；返回地址及其偏移
+func nextHost(prefix netip.Prefix, gateway netip.Addr, offset uint64) (netip.Addr, uint64, bool) {
+	if offset == 0 {
+		offset = 1
+	}
+	limit := hostCount(prefix)
+	for ; offset <= limit; offset++ {
+		addr := addrAtOffset(prefix, offset)
+		if gateway.IsValid() && addr == gateway {
+			continue
+		}
+		return addr, offset, true
+	}
+	return netip.Addr{}, offset, false
+}
+
+// netmask 返回 IPv4 网段的点分十进制掩码，IPv6 返回空字符串
+func netmask(prefix netip.Prefix) string {
+	if !prefix.Addr().Is4() {
+		return ""
+	}
+	mask := ^uint32(0) << (32 - prefix.Bits())
+	return fmt.Sprintf("%d.%d.%d.%d", byte(mask>>24), byte(mask>>16), byte(mask>>8), byte(mask))
+}
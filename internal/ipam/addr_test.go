@@ -0,0 +1,100 @@
+package ipam
+
+import (
+	"math"
+	"net/netip"
+	"testing"
+)
+
+func TestParseSubnet(t *testing.T) {
+	t.Parallel()
+
+	prefix, gw, family, err := parseSubnet("203.0.113.0/24", "203.0.113.1")
+	if err != nil || family != "ipv4" || prefix.Bits() != 24 || gw.String() != "203.0.113.1" {
+		t.Fatalf("parseSubnet ipv4 = %v, %v, %q, %v", prefix, gw, family, err)
+	}
+
+	if _, _, family, err := parseSubnet("2001:db8:1::/64", ""); err != nil || family != "ipv6" {
+		t.Fatalf("parseSubnet ipv6 family = %q, %v", family, err)
+	}
+
+	invalid := []struct{ cidr, gateway string }{
+		{"not-a-cidr", ""},
+		{"203.0.113.5/24", ""},
+		{"10.0.0.0/8", ""},
+		{"203.0.113.0/32", ""},
+		{"203.0.113.0/24", "198.51.100.1"},
+		{"203.0.113.0/24", "gateway"},
+	}
+	for _, tc := range invalid {
+		if _, _, _, err := parseSubnet(tc.cidr, tc.gateway); err == nil {
+			t.Fatalf("parseSubnet(%q, %q) expected error", tc.cidr, tc.gateway)
+		}
+	}
+}
+
+func TestHostCount(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		cidr string
+		want uint64
+	}{
+		{"203.0.113.0/24", 254},
+		{"203.0.113.0/30", 2},
+		{"2001:db8::/120", 255},
+		{"2001:db8::/64", math.MaxInt64},
+	}
+	for _, tc := range tests {
+		if got := hostCount(netip.MustParsePrefix(tc.cidr)); got != tc.want {
+			t.Fatalf("hostCount(%s) = %d, want %d", tc.cidr, got, tc.want)
+		}
+	}
+}
+
+func TestNextHostSkipsGateway(t *testing.T) {
+	t.Parallel()
+
+	prefix := netip.MustParsePrefix("203.0.113.0/30")
+	gateway := netip.MustParseAddr("203.0.113.1")
+
+	addr, offset, ok := nextHost(prefix, gateway, 1)
+	if !ok || addr.String() != "203.0.113.2" || offset != 2 {
+		t.Fatalf("nextHost = %s, %d, %v; want 203.0.113.2, 2, true", addr, offset, ok)
+	}
+
+	// /30 只有两个主机地址，其中一个是网关，广播地址不可分配
+	if addr, _, ok := nextHost(prefix, gateway, 3); ok {
+		t.Fatalf("nextHost returned %s beyond subnet capacity", addr)
+	}
+}
+
+func TestAddrAtOffsetIPv6Carry(t *testing.T) {
+	t.Parallel()
+
+	prefix := netip.MustParsePrefix("2001:db8:0:0:ffff:ffff:ffff:ff00/120")
+	if got := addrAtOffset(prefix, 0x10); got.String() != "2001:db8::ffff:ffff:ffff:ff10" {
+		t.Fatalf("addrAtOffset = %s", got)
+	}
+
+	wide := netip.MustParsePrefix("2001:db8:0:1::/64")
+	if got := addrAtOffset(wide, 1); got.String() != "2001:db8:0:1::1" {
+		t.Fatalf("addrAtOffset = %s", got)
+	}
+
+	carry := netip.MustParsePrefix("2001:db8:0:1:ffff:ffff:ffff:fffe/127")
+	if got := addrAtOffset(carry, 2); got.String() != "2001:db8:0:2::" {
+		t.Fatalf("addrAtOffset carry = %s", got)
+	}
+}
+
+func TestNetmask(t *testing.T) {
+	t.Parallel()
+
+	if got := netmask(netip.MustParsePrefix("10.1.0.0/20")); got != "255.255.240.0" {
+		t.Fatalf("netmask /20 = %s", got)
+	}
+	if got := netmask(netip.MustParsePrefix("2001:db8::/64")); got != "" {
+		t.Fatalf("netmask ipv6 = %q, want empty", got)
+	}
+}
@@ -0,0 +1,236 @@
+package ipam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/adiecho/echobilling/internal/db"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	// ErrNoSubnets 表示没有启用中的该地址族子网，调用方可以选择跳过分配
+	ErrNoSubnets = errors.New("no active subnets for address family")
+	// ErrPoolExhausted 表示所有启用中的子网都已分配完
+	ErrPoolExhausted = errors.New("ip pool exhausted")
+)
+
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// Assignment 分配给服务的地址及其网络参数
+type Assignment struct {
+	AddressID    string `json:"id"`
+	Family       string `json:"family"`
+	Address      string `json:"address"`
+	PrefixLength int    `json:"prefix_length"`
+	Netmask      string `json:"netmask,omitempty"`
+	Gateway      string `json:"gateway,omitempty"`
+	DNSServers   string `json:"dns_servers,omitempty"`
+	ReverseDNS   string `json:"reverse_dns,omitempty"`
+}
+
+const assignmentColumns = `
+	a.id,
+	s.family::text,
+	host(a.address),
+	s.cidr::text,
+	COALESCE(host(s.gateway), ''),
+	s.dns_servers,
+	COALESCE(a.reverse_dns, '')`
+
+func scanAssignment(row pgx.Row) (*Assignment, error) {
+	var (
+		a    Assignment
+		cidr string
+	)
+	if err := row.Scan(&a.AddressID, &a.Family, &a.Address, &cidr, &a.Gateway, &a.DNSServers, &a.ReverseDNS); err != nil {
+		return nil, err
+	}
+	if prefix, err := netip.ParsePrefix(cidr); err == nil {
+		a.PrefixLength = prefix.Bits()
+		a.Netmask = netmask(prefix)
+	}
+	return &a, nil
+}
+
+// Reserve 在事务中为服务分配一个指定地址族的地址。
+// 服务已持有该地址族的地址时直接返回，保证开通任务重试幂等；
+// 否则优先复用已释放的地址，再从子网中按偏移顺序切出新地址。
+func Reserve(ctx context.Context, tx pgx.Tx, serviceID, family, reverseDNS string) (*Assignment, error) {
+	existing, err := scanAssignment(tx.QueryRow(ctx, `
+		SELECT`+assignmentColumns+`
+		FROM ip_addresses a
+		JOIN ip_subnets s ON s.id = a.subnet_id
+		WHERE a.service_id = $1 AND s.family = $2::ip_family AND a.status = 'assigned'
+		ORDER BY a.assigned_at
+		LIMIT 1
+	`, serviceID, family))
+	if err == nil {
+		return existing, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("failed to query existing assignment: %w", err)
+	}
+
+	var addressID string
+	err = tx.QueryRow(ctx, `
+		SELECT a.id
+		FROM ip_addresses a
+		JOIN ip_subnets s ON s.id = a.subnet_id
+		JOIN ip_pools p ON p.id = s.pool_id
+		WHERE s.family = $1::ip_family AND a.status = 'available' AND p.is_active = TRUE
+		ORDER BY p.sort_order, a.address
+		LIMIT 1
+		FOR UPDATE OF a SKIP LOCKED
+	`, family).Scan(&addressID)
+	switch {
+	case err == nil:
+		return assign(ctx, tx, addressID, serviceID, reverseDNS)
+	case !errors.Is(err, pgx.ErrNoRows):
+		return nil, fmt.Errorf("failed to query released addresses: %w", err)
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT s.id, s.cidr::text, COALESCE(host(s.gateway), ''), s.next_offset
+		FROM ip_subnets s
+		JOIN ip_pools p ON p.id = s.pool_id
+		WHERE s.family = $1::ip_family AND p.is_active = TRUE
+		ORDER BY p.sort_order, s.created_at
+		FOR UPDATE OF s
+	`, family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock subnets: %w", err)
+	}
+
+	type candidate struct {
+		subnetID string
+		addr     netip.Addr
+		offset   uint64
+	}
+	var (
+		found   *candidate
+		subnets int
+	)
+	for rows.Next() {
+		var (
+			subnetID, cidr, gateway string
+			nextOffset              int64
+		)
+		if err := rows.Scan(&subnetID, &cidr, &gateway, &nextOffset); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		subnets++
+		if found != nil {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			continue
+		}
+		gw, _ := netip.ParseAddr(gateway)
+		if addr, offset, ok := nextHost(prefix, gw, uint64(nextOffset)); ok {
+			found = &candidate{subnetID: subnetID, addr: addr, offset: offset}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if subnets == 0 {
+		return nil, ErrNoSubnets
+	}
+	if found == nil {
+		return nil, ErrPoolExhausted
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE ip_subnets
+		SET next_offset = $2, updated_at = NOW()
+		WHERE id = $1
+	`, found.subnetID, int64(found.offset+1)); err != nil {
+		return nil, fmt.Errorf("failed to advance subnet offset: %w", err)
+	}
+
+	err = tx.QueryRow(ctx, `
+		INSERT INTO ip_addresses (subnet_id, address, status)
+		VALUES ($1, $2::inet, 'available')
+		RETURNING id
+	`, found.subnetID, found.addr.String()).Scan(&addressID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert address: %w", err)
+	}
+
+	return assign(ctx, tx, addressID, serviceID, reverseDNS)
+}
+
+func assign(ctx context.Context, tx pgx.Tx, addressID, serviceID, reverseDNS string) (*Assignment, error) {
+	if _, err := tx.Exec(ctx, `
+		UPDATE ip_addresses
+		SET status = 'assigned',
+		    service_id = $2,
+		    reverse_dns = NULLIF($3, ''),
+		    assigned_at = NOW(),
+		    released_at = NULL,
+		    updated_at = NOW()
+		WHERE id = $1
+	`, addressID, serviceID, reverseDNS); err != nil {
+		return nil, fmt.Errorf("failed to assign address: %w", err)
+	}
+
+	return scanAssignment(tx.QueryRow(ctx, `
+		SELECT`+assignmentColumns+`
+		FROM ip_addresses a
+		JOIN ip_subnets s ON s.id = a.subnet_id
+		WHERE a.id = $1
+	`, addressID))
+}
+
+// Release 释放服务持有的全部地址，返回释放数量
+func Release(ctx context.Context, q db.DBTX, serviceID string) (int64, error) {
+	tag, err := q.Exec(ctx, `
+		UPDATE ip_addresses
+		SET status = 'available',
+		    service_id = NULL,
+		    reverse_dns = NULL,
+		    released_at = NOW(),
+		    updated_at = NOW()
+		WHERE service_id = $1 AND status = 'assigned'
+	`, serviceID)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// ServiceAddresses 返回服务当前持有的地址，IPv4 在前
+func ServiceAddresses(ctx context.Context, q db.DBTX, serviceID string) ([]Assignment, error) {
+	rows, err := q.Query(ctx, `
+		SELECT`+assignmentColumns+`
+		FROM ip_addresses a
+		JOIN ip_subnets s ON s.id = a.subnet_id
+		WHERE a.service_id = $1 AND a.status = 'assigned'
+		ORDER BY s.family, a.address
+	`, serviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := make([]Assignment, 0)
+	for rows.Next() {
+		a, err := scanAssignment(rows)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, *a)
+	}
+	return addresses, rows.Err()
+}
@@ -0,0 +1,198 @@
+package ipam
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type Handler struct {
+	pool *pgxpool.Pool
+}
+
+func NewHandler(pool *pgxpool.Pool) *Handler {
+	return &Handler{pool: pool}
+}
+
+// Pool 地址池，包含若干 IPv4/IPv6 子网
+type Pool struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	IsActive    bool      `json:"is_active"`
+	SortOrder   int       `json:"sort_order"`
+	Subnets     []Subnet  `json:"subnets"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Subnet 地址池中的一个网段及其使用情况
+type Subnet struct {
+	ID             string    `json:"id"`
+	PoolID         string    `json:"pool_id"`
+	Family         string    `json:"family"`
+	CIDR           string    `json:"cidr"`
+	PrefixLength   int       `json:"prefix_length"`
+	Netmask        string    `json:"netmask,omitempty"`
+	Gateway        string    `json:"gateway,omitempty"`
+	DNSServers     string    `json:"dns_servers"`
+	TotalAddresses uint64    `json:"total_addresses"`
+	AssignedCount  int64     `json:"assigned_count"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Address 已登记的地址记录
+type Address struct {
+	ID         string     `json:"id"`
+	SubnetID   string     `json:"subnet_id"`
+	Address    string     `json:"address"`
+	Status     string     `json:"status"`
+	ServiceID  *string    `json:"service_id"`
+	Hostname   string     `json:"hostname,omitempty"`
+	ReverseDNS string     `json:"reverse_dns"`
+	AssignedAt *time.Time `json:"assigned_at"`
+	ReleasedAt *time.Time `json:"released_at"`
+}
+
+type CreatePoolRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+	IsActive    *bool  `json:"is_active"`
+	SortOrder   int    `json:"sort_order"`
+}
+
+type UpdatePoolRequest struct {
+	Name        string  `json:"name"`
+	Description *string `json:"description"`
+	IsActive    *bool   `json:"is_active"`
+	SortOrder   *int    `json:"sort_order"`
+}
+
+type CreateSubnetRequest struct {
+	CIDR       string `json:"cidr" binding:"required"`
+	Gateway    string `json:"gateway"`
+	DNSServers string `json:"dns_servers"`
+}
+
+type UpdateAddressRequest struct {
+	ReverseDNS string `json:"reverse_dns" binding:"omitempty,hostname_rfc1123"`
+}
+
+// ListPools - GET /api/v1/admin/ip-pools
+func (h *Handler) ListPools(c *gin.Context) {
+	pools, err := h.listPools(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query ip pools"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"pools": pools})
+}
+
+// GetPool - GET /api/v1/admin/ip-pools/:id
+func (h *Handler) GetPool(c *gin.Context) {
+	pool, err := h.getPool(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, pool)
+}
+
+// CreatePool - POST /api/v1/admin/ip-pools
+func (h *Handler) CreatePool(c *gin.Context) {
+	var req CreatePoolRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := h.createPool(c.Request.Context(), req)
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"id": id})
+}
+
+// UpdatePool - PUT /api/v1/admin/ip-pools/:id
+func (h *Handler) UpdatePool(c *gin.Context) {
+	var req UpdatePoolRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.updatePool(c.Request.Context(), c.Param("id"), req); err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "IP pool updated"})
+}
+
+// DeletePool - DELETE /api/v1/admin/ip-pools/:id
+func (h *Handler) DeletePool(c *gin.Context) {
+	if err := h.deletePool(c.Request.Context(), c.Param("id")); err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "IP pool deleted"})
+}
+
+// CreateSubnet - POST /api/v1/admin/ip-pools/:id/subnets
+func (h *Handler) CreateSubnet(c *gin.Context) {
+	var req CreateSubnetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	subnet, err := h.createSubnet(c.Request.Context(), c.Param("id"), req)
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, subnet)
+}
+
+// DeleteSubnet - DELETE /api/v1/admin/ip-pools/:id/subnets/:subnetId
+func (h *Handler) DeleteSubnet(c *gin.Context) {
+	if err := h.deleteSubnet(c.Request.Context(), c.Param("id"), c.Param("subnetId")); err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Subnet deleted"})
+}
+
+// ListAddresses - GET /api/v1/admin/ip-pools/:id/addresses
+func (h *Handler) ListAddresses(c *gin.Context) {
+	status := c.Query("status")
+	if status != "" && status != "available" && status != "assigned" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status filter"})
+		return
+	}
+
+	addresses, err := h.listAddresses(c.Request.Context(), c.Param("id"), status)
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"addresses": addresses})
+}
+
+// UpdateAddress - PUT /api/v1/admin/ip-pools/:id/addresses/:addressId
+func (h *Handler) UpdateAddress(c *gin.Context) {
+	var req UpdateAddressRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.updateAddress(c.Request.Context(), c.Param("id"), c.Param("addressId"), req); err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Address updated"})
+}
@@ -0,0 +1,16 @@
+package ipam
+
+import "github.com/gin-gonic/gin"
+
+func RegisterRoutes(admin *gin.RouterGroup, h *Handler) {
+	pools := admin.Group("/ip-pools")
+	pools.GET("", h.ListPools)
+	pools.POST("", h.CreatePool)
+	pools.GET("/:id", h.GetPool)
+	pools.PUT("/:id", h.UpdatePool)
+	pools.DELETE("/:id", h.DeletePool)
+	pools.POST("/:id/subnets", h.CreateSubnet)
+	pools.DELETE("/:id/subnets/:subnetId", h.DeleteSubnet)
+	pools.GET("/:id/addresses", h.ListAddresses)
+	pools.PUT("/:id/addresses/:addressId", h.UpdateAddress)
+}
@@ -0,0 +1,300 @@
+package ipam
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/jackc/pgx/v5"
+)
+
+func (h *Handler) listPools(ctx context.Context) ([]Pool, error) {
+	rows, err := h.pool.Query(ctx, `
+		SELECT id, name, COALESCE(description, ''), is_active, sort_order, created_at, updated_at
+		FROM ip_pools
+		ORDER BY sort_order, name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pools := make([]Pool, 0)
+	index := make(map[string]int)
+	for rows.Next() {
+		var p Pool
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.IsActive, &p.SortOrder, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		p.Subnets = make([]Subnet, 0)
+		index[p.ID] = len(pools)
+		pools = append(pools, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	subnets, err := h.listSubnets(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range subnets {
+		if i, ok := index[s.PoolID]; ok {
+			pools[i].Subnets = append(pools[i].Subnets, s)
+		}
+	}
+
+	return pools, nil
+}
+
+// listSubnets 查询子网及已分配数量，poolID 为空时返回全部
+func (h *Handler) listSubnets(ctx context.Context, poolID string) ([]Subnet, error) {
+	rows, err := h.pool.Query(ctx, `
+		SELECT s.id, s.pool_id, s.family::text, s.cidr::text, COALESCE(host(s.gateway), ''), s.dns_servers,
+		       (SELECT COUNT(*) FROM ip_addresses a WHERE a.subnet_id = s.id AND a.status = 'assigned'),
+		       s.created_at
+		FROM ip_subnets s
+		WHERE $1 = '' OR s.pool_id::text = $1
+		ORDER BY s.family, s.created_at
+	`, poolID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subnets := make([]Subnet, 0)
+	for rows.Next() {
+		var s Subnet
+		if err := rows.Scan(&s.ID, &s.PoolID, &s.Family, &s.CIDR, &s.Gateway, &s.DNSServers,
+			&s.AssignedCount, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		fillSubnetInfo(&s)
+		subnets = append(subnets, s)
+	}
+	return subnets, rows.Err()
+}
+
+func fillSubnetInfo(s *Subnet) {
+	prefix, err := netip.ParsePrefix(s.CIDR)
+	if err != nil {
+		return
+	}
+	s.PrefixLength = prefix.Bits()
+	s.Netmask = netmask(prefix)
+	s.TotalAddresses = hostCount(prefix)
+	if s.Gateway != "" {
+		s.TotalAddresses--
+	}
+}
+
+func (h *Handler) getPool(ctx context.Context, id string) (*Pool, *common.ServiceError) {
+	var p Pool
+	err := h.pool.QueryRow(ctx, `
+		SELECT id, name, COALESCE(description, ''), is_active, sort_order, created_at, updated_at
+		FROM ip_pools
+		WHERE id = $1
+	`, id).Scan(&p.ID, &p.Name, &p.Description, &p.IsActive, &p.SortOrder, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, common.ErrNotFound("IP pool not found", err)
+		}
+		return nil, common.ErrInternal("Failed to query ip pool", err)
+	}
+
+	subnets, err := h.listSubnets(ctx, p.ID)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to query subnets", err)
+	}
+	p.Subnets = subnets
+
+	return &p, nil
+}
+
+func (h *Handler) createPool(ctx context.Context, req CreatePoolRequest) (string, *common.ServiceError) {
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+
+	var id string
+	err := h.pool.QueryRow(ctx, `
+		INSERT INTO ip_pools (name, description, is_active, sort_order)
+		VALUES ($1, NULLIF($2, ''), $3, $4)
+		RETURNING id
+	`, strings.TrimSpace(req.Name), req.Description, isActive, req.SortOrder).Scan(&id)
+	if err != nil {
+		return "", common.ErrInternal("Failed to create ip pool", err)
+	}
+	return id, nil
+}
+
+func (h *Handler) updatePool(ctx context.Context, id string, req UpdatePoolRequest) *common.ServiceError {
+	tag, err := h.pool.Exec(ctx, `
+		UPDATE ip_pools
+		SET name = COALESCE(NULLIF($2, ''), name),
+		    description = CASE WHEN $3::text IS NULL THEN description ELSE NULLIF($3::text, '') END,
+		    is_active = COALESCE($4, is_active),
+		    sort_order = COALESCE($5, sort_order),
+		    updated_at = NOW()
+		WHERE id = $1
+	`, id, strings.TrimSpace(req.Name), req.Description, req.IsActive, req.SortOrder)
+	if err != nil {
+		return common.ErrInternal("Failed to update ip pool", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return common.ErrNotFound("IP pool not found", nil)
+	}
+	return nil
+}
+
+func (h *Handler) deletePool(ctx context.Context, id string) *common.ServiceError {
+	var assigned int64
+	if err := h.pool.QueryRow(ctx, `
+		SELECT COUNT(*)
+		FROM ip_addresses a
+		JOIN ip_subnets s ON s.id = a.subnet_id
+		WHERE s.pool_id = $1 AND a.status = 'assigned'
+	`, id).Scan(&assigned); err != nil {
+		return common.ErrInternal("Failed to query ip pool usage", err)
+	}
+	if assigned > 0 {
+		return common.NewServiceError(http.StatusConflict, "IP pool still has assigned addresses", nil)
+	}
+
+	tag, err := h.pool.Exec(ctx, `DELETE FROM ip_pools WHERE id = $1`, id)
+	if err != nil {
+		return common.ErrInternal("Failed to delete ip pool", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return common.ErrNotFound("IP pool not found", nil)
+	}
+	return nil
+}
+
+func (h *Handler) createSubnet(ctx context.Context, poolID string, req CreateSubnetRequest) (*Subnet, *common.ServiceError) {
+	prefix, gateway, family, err := parseSubnet(req.CIDR, req.Gateway)
+	if err != nil {
+		return nil, common.ErrBadRequest(err.Error(), err)
+	}
+
+	var exists bool
+	if err := h.pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM ip_pools WHERE id = $1)`, poolID).Scan(&exists); err != nil {
+		return nil, common.ErrInternal("Failed to query ip pool", err)
+	}
+	if !exists {
+		return nil, common.ErrNotFound("IP pool not found", nil)
+	}
+
+	var overlapping string
+	err = h.pool.QueryRow(ctx, `
+		SELECT cidr::text
+		FROM ip_subnets
+		WHERE cidr && $1::cidr
+		LIMIT 1
+	`, prefix.String()).Scan(&overlapping)
+	if err == nil {
+		return nil, common.NewServiceError(http.StatusConflict, "Subnet overlaps with existing subnet "+overlapping, nil)
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, common.ErrInternal("Failed to check subnet overlap", err)
+	}
+
+	gatewayText := ""
+	if gateway.IsValid() {
+		gatewayText = gateway.String()
+	}
+
+	s := Subnet{
+		PoolID:     poolID,
+		Family:     family,
+		CIDR:       prefix.String(),
+		Gateway:    gatewayText,
+		DNSServers: strings.TrimSpace(req.DNSServers),
+	}
+	err = h.pool.QueryRow(ctx, `
+		INSERT INTO ip_subnets (pool_id, family, cidr, gateway, dns_servers)
+		VALUES ($1, $2::ip_family, $3::cidr, NULLIF($4, '')::inet, $5)
+		RETURNING id, created_at
+	`, poolID, family, s.CIDR, gatewayText, s.DNSServers).Scan(&s.ID, &s.CreatedAt)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to create subnet", err)
+	}
+	fillSubnetInfo(&s)
+
+	return &s, nil
+}
+
+func (h *Handler) deleteSubnet(ctx context.Context, poolID, subnetID string) *common.ServiceError {
+	var assigned int64
+	if err := h.pool.QueryRow(ctx, `
+		SELECT COUNT(*)
+		FROM ip_addresses
+		WHERE subnet_id = $1 AND status = 'assigned'
+	`, subnetID).Scan(&assigned); err != nil {
+		return common.ErrInternal("Failed to query subnet usage", err)
+	}
+	if assigned > 0 {
+		return common.NewServiceError(http.StatusConflict, "Subnet still has assigned addresses", nil)
+	}
+
+	tag, err := h.pool.Exec(ctx, `DELETE FROM ip_subnets WHERE id = $1 AND pool_id = $2`, subnetID, poolID)
+	if err != nil {
+		return common.ErrInternal("Failed to delete subnet", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return common.ErrNotFound("Subnet not found", nil)
+	}
+	return nil
+}
+
+func (h *Handler) listAddresses(ctx context.Context, poolID, status string) ([]Address, *common.ServiceError) {
+	rows, err := h.pool.Query(ctx, `
+		SELECT a.id, a.subnet_id, host(a.address), a.status::text, a.service_id::text,
+		       COALESCE(sv.hostname, ''), COALESCE(a.reverse_dns, ''), a.assigned_at, a.released_at
+		FROM ip_addresses a
+		JOIN ip_subnets s ON s.id = a.subnet_id
+		LEFT JOIN services sv ON sv.id = a.service_id
+		WHERE s.pool_id = $1
+		  AND ($2 = '' OR a.status::text = $2)
+		ORDER BY s.family, a.address
+	`, poolID, status)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to query addresses", err)
+	}
+	defer rows.Close()
+
+	addresses := make([]Address, 0)
+	for rows.Next() {
+		var a Address
+		if err := rows.Scan(&a.ID, &a.SubnetID, &a.Address, &a.Status, &a.ServiceID,
+			&a.Hostname, &a.ReverseDNS, &a.AssignedAt, &a.ReleasedAt); err != nil {
+			return nil, common.ErrInternal("Failed to read address", err)
+		}
+		addresses = append(addresses, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, common.ErrInternal("Failed to query addresses", err)
+	}
+	return addresses, nil
+}
+
+func (h *Handler) updateAddress(ctx context.Context, poolID, addressID string, req UpdateAddressRequest) *common.ServiceError {
+	tag, err := h.pool.Exec(ctx, `
+		UPDATE ip_addresses a
+		SET reverse_dns = NULLIF($3, ''),
+		    updated_at = NOW()
+		FROM ip_subnets s
+		WHERE a.id = $2 AND s.id = a.subnet_id AND s.pool_id = $1
+	`, poolID, addressID, strings.TrimSpace(req.ReverseDNS))
+	if err != nil {
+		return common.ErrInternal("Failed to update address", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return common.ErrNotFound("Address not found", nil)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package numbering
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/app"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// SeriesInvoice 发票编号序列
+	SeriesInvoice = "invoice"
+	// SeriesCreditNote 贷项通知单编号序列
+	SeriesCreditNote = "credit_note"
+)
+
+const (
+	defaultPrefix  = "INV"
+	defaultPattern = "{PREFIX}-{YYYY}-{SEQ:6}"
+)
+
+// 未配置前缀时各序列使用的默认前缀
+var defaultPrefixes = map[string]string{
+	SeriesCreditNote: "CN",
+}
+
+// Series 所有编号序列
+var Series = []string{SeriesInvoice, SeriesCreditNote}
+
+// ErrInvalidPattern 编号模板无法在计数器重置后保证编号唯一
+var ErrInvalidPattern = errors.New("invalid number pattern")
+
+var seqToken = regexp.MustCompile(`\{SEQ(?::(\d{1,2}))?\}`)
+
+// Querier 分配编号所需的数据库操作，pgx.Tx 满足该接口
+type Querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Next 在调用方事务中为序列分配下一个编号。计数器行在事务提交前保持锁定，
+// 事务回滚时计数一并回滚，因此并发开票也不会产生空号。
+//
+// 编号格式取自系统设置 <series>_number_prefix / _pattern / _reset，
+// reset 为 yearly（默认）、monthly 或 never。模板不能保证唯一时返回 ErrInvalidPattern。
+func Next(ctx context.Context, tx Querier, store *app.SettingsStore, series string, now time.Time) (string, error) {
+	get := func(string) string { return "" }
+	if store != nil {
+		get = store.Get
+	}
+	prefix, pattern, reset := settings(series, get)
+	if err := ValidatePattern(pattern, reset); err != nil {
+		return "", fmt.Errorf("%s number: %w", series, err)
+	}
+
+	now = now.UTC()
+	var seq int64
+	err := tx.QueryRow(ctx,
+		`INSERT INTO number_sequences (series, period, last_value, updated_at)
+		 VALUES ($1, $2, 1, NOW())
+		 ON CONFLICT (series, period)
+		 DO UPDATE SET last_value = number_sequences.last_value + 1, updated_at = NOW()
+		 RETURNING last_value`,
+		series, Period(reset, now),
+	).Scan(&seq)
+	if err != nil {
+		return "", fmt.Errorf("allocate %s number: %w", series, err)
+	}
+
+	return Format(pattern, prefix, seq, now), nil
+}
+
+// ValidateSettings 校验序列的编号设置，get 按键返回设置值（空值表示使用默认值）。
+// 用于保存设置前检查即将生效的组合
+func ValidateSettings(series string, get func(key string) string) error {
+	_, pattern, reset := settings(series, get)
+	return ValidatePattern(pattern, reset)
+}
+
+// ValidatePattern 检查模板在计数器重置后不会生成重复编号：必须包含 {SEQ}，
+// 按年重置时必须包含年份，按月重置时必须同时包含年份和月份
+func ValidatePattern(pattern, reset string) error {
+	if !seqToken.MatchString(pattern) {
+		return fmt.Errorf("%w: pattern must contain {SEQ}", ErrInvalidPattern)
+	}
+	hasYear := strings.Contains(pattern, "{YYYY}") || strings.Contains(pattern, "{YY}")
+	switch reset {
+	case "never":
+	case "yearly":
+		if !hasYear {
+			return fmt.Errorf("%w: a yearly reset requires {YYYY} or {YY} in the pattern", ErrInvalidPattern)
+		}
+	case "monthly":
+		if !hasYear || !strings.Contains(pattern, "{MM}") {
+			return fmt.Errorf("%w: a monthly reset requires {YYYY} or {YY} and {MM} in the pattern", ErrInvalidPattern)
+		}
+	default:
+		return fmt.Errorf("%w: unknown reset %q", ErrInvalidPattern, reset)
+	}
+	return nil
+}
+
+// settings 返回序列实际生效的前缀、模板和重置周期
+func settings(series string, get func(key string) string) (prefix, pattern, reset string) {
+	prefix, pattern, reset = defaultPrefix, defaultPattern, "yearly"
+	if p, ok := defaultPrefixes[series]; ok {
+		prefix = p
+	}
+	if v := get(series + "_number_prefix"); v != "" {
+		prefix = v
+	}
+	if v := get(series + "_number_pattern"); v != "" {
+		pattern = v
+	}
+	if v := get(series + "_number_reset"); v != "" {
+		reset = v
+	}
+	return prefix, pattern, reset
+}
+
+// Period 返回计数器所属周期，同一周期内编号连续递增
+func Period(reset string, now time.Time) string {
+	switch reset {
+	case "never":
+		return ""
+	case "monthly":
+		return now.Format("2006-01")
+	default:
+		return now.Format("2006")
+	}
+}
+
+// Format 按模板生成编号，支持 {PREFIX} {YYYY} {YY} {MM} {DD} {SEQ} {SEQ:n}（n 位补零）
+func Format(pattern, prefix string, seq int64, now time.Time) string {
+	out := strings.NewReplacer(
+		"{PREFIX}", prefix,
+		"{YYYY}", now.Format("2006"),
+		"{YY}", now.Format("06"),
+		"{MM}", now.Format("01"),
+		"{DD}", now.Format("02"),
+	).Replace(pattern)
+
+	return seqToken.ReplaceAllStringFunc(out, func(token string) string {
+		width := 0
+		if m := seqToken.FindStringSubmatch(token); m[1] != "" {
+			width, _ = strconv.Atoi(m[1])
+		}
+		return fmt.Sprintf("%0*d", width, seq)
+	})
+}
@@ -0,0 +1,127 @@
+package numbering
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/app"
+	"github.com/jackc/pgx/v5"
+)
+
+func TestFormat(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 3, 7, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		pattern string
+		prefix  string
+		seq     int64
+		want    string
+	}{
+		{defaultPattern, "INV", 42, "INV-2026-000042"},
+		{"{PREFIX}{YY}{MM}/{SEQ}", "RE", 7, "RE2603/7"},
+		{"{YYYY}-{MM}-{DD}-{SEQ:3}", "", 1234, "2026-03-07-1234"},
+	}
+	for _, tt := range tests {
+		if got := Format(tt.pattern, tt.prefix, tt.seq, now); got != tt.want {
+			t.Fatalf("Format(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestPeriod(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 12, 31, 23, 0, 0, 0, time.UTC)
+	if got := Period("yearly", now); got != "2026" {
+		t.Fatalf("yearly period = %q", got)
+	}
+	if got := Period("monthly", now); got != "2026-12" {
+		t.Fatalf("monthly period = %q", got)
+	}
+	if got := Period("never", now); got != "" {
+		t.Fatalf("never period = %q", got)
+	}
+}
+
+// fakeCounter 模拟 number_sequences 的 upsert，按 (series, period) 计数
+type fakeCounter map[string]int64
+
+type fakeRow struct {
+	value int64
+}
+
+func (r fakeRow) Scan(dest ...any) error {
+	*dest[0].(*int64) = r.value
+	return nil
+}
+
+func (c fakeCounter) QueryRow(_ context.Context, _ string, args ...any) pgx.Row {
+	key := args[0].(string) + "/" + args[1].(string)
+	c[key]++
+	return fakeRow{value: c[key]}
+}
+
+func TestNext(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	march := time.Date(2026, 3, 7, 12, 0, 0, 0, time.UTC)
+	april := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+	nextYear := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		settings map[string]string
+		series   string
+		at       []time.Time
+		want     []string
+	}{
+		{"defaults reset yearly", nil, SeriesInvoice,
+			[]time.Time{march, april, nextYear}, []string{"INV-2026-000001", "INV-2026-000002", "INV-2027-000001"}},
+		{"credit note prefix", nil, SeriesCreditNote,
+			[]time.Time{march}, []string{"CN-2026-000001"}},
+		{"monthly reset", map[string]string{"invoice_number_pattern": "{YY}{MM}-{SEQ:3}", "invoice_number_reset": "monthly"}, SeriesInvoice,
+			[]time.Time{march, march, april}, []string{"2603-001", "2603-002", "2604-001"}},
+		{"never reset", map[string]string{"invoice_number_pattern": "{PREFIX}{SEQ}", "invoice_number_reset": "never"}, SeriesInvoice,
+			[]time.Time{march, nextYear}, []string{"INV1", "INV2"}},
+	}
+	for _, tt := range tests {
+		store := app.NewSettingsStore(nil, tt.settings)
+		counter := fakeCounter{}
+		for i, at := range tt.at {
+			got, err := Next(ctx, counter, store, tt.series, at)
+			if err != nil {
+				t.Fatalf("%s: Next returned error: %v", tt.name, err)
+			}
+			if got != tt.want[i] {
+				t.Fatalf("%s: number %d = %q, want %q", tt.name, i, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestNextRejectsPatternsThatRepeat(t *testing.T) {
+	t.Parallel()
+
+	invalid := []map[string]string{
+		{"invoice_number_pattern": "{PREFIX}-{YYYY}"},
+		{"invoice_number_pattern": "{PREFIX}-{SEQ:6}"},
+		{"invoice_number_pattern": "{PREFIX}-{MM}-{SEQ}", "invoice_number_reset": "yearly"},
+		// 默认模板不含月份，按月重置会在次月重复
+		{"invoice_number_reset": "monthly"},
+		{"invoice_number_pattern": "{YYYY}-{SEQ}", "invoice_number_reset": "weekly"},
+	}
+	for _, settings := range invalid {
+		counter := fakeCounter{}
+		_, err := Next(context.Background(), counter, app.NewSettingsStore(nil, settings), SeriesInvoice, time.Now())
+		if !errors.Is(err, ErrInvalidPattern) {
+			t.Fatalf("Next with %v: err = %v, want ErrInvalidPattern", settings, err)
+		}
+		if len(counter) != 0 {
+			t.Fatalf("Next with %v should not allocate a number", settings)
+		}
+	}
+}
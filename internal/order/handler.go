@@ -7,7 +7,11 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/adiecho/echobilling/internal/app"
 	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/coupon"
+	"github.com/adiecho/echobilling/internal/credit"
+	"github.com/adiecho/echobilling/internal/tax"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
@@ -54,27 +58,35 @@ func buildPlanSnapshot(p *planFields) (json.RawMessage, error) {
 
 // Handler 订单处理器
 type Handler struct {
-	pool *pgxpool.Pool
+	pool  *pgxpool.Pool
+	store *app.SettingsStore
 }
 
 // NewHandler 创建新的订单处理器
-func NewHandler(pool *pgxpool.Pool) *Handler {
+func NewHandler(pool *pgxpool.Pool, store *app.SettingsStore) *Handler {
 	return &Handler{
-		pool: pool,
+		pool:  pool,
+		store: store,
 	}
 }
 
 // Order 订单
 type Order struct {
-	ID          string      `json:"id"`
-	UserID      string      `json:"user_id"`
-	Status      string      `json:"status"`
-	TotalAmount string      `json:"total_amount"`
-	Currency    string      `json:"currency"`
-	Notes       *string     `json:"notes"`
-	Items       []OrderItem `json:"items,omitempty"`
-	CreatedAt   time.Time   `json:"created_at"`
-	UpdatedAt   time.Time   `json:"updated_at"`
+	ID             string        `json:"id"`
+	UserID         string        `json:"user_id"`
+	Status         string        `json:"status"`
+	Subtotal       string        `json:"subtotal"`
+	TaxAmount      string        `json:"tax_amount"`
+	TotalAmount    string        `json:"total_amount"`
+	Currency       string        `json:"currency"`
+	Tax            *tax.Decision `json:"tax,omitempty"`
+	SetupFeeWaived bool          `json:"setup_fee_waived"`
+	CouponCode     *string       `json:"coupon_code"`
+	DiscountAmount string        `json:"discount_amount"`
+	Notes          *string       `json:"notes"`
+	Items          []OrderItem   `json:"items,omitempty"`
+	CreatedAt      time.Time     `json:"created_at"`
+	UpdatedAt      time.Time     `json:"updated_at"`
 }
 
 // OrderItem 订单项
@@ -85,6 +97,8 @@ type OrderItem struct {
 	PlanSnapshot json.RawMessage `json:"plan_snapshot"`
 	Quantity     int             `json:"quantity"`
 	UnitPrice    string          `json:"unit_price"`
+	SetupFee     string          `json:"setup_fee"`
+	UnitDiscount string          `json:"unit_discount"`
 	BillingCycle string          `json:"billing_cycle"`
 	CreatedAt    time.Time       `json:"created_at"`
 }
@@ -123,6 +137,16 @@ type UpdateCartItemRequest struct {
 	Quantity int `json:"quantity" binding:"required,min=1"`
 }
 
+// WaiveSetupFeeRequest 免除或恢复订单开通费请求
+type WaiveSetupFeeRequest struct {
+	Waived *bool `json:"waived" binding:"required"`
+}
+
+// ApplyCouponRequest 购物车使用优惠码请求
+type ApplyCouponRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
 // UpdateOrderStatusRequest 更新订单状态请求
 type UpdateOrderStatusRequest struct {
 	Status string `json:"status" binding:"required"`
@@ -228,9 +252,9 @@ func (h *Handler) AddCartItem(c *gin.Context) {
 	case err == nil:
 		_, err = tx.Exec(ctx,
 			`UPDATE order_items
-			 SET quantity = quantity + $2, unit_price = $3
+			 SET quantity = quantity + $2, unit_price = $3, setup_fee = $4
 			 WHERE id = $1`,
-			existingItemID, req.Quantity, unitPrice,
+			existingItemID, req.Quantity, unitPrice, plan.SetupFee,
 		)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart item"})
@@ -238,9 +262,9 @@ func (h *Handler) AddCartItem(c *gin.Context) {
 		}
 	case errors.Is(err, pgx.ErrNoRows):
 		_, err = tx.Exec(ctx,
-			`INSERT INTO order_items (id, order_id, plan_id, plan_snapshot, quantity, unit_price, billing_cycle, created_at)
-			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
-			uuid.New().String(), orderID, req.PlanID, snapshotJSON, req.Quantity, unitPrice, req.BillingCycle, now,
+			`INSERT INTO order_items (id, order_id, plan_id, plan_snapshot, quantity, unit_price, setup_fee, billing_cycle, created_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			uuid.New().String(), orderID, req.PlanID, snapshotJSON, req.Quantity, unitPrice, plan.SetupFee, req.BillingCycle, now,
 		)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add cart item"})
@@ -251,25 +275,7 @@ func (h *Handler) AddCartItem(c *gin.Context) {
 		return
 	}
 
-	var totalAmount string
-	err = tx.QueryRow(ctx,
-		`SELECT COALESCE(SUM(quantity * unit_price), 0)::text
-		 FROM order_items
-		 WHERE order_id = $1`,
-		orderID,
-	).Scan(&totalAmount)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate cart total"})
-		return
-	}
-
-	_, err = tx.Exec(ctx,
-		`UPDATE orders
-		 SET total_amount = $2, updated_at = $3
-		 WHERE id = $1`,
-		orderID, totalAmount, now,
-	)
-	if err != nil {
+	if _, err := RecalculateTotals(ctx, tx, h.store, orderID, now); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart total"})
 		return
 	}
@@ -288,6 +294,8 @@ func (h *Handler) AddCartItem(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"status":       "draft",
 			"currency":     "USD",
+			"subtotal":     "0.00",
+			"tax_amount":   "0.00",
 			"total_amount": "0.00",
 			"items":        []OrderItem{},
 		})
@@ -340,16 +348,8 @@ func (h *Handler) RemoveCartItem(c *gin.Context) {
 		return
 	}
 
-	// 重新计算订单总额
-	now := time.Now()
-	_, err = tx.Exec(ctx,
-		`UPDATE orders
-		 SET total_amount = (SELECT COALESCE(SUM(quantity * unit_price), 0) FROM order_items WHERE order_id = $1),
-		     updated_at = $2
-		 WHERE id = $1`,
-		orderID, now,
-	)
-	if err != nil {
+	// 重新计算订单总额和税费
+	if _, err := RecalculateTotals(ctx, tx, h.store, orderID, time.Now()); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart total"})
 		return
 	}
@@ -414,16 +414,8 @@ func (h *Handler) UpdateCartItem(c *gin.Context) {
 		return
 	}
 
-	// 重新计算订单总额
-	now := time.Now()
-	_, err = tx.Exec(ctx,
-		`UPDATE orders
-		 SET total_amount = (SELECT COALESCE(SUM(quantity * unit_price), 0) FROM order_items WHERE order_id = $1),
-		     updated_at = $2
-		 WHERE id = $1`,
-		orderID, now,
-	)
-	if err != nil {
+	// 重新计算订单总额和税费
+	if _, err := RecalculateTotals(ctx, tx, h.store, orderID, time.Now()); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart total"})
 		return
 	}
@@ -442,6 +434,8 @@ func (h *Handler) UpdateCartItem(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"status":       "draft",
 			"currency":     "USD",
+			"subtotal":     "0.00",
+			"tax_amount":   "0.00",
 			"total_amount": "0.00",
 			"items":        []OrderItem{},
 		})
@@ -469,6 +463,8 @@ func (h *Handler) GetCart(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"status":       "draft",
 			"currency":     "USD",
+			"subtotal":     "0.00",
+			"tax_amount":   "0.00",
 			"total_amount": "0.00",
 			"items":        []OrderItem{},
 		})
@@ -478,6 +474,127 @@ func (h *Handler) GetCart(c *gin.Context) {
 	c.JSON(http.StatusOK, cart)
 }
 
+// ApplyCoupon 为购物车使用优惠码，同一订单只能使用一张优惠券，再次使用会替换
+func (h *Handler) ApplyCoupon(c *gin.Context) {
+	var req ApplyCouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	userID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now()
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	orderID, err := h.getDraftOrderID(ctx, tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
+	}
+	if orderID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cart is empty"})
+		return
+	}
+
+	applied, err := coupon.GetByCode(ctx, tx, req.Code)
+	if err == nil {
+		err = coupon.CheckRedeemable(ctx, tx, applied, userID, now)
+	}
+	if err != nil {
+		writeCouponError(c, err)
+		return
+	}
+
+	if _, err := tx.Exec(ctx,
+		`UPDATE orders SET coupon_id = $2 WHERE id = $1`,
+		orderID, applied.ID,
+	); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply coupon"})
+		return
+	}
+
+	totals, err := RecalculateTotals(ctx, tx, h.store, orderID, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart total"})
+		return
+	}
+	if totals.Discount == 0 {
+		writeCouponError(c, coupon.ErrNotApplicable)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	cart, err := h.getDraftCart(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
+	}
+	c.JSON(http.StatusOK, cart)
+}
+
+// RemoveCoupon 移除购物车上的优惠码
+func (h *Handler) RemoveCoupon(c *gin.Context) {
+	userID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	orderID, err := h.getDraftOrderID(ctx, tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
+	}
+	if orderID == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+		return
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE orders SET coupon_id = NULL WHERE id = $1`, orderID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove coupon"})
+		return
+	}
+	if _, err := RecalculateTotals(ctx, tx, h.store, orderID, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart total"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	cart, err := h.getDraftCart(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
+	}
+	c.JSON(http.StatusOK, cart)
+}
+
 // CreateOrder 创建订单
 func (h *Handler) CreateOrder(c *gin.Context) {
 	var req CreateOrderRequest
@@ -583,9 +700,10 @@ func (h *Handler) CreateOrder(c *gin.Context) {
 	err = tx.QueryRow(ctx,
 		`INSERT INTO orders (id, user_id, status, total_amount, currency, notes, created_at, updated_at)
 		 VALUES ($1, $2, $3, 0, $4, $5, $6, $6)
-		 RETURNING id, user_id, status, total_amount, currency, notes, created_at, updated_at`,
+		 RETURNING id, user_id, status, subtotal, tax_amount, total_amount, currency, tax_details, setup_fee_waived, discount_amount,
+		        (SELECT code FROM coupons WHERE coupons.id = orders.coupon_id), notes, created_at, updated_at`,
 		orderID, userID, "draft", "USD", req.Notes, now,
-	).Scan(&order.ID, &order.UserID, &order.Status, &order.TotalAmount, &order.Currency, &order.Notes, &order.CreatedAt, &order.UpdatedAt)
+	).Scan(&order.ID, &order.UserID, &order.Status, &order.Subtotal, &order.TaxAmount, &order.TotalAmount, &order.Currency, &order.Tax, &order.SetupFeeWaived, &order.DiscountAmount, &order.CouponCode, &order.Notes, &order.CreatedAt, &order.UpdatedAt)
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
@@ -605,11 +723,11 @@ func (h *Handler) CreateOrder(c *gin.Context) {
 		var item OrderItem
 
 		err = tx.QueryRow(ctx,
-			`INSERT INTO order_items (id, order_id, plan_id, plan_snapshot, quantity, unit_price, billing_cycle, created_at)
-			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-			 RETURNING id, order_id, plan_id, plan_snapshot, quantity, unit_price, billing_cycle, created_at`,
-			itemID, orderID, plan.ID, snapshotJSON, plan.Quantity, plan.UnitPrice, plan.BillingCycle, now,
-		).Scan(&item.ID, &item.OrderID, &item.PlanID, &item.PlanSnapshot, &item.Quantity, &item.UnitPrice, &item.BillingCycle, &item.CreatedAt)
+			`INSERT INTO order_items (id, order_id, plan_id, plan_snapshot, quantity, unit_price, setup_fee, billing_cycle, created_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			 RETURNING id, order_id, plan_id, plan_snapshot, quantity, unit_price, setup_fee, unit_discount, billing_cycle, created_at`,
+			itemID, orderID, plan.ID, snapshotJSON, plan.Quantity, plan.UnitPrice, plan.SetupFee, plan.BillingCycle, now,
+		).Scan(&item.ID, &item.OrderID, &item.PlanID, &item.PlanSnapshot, &item.Quantity, &item.UnitPrice, &item.SetupFee, &item.UnitDiscount, &item.BillingCycle, &item.CreatedAt)
 
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order item"})
@@ -619,19 +737,17 @@ func (h *Handler) CreateOrder(c *gin.Context) {
 		order.Items = append(order.Items, item)
 	}
 
-	// 使用数据库端 SUM 计算总金额，避免浮点精度问题
-	err = tx.QueryRow(ctx,
-		`UPDATE orders
-		 SET total_amount = (SELECT COALESCE(SUM(quantity * unit_price), 0) FROM order_items WHERE order_id = $1),
-		     updated_at = $2
-		 WHERE id = $1
-		 RETURNING total_amount`,
-		orderID, now,
-	).Scan(&order.TotalAmount)
+	// 汇总金额并计税
+	totals, err := RecalculateTotals(ctx, tx, h.store, orderID, now)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate order total"})
 		return
 	}
+	order.Subtotal = common.CentsToDecimal(totals.Subtotal)
+	order.DiscountAmount = common.CentsToDecimal(totals.Discount)
+	order.TaxAmount = common.CentsToDecimal(totals.Tax.Tax)
+	order.TotalAmount = common.CentsToDecimal(totals.Tax.Total)
+	order.Tax = &totals.Tax.Decision
 
 	// 提交事务
 	if err := tx.Commit(ctx); err != nil {
@@ -676,7 +792,8 @@ func (h *Handler) ListOrders(c *gin.Context) {
 
 	// 查询订单
 	rows, err := h.pool.Query(ctx,
-		`SELECT id, user_id, status, total_amount, currency, notes, created_at, updated_at
+		`SELECT id, user_id, status, subtotal, tax_amount, total_amount, currency, tax_details, setup_fee_waived, discount_amount,
+		        (SELECT code FROM coupons WHERE coupons.id = orders.coupon_id), notes, created_at, updated_at
 		 FROM orders
 		 WHERE user_id = $1
 		 ORDER BY created_at DESC
@@ -692,7 +809,7 @@ func (h *Handler) ListOrders(c *gin.Context) {
 	orders := make([]Order, 0)
 	for rows.Next() {
 		var order Order
-		err := rows.Scan(&order.ID, &order.UserID, &order.Status, &order.TotalAmount, &order.Currency, &order.Notes, &order.CreatedAt, &order.UpdatedAt)
+		err := rows.Scan(&order.ID, &order.UserID, &order.Status, &order.Subtotal, &order.TaxAmount, &order.TotalAmount, &order.Currency, &order.Tax, &order.SetupFeeWaived, &order.DiscountAmount, &order.CouponCode, &order.Notes, &order.CreatedAt, &order.UpdatedAt)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan order"})
 			return
@@ -728,11 +845,12 @@ func (h *Handler) GetOrder(c *gin.Context) {
 	// 查询订单并验证所有权
 	var order Order
 	err := h.pool.QueryRow(ctx,
-		`SELECT id, user_id, status, total_amount, currency, notes, created_at, updated_at
+		`SELECT id, user_id, status, subtotal, tax_amount, total_amount, currency, tax_details, setup_fee_waived, discount_amount,
+		        (SELECT code FROM coupons WHERE coupons.id = orders.coupon_id), notes, created_at, updated_at
 		 FROM orders
 		 WHERE id = $1 AND user_id = $2`,
 		orderID, userID,
-	).Scan(&order.ID, &order.UserID, &order.Status, &order.TotalAmount, &order.Currency, &order.Notes, &order.CreatedAt, &order.UpdatedAt)
+	).Scan(&order.ID, &order.UserID, &order.Status, &order.Subtotal, &order.TaxAmount, &order.TotalAmount, &order.Currency, &order.Tax, &order.SetupFeeWaived, &order.DiscountAmount, &order.CouponCode, &order.Notes, &order.CreatedAt, &order.UpdatedAt)
 
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -745,7 +863,7 @@ func (h *Handler) GetOrder(c *gin.Context) {
 
 	// 查询订单项
 	rows, err := h.pool.Query(ctx,
-		`SELECT id, order_id, plan_id, plan_snapshot, quantity, unit_price, billing_cycle, created_at
+		`SELECT id, order_id, plan_id, plan_snapshot, quantity, unit_price, setup_fee, unit_discount, billing_cycle, created_at
 		 FROM order_items
 		 WHERE order_id = $1`,
 		orderID,
@@ -759,7 +877,7 @@ func (h *Handler) GetOrder(c *gin.Context) {
 	order.Items = make([]OrderItem, 0)
 	for rows.Next() {
 		var item OrderItem
-		err := rows.Scan(&item.ID, &item.OrderID, &item.PlanID, &item.PlanSnapshot, &item.Quantity, &item.UnitPrice, &item.BillingCycle, &item.CreatedAt)
+		err := rows.Scan(&item.ID, &item.OrderID, &item.PlanID, &item.PlanSnapshot, &item.Quantity, &item.UnitPrice, &item.SetupFee, &item.UnitDiscount, &item.BillingCycle, &item.CreatedAt)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan order item"})
 			return
@@ -887,21 +1005,116 @@ func (h *Handler) AdminUpdateOrderStatus(c *gin.Context) {
 		return
 	}
 
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
 	// 更新订单状态
 	now := time.Now()
 	var order Order
-	err = h.pool.QueryRow(ctx,
+	err = tx.QueryRow(ctx,
 		`UPDATE orders
 		 SET status = $1, updated_at = $2
 		 WHERE id = $3
-		 RETURNING id, user_id, status, total_amount, currency, notes, created_at, updated_at`,
+		 RETURNING id, user_id, status, subtotal, tax_amount, total_amount, currency, tax_details, setup_fee_waived, discount_amount,
+		        (SELECT code FROM coupons WHERE coupons.id = orders.coupon_id), notes, created_at, updated_at`,
 		req.Status, now, orderID,
-	).Scan(&order.ID, &order.UserID, &order.Status, &order.TotalAmount, &order.Currency, &order.Notes, &order.CreatedAt, &order.UpdatedAt)
+	).Scan(&order.ID, &order.UserID, &order.Status, &order.Subtotal, &order.TaxAmount, &order.TotalAmount, &order.Currency, &order.Tax, &order.SetupFeeWaived, &order.DiscountAmount, &order.CouponCode, &order.Notes, &order.CreatedAt, &order.UpdatedAt)
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order status"})
 		return
 	}
 
+	// 未支付的订单取消后，退回结账时占用的账户余额
+	if req.Status == "cancelled" && (currentStatus == "draft" || currentStatus == "pending_payment") {
+		if err := credit.ReleaseOrder(ctx, tx, order.UserID, orderID, now); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release account credit"})
+			return
+		}
+		if _, err := tx.Exec(ctx, `UPDATE orders SET credit_applied = 0 WHERE id = $1`, orderID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release account credit"})
+			return
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
 	c.JSON(http.StatusOK, order)
 }
+
+// AdminWaiveSetupFee 管理员免除或恢复订单的开通费，仅限尚未支付的订单
+func (h *Handler) AdminWaiveSetupFee(c *gin.Context) {
+	var req WaiveSetupFeeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	orderID := c.Param("id")
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var status string
+	err = tx.QueryRow(ctx,
+		`SELECT status FROM orders WHERE id = $1 FOR UPDATE`,
+		orderID,
+	).Scan(&status)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query order"})
+		return
+	}
+	if status != "draft" && status != "pending_payment" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Setup fees can only be changed before the order is paid"})
+		return
+	}
+
+	// 已发起支付的订单退回草稿，客户需按新金额重新结账
+	now := time.Now()
+	_, err = tx.Exec(ctx,
+		`UPDATE orders
+		 SET setup_fee_waived = $2, status = 'draft', updated_at = $3
+		 WHERE id = $1`,
+		orderID, *req.Waived, now,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order"})
+		return
+	}
+
+	totals, err := RecalculateTotals(ctx, tx, h.store, orderID, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate order total"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":               orderID,
+		"setup_fee_waived": *req.Waived,
+		"subtotal":         common.CentsToDecimal(totals.Subtotal),
+		"discount_amount":  common.CentsToDecimal(totals.Discount),
+		"tax_amount":       common.CentsToDecimal(totals.Tax.Tax),
+		"total_amount":     common.CentsToDecimal(totals.Tax.Total),
+	})
+}
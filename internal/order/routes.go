@@ -20,6 +20,7 @@ func RegisterRoutes(portal *gin.RouterGroup, admin *gin.RouterGroup, h *Handler)
 		adminOrders.GET("", h.AdminListOrders)
 		adminOrders.PATCH("/:id/status", h.AdminUpdateOrderStatus)
 		adminOrders.PATCH("/:id", h.AdminUpdateOrderStatus)
+		adminOrders.PATCH("/:id/setup-fee", h.AdminWaiveSetupFee)
 	}
 }
 
@@ -31,5 +32,7 @@ func RegisterCartRoutes(authenticated *gin.RouterGroup, h *Handler) {
 		cart.GET("", h.GetCart)
 		cart.PUT("/items/:id", h.UpdateCartItem)
 		cart.DELETE("/items/:id", h.RemoveCartItem)
+		cart.POST("/coupon", h.ApplyCoupon)
+		cart.DELETE("/coupon", h.RemoveCoupon)
 	}
 }
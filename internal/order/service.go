@@ -3,8 +3,11 @@ package order
 import (
 	"context"
 	"errors"
+	"net/http"
 	"time"
 
+	"github.com/adiecho/echobilling/internal/coupon"
+	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 )
@@ -41,16 +44,43 @@ func (h *Handler) getOrCreateDraftOrder(ctx context.Context, tx pgx.Tx, userID s
 	return orderID, nil
 }
 
+// getDraftOrderID 返回用户当前的草稿订单，没有时返回空字符串
+func (h *Handler) getDraftOrderID(ctx context.Context, tx pgx.Tx, userID string) (string, error) {
+	var orderID string
+	err := tx.QueryRow(ctx,
+		`SELECT id
+		 FROM orders
+		 WHERE user_id = $1 AND status = 'draft'
+		 ORDER BY created_at DESC
+		 LIMIT 1`,
+		userID,
+	).Scan(&orderID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return orderID, err
+}
+
+// writeCouponError 优惠券不可用时返回 400 和具体原因
+func writeCouponError(c *gin.Context, err error) {
+	if coupon.IsRejection(err) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply coupon"})
+}
+
 func (h *Handler) getDraftCart(ctx context.Context, userID string) (*Order, error) {
 	var order Order
 	err := h.pool.QueryRow(ctx,
-		`SELECT id, user_id, status, total_amount, currency, notes, created_at, updated_at
+		`SELECT id, user_id, status, subtotal, tax_amount, total_amount, currency, tax_details, setup_fee_waived, discount_amount,
+		        (SELECT code FROM coupons WHERE coupons.id = orders.coupon_id), notes, created_at, updated_at
 		 FROM orders
 		 WHERE user_id = $1 AND status = 'draft'
 		 ORDER BY created_at DESC
 		 LIMIT 1`,
 		userID,
-	).Scan(&order.ID, &order.UserID, &order.Status, &order.TotalAmount, &order.Currency, &order.Notes, &order.CreatedAt, &order.UpdatedAt)
+	).Scan(&order.ID, &order.UserID, &order.Status, &order.Subtotal, &order.TaxAmount, &order.TotalAmount, &order.Currency, &order.Tax, &order.SetupFeeWaived, &order.DiscountAmount, &order.CouponCode, &order.Notes, &order.CreatedAt, &order.UpdatedAt)
 
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, nil
@@ -60,7 +90,7 @@ func (h *Handler) getDraftCart(ctx context.Context, userID string) (*Order, erro
 	}
 
 	rows, err := h.pool.Query(ctx,
-		`SELECT id, order_id, plan_id, plan_snapshot, quantity, unit_price, billing_cycle, created_at
+		`SELECT id, order_id, plan_id, plan_snapshot, quantity, unit_price, setup_fee, unit_discount, billing_cycle, created_at
 		 FROM order_items
 		 WHERE order_id = $1
 		 ORDER BY created_at`,
@@ -74,7 +104,7 @@ func (h *Handler) getDraftCart(ctx context.Context, userID string) (*Order, erro
 	order.Items = make([]OrderItem, 0)
 	for rows.Next() {
 		var item OrderItem
-		if err := rows.Scan(&item.ID, &item.OrderID, &item.PlanID, &item.PlanSnapshot, &item.Quantity, &item.UnitPrice, &item.BillingCycle, &item.CreatedAt); err != nil {
+		if err := rows.Scan(&item.ID, &item.OrderID, &item.PlanID, &item.PlanSnapshot, &item.Quantity, &item.UnitPrice, &item.SetupFee, &item.UnitDiscount, &item.BillingCycle, &item.CreatedAt); err != nil {
 			return nil, err
 		}
 		order.Items = append(order.Items, item)
@@ -0,0 +1,144 @@
+package order
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/app"
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/coupon"
+	"github.com/adiecho/echobilling/internal/tax"
+	"github.com/jackc/pgx/v5"
+)
+
+// Totals 订单金额汇总（分）。Subtotal 为折扣前按定价的合计，应付金额为 Tax.Total
+type Totals struct {
+	Subtotal int64
+	Discount int64
+	Tax      *tax.Breakdown
+}
+
+type totalsItem struct {
+	id           string
+	planID       string
+	billingCycle string
+	quantity     int64
+	unitPrice    int64
+	setupFee     int64
+}
+
+// RecalculateTotals 重新汇总订单金额：套餐价减去优惠券折扣、加上未免除的开通费，
+// 再按客户当前资料计税，结果写回 orders 和 order_items.unit_discount。
+func RecalculateTotals(ctx context.Context, tx pgx.Tx, store *app.SettingsStore, orderID string, now time.Time) (*Totals, error) {
+	var (
+		userID         string
+		setupFeeWaived bool
+		couponID       *string
+	)
+	if err := tx.QueryRow(ctx,
+		`SELECT user_id, setup_fee_waived, coupon_id::text FROM orders WHERE id = $1 FOR UPDATE`,
+		orderID,
+	).Scan(&userID, &setupFeeWaived, &couponID); err != nil {
+		return nil, err
+	}
+
+	var applied *coupon.Coupon
+	if couponID != nil {
+		c, err := coupon.Get(ctx, tx, *couponID)
+		if err != nil && !errors.Is(err, coupon.ErrNotFound) {
+			return nil, err
+		}
+		applied = c
+	}
+
+	items, err := loadTotalsItems(ctx, tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	totals := &Totals{}
+	amounts := make([]int64, 0, len(items)*2)
+	for _, item := range items {
+		var unitDiscount int64
+		if applied != nil && applied.AppliesTo(item.planID, item.billingCycle) {
+			unitDiscount = applied.UnitDiscount(item.unitPrice)
+		}
+		if _, err := tx.Exec(ctx,
+			`UPDATE order_items SET unit_discount = $2 WHERE id = $1`,
+			item.id, common.CentsToDecimal(unitDiscount),
+		); err != nil {
+			return nil, err
+		}
+
+		totals.Subtotal += item.quantity * item.unitPrice
+		totals.Discount += item.quantity * unitDiscount
+		amounts = append(amounts, item.quantity*(item.unitPrice-unitDiscount))
+
+		// 开通费作为单独的计税行，不参与折扣
+		if item.setupFee > 0 && !setupFeeWaived {
+			totals.Subtotal += item.quantity * item.setupFee
+			amounts = append(amounts, item.quantity*item.setupFee)
+		}
+	}
+
+	decision, err := tax.ForUser(ctx, tx, store, userID)
+	if err != nil {
+		return nil, err
+	}
+	totals.Tax, err = decision.Apply(amounts)
+	if err != nil {
+		return nil, err
+	}
+
+	details, _ := json.Marshal(totals.Tax.Decision)
+	_, err = tx.Exec(ctx,
+		`UPDATE orders
+		 SET subtotal = $2, discount_amount = $3, tax_amount = $4, total_amount = $5, tax_details = $6, updated_at = $7
+		 WHERE id = $1`,
+		orderID,
+		common.CentsToDecimal(totals.Subtotal),
+		common.CentsToDecimal(totals.Discount),
+		common.CentsToDecimal(totals.Tax.Tax),
+		common.CentsToDecimal(totals.Tax.Total),
+		details, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return totals, nil
+}
+
+func loadTotalsItems(ctx context.Context, tx pgx.Tx, orderID string) ([]totalsItem, error) {
+	rows, err := tx.Query(ctx,
+		`SELECT id, plan_id, billing_cycle::text, quantity, unit_price::text, setup_fee::text
+		 FROM order_items
+		 WHERE order_id = $1
+		 ORDER BY created_at`,
+		orderID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]totalsItem, 0)
+	for rows.Next() {
+		var (
+			item                totalsItem
+			unitPrice, setupFee string
+		)
+		if err := rows.Scan(&item.id, &item.planID, &item.billingCycle, &item.quantity, &unitPrice, &setupFee); err != nil {
+			return nil, err
+		}
+		if item.unitPrice, err = common.DecimalAmountToCents(unitPrice); err != nil {
+			return nil, err
+		}
+		if item.setupFee, err = common.DecimalAmountToCents(setupFee); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
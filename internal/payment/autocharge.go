@@ -0,0 +1,375 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/credit"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/adiecho/echobilling/internal/invoicestatus"
+	"github.com/adiecho/echobilling/internal/paymethod"
+	"github.com/adiecho/echobilling/internal/provisioning"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// autoChargeClaimTimeout 自动扣款占用发票的最长时间。任务在扣款完成前彻底失败时，超时后客户可以重新手动付款
+const autoChargeClaimTimeout = time.Hour
+
+// HandleAutoCharge 处理 billing:auto_charge 任务：先用余额抵扣，剩余部分用默认卡离线扣款。
+// 没有默认卡或扣款被拒时不重试，发票保持待支付，由催缴流程提醒客户
+func (h *Handler) HandleAutoCharge(ctx context.Context, t *asynq.Task) error {
+	var payload provisioning.AutoChargePayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal payload: %w", err)
+	}
+	invoiceID := payload.InvoiceID
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		userID, invoiceNumber, status, total, currency string
+		attemptedAt                                    *time.Time
+	)
+	err = tx.QueryRow(ctx,
+		`SELECT user_id::text, COALESCE(invoice_number, ''), status::text, total::text, currency, auto_charge_attempted_at
+		 FROM invoices
+		 WHERE id = $1
+		 FOR UPDATE`,
+		invoiceID,
+	).Scan(&userID, &invoiceNumber, &status, &total, &currency, &attemptedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("failed to query invoice: %w", err)
+	}
+	if status != "pending" || attemptedAt != nil {
+		return nil
+	}
+
+	totalCents, err := common.DecimalAmountToCents(total)
+	if err != nil {
+		return fmt.Errorf("invalid invoice total %q: %w", total, err)
+	}
+
+	now := time.Now()
+	creditApplied, err := credit.ApplyToInvoice(ctx, tx, userID, invoiceID, totalCents, now)
+	if err != nil {
+		return fmt.Errorf("failed to apply account credit: %w", err)
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE invoices SET credit_applied = $2, updated_at = $3 WHERE id = $1`,
+		invoiceID, common.CentsToDecimal(creditApplied), now,
+	); err != nil {
+		return fmt.Errorf("failed to apply account credit: %w", err)
+	}
+
+	amountDue := totalCents - creditApplied
+	if amountDue == 0 {
+		result, err := h.settleInvoicePayment(ctx, tx, invoiceID, now)
+		if err != nil {
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("failed to commit invoice payment: %w", err)
+		}
+		log.Printf("[auto-charge] invoice %s paid with account credit", invoiceID)
+		return h.finishInvoicePayment(ctx, result)
+	}
+
+	saved, err := h.gateways.SavedMethods()
+	if errors.Is(err, gateway.ErrNotSupported) {
+		return tx.Commit(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get payment gateway: %w", err)
+	}
+
+	method, customerID, err := paymethod.Default(ctx, tx, userID)
+	if errors.Is(err, paymethod.ErrNotFound) {
+		return tx.Commit(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query default payment method: %w", err)
+	}
+	// 提交前占用发票：扣款进行中时客户不能再发起付款。任务重试时沿用原来的占用时间
+	if _, err := tx.Exec(ctx,
+		`UPDATE invoices SET auto_charge_started_at = COALESCE(auto_charge_started_at, $2) WHERE id = $1`,
+		invoiceID, now,
+	); err != nil {
+		return fmt.Errorf("failed to claim invoice for auto charge: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit credit application: %w", err)
+	}
+
+	// 占用前已经打开的支付页一并失效；失败时照常扣款，重复的付款在完成时转入余额或退款
+	if err := h.expireInvoiceCheckouts(ctx, invoiceID); err != nil {
+		log.Printf("[auto-charge] failed to expire open checkouts for invoice %s: %v", invoiceID, err)
+	}
+
+	metadata := map[string]string{
+		"invoice_id":     invoiceID,
+		"invoice_number": invoiceNumber,
+		"user_id":        userID,
+		"auto_charge":    "true",
+	}
+	charge, err := saved.ChargeOffSession(ctx, gateway.OffSessionCharge{
+		CustomerID:      customerID,
+		PaymentMethodID: method.StripePaymentMethodID,
+		Amount:          amountDue,
+		Currency:        currency,
+		Description:     "Invoice " + invoiceNumber,
+		Metadata:        metadata,
+		// 任务重试时复用同一笔扣款，不会重复扣款
+		IdempotencyKey: "auto-charge-" + invoiceID,
+	})
+	var declined *gateway.DeclinedError
+	if errors.As(err, &declined) {
+		return h.recordAutoChargeFailure(ctx, invoiceID, userID, amountDue, currency, declined.PaymentID, declined.Reason)
+	}
+	if err != nil {
+		// 网络等临时错误交给 Asynq 重试
+		return fmt.Errorf("failed to charge saved payment method: %w", err)
+	}
+
+	return h.completeAutoCharge(ctx, invoiceID, userID, amountDue, currency, charge.ID)
+}
+
+func (h *Handler) completeAutoCharge(ctx context.Context, invoiceID, userID string, amount int64, currency, paymentIntentID string) error {
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var status, prior string
+	if err := tx.QueryRow(ctx,
+		`SELECT i.status::text,
+		        COALESCE((SELECT p.status::text FROM payments p WHERE p.stripe_payment_intent_id = $2), '')
+		 FROM invoices i
+		 WHERE i.id = $1
+		 FOR UPDATE OF i`,
+		invoiceID, paymentIntentID,
+	).Scan(&status, &prior); err != nil {
+		return fmt.Errorf("failed to query invoice: %w", err)
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec(ctx,
+		`UPDATE invoices SET auto_charge_attempted_at = $2 WHERE id = $1`,
+		invoiceID, now,
+	); err != nil {
+		return fmt.Errorf("failed to mark auto charge attempt: %w", err)
+	}
+
+	if status != invoicestatus.Pending {
+		// 这笔扣款已经处理过（结清了发票或已转入余额）
+		if paymentSettled(prior) {
+			return tx.Commit(ctx)
+		}
+		// 扣款期间发票被作废或已通过其他方式付清：付款照常登记，金额转入余额或原路退款，任务不再重试
+		paymentID, err := recordIntentPayment(ctx, tx, paymentIntentID, userID, nil, amount, currency, "succeeded", now)
+		if err != nil {
+			return err
+		}
+		if err := h.holdUnappliedPayment(ctx, tx, gateway.Stripe, paymentID, paymentIntentID, userID,
+			amount, currency, "Invoice "+invoiceID+" was no longer payable when the automatic charge completed", now); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	}
+
+	result, err := h.settleInvoicePayment(ctx, tx, invoiceID, now)
+	if err != nil {
+		return err
+	}
+	if _, err := recordIntentPayment(ctx, tx, paymentIntentID, userID, &invoiceID, amount, currency, "succeeded", now); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit auto charge: %w", err)
+	}
+
+	log.Printf("[auto-charge] invoice %s charged %s %s", invoiceID, common.CentsToDecimal(amount), strings.ToUpper(currency))
+	return h.finishInvoicePayment(ctx, result)
+}
+
+// recordAutoChargeFailure 记录扣款失败并标记已尝试，发票转由催缴流程处理
+func (h *Handler) recordAutoChargeFailure(
+	ctx context.Context,
+	invoiceID, userID string,
+	amount int64,
+	currency, paymentIntentID string,
+	reason string,
+) error {
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	if _, err := tx.Exec(ctx,
+		`UPDATE invoices SET auto_charge_attempted_at = $2 WHERE id = $1`,
+		invoiceID, now,
+	); err != nil {
+		return fmt.Errorf("failed to mark auto charge attempt: %w", err)
+	}
+
+	if paymentIntentID != "" {
+		if _, err := recordIntentPayment(ctx, tx, paymentIntentID, userID, &invoiceID, amount, currency, "failed", now); err != nil {
+			return err
+		}
+	}
+
+	details, _ := json.Marshal(map[string]interface{}{
+		"amount": common.CentsToDecimal(amount),
+		"reason": reason,
+	})
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO audit_logs (user_id, action, entity_type, entity_id, new_values, ip_address, user_agent, created_at)
+		 VALUES ($1, 'auto_charge_failed', 'invoice', $2, $3, 'worker', 'asynq-worker', $4)`,
+		userID, invoiceID, details, now,
+	); err != nil {
+		return fmt.Errorf("failed to record auto charge failure: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit auto charge failure: %w", err)
+	}
+
+	log.Printf("[auto-charge] invoice %s not charged: %s", invoiceID, reason)
+	return nil
+}
+
+// paymentSettled 付款已成功入账（含之后发生的退款）
+func paymentSettled(status string) bool {
+	switch status {
+	case "succeeded", "partially_refunded", "refunded":
+		return true
+	}
+	return false
+}
+
+// recordIntentPayment 按 PaymentIntent 幂等地登记一笔离线扣款，返回付款 ID。
+// invoiceID 为 nil 表示付款未用于结清发票
+func recordIntentPayment(
+	ctx context.Context,
+	tx pgx.Tx,
+	paymentIntentID, userID string,
+	invoiceID *string,
+	amount int64,
+	currency, status string,
+	now time.Time,
+) (string, error) {
+	var paymentID string
+	err := tx.QueryRow(ctx,
+		`INSERT INTO payments (
+			id, user_id, invoice_id, stripe_payment_intent_id, amount, currency, status, method, gateway, created_at, updated_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, 'card', $8, $9, $9)
+		ON CONFLICT (stripe_payment_intent_id) DO UPDATE
+		SET invoice_id = EXCLUDED.invoice_id, status = EXCLUDED.status, gateway = EXCLUDED.gateway,
+		    updated_at = EXCLUDED.updated_at
+		RETURNING id`,
+		uuid.New().String(), userID, invoiceID, paymentIntentID, common.CentsToDecimal(amount),
+		strings.ToUpper(currency), status, gateway.Stripe, now,
+	).Scan(&paymentID)
+	if err != nil {
+		return "", fmt.Errorf("failed to record payment: %w", err)
+	}
+	return paymentID, nil
+}
+
+// autoChargeInvoice 返回离线自动扣款对应的发票和用户，其他来源的 PaymentIntent 返回空
+func autoChargeInvoice(intent *stripe.PaymentIntent) (invoiceID, userID string) {
+	if intent.Metadata["auto_charge"] != "true" {
+		return "", ""
+	}
+	return intent.Metadata["invoice_id"], intent.Metadata["user_id"]
+}
+
+// handlePaymentIntentSucceeded 离线扣款需要客户验证（3DS 等）时首次扣款记为失败，
+// 客户完成验证后按该事件更新付款并结清发票。Checkout 发起的付款由 Session 事件处理
+func (h *Handler) handlePaymentIntentSucceeded(ctx context.Context, event *gateway.Event) error {
+	var intent stripe.PaymentIntent
+	if err := json.Unmarshal(event.Data, &intent); err != nil {
+		return fmt.Errorf("failed to parse payment intent: %w", err)
+	}
+
+	invoiceID, userID := autoChargeInvoice(&intent)
+	if intent.ID == "" || invoiceID == "" || userID == "" {
+		return nil
+	}
+
+	var exists bool
+	if err := h.pool.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM invoices WHERE id = $1)`,
+		invoiceID,
+	).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to query invoice: %w", err)
+	}
+	if !exists {
+		return nil
+	}
+
+	// 付款状态由 completeAutoCharge 更新；发票已不再待支付时这笔付款转入余额或退款
+	return h.completeAutoCharge(ctx, invoiceID, userID, intent.Amount, string(intent.Currency), intent.ID)
+}
+
+// handlePaymentMethodAttached Checkout 保存卡片后同步到本地
+func (h *Handler) handlePaymentMethodAttached(ctx context.Context, event *gateway.Event) error {
+	var pm stripe.PaymentMethod
+	if err := json.Unmarshal(event.Data, &pm); err != nil {
+		return fmt.Errorf("failed to parse payment method: %w", err)
+	}
+	if pm.ID == "" || pm.Customer == nil || pm.Customer.ID == "" {
+		return nil
+	}
+
+	userID, err := paymethod.UserIDForCustomer(ctx, h.pool, pm.Customer.ID)
+	if err != nil {
+		return fmt.Errorf("failed to query customer: %w", err)
+	}
+	if userID == "" {
+		return nil
+	}
+	return paymethod.Save(ctx, h.pool, userID, &pm, time.Now())
+}
+
+// handlePaymentMethodDetached 卡片在 Stripe 侧解绑后删除本地记录
+func (h *Handler) handlePaymentMethodDetached(ctx context.Context, event *gateway.Event) error {
+	var pm stripe.PaymentMethod
+	if err := json.Unmarshal(event.Data, &pm); err != nil {
+		return fmt.Errorf("failed to parse payment method: %w", err)
+	}
+	if pm.ID == "" {
+		return nil
+	}
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := paymethod.Forget(ctx, tx, pm.ID, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
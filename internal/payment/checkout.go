@@ -0,0 +1,383 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/credit"
+	"github.com/adiecho/echobilling/internal/db"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// checkoutOrderID 返回订单支付会话对应的订单 ID，发票支付和余额充值会话返回空
+func checkoutOrderID(sess *stripe.CheckoutSession) string {
+	if sess.Metadata["invoice_id"] != "" || sess.Metadata["credit_top_up"] == "true" {
+		return ""
+	}
+	if orderID := sess.Metadata["order_id"]; orderID != "" {
+		return orderID
+	}
+	return sess.ClientReferenceID
+}
+
+// awaitingAsyncPayment 客户已完成 Checkout，但银行转账、SEPA 借记等延迟到账的支付方式尚未确认
+func awaitingAsyncPayment(sess *stripe.CheckoutSession) bool {
+	return sess.Status == stripe.CheckoutSessionStatusComplete &&
+		sess.PaymentStatus == stripe.CheckoutSessionPaymentStatusUnpaid
+}
+
+// checkoutCreditDue 结算时仍需由余额抵扣的金额（分）。
+// 余额在创建会话时占用，但客户可能支付的是抵扣前创建的旧会话，此时按实际收款重新核定，
+// 多占用的余额退回给客户。网关未返回金额时 ok 为 false，保留原有抵扣
+func checkoutCreditDue(total string, sess *stripe.CheckoutSession) (due int64, ok bool, err error) {
+	if sess.AmountTotal <= 0 {
+		return 0, false, nil
+	}
+	totalCents, err := common.DecimalAmountToCents(total)
+	if err != nil {
+		return 0, false, err
+	}
+	if sess.AmountTotal >= totalCents {
+		return 0, true, nil
+	}
+	return totalCents - sess.AmountTotal, true, nil
+}
+
+// reconcileInvoiceCredit 按实际收款调整发票上的余额抵扣，只处理尚未结清的发票。
+// 实际收款加可用余额仍不足发票总额时退回发票上占用的余额并返回 false，发票不能按已付清结算
+func reconcileInvoiceCredit(ctx context.Context, tx pgx.Tx, userID, invoiceID string, sess *stripe.CheckoutSession, now time.Time) (bool, error) {
+	var status, total string
+	if err := tx.QueryRow(ctx,
+		`SELECT status::text, total::text FROM invoices WHERE id = $1 FOR UPDATE`,
+		invoiceID,
+	).Scan(&status, &total); err != nil {
+		return false, fmt.Errorf("failed to query invoice: %w", err)
+	}
+	if status != "pending" {
+		return true, nil
+	}
+
+	due, ok, err := checkoutCreditDue(total, sess)
+	if err != nil || !ok {
+		return err == nil, err
+	}
+	applied, err := credit.ApplyToInvoice(ctx, tx, userID, invoiceID, due, now)
+	if err != nil {
+		return false, fmt.Errorf("failed to apply credit: %w", err)
+	}
+	if applied < due {
+		if err := credit.ReleaseInvoice(ctx, tx, userID, invoiceID, now); err != nil {
+			return false, fmt.Errorf("failed to release account credit: %w", err)
+		}
+		applied = 0
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE invoices SET credit_applied = $2, updated_at = $3 WHERE id = $1`,
+		invoiceID, common.CentsToDecimal(applied), now,
+	); err != nil {
+		return false, fmt.Errorf("failed to update invoice credit: %w", err)
+	}
+	return applied >= due, nil
+}
+
+// reconcileOrderCredit 按实际收款调整订单上的余额抵扣，开具发票前调用。
+// 实际收款加可用余额仍不足订单总额时返回 false，占用的余额由调用方释放订单时退回
+func reconcileOrderCredit(ctx context.Context, tx pgx.Tx, userID, orderID, total string, sess *stripe.CheckoutSession, now time.Time) (bool, error) {
+	due, ok, err := checkoutCreditDue(total, sess)
+	if err != nil || !ok {
+		return err == nil, err
+	}
+	applied, err := credit.ApplyToOrder(ctx, tx, userID, orderID, due, now)
+	if err != nil {
+		return false, fmt.Errorf("failed to apply credit: %w", err)
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE orders SET credit_applied = $2 WHERE id = $1`,
+		orderID, common.CentsToDecimal(applied),
+	); err != nil {
+		return false, fmt.Errorf("failed to update order credit: %w", err)
+	}
+	return applied >= due, nil
+}
+
+// holdUnappliedCheckout 登记无法结清单据的 Checkout 付款（实际收款不足、发票已作废）：
+// 付款不关联发票，金额转入余额或原路退款，单据状态不变
+func (h *Handler) holdUnappliedCheckout(
+	ctx context.Context,
+	tx pgx.Tx,
+	gatewayName string,
+	sess *stripe.CheckoutSession,
+	userID, reason string,
+	now time.Time,
+) error {
+	paymentID, err := recordCheckoutPayment(ctx, tx, gatewayName, sess, userID, nil,
+		common.CentsToDecimal(sess.AmountTotal), string(sess.Currency), "succeeded", now)
+	if err != nil {
+		return err
+	}
+	log.Printf("[webhook] checkout session %s paid %d without settling: %s", sess.ID, sess.AmountTotal, reason)
+	return h.holdUnappliedPayment(ctx, tx, gatewayName, paymentID, sessionPaymentReference(sess), userID,
+		sess.AmountTotal, string(sess.Currency), reason, now)
+}
+
+// checkoutHeldUnapplied 该 Checkout Session 的付款是否已按未结清处理过（付款未关联发票），
+// Webhook 重投时不能再用同一笔付款结算单据
+func checkoutHeldUnapplied(ctx context.Context, tx pgx.Tx, sessionID string) (bool, error) {
+	var held bool
+	if err := tx.QueryRow(ctx,
+		`SELECT EXISTS (
+			SELECT 1 FROM payments
+			WHERE stripe_checkout_session_id = $1 AND invoice_id IS NULL AND status NOT IN ('pending', 'processing', 'failed')
+		)`,
+		sessionID,
+	).Scan(&held); err != nil {
+		return false, fmt.Errorf("failed to query payment: %w", err)
+	}
+	return held, nil
+}
+
+// checkoutSettledInvoice 该 Checkout Session 的付款是否已登记为发票的成功付款
+func checkoutSettledInvoice(ctx context.Context, tx pgx.Tx, invoiceID string, sess *stripe.CheckoutSession) (bool, error) {
+	var recorded bool
+	if err := tx.QueryRow(ctx,
+		`SELECT EXISTS (
+			SELECT 1 FROM payments
+			WHERE invoice_id = $1
+			  AND (stripe_checkout_session_id = $2 OR stripe_payment_intent_id = NULLIF($3, ''))
+			  AND status IN ('succeeded', 'partially_refunded', 'refunded')
+		)`,
+		invoiceID, sess.ID, sessionPaymentReference(sess),
+	).Scan(&recorded); err != nil {
+		return false, fmt.Errorf("failed to query payment: %w", err)
+	}
+	return recorded, nil
+}
+
+// sessionPaymentReference Checkout Session 对应的网关付款参考号，用于原路退款
+func sessionPaymentReference(sess *stripe.CheckoutSession) string {
+	if sess.PaymentIntent != nil {
+		return sess.PaymentIntent.ID
+	}
+	return ""
+}
+
+// recordPendingCheckout 登记一笔处理中的付款，订单和发票保持待支付，
+// 由 checkout.session.async_payment_succeeded 或 async_payment_failed 完成后续处理
+func (h *Handler) recordPendingCheckout(ctx context.Context, gatewayName string, sess *stripe.CheckoutSession) error {
+	userID := sess.Metadata["user_id"]
+	if userID == "" {
+		return fmt.Errorf("user_id not found in session metadata")
+	}
+	var invoiceID *string
+	if id := sess.Metadata["invoice_id"]; id != "" {
+		invoiceID = &id
+	}
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := recordCheckoutPayment(ctx, tx, gatewayName, sess, userID, invoiceID,
+		common.CentsToDecimal(sess.AmountTotal), string(sess.Currency), "processing", time.Now()); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit pending payment: %w", err)
+	}
+
+	log.Printf("[webhook] checkout session %s awaiting asynchronous payment", sess.ID)
+	return nil
+}
+
+// handleCheckoutAsyncPaymentFailed 延迟到账的付款最终失败：付款标记为失败，订单退回购物车以便重新支付。
+// 发票保持待支付，由催缴流程继续跟进
+func (h *Handler) handleCheckoutAsyncPaymentFailed(ctx context.Context, event *gateway.Event) error {
+	var sess stripe.CheckoutSession
+	if err := json.Unmarshal(event.Data, &sess); err != nil {
+		return fmt.Errorf("failed to parse session: %w", err)
+	}
+
+	if _, err := h.pool.Exec(ctx,
+		`UPDATE payments
+		 SET status = 'failed', updated_at = $2
+		 WHERE stripe_checkout_session_id = $1 AND status IN ('pending', 'processing')`,
+		sess.ID, time.Now(),
+	); err != nil {
+		return fmt.Errorf("failed to mark payment failed: %w", err)
+	}
+
+	if orderID := checkoutOrderID(&sess); orderID != "" {
+		return h.releaseOrderCheckout(ctx, orderID)
+	}
+	return nil
+}
+
+// handleCheckoutSessionExpired 客户未完成支付，Checkout Session 过期后释放订单
+func (h *Handler) handleCheckoutSessionExpired(ctx context.Context, event *gateway.Event) error {
+	var sess stripe.CheckoutSession
+	if err := json.Unmarshal(event.Data, &sess); err != nil {
+		return fmt.Errorf("failed to parse session: %w", err)
+	}
+
+	if sess.Metadata["invoice_id"] != "" {
+		return markInvoiceCheckout(ctx, h.pool, event.Gateway, sess.ID, "expired", time.Now())
+	}
+	if orderID := checkoutOrderID(&sess); orderID != "" {
+		return h.releaseOrderCheckout(ctx, orderID)
+	}
+	return nil
+}
+
+// markInvoiceCheckout 结束发票的托管支付会话记录，status 为 completed 或 expired
+func markInvoiceCheckout(ctx context.Context, q db.DBTX, gatewayName, sessionID, status string, now time.Time) error {
+	if _, err := q.Exec(ctx,
+		`UPDATE invoice_checkout_sessions
+		 SET status = $3, closed_at = $4
+		 WHERE gateway = $1 AND session_id = $2 AND status = 'open'`,
+		gatewayName, sessionID, status, now,
+	); err != nil {
+		return fmt.Errorf("failed to update checkout session: %w", err)
+	}
+	return nil
+}
+
+// invoiceCheckoutLifetime 托管支付会话的最长有效期（Stripe 默认 24 小时），超过后无需再调用网关
+const invoiceCheckoutLifetime = 24 * time.Hour
+
+// HandleExpireInvoiceCheckouts 处理 billing:expire_checkouts 任务：发票已作废或已结清后，
+// 在网关侧使仍未完成的支付会话失效，避免客户继续为不再待支付的发票付款。
+// 单个会话失败只记录日志，下次执行时重试
+func (h *Handler) HandleExpireInvoiceCheckouts(ctx context.Context, _ *asynq.Task) error {
+	return h.expireOpenCheckouts(ctx,
+		`SELECT s.gateway, s.session_id, s.created_at
+		 FROM invoice_checkout_sessions s
+		 JOIN invoices i ON i.id = s.invoice_id
+		 WHERE s.status = 'open' AND i.status <> 'pending'
+		 ORDER BY s.created_at
+		 LIMIT 100`,
+	)
+}
+
+// expireInvoiceCheckouts 使发票所有未完成的支付会话失效
+func (h *Handler) expireInvoiceCheckouts(ctx context.Context, invoiceID string) error {
+	return h.expireOpenCheckouts(ctx,
+		`SELECT gateway, session_id, created_at
+		 FROM invoice_checkout_sessions
+		 WHERE invoice_id = $1 AND status = 'open'`,
+		invoiceID,
+	)
+}
+
+// expireOpenCheckouts 按查询结果（gateway, session_id, created_at）逐个使会话失效并标记为 expired，
+// 超过有效期的会话只更新记录。网关调用失败的会话保持 open
+func (h *Handler) expireOpenCheckouts(ctx context.Context, query string, args ...interface{}) error {
+	rows, err := h.pool.Query(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query checkout sessions: %w", err)
+	}
+	type openSession struct {
+		gateway, id string
+		createdAt   time.Time
+	}
+	var sessions []openSession
+	for rows.Next() {
+		var s openSession
+		if err := rows.Scan(&s.gateway, &s.id, &s.createdAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan checkout session: %w", err)
+		}
+		sessions = append(sessions, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query checkout sessions: %w", err)
+	}
+
+	now := time.Now()
+	for _, s := range sessions {
+		if now.Sub(s.createdAt) < invoiceCheckoutLifetime {
+			expirer, err := h.gateways.CheckoutExpirer(s.gateway)
+			if err != nil && !errors.Is(err, gateway.ErrNotSupported) {
+				log.Printf("[checkout] cannot expire session %s: %v", s.id, err)
+				continue
+			}
+			if expirer != nil {
+				if err := expirer.ExpireCheckout(ctx, s.id); err != nil {
+					log.Printf("[checkout] failed to expire session %s: %v", s.id, err)
+					continue
+				}
+			}
+		}
+		if err := markInvoiceCheckout(ctx, h.pool, s.gateway, s.id, "expired", now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseOrderCheckout 将仍在等待支付的订单退回草稿并退回已抵扣的余额，客户可以修改后重新结账。
+// 客户已经有新的购物车时直接取消订单，避免出现两个草稿订单。
+// 已支付、已取消或已开具线下付款发票的订单不受影响
+func (h *Handler) releaseOrderCheckout(ctx context.Context, orderID string) error {
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID, status string
+	var hasInvoice, hasCart bool
+	err = tx.QueryRow(ctx,
+		`SELECT o.user_id, o.status::text,
+		        EXISTS (SELECT 1 FROM invoices WHERE order_id = o.id),
+		        EXISTS (SELECT 1 FROM orders d WHERE d.user_id = o.user_id AND d.status = 'draft' AND d.id <> o.id)
+		 FROM orders o
+		 WHERE o.id = $1
+		 FOR UPDATE OF o`,
+		orderID,
+	).Scan(&userID, &status, &hasInvoice, &hasCart)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("failed to query order: %w", err)
+	}
+	if status != "pending_payment" || hasInvoice {
+		return nil
+	}
+
+	next := "draft"
+	if hasCart {
+		next = "cancelled"
+	}
+
+	now := time.Now()
+	if err := credit.ReleaseOrder(ctx, tx, userID, orderID, now); err != nil {
+		return fmt.Errorf("failed to release account credit: %w", err)
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE orders
+		 SET status = $2, credit_applied = 0, updated_at = $3
+		 WHERE id = $1`,
+		orderID, next, now,
+	); err != nil {
+		return fmt.Errorf("failed to update order status: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit order release: %w", err)
+	}
+
+	log.Printf("[webhook] order %s checkout abandoned, moved to %s", orderID, next)
+	return nil
+}
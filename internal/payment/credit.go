@@ -0,0 +1,126 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/credit"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v82"
+)
+
+type CreditTopUpRequest struct {
+	Amount  string `json:"amount" binding:"required"`
+	Gateway string `json:"gateway"`
+}
+
+// CreateCreditTopUpSession - POST /api/v1/portal/credit/top-up
+// 为账户余额充值发起托管支付，付款成功后由 Webhook 入账。充值没有发票可供核对，不支持线下转账
+func (h *Handler) CreateCreditTopUpSession(c *gin.Context) {
+	userID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	var req CreditTopUpRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	amount, err := common.DecimalAmountToCents(req.Amount)
+	if err != nil || amount <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
+		return
+	}
+	minAmount, _ := common.DecimalAmountToCents(h.store.Get("credit_top_up_min"))
+	maxAmount, _ := common.DecimalAmountToCents(h.store.Get("credit_top_up_max"))
+	if amount < minAmount {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Minimum top-up amount is %s", common.CentsToDecimal(minAmount))})
+		return
+	}
+	if maxAmount > 0 && amount > maxAmount {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Maximum top-up amount is %s", common.CentsToDecimal(maxAmount))})
+		return
+	}
+
+	gw := h.resolveGateway(c, req.Gateway)
+	if gw == nil {
+		return
+	}
+	if !gw.Capabilities().HostedCheckout {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Payment gateway does not support credit top-ups"})
+		return
+	}
+
+	checkoutReq := h.newCheckoutRequest(userID, credit.Currency, amount)
+	checkoutReq.LineItems = []gateway.LineItem{{Name: "Account credit top-up", UnitAmount: amount, Quantity: 1}}
+	checkoutReq.Metadata = map[string]string{
+		"credit_top_up": "true",
+		"user_id":       userID,
+		"amount":        common.CentsToDecimal(amount),
+	}
+
+	checkout, err := gw.CreateCheckout(c.Request.Context(), checkoutReq)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create checkout session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"gateway":     checkout.Gateway,
+		"session_id":  checkout.SessionID,
+		"session_url": checkout.URL,
+	})
+}
+
+// handleCreditTopUpCompleted 充值付款成功后入账，按 Checkout Session 去重
+func (h *Handler) handleCreditTopUpCompleted(ctx context.Context, gatewayName string, sess *stripe.CheckoutSession) error {
+	userID := sess.Metadata["user_id"]
+	if userID == "" {
+		return fmt.Errorf("user_id not found in top-up session metadata")
+	}
+
+	amount := sess.AmountTotal
+	if amount <= 0 {
+		var err error
+		amount, err = common.DecimalAmountToCents(sess.Metadata["amount"])
+		if err != nil || amount <= 0 {
+			return fmt.Errorf("invalid top-up amount for session %s", sess.ID)
+		}
+	}
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	if _, err := credit.Post(ctx, tx, credit.Entry{
+		UserID:            userID,
+		Kind:              credit.KindTopUp,
+		Amount:            amount,
+		Reason:            "Account credit top-up",
+		CheckoutSessionID: sess.ID,
+	}, now); err != nil {
+		return fmt.Errorf("failed to post top-up credit: %w", err)
+	}
+
+	currency := credit.Currency
+	if sess.Currency != "" {
+		currency = string(sess.Currency)
+	}
+	if _, err := recordCheckoutPayment(ctx, tx, gatewayName, sess, userID, nil, common.CentsToDecimal(amount), currency, "succeeded", now); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit top-up transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// 网关事件处理状态，由 processed 和 failed_at 推导
+const (
+	EventStatusPending   = "pending"
+	EventStatusProcessed = "processed"
+	EventStatusFailed    = "failed"
+)
+
+// PaymentEvent 已登记的网关事件
+type PaymentEvent struct {
+	ID           string          `json:"id"`
+	Gateway      string          `json:"gateway"`
+	EventID      string          `json:"event_id"`
+	EventType    string          `json:"event_type"`
+	Status       string          `json:"status"`
+	Attempts     int             `json:"attempts"`
+	ErrorMessage *string         `json:"error_message"`
+	Payload      json.RawMessage `json:"payload,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+	ProcessedAt  *time.Time      `json:"processed_at"`
+	FailedAt     *time.Time      `json:"failed_at"`
+}
+
+// PaymentEventFilter 事件列表筛选条件，零值表示不限
+type PaymentEventFilter struct {
+	Type   string
+	Status string
+	From   time.Time
+	To     time.Time
+}
+
+// parseEventFilter 解析 type、status、from、to 查询参数，日期格式为 YYYY-MM-DD，to 包含当天
+func parseEventFilter(c *gin.Context) (PaymentEventFilter, error) {
+	f := PaymentEventFilter{Type: c.Query("type"), Status: c.Query("status")}
+	switch f.Status {
+	case "", EventStatusPending, EventStatusProcessed, EventStatusFailed:
+	default:
+		return f, errors.New("invalid status filter")
+	}
+	if from := c.Query("from"); from != "" {
+		t, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return f, errors.New("invalid from date")
+		}
+		f.From = t
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return f, errors.New("invalid to date")
+		}
+		f.To = t.AddDate(0, 0, 1)
+	}
+	return f, nil
+}
+
+// AdminListPaymentEvents - GET /api/v1/admin/payment-events
+// 按事件类型、处理状态和日期筛选网关事件，列表不含 payload
+func (h *Handler) AdminListPaymentEvents(c *gin.Context) {
+	filter, err := parseEventFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	events, total, svcErr := h.listPaymentEvents(c.Request.Context(), filter, page, limit)
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+	c.Header("X-Page", strconv.Itoa(page))
+	c.Header("X-Limit", strconv.Itoa(limit))
+	c.JSON(http.StatusOK, events)
+}
+
+// AdminGetPaymentEvent - GET /api/v1/admin/payment-events/:id
+func (h *Handler) AdminGetPaymentEvent(c *gin.Context) {
+	event, svcErr := h.getPaymentEvent(c.Request.Context(), c.Param("id"))
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+	c.JSON(http.StatusOK, event)
+}
+
+// AdminReprocessPaymentEvent - POST /api/v1/admin/payment-events/:id/reprocess
+// 用保存的 payload 重新执行事件处理。各处理函数按付款、发票和开通作业去重，重放不会重复记账或开通
+func (h *Handler) AdminReprocessPaymentEvent(c *gin.Context) {
+	event, svcErr := h.reprocessPaymentEvent(c.Request.Context(), c.Param("id"))
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+	c.JSON(http.StatusOK, event)
+}
+
+const paymentEventColumns = `id, gateway, stripe_event_id, event_type,
+	CASE WHEN processed THEN 'processed' WHEN failed_at IS NOT NULL THEN 'failed' ELSE 'pending' END,
+	attempts, error_message, created_at, processed_at, failed_at`
+
+const paymentEventFilterSQL = `($1 = '' OR event_type = $1)
+	AND ($2 = ''
+	     OR ($2 = 'processed' AND processed)
+	     OR ($2 = 'failed' AND NOT processed AND failed_at IS NOT NULL)
+	     OR ($2 = 'pending' AND NOT processed AND failed_at IS NULL))
+	AND ($3::timestamptz IS NULL OR created_at >= $3)
+	AND ($4::timestamptz IS NULL OR created_at < $4)`
+
+func (h *Handler) listPaymentEvents(ctx context.Context, f PaymentEventFilter, page, limit int) ([]PaymentEvent, int64, *common.ServiceError) {
+	var from, to *time.Time
+	if !f.From.IsZero() {
+		from = &f.From
+	}
+	if !f.To.IsZero() {
+		to = &f.To
+	}
+
+	var total int64
+	if err := h.pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM payment_events WHERE `+paymentEventFilterSQL,
+		f.Type, f.Status, from, to,
+	).Scan(&total); err != nil {
+		return nil, 0, common.ErrInternal("Failed to count payment events", err)
+	}
+
+	rows, err := h.pool.Query(ctx,
+		`SELECT `+paymentEventColumns+`
+		 FROM payment_events
+		 WHERE `+paymentEventFilterSQL+`
+		 ORDER BY created_at DESC
+		 LIMIT $5 OFFSET $6`,
+		f.Type, f.Status, from, to, limit, (page-1)*limit,
+	)
+	if err != nil {
+		return nil, 0, common.ErrInternal("Failed to query payment events", err)
+	}
+	defer rows.Close()
+
+	events := make([]PaymentEvent, 0)
+	for rows.Next() {
+		var e PaymentEvent
+		if err := rows.Scan(&e.ID, &e.Gateway, &e.EventID, &e.EventType, &e.Status,
+			&e.Attempts, &e.ErrorMessage, &e.CreatedAt, &e.ProcessedAt, &e.FailedAt); err != nil {
+			return nil, 0, common.ErrInternal("Failed to read payment event", err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, common.ErrInternal("Failed to query payment events", err)
+	}
+	return events, total, nil
+}
+
+func (h *Handler) getPaymentEvent(ctx context.Context, id string) (*PaymentEvent, *common.ServiceError) {
+	var e PaymentEvent
+	err := h.pool.QueryRow(ctx,
+		`SELECT `+paymentEventColumns+`, payload
+		 FROM payment_events
+		 WHERE id = $1`,
+		id,
+	).Scan(&e.ID, &e.Gateway, &e.EventID, &e.EventType, &e.Status,
+		&e.Attempts, &e.ErrorMessage, &e.CreatedAt, &e.ProcessedAt, &e.FailedAt, &e.Payload)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, common.ErrNotFound("Payment event not found", nil)
+	}
+	if err != nil {
+		return nil, common.ErrInternal("Failed to query payment event", err)
+	}
+	return &e, nil
+}
+
+// reprocessPaymentEvent 领取未成功处理的事件并重新分发，返回处理后的事件记录。
+// 处理失败时错误信息写入事件记录，接口本身仍返回 200
+func (h *Handler) reprocessPaymentEvent(ctx context.Context, id string) (*PaymentEvent, *common.ServiceError) {
+	event := &gateway.Event{}
+	var payload []byte
+	err := h.pool.QueryRow(ctx,
+		`UPDATE payment_events
+		 SET attempts = attempts + 1, locked_at = $2
+		 WHERE id = $1
+		   AND NOT processed
+		   AND (locked_at IS NULL OR locked_at < $3)
+		 RETURNING gateway, stripe_event_id, event_type, payload`,
+		id, time.Now(), time.Now().Add(-eventLockTimeout),
+	).Scan(&event.Gateway, &event.ID, &event.Type, &payload)
+	if errors.Is(err, pgx.ErrNoRows) {
+		existing, svcErr := h.getPaymentEvent(ctx, id)
+		if svcErr != nil {
+			return nil, svcErr
+		}
+		if existing.Status == EventStatusProcessed {
+			return nil, common.NewServiceError(http.StatusConflict, "Event already processed", nil)
+		}
+		return nil, common.NewServiceError(http.StatusConflict, "Event is being processed", nil)
+	}
+	if err != nil {
+		return nil, common.ErrInternal("Failed to claim payment event", err)
+	}
+	event.Data = payload
+
+	_ = h.runEvent(ctx, id, event)
+	return h.getPaymentEvent(ctx, id)
+}
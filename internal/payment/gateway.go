@@ -0,0 +1,216 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/billing"
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/adiecho/echobilling/internal/paymethod"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+type gatewayInfo struct {
+	Name         string               `json:"name"`
+	Default      bool                 `json:"default"`
+	Capabilities gateway.Capabilities `json:"capabilities"`
+}
+
+// ListGateways - GET /api/v1/payment-gateways
+// 返回客户结账时可选的支付网关
+func (h *Handler) ListGateways(c *gin.Context) {
+	enabled := h.gateways.Enabled()
+	gateways := make([]gatewayInfo, 0, len(enabled))
+	for i, name := range enabled {
+		g, err := h.gateways.Lookup(name)
+		if err != nil {
+			continue
+		}
+		gateways = append(gateways, gatewayInfo{Name: name, Default: i == 0, Capabilities: g.Capabilities()})
+	}
+	c.JSON(http.StatusOK, gin.H{"gateways": gateways})
+}
+
+// resolveGateway 返回客户选择的网关，不可用时写入 400 响应并返回 nil
+func (h *Handler) resolveGateway(c *gin.Context, name string) gateway.Gateway {
+	g, err := h.gateways.Get(name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Payment gateway is not available"})
+		return nil
+	}
+	return g
+}
+
+// bindOptionalJSON 解析可选的请求体，空请求体视为使用默认值
+func bindOptionalJSON(c *gin.Context, obj interface{}) error {
+	if err := c.ShouldBindJSON(obj); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// newCheckoutRequest 填充托管支付页的回跳地址
+func (h *Handler) newCheckoutRequest(userID, currency string, amount int64) gateway.CheckoutRequest {
+	return gateway.CheckoutRequest{
+		UserID:     userID,
+		Currency:   currency,
+		Amount:     amount,
+		SuccessURL: fmt.Sprintf("%s/checkout/success?session_id={CHECKOUT_SESSION_ID}", h.frontendURL),
+		CancelURL:  fmt.Sprintf("%s/checkout/cancel", h.frontendURL),
+	}
+}
+
+// saveCardForRenewals 让托管支付页把卡片保存到客户的网关 Customer 上，供续费自动扣款使用。
+// 网关不支持或创建 Customer 失败时不影响本次支付
+func (h *Handler) saveCardForRenewals(ctx context.Context, g gateway.Gateway, req *gateway.CheckoutRequest, userID string) {
+	saved, ok := g.(gateway.SavedMethods)
+	if !ok || !g.Capabilities().SavedMethods {
+		return
+	}
+	customerID, err := paymethod.EnsureCustomer(ctx, h.pool, saved, userID)
+	if err != nil {
+		log.Printf("Failed to prepare %s customer for user %s: %v", g.Name(), userID, err)
+		return
+	}
+	req.CustomerID = customerID
+	req.SaveMethod = true
+}
+
+// checkoutResponse 托管支付返回跳转地址，线下支付返回付款说明
+func checkoutResponse(checkout *gateway.Checkout, creditApplied int64) gin.H {
+	resp := gin.H{
+		"gateway":        checkout.Gateway,
+		"credit_applied": common.CentsToDecimal(creditApplied),
+	}
+	if checkout.URL != "" {
+		resp["session_id"] = checkout.SessionID
+		resp["session_url"] = checkout.URL
+	}
+	if checkout.Instructions != nil {
+		resp["instructions"] = checkout.Instructions
+	}
+	return resp
+}
+
+// AdminMarkInvoicePaid - POST /api/v1/admin/invoices/:id/mark-paid
+// 管理员核对线下到账后登记付款，之后与在线支付一样续期服务或开通订单
+func (h *Handler) AdminMarkInvoicePaid(c *gin.Context) {
+	adminID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	var req MarkInvoicePaidRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Transaction reference is required"})
+		return
+	}
+	reference := strings.TrimSpace(req.TransactionReference)
+	if reference == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Transaction reference is required"})
+		return
+	}
+
+	method := req.Method
+	if method == "" {
+		method = "bank_transfer"
+	}
+	settlement, err := h.markInvoicePaid(c.Request.Context(), c.Param("id"), reference, method, adminID, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		switch {
+		case errors.Is(err, billing.ErrInvoiceNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+		case errors.Is(err, billing.ErrInvoiceNotPayable):
+			c.JSON(http.StatusConflict, gin.H{"error": "Invoice cannot be marked as paid"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Invoice marked as paid",
+		"already_paid": settlement.AlreadyPaid,
+		"service_id":   settlement.ServiceID,
+		"expires_at":   settlement.ExpiresAt,
+	})
+}
+
+// markInvoicePaid 结清发票并登记一笔线下付款，事务提交后投递开通、恢复和套餐变更任务
+func (h *Handler) markInvoicePaid(ctx context.Context, invoiceID, reference, method, adminID, ip, userAgent string) (*billing.Settlement, error) {
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID, currency, amountDue string
+	err = tx.QueryRow(ctx,
+		`SELECT user_id::text, currency, (total - credit_applied)::text
+		 FROM invoices
+		 WHERE id = $1`,
+		invoiceID,
+	).Scan(&userID, &currency, &amountDue)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, billing.ErrInvoiceNotFound
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	result, err := h.settleInvoicePayment(ctx, tx, invoiceID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err := common.DecimalAmountToCents(amountDue)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invoice amount %q: %w", amountDue, err)
+	}
+	if !result.settlement.AlreadyPaid && amount > 0 {
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO payments (
+				id, user_id, invoice_id, amount, currency, status, method, gateway, transaction_reference, created_at, updated_at
+			)
+			VALUES ($1, $2, $3, $4, $5, 'succeeded', $6, $7, $8, $9, $9)`,
+			uuid.New().String(), userID, invoiceID, common.CentsToDecimal(amount), strings.ToUpper(currency),
+			method, gateway.Manual, reference, now,
+		); err != nil {
+			return nil, fmt.Errorf("failed to record payment: %w", err)
+		}
+	}
+	if !result.settlement.AlreadyPaid {
+		details, _ := json.Marshal(map[string]interface{}{
+			"transaction_reference": reference,
+			"method":                method,
+			"amount":                common.CentsToDecimal(amount),
+		})
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO audit_logs (user_id, action, entity_type, entity_id, new_values, ip_address, user_agent, created_at)
+			 VALUES ($1, 'invoice_marked_paid', 'invoice', $2, $3, $4, $5, $6)`,
+			adminID, invoiceID, details, ip, userAgent, now,
+		); err != nil {
+			return nil, fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := h.finishInvoicePayment(ctx, result); err != nil {
+		log.Printf("Failed to run follow-up actions for invoice %s: %v", invoiceID, err)
+	}
+	return result.settlement, nil
+}
@@ -2,6 +2,7 @@ package payment
 
 import (
 	"github.com/adiecho/echobilling/internal/app"
+	"github.com/adiecho/echobilling/internal/gateway"
 	"github.com/hibiken/asynq"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -11,17 +12,32 @@ type Handler struct {
 	store       *app.SettingsStore
 	frontendURL string
 	asynqClient *asynq.Client
+	gateways    *gateway.Registry
 }
 
-func NewHandler(pool *pgxpool.Pool, cfg *app.Config, asynqClient *asynq.Client, store *app.SettingsStore) *Handler {
+func NewHandler(pool *pgxpool.Pool, cfg *app.Config, asynqClient *asynq.Client, store *app.SettingsStore, gateways *gateway.Registry) *Handler {
 	return &Handler{
 		pool:        pool,
 		store:       store,
 		frontendURL: cfg.FrontendURL,
 		asynqClient: asynqClient,
+		gateways:    gateways,
 	}
 }
 
 type CreateCheckoutRequest struct {
 	OrderID string `json:"order_id" binding:"required"`
+	// Gateway 为空时使用默认网关
+	Gateway string `json:"gateway"`
+}
+
+type PayInvoiceRequest struct {
+	Gateway string `json:"gateway"`
+}
+
+type MarkInvoicePaidRequest struct {
+	// TransactionReference 银行流水号等到账凭证
+	TransactionReference string `json:"transaction_reference" binding:"required"`
+	// Method 线下付款方式，缺省为银行转账
+	Method string `json:"method" binding:"omitempty,oneof=bank_transfer cash cheque other"`
 }
@@ -1,10 +1,13 @@
 package payment
 
 import (
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/adiecho/echobilling/internal/common"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v82"
 )
 
 func TestDecimalAndCentsConversions(t *testing.T) {
@@ -63,3 +66,107 @@ func TestCalculateExpiryDate(t *testing.T) {
 		t.Fatalf("annual expiry mismatch: %s", got)
 	}
 }
+
+func TestBuildCheckoutLines(t *testing.T) {
+	t.Parallel()
+
+	items := []invoiceLine{
+		{Description: "VPS renewal", Quantity: 1, UnitAmount: 1000},
+		{Description: "Free backup", Quantity: 1, UnitAmount: 0},
+	}
+	lines := buildCheckoutLines(items, 200, 1200, "INV-1")
+	if len(lines) != 2 || lines[0].UnitAmount != 1000 || lines[1].Description != "Tax" || lines[1].UnitAmount != 200 {
+		t.Fatalf("unexpected itemized lines: %+v", lines)
+	}
+
+	// 含折扣（负数）行时退化为总额
+	discounted := append(items, invoiceLine{Description: "Discount", Quantity: 1, UnitAmount: -300})
+	lines = buildCheckoutLines(discounted, 0, 700, "INV-2")
+	if len(lines) != 1 || lines[0].UnitAmount != 700 || lines[0].Description != "Invoice INV-2" {
+		t.Fatalf("expected single total line, got %+v", lines)
+	}
+
+	// 明细与总额不一致时同样退化
+	lines = buildCheckoutLines(items, 0, 1500, "INV-3")
+	if len(lines) != 1 || lines[0].UnitAmount != 1500 {
+		t.Fatalf("expected total fallback on mismatch, got %+v", lines)
+	}
+}
+
+func TestCheckoutCreditDue(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		total  string
+		paid   int64
+		want   int64
+		wantOK bool
+	}{
+		{"credit covers the unpaid part", "25.00", 1500, 1000, true},
+		{"stale session paid in full releases credit", "25.00", 2500, 0, true},
+		{"overpayment needs no credit", "25.00", 3000, 0, true},
+		{"unknown amount keeps existing credit", "25.00", 0, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok, err := checkoutCreditDue(tt.total, &stripe.CheckoutSession{AmountTotal: tt.paid})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if got != tt.want || ok != tt.wantOK {
+			t.Fatalf("%s: got (%d, %v), want (%d, %v)", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestPaymentSettled(t *testing.T) {
+	t.Parallel()
+
+	for status, want := range map[string]bool{
+		"succeeded":          true,
+		"partially_refunded": true,
+		"refunded":           true,
+		"failed":             false,
+		"processing":         false,
+		"":                   false,
+	} {
+		if got := paymentSettled(status); got != want {
+			t.Fatalf("paymentSettled(%q) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestParseEventFilter(t *testing.T) {
+	t.Parallel()
+
+	newContext := func(query string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/admin/payment-events?"+query, nil)
+		return c
+	}
+
+	f, err := parseEventFilter(newContext("type=charge.refunded&status=failed&from=2026-03-01&to=2026-03-31"))
+	if err != nil {
+		t.Fatalf("parseEventFilter returned error: %v", err)
+	}
+	if f.Type != "charge.refunded" || f.Status != EventStatusFailed {
+		t.Fatalf("parseEventFilter = %+v", f)
+	}
+	if !f.From.Equal(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("From = %v, want 2026-03-01", f.From)
+	}
+	// to 包含当天，查询条件为小于次日零点
+	if !f.To.Equal(time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("To = %v, want 2026-04-01", f.To)
+	}
+
+	if f, err := parseEventFilter(newContext("")); err != nil || !f.From.IsZero() || !f.To.IsZero() {
+		t.Fatalf("parseEventFilter(empty) = %+v, %v", f, err)
+	}
+	if _, err := parseEventFilter(newContext("status=done")); err == nil {
+		t.Fatal("expected error for unknown status")
+	}
+	if _, err := parseEventFilter(newContext("from=03/01/2026")); err == nil {
+		t.Fatal("expected error for malformed date")
+	}
+}
@@ -0,0 +1,409 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/billing"
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/credit"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/adiecho/echobilling/internal/invoicestatus"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/stripe/stripe-go/v82"
+)
+
+type invoiceLine struct {
+	Description string
+	Quantity    int64
+	UnitAmount  int64
+}
+
+// CreateInvoiceCheckoutSession 通过客户选择的支付网关为待支付发票发起付款，
+// 线下转账返回以发票号为参考号的付款说明
+func (h *Handler) CreateInvoiceCheckoutSession(c *gin.Context) {
+	userID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	var req PayInvoiceRequest
+	if err := bindOptionalJSON(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	gw := h.resolveGateway(c, req.Gateway)
+	if gw == nil {
+		return
+	}
+
+	ctx := c.Request.Context()
+	invoiceID := c.Param("id")
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var invoiceUserID, invoiceNumber, status, total, tax, currency string
+	var taxInclusive, autoCharging bool
+	err = tx.QueryRow(ctx,
+		`SELECT user_id, COALESCE(invoice_number, ''), status::text, total::text, tax::text, currency, tax_inclusive,
+		        auto_charge_attempted_at IS NULL AND COALESCE(auto_charge_started_at > $2, FALSE)
+		 FROM invoices
+		 WHERE id = $1
+		 FOR UPDATE`,
+		invoiceID, time.Now().Add(-autoChargeClaimTimeout),
+	).Scan(&invoiceUserID, &invoiceNumber, &status, &total, &tax, &currency, &taxInclusive, &autoCharging)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if invoiceUserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	if status != "pending" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invoice is not awaiting payment"})
+		return
+	}
+
+	// 自动扣款进行中，等待扣款结果，避免重复付款
+	if autoCharging {
+		c.JSON(http.StatusConflict, gin.H{"error": "Automatic payment for this invoice is in progress"})
+		return
+	}
+
+	totalCents, err := common.DecimalAmountToCents(total)
+	if err != nil || totalCents <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invoice has no amount due"})
+		return
+	}
+
+	// 先用账户余额抵扣，剩余部分再走支付网关
+	now := time.Now()
+	creditApplied, err := credit.ApplyToInvoice(ctx, tx, userID, invoiceID, totalCents, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply account credit"})
+		return
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE invoices SET credit_applied = $2, updated_at = $3 WHERE id = $1`,
+		invoiceID, common.CentsToDecimal(creditApplied), now,
+	); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply account credit"})
+		return
+	}
+
+	amountDue := totalCents - creditApplied
+	if amountDue == 0 {
+		result, err := h.settleInvoicePayment(ctx, tx, invoiceID, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to settle invoice"})
+			return
+		}
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to settle invoice"})
+			return
+		}
+		if err := h.finishInvoicePayment(ctx, result); err != nil {
+			log.Printf("Failed to run follow-up actions for invoice %s: %v", invoiceID, err)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"paid_with_credit": true,
+			"credit_applied":   common.CentsToDecimal(creditApplied),
+		})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// 含税定价的发票明细已包含税额
+	if taxInclusive {
+		tax = "0"
+	}
+	lines, err := h.invoiceCheckoutLines(ctx, invoiceID, invoiceNumber, tax, amountDue)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invoice items"})
+		return
+	}
+
+	checkoutReq := h.newCheckoutRequest(userID, currency, amountDue)
+	checkoutReq.Reference = invoiceNumber
+	for _, line := range lines {
+		checkoutReq.LineItems = append(checkoutReq.LineItems, gateway.LineItem{
+			Name:       line.Description,
+			UnitAmount: line.UnitAmount,
+			Quantity:   line.Quantity,
+		})
+	}
+	checkoutReq.Metadata = map[string]string{
+		"invoice_id":     invoiceID,
+		"invoice_number": invoiceNumber,
+		"user_id":        userID,
+	}
+	h.saveCardForRenewals(ctx, gw, &checkoutReq, userID)
+
+	checkout, err := gw.CreateCheckout(ctx, checkoutReq)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create checkout session"})
+		return
+	}
+	// 记录会话，发票作废后由定时任务使其失效
+	if checkout.SessionID != "" {
+		if _, err := h.pool.Exec(ctx,
+			`INSERT INTO invoice_checkout_sessions (invoice_id, gateway, session_id, created_at)
+			 VALUES ($1, $2, $3, $4)
+			 ON CONFLICT (gateway, session_id) DO NOTHING`,
+			invoiceID, gw.Name(), checkout.SessionID, time.Now(),
+		); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create checkout session"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, checkoutResponse(checkout, creditApplied))
+}
+
+// invoiceCheckoutLines 读取发票明细并转换为 Checkout 行项目，税费行由 tax 参数单独生成。
+// totalCents 为实际应付金额，使用余额抵扣后与明细合计不一致，会退化为一行总额
+func (h *Handler) invoiceCheckoutLines(ctx context.Context, invoiceID, invoiceNumber, tax string, totalCents int64) ([]invoiceLine, error) {
+	rows, err := h.pool.Query(ctx,
+		`SELECT description, quantity, unit_price::text
+		 FROM invoice_items
+		 WHERE invoice_id = $1 AND kind <> 'tax'
+		 ORDER BY created_at`,
+		invoiceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]invoiceLine, 0)
+	for rows.Next() {
+		var (
+			line      invoiceLine
+			unitPrice string
+		)
+		if err := rows.Scan(&line.Description, &line.Quantity, &unitPrice); err != nil {
+			return nil, err
+		}
+		line.UnitAmount, err = common.DecimalAmountToCents(unitPrice)
+		if err != nil {
+			// 无法解析的金额交给 buildCheckoutLines 退化为总额行
+			line.UnitAmount = -1
+		}
+		items = append(items, line)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	taxCents, _ := common.DecimalAmountToCents(tax)
+	return buildCheckoutLines(items, taxCents, totalCents, invoiceNumber), nil
+}
+
+// buildCheckoutLines 将发票明细和税额组合为 Checkout 行项目。
+// Stripe 不接受负数单价，明细无法与发票总额对齐时退化为一行总额，保证实收金额等于发票总额。
+func buildCheckoutLines(items []invoiceLine, taxCents, totalCents int64, invoiceNumber string) []invoiceLine {
+	lines := make([]invoiceLine, 0, len(items)+1)
+	var sum int64
+	itemized := true
+	for _, item := range items {
+		if item.UnitAmount < 0 || item.Quantity <= 0 {
+			itemized = false
+			break
+		}
+		if item.UnitAmount == 0 {
+			continue
+		}
+		sum += item.UnitAmount * item.Quantity
+		lines = append(lines, item)
+	}
+
+	if taxCents > 0 {
+		lines = append(lines, invoiceLine{Description: "Tax", Quantity: 1, UnitAmount: taxCents})
+		sum += taxCents
+	}
+
+	if !itemized || len(lines) == 0 || sum != totalCents {
+		return []invoiceLine{{
+			Description: "Invoice " + invoiceNumber,
+			Quantity:    1,
+			UnitAmount:  totalCents,
+		}}
+	}
+	return lines
+}
+
+// handleInvoiceCheckoutCompleted 处理发票支付完成：结清发票、登记付款，并触发发票对应的后续动作
+func (h *Handler) handleInvoiceCheckoutCompleted(ctx context.Context, gatewayName string, sess *stripe.CheckoutSession, invoiceID string) error {
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID, status, currency, amountDue string
+	err = tx.QueryRow(ctx,
+		`SELECT user_id, status::text, currency, (total - credit_applied)::text
+		 FROM invoices
+		 WHERE id = $1
+		 FOR UPDATE`,
+		invoiceID,
+	).Scan(&userID, &status, &currency, &amountDue)
+	if err != nil {
+		return fmt.Errorf("failed to query invoice: %w", err)
+	}
+
+	held, err := checkoutHeldUnapplied(ctx, tx, sess.ID)
+	if err != nil || held {
+		return err
+	}
+
+	now := time.Now()
+	if err := markInvoiceCheckout(ctx, tx, gatewayName, sess.ID, "completed", now); err != nil {
+		return err
+	}
+
+	// 发票在客户付款前已作废，或已通过自动扣款等其他方式付清：付款照常登记，
+	// 金额转入余额或原路退款，不再重试结算。本次付款此前已结清发票时按原流程幂等处理
+	if status != invoicestatus.Pending {
+		recorded, err := checkoutSettledInvoice(ctx, tx, invoiceID, sess)
+		if err != nil {
+			return err
+		}
+		if !recorded {
+			reason := "Invoice " + invoiceID + " was already paid"
+			if status == invoicestatus.Void {
+				reason = "Invoice " + invoiceID + " was voided before payment"
+			}
+			if err := h.holdUnappliedCheckout(ctx, tx, gatewayName, sess, userID, reason, now); err != nil {
+				return err
+			}
+			if err := tx.Commit(ctx); err != nil {
+				return fmt.Errorf("failed to commit unapplied invoice payment: %w", err)
+			}
+			return nil
+		}
+		if status != invoicestatus.Paid {
+			return tx.Commit(ctx)
+		}
+	}
+
+	covered, err := reconcileInvoiceCredit(ctx, tx, userID, invoiceID, sess, now)
+	if err != nil {
+		return err
+	}
+	if !covered {
+		if err := h.holdUnappliedCheckout(ctx, tx, gatewayName, sess, userID, "Partial payment for invoice "+invoiceID, now); err != nil {
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("failed to commit underpaid invoice payment: %w", err)
+		}
+		return nil
+	}
+	result, err := h.settleInvoicePayment(ctx, tx, invoiceID, now)
+	if err != nil {
+		return err
+	}
+
+	amount := amountDue
+	if sess.AmountTotal > 0 {
+		amount = common.CentsToDecimal(sess.AmountTotal)
+	}
+	if _, err := recordCheckoutPayment(ctx, tx, gatewayName, sess, userID, &invoiceID, amount, currency, "succeeded", now); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit invoice payment: %w", err)
+	}
+
+	return h.finishInvoicePayment(ctx, result)
+}
+
+// invoicePayment 发票结清后需要在事务提交后执行的动作
+type invoicePayment struct {
+	settlement        *billing.Settlement
+	provisioningTasks []provisioningTask
+}
+
+// settleInvoicePayment 在事务内结清发票；订单首付发票（未关联服务）同时完成订单支付并准备开通
+func (h *Handler) settleInvoicePayment(ctx context.Context, tx pgx.Tx, invoiceID string, now time.Time) (*invoicePayment, error) {
+	var (
+		userID      string
+		orderID     *string
+		serviceID   *string
+		orderStatus string
+	)
+	err := tx.QueryRow(ctx,
+		`SELECT i.user_id, i.order_id::text, i.service_id::text,
+		        COALESCE(o.status::text, '')
+		 FROM invoices i
+		 LEFT JOIN orders o ON o.id = i.order_id
+		 WHERE i.id = $1`,
+		invoiceID,
+	).Scan(&userID, &orderID, &serviceID, &orderStatus)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query invoice: %w", err)
+	}
+
+	settlement, err := billing.SettleInvoice(ctx, tx, invoiceID, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to settle invoice: %w", err)
+	}
+	result := &invoicePayment{settlement: settlement}
+
+	if orderID != nil && serviceID == nil && (orderStatus == "draft" || orderStatus == "pending_payment") {
+		if _, err := tx.Exec(ctx,
+			`UPDATE orders
+			 SET status = 'paid', updated_at = $1
+			 WHERE id = $2`,
+			now, *orderID,
+		); err != nil {
+			return nil, fmt.Errorf("failed to update order status: %w", err)
+		}
+
+		result.provisioningTasks, err = h.prepareProvisioningJobs(ctx, tx, *orderID, userID, now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare provisioning jobs: %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+// finishInvoicePayment 事务提交后投递恢复、套餐变更和开通任务
+func (h *Handler) finishInvoicePayment(ctx context.Context, result *invoicePayment) error {
+	settlement := result.settlement
+	if err := billing.EnqueueUnsuspend(h.asynqClient, settlement); err != nil {
+		log.Printf("[webhook] failed to enqueue unsuspend for service %s: %v", settlement.ServiceID, err)
+	}
+	if err := billing.EnqueuePlanChange(h.asynqClient, settlement); err != nil {
+		log.Printf("[webhook] failed to enqueue plan change %s: %v", settlement.PlanChangeID, err)
+	}
+
+	if err := h.enqueueProvisioningTasks(ctx, result.provisioningTasks); err != nil {
+		return fmt.Errorf("failed to enqueue provisioning tasks: %w", err)
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/adiecho/echobilling/internal/common"
 	"github.com/adiecho/echobilling/internal/provisioning"
 	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
@@ -29,7 +30,7 @@ func (h *Handler) prepareProvisioningJobs(
 	now time.Time,
 ) ([]provisioningTask, error) {
 	rows, err := tx.Query(ctx,
-		`SELECT id, plan_id, billing_cycle::text
+		`SELECT id, plan_id, billing_cycle::text, quantity
 		 FROM order_items
 		 WHERE order_id = $1
 		 ORDER BY created_at ASC`,
@@ -38,45 +39,71 @@ func (h *Handler) prepareProvisioningJobs(
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	tasks := make([]provisioningTask, 0)
+	type orderItemRow struct {
+		id           string
+		planID       string
+		billingCycle string
+		quantity     int
+	}
+	items := make([]orderItemRow, 0)
 	for rows.Next() {
-		var (
-			orderItemID  string
-			planID       string
-			billingCycle string
-		)
-		if err := rows.Scan(&orderItemID, &planID, &billingCycle); err != nil {
+		var item orderItemRow
+		if err := rows.Scan(&item.id, &item.planID, &item.billingCycle, &item.quantity); err != nil {
+			rows.Close()
 			return nil, err
 		}
+		items = append(items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-		serviceID, serviceStatus, err := h.ensureServiceRecord(ctx, tx, orderItemID, planID, userID, billingCycle, now)
+	tasks := make([]provisioningTask, 0)
+	for _, item := range items {
+		services, err := h.ensureServiceRecords(ctx, tx, item.id, item.planID, userID, item.billingCycle, item.quantity, now)
 		if err != nil {
 			return nil, err
 		}
-		if serviceStatus == "active" {
-			continue
-		}
 
-		jobID, shouldEnqueue, err := h.ensureProvisioningJob(ctx, tx, serviceID, now)
-		if err != nil {
-			return nil, err
-		}
-		if !shouldEnqueue {
-			continue
-		}
+		for _, svc := range services {
+			if svc.status == "active" {
+				continue
+			}
 
-		tasks = append(tasks, provisioningTask{
-			ServiceID: serviceID,
-			OrderID:   orderID,
-			PlanID:    planID,
-			UserID:    userID,
-			JobID:     jobID,
-		})
+			jobID, shouldEnqueue, err := h.ensureProvisioningJob(ctx, tx, svc.id, now)
+			if err != nil {
+				return nil, err
+			}
+			if !shouldEnqueue {
+				continue
+			}
+
+			tasks = append(tasks, provisioningTask{
+				ServiceID: svc.id,
+				OrderID:   orderID,
+				PlanID:    item.planID,
+				UserID:    userID,
+				JobID:     jobID,
+			})
+		}
 	}
 
-	if err := rows.Err(); err != nil {
+	// 持续优惠的优惠券记到服务上，续费时继续按折扣出账
+	_, err = tx.Exec(ctx,
+		`UPDATE services s
+		 SET coupon_id = o.coupon_id
+		 FROM order_items oi
+		 JOIN orders o ON o.id = oi.order_id
+		 JOIN coupons c ON c.id = o.coupon_id
+		 WHERE s.order_item_id = oi.id
+		   AND oi.order_id = $1
+		   AND oi.unit_discount > 0
+		   AND c.duration = 'forever'`,
+		orderID,
+	)
+	if err != nil {
 		return nil, err
 	}
 
@@ -95,63 +122,75 @@ func (h *Handler) prepareProvisioningJobs(
 	return tasks, nil
 }
 
-func (h *Handler) ensureServiceRecord(
+type serviceRecord struct {
+	id     string
+	status string
+}
+
+// ensureServiceRecords 保证订单项的每个单位都有一条服务记录（按 unit_index 区分）。
+// 插入依赖 (order_item_id, unit_index) 唯一索引，Webhook 重复投递时不会多建服务。
+func (h *Handler) ensureServiceRecords(
 	ctx context.Context,
 	tx pgx.Tx,
 	orderItemID string,
 	planID string,
 	userID string,
 	billingCycle string,
+	quantity int,
 	now time.Time,
-) (string, string, error) {
-	var (
-		serviceID string
-		status    string
-	)
-	err := tx.QueryRow(ctx,
-		`SELECT id, status::text
-		 FROM services
-		 WHERE order_item_id = $1`,
-		orderItemID,
-	).Scan(&serviceID, &status)
-	if err == nil {
-		if status != "active" && status != "provisioning" {
-			_, err = tx.Exec(ctx,
-				`UPDATE services
-				 SET status = 'provisioning', updated_at = $2
-				 WHERE id = $1`,
-				serviceID, now,
-			)
-			if err != nil {
-				return "", "", err
-			}
-			status = "provisioning"
-		}
-		return serviceID, status, nil
-	}
-	if !errors.Is(err, pgx.ErrNoRows) {
-		return "", "", err
-	}
-
+) ([]serviceRecord, error) {
 	expiresAt := calculateExpiryDate(billingCycle, now)
 	metadata, _ := json.Marshal(map[string]interface{}{
 		"provisioning_source": "stripe_webhook",
 		"created_at":          now.UTC().Format(time.RFC3339),
 	})
 
-	serviceID = uuid.New().String()
-	_, err = tx.Exec(ctx,
-		`INSERT INTO services (
-			id, user_id, order_item_id, plan_id, status, expires_at, metadata, created_at, updated_at
+	for unit := 0; unit < quantity; unit++ {
+		_, err := tx.Exec(ctx,
+			`INSERT INTO services (
+				id, user_id, order_item_id, unit_index, plan_id, status, expires_at, metadata, created_at, updated_at
+			)
+			VALUES ($1, $2, $3, $4, $5, 'provisioning', $6, $7, $8, $8)
+			ON CONFLICT (order_item_id, unit_index) DO NOTHING`,
+			uuid.New().String(), userID, orderItemID, unit, planID, expiresAt, metadata, now,
 		)
-		VALUES ($1, $2, $3, $4, 'provisioning', $5, $6, $7, $7)`,
-		serviceID, userID, orderItemID, planID, expiresAt, metadata, now,
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 已存在但未开通的服务重新进入开通流程
+	_, err := tx.Exec(ctx,
+		`UPDATE services
+		 SET status = 'provisioning', updated_at = $2
+		 WHERE order_item_id = $1 AND status NOT IN ('active', 'provisioning')`,
+		orderItemID, now,
 	)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
-	return serviceID, "provisioning", nil
+	rows, err := tx.Query(ctx,
+		`SELECT id, status::text
+		 FROM services
+		 WHERE order_item_id = $1
+		 ORDER BY unit_index`,
+		orderItemID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	services := make([]serviceRecord, 0, quantity)
+	for rows.Next() {
+		var svc serviceRecord
+		if err := rows.Scan(&svc.id, &svc.status); err != nil {
+			return nil, err
+		}
+		services = append(services, svc)
+	}
+	return services, rows.Err()
 }
 
 func (h *Handler) ensureProvisioningJob(
@@ -250,12 +289,5 @@ func (h *Handler) markProvisioningJobFailed(ctx context.Context, jobID, serviceI
 }
 
 func calculateExpiryDate(billingCycle string, now time.Time) time.Time {
-	switch billingCycle {
-	case "quarterly":
-		return now.AddDate(0, 3, 0)
-	case "annually":
-		return now.AddDate(1, 0, 0)
-	default:
-		return now.AddDate(0, 1, 0)
-	}
+	return common.AddBillingCycle(now, billingCycle)
 }
@@ -3,6 +3,25 @@ package payment
 import "github.com/gin-gonic/gin"
 
 func RegisterRoutes(public *gin.RouterGroup, webhook *gin.RouterGroup, h *Handler) {
+	public.GET("/payment-gateways", h.ListGateways)
 	public.POST("/checkout/session", h.CreateCheckoutSession)
-	webhook.POST("/stripe", h.HandleWebhook)
+	webhook.POST("/:gateway", h.HandleWebhook)
+}
+
+func RegisterPortalRoutes(portal *gin.RouterGroup, h *Handler) {
+	portal.POST("/invoices/:id/pay", h.CreateInvoiceCheckoutSession)
+	portal.POST("/credit/top-up", h.CreateCreditTopUpSession)
+}
+
+func RegisterAdminRoutes(admin *gin.RouterGroup, h *Handler) {
+	admin.POST("/invoices/:id/mark-paid", h.AdminMarkInvoicePaid)
+	admin.GET("/payment-events", h.AdminListPaymentEvents)
+	admin.GET("/payment-events/:id", h.AdminGetPaymentEvent)
+	admin.POST("/payment-events/:id/reprocess", h.AdminReprocessPaymentEvent)
+}
+
+// RegisterSandboxRoutes 沙箱支付页，公开访问，Session ID 即访问凭证
+func RegisterSandboxRoutes(sandbox *gin.RouterGroup, h *Handler) {
+	sandbox.GET("/checkout/:id", h.SandboxCheckoutPage)
+	sandbox.POST("/checkout/:id", h.CompleteSandboxCheckout)
 }
@@ -0,0 +1,135 @@
+package payment
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/gin-gonic/gin"
+)
+
+var sandboxCheckoutPage = template.Must(template.New("sandbox").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Sandbox checkout</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 32rem; margin: 3rem auto; color: #111; }
+.banner { background: #fef3c7; border: 1px solid #f59e0b; padding: .5rem .75rem; border-radius: .375rem; }
+table { width: 100%; border-collapse: collapse; margin: 1.5rem 0; }
+td { padding: .375rem 0; border-bottom: 1px solid #e5e7eb; }
+td.amount { text-align: right; }
+tr.total td { font-weight: 600; border-bottom: none; }
+button { display: block; width: 100%; margin: .5rem 0; padding: .625rem; font-size: 1rem; cursor: pointer; }
+</style>
+</head>
+<body>
+<p class="banner">Sandbox payment gateway: no real money is moved.</p>
+<h1>Pay {{.Total}} {{.Currency}}</h1>
+<table>
+{{range .Items}}<tr><td>{{.Name}} &times; {{.Quantity}}</td><td class="amount">{{.Amount}}</td></tr>
+{{end}}<tr class="total"><td>Total</td><td class="amount">{{.Total}} {{.Currency}}</td></tr>
+</table>
+<form method="post">
+<button name="outcome" value="succeed">Pay successfully</button>
+<button name="outcome" value="fail">Decline the card</button>
+<button name="outcome" value="dispute">Pay, then open a dispute</button>
+<button name="outcome" value="refund">Pay, then refund in full</button>
+</form>
+</body>
+</html>
+`))
+
+type sandboxPageItem struct {
+	Name     string
+	Quantity int64
+	Amount   string
+}
+
+// sandboxGateway 返回沙箱网关，生产环境未注册时返回 nil
+func (h *Handler) sandboxGateway() *gateway.SandboxGateway {
+	g, err := h.gateways.Lookup(gateway.Sandbox)
+	if err != nil {
+		return nil
+	}
+	sandbox, _ := g.(*gateway.SandboxGateway)
+	return sandbox
+}
+
+// SandboxCheckoutPage - GET /api/v1/sandbox/checkout/:id
+// 模拟的托管支付页，列出应付金额并提供付款结果选项
+func (h *Handler) SandboxCheckoutPage(c *gin.Context) {
+	sandbox := h.sandboxGateway()
+	if sandbox == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sandbox gateway is not available"})
+		return
+	}
+	sess, ok := sandbox.Session(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Checkout session not found"})
+		return
+	}
+
+	items := make([]sandboxPageItem, 0, len(sess.LineItems))
+	for _, item := range sess.LineItems {
+		items = append(items, sandboxPageItem{
+			Name:     item.Name,
+			Quantity: item.Quantity,
+			Amount:   common.CentsToDecimal(item.UnitAmount * item.Quantity),
+		})
+	}
+
+	var page bytes.Buffer
+	if err := sandboxCheckoutPage.Execute(&page, gin.H{
+		"Items":    items,
+		"Total":    common.CentsToDecimal(sess.Amount),
+		"Currency": strings.ToUpper(sess.Currency),
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render checkout page"})
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+}
+
+// CompleteSandboxCheckout - POST /api/v1/sandbox/checkout/:id
+// 按选择的结果生成签名事件并交给 Webhook 流程处理，然后跳回前端
+func (h *Handler) CompleteSandboxCheckout(c *gin.Context) {
+	sandbox := h.sandboxGateway()
+	if sandbox == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sandbox gateway is not available"})
+		return
+	}
+
+	sess, events, err := sandbox.Complete(c.Param("id"), c.PostForm("outcome"))
+	if err != nil {
+		switch {
+		case errors.Is(err, gateway.ErrSessionNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Checkout session not found"})
+		case errors.Is(err, gateway.ErrUnknownOutcome):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid outcome"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign sandbox events"})
+		}
+		return
+	}
+
+	ctx := c.Request.Context()
+	for _, event := range events {
+		if _, svcErr := h.processWebhook(ctx, sandbox, event.Payload, event.Signature); svcErr != nil {
+			log.Printf("[sandbox] failed to process event for session %s: %v", sess.ID, svcErr)
+			common.WriteServiceError(c, svcErr)
+			return
+		}
+	}
+
+	target := strings.ReplaceAll(sess.SuccessURL, "{CHECKOUT_SESSION_ID}", sess.ID)
+	if c.PostForm("outcome") == gateway.OutcomeFail {
+		target = sess.CancelURL
+	}
+	c.Redirect(http.StatusSeeOther, target)
+}
@@ -4,19 +4,25 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/coupon"
+	"github.com/adiecho/echobilling/internal/credit"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/adiecho/echobilling/internal/numbering"
+	"github.com/adiecho/echobilling/internal/order"
+	"github.com/adiecho/echobilling/internal/tax"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
-	"github.com/stripe/stripe-go/v82"
-	"github.com/stripe/stripe-go/v82/checkout/session"
 )
 
-// CreateCheckoutSession 创建 Stripe Checkout Session
+// CreateCheckoutSession 通过客户选择的支付网关为订单发起付款。
+// 托管支付返回跳转地址；线下转账先开具待支付发票，返回以发票号为参考号的付款说明
 func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 	var req CreateCheckoutRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -29,6 +35,11 @@ func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 		return
 	}
 
+	gw := h.resolveGateway(c, req.Gateway)
+	if gw == nil {
+		return
+	}
+
 	ctx := c.Request.Context()
 	tx, err := h.pool.Begin(ctx)
 	if err != nil {
@@ -38,12 +49,14 @@ func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 	defer tx.Rollback(ctx)
 
 	var orderUserID, orderStatus, orderTotal, currency string
+	var setupFeeWaived bool
+	var couponID *string
 	err = tx.QueryRow(ctx,
-		`SELECT user_id, status, total_amount::text, currency
+		`SELECT user_id, status, total_amount::text, currency, setup_fee_waived, coupon_id::text
 		 FROM orders
 		 WHERE id = $1`,
 		req.OrderID,
-	).Scan(&orderUserID, &orderStatus, &orderTotal, &currency)
+	).Scan(&orderUserID, &orderStatus, &orderTotal, &currency, &setupFeeWaived, &couponID)
 
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -64,8 +77,34 @@ func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 		return
 	}
 
+	// 优惠券可能在加入购物车后过期或用尽，下单前重新校验
+	couponCode := ""
+	if couponID != nil {
+		applied, err := coupon.Get(ctx, tx, *couponID)
+		if err == nil {
+			err = coupon.CheckRedeemable(ctx, tx, applied, userID, time.Now())
+		}
+		if err != nil {
+			if coupon.IsRejection(err) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		couponCode = applied.Code
+	}
+
+	// 客户资料可能在加入购物车后变化，下单前按最新资料重新计税
+	totals, err := order.RecalculateTotals(ctx, tx, h.store, req.OrderID, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate tax"})
+		return
+	}
+	orderTotal = common.CentsToDecimal(totals.Tax.Total)
+
 	rows, err := tx.Query(ctx,
-		`SELECT oi.quantity, oi.unit_price::text,
+		`SELECT oi.quantity, oi.unit_price::text, oi.unit_discount::text, oi.setup_fee::text,
 		        COALESCE(oi.plan_snapshot->>'name', p.name, 'Service Plan') AS plan_name
 		 FROM order_items oi
 		 LEFT JOIN plans p ON p.id = oi.plan_id
@@ -78,11 +117,11 @@ func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 	}
 	defer rows.Close()
 
-	lineItems := make([]*stripe.CheckoutSessionLineItemParams, 0)
+	lineItems := make([]gateway.LineItem, 0)
 	for rows.Next() {
 		var quantity int64
-		var unitPriceDecimal, name string
-		if err := rows.Scan(&quantity, &unitPriceDecimal, &name); err != nil {
+		var unitPriceDecimal, unitDiscountDecimal, setupFeeDecimal, name string
+		if err := rows.Scan(&quantity, &unitPriceDecimal, &unitDiscountDecimal, &setupFeeDecimal, &name); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read order items"})
 			return
 		}
@@ -92,17 +131,36 @@ func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid order item amount"})
 			return
 		}
+		unitDiscount, err := common.DecimalAmountToCents(unitDiscountDecimal)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid order item amount"})
+			return
+		}
 
-		lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
-			PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
-				Currency: stripe.String(strings.ToLower(currency)),
-				ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
-					Name: stripe.String(name),
-				},
-				UnitAmount: stripe.Int64(unitAmount),
-			},
-			Quantity: stripe.Int64(quantity),
+		// 网关不接受负数行，折扣直接体现在折后单价上
+		itemName := name
+		if unitDiscount > 0 {
+			itemName = fmt.Sprintf("%s (%s)", name, couponCode)
+		}
+
+		lineItems = append(lineItems, gateway.LineItem{
+			Name:       itemName,
+			UnitAmount: unitAmount - unitDiscount,
+			Quantity:   quantity,
 		})
+
+		setupFee, err := common.DecimalAmountToCents(setupFeeDecimal)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid order item amount"})
+			return
+		}
+		if setupFee > 0 && !setupFeeWaived {
+			lineItems = append(lineItems, gateway.LineItem{
+				Name:       setupFeeDescription(name),
+				UnitAmount: setupFee,
+				Quantity:   quantity,
+			})
+		}
 	}
 
 	if err := rows.Err(); err != nil {
@@ -115,21 +173,89 @@ func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 		return
 	}
 
-	params := &stripe.CheckoutSessionParams{
-		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
-		LineItems:          lineItems,
-		Mode:               stripe.String(string(stripe.CheckoutSessionModePayment)),
-		SuccessURL:         stripe.String(fmt.Sprintf("%s/checkout/success?session_id={CHECKOUT_SESSION_ID}", h.frontendURL)),
-		CancelURL:          stripe.String(fmt.Sprintf("%s/checkout/cancel", h.frontendURL)),
-		ClientReferenceID:  stripe.String(req.OrderID),
-		Metadata: map[string]string{
-			"order_id":    req.OrderID,
-			"user_id":     userID,
-			"order_total": orderTotal,
-		},
+	// 含税定价时税额已包含在单价中，否则单独列一行税费
+	if !totals.Tax.Decision.Inclusive && totals.Tax.Tax > 0 {
+		lineItems = append(lineItems, gateway.LineItem{
+			Name:       totals.Tax.Decision.Label(),
+			UnitAmount: totals.Tax.Tax,
+			Quantity:   1,
+		})
 	}
 
-	sess, err := session.New(params)
+	// 账户余额优先抵扣，足额抵扣时直接完成订单，无需走支付网关
+	now := time.Now()
+	creditApplied, err := credit.ApplyToOrder(ctx, tx, userID, req.OrderID, totals.Tax.Total, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply account credit"})
+		return
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE orders SET credit_applied = $2 WHERE id = $1`,
+		req.OrderID, common.CentsToDecimal(creditApplied),
+	); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply account credit"})
+		return
+	}
+
+	amountDue := totals.Tax.Total - creditApplied
+	if amountDue == 0 {
+		invoiceID, provisioningTasks, err := h.completeOrderPayment(ctx, tx, req.OrderID, userID, orderStatus, currency, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete order"})
+			return
+		}
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+			return
+		}
+		if err := h.enqueueProvisioningTasks(ctx, provisioningTasks); err != nil {
+			log.Printf("Failed to enqueue provisioning tasks for order %s: %v", req.OrderID, err)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"paid_with_credit": true,
+			"credit_applied":   common.CentsToDecimal(creditApplied),
+			"invoice_id":       invoiceID,
+		})
+		return
+	}
+
+	// 网关不接受负数行，部分抵扣时按应付金额收一行总额
+	if creditApplied > 0 {
+		lineItems = []gateway.LineItem{{
+			Name:       fmt.Sprintf("Order total (%s account credit applied)", common.CentsToDecimal(creditApplied)),
+			UnitAmount: amountDue,
+			Quantity:   1,
+		}}
+	}
+
+	checkoutReq := h.newCheckoutRequest(userID, currency, amountDue)
+	checkoutReq.LineItems = lineItems
+	checkoutReq.ClientReferenceID = req.OrderID
+	checkoutReq.Metadata = map[string]string{
+		"order_id":    req.OrderID,
+		"user_id":     userID,
+		"order_total": orderTotal,
+	}
+
+	// 线下付款没有网关回调，先开具待支付发票，管理员登记到账后按发票完成订单
+	var invoiceID string
+	if !gw.Capabilities().HostedCheckout {
+		invoiceID, err = h.createInvoice(ctx, tx, req.OrderID, userID, currency, "pending", now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invoice"})
+			return
+		}
+		if err := tx.QueryRow(ctx,
+			`SELECT invoice_number FROM invoices WHERE id = $1`,
+			invoiceID,
+		).Scan(&checkoutReq.Reference); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invoice"})
+			return
+		}
+	}
+	h.saveCardForRenewals(ctx, gw, &checkoutReq, userID)
+
+	checkout, err := gw.CreateCheckout(ctx, checkoutReq)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create checkout session"})
 		return
@@ -139,7 +265,7 @@ func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 		`UPDATE orders
 		 SET status = 'pending_payment', updated_at = $1
 		 WHERE id = $2`,
-		time.Now(), req.OrderID,
+		now, req.OrderID,
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order status"})
@@ -151,16 +277,19 @@ func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"session_id":  sess.ID,
-		"session_url": sess.URL,
-	})
+	resp := checkoutResponse(checkout, creditApplied)
+	if invoiceID != "" {
+		resp["invoice_id"] = invoiceID
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
+// createInvoice 为订单开具发票。status 为 paid 时同时记录付款时间，
+// 线下付款开具 pending 发票，待管理员登记到账后结清
 func (h *Handler) createInvoice(
 	ctx context.Context,
 	tx pgx.Tx,
-	orderID, userID, currency, totalAmount string,
+	orderID, userID, currency, status string,
 	now time.Time,
 ) (string, error) {
 	var existingInvoiceID string
@@ -179,17 +308,47 @@ func (h *Handler) createInvoice(
 		return "", err
 	}
 
+	var (
+		subtotal, discountAmount, taxAmount, totalAmount string
+		creditApplied                                    string
+		decision                                         *tax.Decision
+		setupFeeWaived                                   bool
+		couponID, couponCode                             *string
+	)
+	err = tx.QueryRow(ctx,
+		`SELECT (subtotal - discount_amount)::text, discount_amount::text, tax_amount::text, total_amount::text,
+		        credit_applied::text, tax_details, setup_fee_waived, coupon_id::text,
+		        (SELECT code FROM coupons WHERE coupons.id = orders.coupon_id)
+		 FROM orders
+		 WHERE id = $1`,
+		orderID,
+	).Scan(&subtotal, &discountAmount, &taxAmount, &totalAmount, &creditApplied, &decision, &setupFeeWaived, &couponID, &couponCode)
+	if err != nil {
+		return "", err
+	}
+	if decision == nil {
+		decision = &tax.Decision{}
+	}
+
 	invoiceID := uuid.New().String()
-	invoiceNumber := fmt.Sprintf("INV-%s-%s", now.Format("20060102"), strings.ToUpper(invoiceID[:8]))
+	invoiceNumber, err := numbering.Next(ctx, tx, h.store, numbering.SeriesInvoice, now)
+	if err != nil {
+		return "", err
+	}
 	dueDate := now.AddDate(0, 0, 30)
+	var paidAt *time.Time
+	if status == "paid" {
+		paidAt = &now
+	}
 
 	_, err = tx.Exec(ctx,
 		`INSERT INTO invoices (
-			id, user_id, order_id, invoice_number, status, subtotal, tax, total, currency,
-			due_date, paid_at, created_at, updated_at
+			id, user_id, order_id, invoice_number, status, subtotal, tax, total, credit_applied, currency,
+			tax_inclusive, reverse_charge, due_date, paid_at, created_at, updated_at
 		)
-		VALUES ($1, $2, $3, $4, 'paid', $5, $6, $7, $8, $9, $10, $10, $10)`,
-		invoiceID, userID, orderID, invoiceNumber, totalAmount, "0", totalAmount, strings.ToUpper(currency), dueDate, now,
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $15)`,
+		invoiceID, userID, orderID, invoiceNumber, status, subtotal, taxAmount, totalAmount, creditApplied, strings.ToUpper(currency),
+		decision.Inclusive, decision.ReverseCharge, dueDate, paidAt, now,
 	)
 	if err != nil {
 		return "", err
@@ -199,45 +358,104 @@ func (h *Handler) createInvoice(
 		`SELECT COALESCE(oi.plan_snapshot->>'name', p.name, 'Service'),
 		        oi.quantity,
 		        oi.unit_price::text,
-		        (oi.quantity * oi.unit_price)::text
+		        (oi.quantity * oi.unit_price)::text,
+		        oi.unit_discount::text,
+		        (oi.quantity * oi.unit_discount)::text,
+		        oi.setup_fee::text,
+		        (oi.quantity * oi.setup_fee)::text
 		 FROM order_items oi
 		 LEFT JOIN plans p ON p.id = oi.plan_id
-		 WHERE oi.order_id = $1`,
+		 WHERE oi.order_id = $1
+		 ORDER BY oi.created_at`,
 		orderID,
 	)
 	if err != nil {
 		return "", err
 	}
-	defer rows.Close()
 
+	type invoiceItemRow struct {
+		kind        string
+		description string
+		quantity    int64
+		unitPrice   string
+		amount      string
+	}
+	items := make([]invoiceItemRow, 0)
 	for rows.Next() {
 		var (
-			description string
-			quantity    int64
-			unitPrice   string
-			amount      string
+			item                        invoiceItemRow
+			unitDiscount, discountTotal string
+			setupFee, setupFeeTotal     string
 		)
-		if err := rows.Scan(&description, &quantity, &unitPrice, &amount); err != nil {
+		if err := rows.Scan(
+			&item.description, &item.quantity, &item.unitPrice, &item.amount,
+			&unitDiscount, &discountTotal, &setupFee, &setupFeeTotal,
+		); err != nil {
+			rows.Close()
 			return "", err
 		}
+		item.kind = "line"
+		items = append(items, item)
+
+		// 优惠券折扣单独列为负数行，便于客户看到原价和优惠
+		if couponCode != nil && common.NormalizeAmount(unitDiscount) != "0.00" {
+			items = append(items, invoiceItemRow{
+				kind:        "discount",
+				description: fmt.Sprintf("Discount (%s) - %s", *couponCode, item.description),
+				quantity:    item.quantity,
+				unitPrice:   "-" + common.NormalizeAmount(unitDiscount),
+				amount:      "-" + common.NormalizeAmount(discountTotal),
+			})
+		}
+
+		if !setupFeeWaived && common.NormalizeAmount(setupFee) != "0.00" {
+			items = append(items, invoiceItemRow{
+				kind:        "line",
+				description: setupFeeDescription(item.description),
+				quantity:    item.quantity,
+				unitPrice:   setupFee,
+				amount:      setupFeeTotal,
+			})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
 
+	for _, item := range items {
 		_, err = tx.Exec(ctx,
-			`INSERT INTO invoice_items (id, invoice_id, description, quantity, unit_price, amount, created_at)
-			 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-			uuid.New().String(), invoiceID, description, quantity, unitPrice, amount, now,
+			`INSERT INTO invoice_items (id, invoice_id, kind, description, quantity, unit_price, amount, created_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			uuid.New().String(), invoiceID, item.kind, item.description, item.quantity, item.unitPrice, item.amount, now,
 		)
 		if err != nil {
 			return "", err
 		}
 	}
 
-	if err := rows.Err(); err != nil {
+	taxCents, err := common.DecimalAmountToCents(taxAmount)
+	if err != nil {
+		return "", err
+	}
+	if err := tax.InsertInvoiceLine(ctx, tx, invoiceID, &tax.Breakdown{Decision: *decision, Tax: taxCents}, now); err != nil {
 		return "", err
 	}
 
+	if couponID != nil {
+		if err := coupon.Redeem(ctx, tx, *couponID, userID, orderID, &invoiceID, discountAmount, now); err != nil {
+			return "", err
+		}
+	}
+
 	return invoiceID, nil
 }
 
+// setupFeeDescription 开通费明细行的描述
+func setupFeeDescription(planName string) string {
+	return "Setup fee - " + planName
+}
+
 func mapDisputeStatus(stripeStatus string) string {
 	switch stripeStatus {
 	case "won":
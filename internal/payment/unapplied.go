@@ -0,0 +1,90 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/billing"
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/credit"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/jackc/pgx/v5"
+)
+
+// holdUnappliedPayment 处理已收款但无法结清单据的付款（实际收款不足、发票已作废等）。
+// 付款由调用方照常登记；与余额同币种时金额转入账户余额，供下次付款抵扣，否则原路退款。
+// 按付款去重，Webhook 重投或任务重试不会重复入账或退款
+func (h *Handler) holdUnappliedPayment(
+	ctx context.Context,
+	tx pgx.Tx,
+	gatewayName, paymentID, paymentReference, userID string,
+	amount int64,
+	currency, reason string,
+	now time.Time,
+) error {
+	if amount <= 0 {
+		return nil
+	}
+
+	if credit.SameCurrency(currency) {
+		posted, err := credit.Post(ctx, tx, credit.Entry{
+			UserID:    userID,
+			Kind:      credit.KindUnapplied,
+			Amount:    amount,
+			Reason:    reason,
+			PaymentID: paymentID,
+		}, now)
+		if err != nil {
+			return fmt.Errorf("failed to post unapplied payment: %w", err)
+		}
+		if posted {
+			log.Printf("[payment] payment %s moved to account credit: %s", paymentID, reason)
+		}
+		return nil
+	}
+
+	var refunded bool
+	if err := tx.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM refunds WHERE payment_id = $1 AND status <> 'failed')`,
+		paymentID,
+	).Scan(&refunded); err != nil {
+		return fmt.Errorf("failed to query refunds: %w", err)
+	}
+	if refunded {
+		return nil
+	}
+
+	gw, err := h.gateways.Lookup(gatewayName)
+	if err != nil {
+		return err
+	}
+	if !gw.Capabilities().Refunds || paymentReference == "" {
+		// 无法原路退款时保留付款记录，由管理员线下处理
+		log.Printf("[payment] payment %s cannot be applied or refunded automatically: %s", paymentID, reason)
+		return nil
+	}
+	refund, err := gw.Refund(ctx, gateway.RefundRequest{
+		PaymentReference: paymentReference,
+		Amount:           amount,
+		Reason:           reason,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to refund unapplied payment: %w", err)
+	}
+	if _, err := billing.RecordRefund(ctx, tx, h.store, billing.Refund{
+		PaymentID:       paymentID,
+		GatewayRefundID: refund.ID,
+		Amount:          common.CentsToDecimal(amount),
+		Reason:          reason,
+		Status:          common.MapRefundStatus(refund.Status),
+	}, now); err != nil {
+		return err
+	}
+	if _, err := billing.SyncRefundState(ctx, tx, paymentID, 0, now); err != nil {
+		return fmt.Errorf("failed to update refunded payment: %w", err)
+	}
+	log.Printf("[payment] payment %s refunded: %s", paymentID, reason)
+	return nil
+}
@@ -11,98 +11,172 @@ import (
 	"strings"
 	"time"
 
+	"github.com/adiecho/echobilling/internal/billing"
 	"github.com/adiecho/echobilling/internal/common"
+	disputes "github.com/adiecho/echobilling/internal/dispute"
+	"github.com/adiecho/echobilling/internal/gateway"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/stripe/stripe-go/v82"
-	"github.com/stripe/stripe-go/v82/webhook"
 )
 
-// HandleWebhook 处理 Stripe Webhook 事件
+// HandleWebhook 处理支付网关推送的 Webhook 事件，网关由路径参数指定
 func (h *Handler) HandleWebhook(c *gin.Context) {
+	gw, err := h.gateways.Lookup(c.Param("gateway"))
+	if err != nil || !gw.Capabilities().Webhooks {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment gateway not found"})
+		return
+	}
+
 	body, err := io.ReadAll(c.Request.Body)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
 		return
 	}
 
-	event, err := webhook.ConstructEvent(body, c.GetHeader("Stripe-Signature"), h.store.StripeWebhookSecret())
-	if err != nil {
-		log.Printf("[webhook] signature verification failed: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signature"})
+	message, svcErr := h.processWebhook(c.Request.Context(), gw, body, c.GetHeader("Stripe-Signature"))
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
 
-	ctx := c.Request.Context()
+// processWebhook 验签、按事件 ID 幂等登记并处理一个网关事件。
+// 沙箱支付页生成的签名事件也经由这里处理，与真实回调走同一流程
+func (h *Handler) processWebhook(ctx context.Context, gw gateway.Gateway, body []byte, signature string) (string, *common.ServiceError) {
+	event, err := gw.VerifyWebhook(body, signature)
+	if err != nil {
+		log.Printf("[webhook] %s signature verification failed: %v", gw.Name(), err)
+		return "", common.ErrBadRequest("Invalid signature", err)
+	}
 
-	// Atomic idempotency: INSERT ON CONFLICT DO NOTHING, then check affected rows
-	eventData, _ := json.Marshal(event.Data.Raw)
-	eventRecordID := uuid.New().String()
-	tag, err := h.pool.Exec(ctx,
-		`INSERT INTO payment_events (id, stripe_event_id, event_type, payload, processed, created_at)
-		 VALUES ($1, $2, $3, $4, false, $5)
-		 ON CONFLICT (stripe_event_id) DO NOTHING`,
-		eventRecordID, event.ID, event.Type, eventData, time.Now(),
-	)
+	recordID, claimed, err := h.claimEvent(ctx, event)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store event"})
-		return
+		return "", common.ErrInternal("Failed to store event", err)
+	}
+	if !claimed {
+		var processed bool
+		if err := h.pool.QueryRow(ctx,
+			`SELECT processed FROM payment_events WHERE stripe_event_id = $1`, event.ID,
+		).Scan(&processed); err != nil {
+			return "", common.ErrInternal("Failed to query event", err)
+		}
+		if processed {
+			return "Event already processed", nil
+		}
+		// 另一次投递正在处理，返回非 2xx 让网关稍后重试
+		return "", common.NewServiceError(http.StatusConflict, "Event is being processed", nil)
 	}
-	if tag.RowsAffected() == 0 {
-		// Event already exists — duplicate delivery
-		c.JSON(http.StatusOK, gin.H{"message": "Event already processed"})
-		return
+
+	if err := h.runEvent(ctx, recordID, event); err != nil {
+		return "", common.ErrInternal(err.Error(), err)
 	}
+	return "Webhook processed", nil
+}
+
+// eventLockTimeout 处理中的事件超过该时间仍未结束（进程崩溃等）视为可重新领取
+const eventLockTimeout = 5 * time.Minute
 
-	var processErr error
-	switch event.Type {
-	case "checkout.session.completed":
-		processErr = h.handleCheckoutSessionCompleted(ctx, event)
-	case "payment_intent.payment_failed":
-		processErr = h.handlePaymentIntentFailed(ctx, event)
-	case "charge.refunded":
-		processErr = h.handleChargeRefunded(ctx, event)
-	case "charge.dispute.created":
-		processErr = h.handleDisputeCreated(ctx, event)
+// claimEvent 登记事件并领取处理权。
+// 已成功处理或正在处理的事件不会被领取；处理失败的事件在网关重试时会被再次领取
+func (h *Handler) claimEvent(ctx context.Context, event *gateway.Event) (string, bool, error) {
+	now := time.Now()
+	payload, _ := json.Marshal(event.Data)
+	var recordID string
+	err := h.pool.QueryRow(ctx,
+		`INSERT INTO payment_events (id, stripe_event_id, gateway, event_type, payload, processed, attempts, locked_at, created_at)
+		 VALUES ($1, $2, $3, $4, $5, false, 1, $6, $6)
+		 ON CONFLICT (stripe_event_id) DO UPDATE
+		 SET attempts = payment_events.attempts + 1, locked_at = EXCLUDED.locked_at
+		 WHERE NOT payment_events.processed
+		   AND (payment_events.locked_at IS NULL OR payment_events.locked_at < $7)
+		 RETURNING id`,
+		uuid.New().String(), event.ID, event.Gateway, event.Type, payload, now, now.Add(-eventLockTimeout),
+	).Scan(&recordID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
 	}
+	return recordID, true, nil
+}
+
+// runEvent 分发已领取的事件并记录处理结果，失败时保留错误信息供管理员查看和重放
+func (h *Handler) runEvent(ctx context.Context, recordID string, event *gateway.Event) error {
+	processErr := h.dispatchEvent(ctx, event)
 
 	now := time.Now()
 	if processErr != nil {
+		log.Printf("[webhook] %s event %s (%s) failed: %v", event.Gateway, event.ID, event.Type, processErr)
 		_, _ = h.pool.Exec(ctx,
 			`UPDATE payment_events
-			 SET processed = true, error_message = $2, processed_at = $3
+			 SET processed = false, error_message = $2, failed_at = $3, locked_at = NULL
 			 WHERE id = $1`,
-			eventRecordID, processErr.Error(), now,
+			recordID, processErr.Error(), now,
 		)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": processErr.Error()})
-		return
+		return processErr
 	}
 
-	_, err = h.pool.Exec(ctx,
+	_, err := h.pool.Exec(ctx,
 		`UPDATE payment_events
-		 SET processed = true, processed_at = $2
+		 SET processed = true, processed_at = $2, error_message = NULL, failed_at = NULL, locked_at = NULL
 		 WHERE id = $1`,
-		eventRecordID, now,
+		recordID, now,
 	)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark event processed"})
-		return
+		return fmt.Errorf("failed to mark event processed: %w", err)
 	}
+	return nil
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Webhook processed"})
+// eventHandlers 已支持的网关事件类型及其处理函数
+var eventHandlers = map[string]func(*Handler, context.Context, *gateway.Event) error{
+	"checkout.session.completed":               (*Handler).handleCheckoutSessionCompleted,
+	"checkout.session.async_payment_succeeded": (*Handler).handleCheckoutSessionCompleted,
+	"checkout.session.async_payment_failed":    (*Handler).handleCheckoutAsyncPaymentFailed,
+	"checkout.session.expired":                 (*Handler).handleCheckoutSessionExpired,
+	"payment_intent.succeeded":                 (*Handler).handlePaymentIntentSucceeded,
+	"payment_intent.payment_failed":            (*Handler).handlePaymentIntentFailed,
+	"charge.refunded":                          (*Handler).handleChargeRefunded,
+	"charge.refund.updated":                    (*Handler).handleRefundUpdated,
+	"charge.dispute.created":                   (*Handler).handleDisputeEvent,
+	"charge.dispute.updated":                   (*Handler).handleDisputeEvent,
+	"charge.dispute.closed":                    (*Handler).handleDisputeEvent,
+	"payment_method.attached":                  (*Handler).handlePaymentMethodAttached,
+	"payment_method.detached":                  (*Handler).handlePaymentMethodDetached,
 }
 
-func (h *Handler) handleCheckoutSessionCompleted(ctx context.Context, event stripe.Event) error {
+// dispatchEvent 按事件类型调用对应的处理函数，未识别的类型直接视为处理成功
+func (h *Handler) dispatchEvent(ctx context.Context, event *gateway.Event) error {
+	handle, ok := eventHandlers[event.Type]
+	if !ok {
+		return nil
+	}
+	return handle(h, ctx, event)
+}
+
+func (h *Handler) handleCheckoutSessionCompleted(ctx context.Context, event *gateway.Event) error {
 	var sess stripe.CheckoutSession
-	if err := json.Unmarshal(event.Data.Raw, &sess); err != nil {
+	if err := json.Unmarshal(event.Data, &sess); err != nil {
 		return fmt.Errorf("failed to parse session: %w", err)
 	}
 
-	orderID := sess.Metadata["order_id"]
-	if orderID == "" && sess.ClientReferenceID != "" {
-		orderID = sess.ClientReferenceID
+	// 延迟到账的支付方式完成 Checkout 时尚未付款，等待 async_payment_succeeded 再完成履约
+	if awaitingAsyncPayment(&sess) {
+		return h.recordPendingCheckout(ctx, event.Gateway, &sess)
+	}
+
+	if invoiceID := sess.Metadata["invoice_id"]; invoiceID != "" {
+		return h.handleInvoiceCheckoutCompleted(ctx, event.Gateway, &sess, invoiceID)
+	}
+	if sess.Metadata["credit_top_up"] == "true" {
+		return h.handleCreditTopUpCompleted(ctx, event.Gateway, &sess)
 	}
+
+	orderID := checkoutOrderID(&sess)
 	if orderID == "" {
 		return fmt.Errorf("order_id not found in session metadata")
 	}
@@ -113,122 +187,100 @@ func (h *Handler) handleCheckoutSessionCompleted(ctx context.Context, event stri
 	}
 	defer tx.Rollback(ctx)
 
-	var userID, orderStatus, currency, totalAmount string
+	var userID, orderStatus, currency, total, amountDue string
 	err = tx.QueryRow(ctx,
-		`SELECT user_id, status, currency, total_amount::text
+		`SELECT user_id, status, currency, total_amount::text, (total_amount - credit_applied)::text
 		 FROM orders
-		 WHERE id = $1`,
+		 WHERE id = $1
+		 FOR UPDATE`,
 		orderID,
-	).Scan(&userID, &orderStatus, &currency, &totalAmount)
+	).Scan(&userID, &orderStatus, &currency, &total, &amountDue)
 	if err != nil {
 		return fmt.Errorf("failed to query order: %w", err)
 	}
 
+	held, err := checkoutHeldUnapplied(ctx, tx, sess.ID)
+	if err != nil || held {
+		return err
+	}
+
 	now := time.Now()
-	if orderStatus != "paid" {
-		_, err = tx.Exec(ctx,
-			`UPDATE orders
-			 SET status = 'paid', updated_at = $1
-			 WHERE id = $2`,
-			now, orderID,
-		)
+	if orderStatus == "draft" || orderStatus == "pending_payment" {
+		covered, err := reconcileOrderCredit(ctx, tx, userID, orderID, total, &sess, now)
 		if err != nil {
-			return fmt.Errorf("failed to update order status: %w", err)
+			return err
+		}
+		if !covered {
+			if err := h.holdUnappliedCheckout(ctx, tx, event.Gateway, &sess, userID, "Partial payment for order "+orderID, now); err != nil {
+				return err
+			}
+			if err := tx.Commit(ctx); err != nil {
+				return fmt.Errorf("failed to commit underpaid order payment: %w", err)
+			}
+			// 订单退回购物车并退回占用的余额，客户可以重新结账
+			return h.releaseOrderCheckout(ctx, orderID)
 		}
 	}
-
-	invoiceID, err := h.createInvoice(ctx, tx, orderID, userID, currency, totalAmount, now)
+	invoiceID, provisioningTasks, err := h.completeOrderPayment(ctx, tx, orderID, userID, orderStatus, currency, now)
 	if err != nil {
-		return fmt.Errorf("failed to create invoice: %w", err)
+		return err
 	}
 
-	amount := totalAmount
+	amount := amountDue
 	if sess.AmountTotal > 0 {
 		amount = common.CentsToDecimal(sess.AmountTotal)
 	}
 
-	var paymentIntentID string
-	if sess.PaymentIntent != nil {
-		paymentIntentID = sess.PaymentIntent.ID
+	if _, err := recordCheckoutPayment(ctx, tx, event.Gateway, &sess, userID, &invoiceID, amount, currency, "succeeded", now); err != nil {
+		return err
 	}
 
-	var existingPaymentID string
-	if paymentIntentID != "" {
-		_ = tx.QueryRow(ctx,
-			`SELECT id
-			 FROM payments
-			 WHERE stripe_payment_intent_id = $1
-			 LIMIT 1`,
-			paymentIntentID,
-		).Scan(&existingPaymentID)
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit payment transaction: %w", err)
 	}
-	if existingPaymentID == "" {
-		_ = tx.QueryRow(ctx,
-			`SELECT id
-			 FROM payments
-			 WHERE stripe_checkout_session_id = $1
-			 LIMIT 1`,
-			sess.ID,
-		).Scan(&existingPaymentID)
+
+	if err := h.enqueueProvisioningTasks(ctx, provisioningTasks); err != nil {
+		return fmt.Errorf("failed to enqueue provisioning tasks: %w", err)
 	}
 
-	if existingPaymentID != "" {
-		_, err = tx.Exec(ctx,
-			`UPDATE payments
-			 SET user_id = $2,
-			     invoice_id = $3,
-			     stripe_payment_intent_id = COALESCE(NULLIF($4, ''), stripe_payment_intent_id),
-			     stripe_checkout_session_id = $5,
-			     amount = $6,
-			     currency = $7,
-			     status = 'succeeded',
-			     method = 'card',
-			     updated_at = $8
-			 WHERE id = $1`,
-			existingPaymentID, userID, invoiceID, paymentIntentID, sess.ID, amount, strings.ToUpper(currency), now,
-		)
-		if err != nil {
-			return fmt.Errorf("failed to update payment: %w", err)
-		}
-	} else {
-		paymentID := uuid.New().String()
-		var stripePaymentIntentID interface{}
-		if paymentIntentID != "" {
-			stripePaymentIntentID = paymentIntentID
-		}
+	return nil
+}
 
-		_, err = tx.Exec(ctx,
-			`INSERT INTO payments (
-				id, user_id, invoice_id, stripe_payment_intent_id, stripe_checkout_session_id,
-				amount, currency, status, method, created_at, updated_at
-			)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, 'succeeded', 'card', $8, $8)`,
-			paymentID, userID, invoiceID, stripePaymentIntentID, sess.ID, amount, strings.ToUpper(currency), now,
+// completeOrderPayment 订单付清（Stripe 支付或余额全额抵扣）后标记为已支付、开具发票并准备开通任务
+func (h *Handler) completeOrderPayment(
+	ctx context.Context,
+	tx pgx.Tx,
+	orderID, userID, orderStatus, currency string,
+	now time.Time,
+) (string, []provisioningTask, error) {
+	if orderStatus != "paid" {
+		_, err := tx.Exec(ctx,
+			`UPDATE orders
+			 SET status = 'paid', updated_at = $1
+			 WHERE id = $2`,
+			now, orderID,
 		)
 		if err != nil {
-			return fmt.Errorf("failed to create payment: %w", err)
+			return "", nil, fmt.Errorf("failed to update order status: %w", err)
 		}
 	}
 
-	provisioningTasks, err := h.prepareProvisioningJobs(ctx, tx, orderID, userID, now)
+	invoiceID, err := h.createInvoice(ctx, tx, orderID, userID, currency, "paid", now)
 	if err != nil {
-		return fmt.Errorf("failed to prepare provisioning jobs: %w", err)
+		return "", nil, fmt.Errorf("failed to create invoice: %w", err)
 	}
 
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("failed to commit payment transaction: %w", err)
-	}
-
-	if err := h.enqueueProvisioningTasks(ctx, provisioningTasks); err != nil {
-		return fmt.Errorf("failed to enqueue provisioning tasks: %w", err)
+	provisioningTasks, err := h.prepareProvisioningJobs(ctx, tx, orderID, userID, now)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to prepare provisioning jobs: %w", err)
 	}
 
-	return nil
+	return invoiceID, provisioningTasks, nil
 }
 
-func (h *Handler) handlePaymentIntentFailed(ctx context.Context, event stripe.Event) error {
+func (h *Handler) handlePaymentIntentFailed(ctx context.Context, event *gateway.Event) error {
 	var intent stripe.PaymentIntent
-	if err := json.Unmarshal(event.Data.Raw, &intent); err != nil {
+	if err := json.Unmarshal(event.Data, &intent); err != nil {
 		return fmt.Errorf("failed to parse payment intent: %w", err)
 	}
 
@@ -249,9 +301,9 @@ func (h *Handler) handlePaymentIntentFailed(ctx context.Context, event stripe.Ev
 	return nil
 }
 
-func (h *Handler) handleChargeRefunded(ctx context.Context, event stripe.Event) error {
+func (h *Handler) handleChargeRefunded(ctx context.Context, event *gateway.Event) error {
 	var charge stripe.Charge
-	if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+	if err := json.Unmarshal(event.Data, &charge); err != nil {
 		return fmt.Errorf("failed to parse charge: %w", err)
 	}
 
@@ -281,59 +333,45 @@ func (h *Handler) handleChargeRefunded(ctx context.Context, event stripe.Event)
 	}
 
 	now := time.Now()
-	_, err = tx.Exec(ctx,
-		`UPDATE payments
-		 SET status = 'refunded', updated_at = $2
-		 WHERE id = $1`,
-		paymentID, now,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to update payment: %w", err)
-	}
-
-	if len(charge.Refunds.Data) > 0 {
-		ref := charge.Refunds.Data[0]
-		_, err = tx.Exec(ctx,
-			`INSERT INTO refunds (id, payment_id, stripe_refund_id, amount, reason, status, created_at, updated_at)
-			 VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
-			 ON CONFLICT (stripe_refund_id) DO UPDATE SET
-			   amount = EXCLUDED.amount,
-			   reason = EXCLUDED.reason,
-			   status = EXCLUDED.status,
-			   updated_at = EXCLUDED.updated_at`,
-			uuid.New().String(),
-			paymentID,
-			ref.ID,
-			common.CentsToDecimal(ref.Amount),
-			string(ref.Reason),
-			common.MapRefundStatus(string(ref.Status)),
-			now,
-		)
-		if err != nil {
-			return fmt.Errorf("failed to create refund: %w", err)
+	if charge.Refunds != nil {
+		for _, ref := range charge.Refunds.Data {
+			if err := h.recordGatewayRefund(ctx, tx, paymentID, ref, now); err != nil {
+				return err
+			}
 		}
 	}
 
+	// 较新的 API 版本不在事件中附带退款列表，此时以 amount_refunded 作为累计退款金额
+	if _, err := billing.SyncRefundState(ctx, tx, paymentID, charge.AmountRefunded, now); err != nil {
+		return err
+	}
+
 	return tx.Commit(ctx)
 }
 
-func (h *Handler) handleDisputeCreated(ctx context.Context, event stripe.Event) error {
-	var dispute stripe.Dispute
-	if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
-		return fmt.Errorf("failed to parse dispute: %w", err)
+// handleRefundUpdated 同步退款状态。退款失败或被取消时作废对应的贷项通知单，并按剩余的有效退款重新计算付款和发票状态
+func (h *Handler) handleRefundUpdated(ctx context.Context, event *gateway.Event) error {
+	var refund stripe.Refund
+	if err := json.Unmarshal(event.Data, &refund); err != nil {
+		return fmt.Errorf("failed to parse refund: %w", err)
 	}
-
-	if dispute.PaymentIntent == nil || dispute.PaymentIntent.ID == "" {
+	if refund.PaymentIntent == nil || refund.PaymentIntent.ID == "" {
 		return nil
 	}
-	paymentIntentID := dispute.PaymentIntent.ID
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
 
 	var paymentID string
-	err := h.pool.QueryRow(ctx,
+	err = tx.QueryRow(ctx,
 		`SELECT id
 		 FROM payments
-		 WHERE stripe_payment_intent_id = $1`,
-		paymentIntentID,
+		 WHERE stripe_payment_intent_id = $1
+		 FOR UPDATE`,
+		refund.PaymentIntent.ID,
 	).Scan(&paymentID)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -342,14 +380,110 @@ func (h *Handler) handleDisputeCreated(ctx context.Context, event stripe.Event)
 		return fmt.Errorf("failed to get payment: %w", err)
 	}
 
-	var evidenceDueBy *time.Time
+	now := time.Now()
+	if err := h.recordGatewayRefund(ctx, tx, paymentID, &refund, now); err != nil {
+		return err
+	}
+	if _, err := billing.SyncRefundState(ctx, tx, paymentID, 0, now); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// recordGatewayRefund 按网关退款 ID 幂等地登记退款并签发贷项通知单
+func (h *Handler) recordGatewayRefund(ctx context.Context, tx pgx.Tx, paymentID string, ref *stripe.Refund, now time.Time) error {
+	_, err := billing.RecordRefund(ctx, tx, h.store, billing.Refund{
+		PaymentID:       paymentID,
+		GatewayRefundID: ref.ID,
+		Amount:          common.CentsToDecimal(ref.Amount),
+		Reason:          string(ref.Reason),
+		Status:          common.MapRefundStatus(string(ref.Status)),
+	}, now)
+	return err
+}
+
+// disputeUpdate 从争议事件中提取的字段
+type disputeUpdate struct {
+	DisputeID       string
+	PaymentIntentID string
+	Amount          string
+	Reason          string
+	Status          string
+	EvidenceDueBy   *time.Time
+}
+
+func parseDispute(event *gateway.Event) (*disputeUpdate, error) {
+	var dispute stripe.Dispute
+	if err := json.Unmarshal(event.Data, &dispute); err != nil {
+		return nil, fmt.Errorf("failed to parse dispute: %w", err)
+	}
+
+	d := &disputeUpdate{
+		DisputeID: dispute.ID,
+		Amount:    common.CentsToDecimal(dispute.Amount),
+		Reason:    string(dispute.Reason),
+		Status:    mapDisputeStatus(string(dispute.Status)),
+	}
+	if dispute.PaymentIntent != nil {
+		d.PaymentIntentID = dispute.PaymentIntent.ID
+	}
 	if dispute.EvidenceDetails != nil && dispute.EvidenceDetails.DueBy > 0 {
 		t := time.Unix(dispute.EvidenceDetails.DueBy, 0)
-		evidenceDueBy = &t
+		d.EvidenceDueBy = &t
+	}
+	return d, nil
+}
+
+// disputeResolved 争议状态首次变为 won 或 lost 时返回 true，重复投递不会重复处理
+func disputeResolved(previous, current string) bool {
+	return previous != current && (current == "won" || current == "lost")
+}
+
+// handleDisputeEvent 处理争议创建、更新和结案事件，同步争议状态。
+// 败诉时款项已被发卡行追回，付款标记为 refunded；胜诉时恢复被标记的付款，两种结果都写入审计日志
+func (h *Handler) handleDisputeEvent(ctx context.Context, event *gateway.Event) error {
+	dispute, err := parseDispute(event)
+	if err != nil {
+		return err
+	}
+	if dispute.PaymentIntentID == "" {
+		return nil
+	}
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var paymentID, userID string
+	err = tx.QueryRow(ctx,
+		`SELECT id, user_id
+		 FROM payments
+		 WHERE stripe_payment_intent_id = $1
+		 FOR UPDATE`,
+		dispute.PaymentIntentID,
+	).Scan(&paymentID, &userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("failed to get payment: %w", err)
+	}
+
+	var previous string
+	err = tx.QueryRow(ctx,
+		`SELECT status::text FROM disputes WHERE stripe_dispute_id = $1`,
+		dispute.DisputeID,
+	).Scan(&previous)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("failed to get dispute: %w", err)
 	}
 
 	now := time.Now()
-	_, err = h.pool.Exec(ctx,
+	var disputeRecordID string
+	err = tx.QueryRow(ctx,
 		`INSERT INTO disputes (
 			id, payment_id, stripe_dispute_id, amount, reason, status, evidence_due_by, created_at, updated_at
 		)
@@ -358,20 +492,137 @@ func (h *Handler) handleDisputeCreated(ctx context.Context, event stripe.Event)
 		  amount = EXCLUDED.amount,
 		  reason = EXCLUDED.reason,
 		  status = EXCLUDED.status,
-		  evidence_due_by = EXCLUDED.evidence_due_by,
-		  updated_at = EXCLUDED.updated_at`,
+		  evidence_due_by = COALESCE(EXCLUDED.evidence_due_by, disputes.evidence_due_by),
+		  updated_at = EXCLUDED.updated_at
+		RETURNING id`,
 		uuid.New().String(),
 		paymentID,
-		dispute.ID,
-		common.CentsToDecimal(dispute.Amount),
+		dispute.DisputeID,
+		dispute.Amount,
 		dispute.Reason,
-		mapDisputeStatus(string(dispute.Status)),
-		evidenceDueBy,
+		dispute.Status,
+		dispute.EvidenceDueBy,
 		now,
+	).Scan(&disputeRecordID)
+	if err != nil {
+		return fmt.Errorf("failed to upsert dispute: %w", err)
+	}
+
+	if disputeResolved(previous, dispute.Status) {
+		paymentStatus, fromStatus := "refunded", "succeeded"
+		if dispute.Status == "won" {
+			paymentStatus, fromStatus = "succeeded", "refunded"
+		}
+		if _, err := tx.Exec(ctx,
+			`UPDATE payments
+			 SET status = $2, updated_at = $4
+			 WHERE id = $1 AND status = $3
+			   AND NOT EXISTS (SELECT 1 FROM refunds WHERE payment_id = $1 AND status <> 'failed')`,
+			paymentID, paymentStatus, fromStatus, now,
+		); err != nil {
+			return fmt.Errorf("failed to update disputed payment: %w", err)
+		}
+
+		details, _ := json.Marshal(map[string]interface{}{
+			"dispute_id": dispute.DisputeID,
+			"amount":     dispute.Amount,
+			"reason":     dispute.Reason,
+		})
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO audit_logs (user_id, action, entity_type, entity_id, new_values, ip_address, user_agent, created_at)
+			 VALUES ($1, $2, 'payment', $3, $4, 'webhook', $5, $6)`,
+			userID, "dispute_"+dispute.Status, paymentID, details, event.Gateway+"-webhook", now,
+		); err != nil {
+			return fmt.Errorf("failed to record dispute outcome: %w", err)
+		}
+		log.Printf("[webhook] dispute %s on payment %s %s", dispute.DisputeID, paymentID, dispute.Status)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit dispute: %w", err)
+	}
+	return disputes.ApplyServiceHold(ctx, h.pool, h.asynqClient, h.store, disputeRecordID, dispute.Status)
+}
+
+// recordCheckoutPayment 按 PaymentIntent 或 Checkout Session 幂等地登记一笔付款。
+// status 为 processing 时只登记等待到账的付款，不会覆盖已有的最终状态
+func recordCheckoutPayment(
+	ctx context.Context,
+	tx pgx.Tx,
+	gatewayName string,
+	sess *stripe.CheckoutSession,
+	userID string,
+	invoiceID *string,
+	amount, currency, status string,
+	now time.Time,
+) (string, error) {
+	var paymentIntentID string
+	if sess.PaymentIntent != nil {
+		paymentIntentID = sess.PaymentIntent.ID
+	}
+
+	var existingPaymentID string
+	if paymentIntentID != "" {
+		_ = tx.QueryRow(ctx,
+			`SELECT id
+			 FROM payments
+			 WHERE stripe_payment_intent_id = $1
+			 LIMIT 1`,
+			paymentIntentID,
+		).Scan(&existingPaymentID)
+	}
+	if existingPaymentID == "" {
+		_ = tx.QueryRow(ctx,
+			`SELECT id
+			 FROM payments
+			 WHERE stripe_checkout_session_id = $1
+			 LIMIT 1`,
+			sess.ID,
+		).Scan(&existingPaymentID)
+	}
+
+	if existingPaymentID != "" {
+		_, err := tx.Exec(ctx,
+			`UPDATE payments
+			 SET user_id = $2,
+			     invoice_id = $3,
+			     stripe_payment_intent_id = COALESCE(NULLIF($4, ''), stripe_payment_intent_id),
+			     stripe_checkout_session_id = $5,
+			     amount = $6,
+			     currency = $7,
+			     status = CASE
+			         WHEN $10 = 'processing' AND status NOT IN ('pending', 'processing') THEN status
+			         ELSE $10::payment_status
+			     END,
+			     method = 'card',
+			     gateway = $9,
+			     updated_at = $8
+			 WHERE id = $1`,
+			existingPaymentID, userID, invoiceID, paymentIntentID, sess.ID, amount, strings.ToUpper(currency), now, gatewayName, status,
+		)
+		if err != nil {
+			return "", fmt.Errorf("failed to update payment: %w", err)
+		}
+		return existingPaymentID, nil
+	}
+
+	paymentID := uuid.New().String()
+	var stripePaymentIntentID interface{}
+	if paymentIntentID != "" {
+		stripePaymentIntentID = paymentIntentID
+	}
+
+	_, err := tx.Exec(ctx,
+		`INSERT INTO payments (
+			id, user_id, invoice_id, stripe_payment_intent_id, stripe_checkout_session_id,
+			amount, currency, status, method, gateway, created_at, updated_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $10, 'card', $9, $8, $8)`,
+		paymentID, userID, invoiceID, stripePaymentIntentID, sess.ID, amount, strings.ToUpper(currency), now, gatewayName, status,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to create dispute: %w", err)
+		return "", fmt.Errorf("failed to create payment: %w", err)
 	}
 
-	return nil
+	return paymentID, nil
 }
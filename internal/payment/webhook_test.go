@@ -0,0 +1,158 @@
+package payment
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// loadEventFixture 读取 testdata 中录制的 Stripe 事件，并确认该事件类型已注册处理函数
+func loadEventFixture(t *testing.T, name string) *gateway.Event {
+	t.Helper()
+
+	raw, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read fixture %s: %v", name, err)
+	}
+	var event stripe.Event
+	if err := json.Unmarshal(raw, &event); err != nil {
+		t.Fatalf("failed to parse fixture %s: %v", name, err)
+	}
+	if _, ok := eventHandlers[string(event.Type)]; !ok {
+		t.Fatalf("no handler registered for %s", event.Type)
+	}
+	return &gateway.Event{Gateway: gateway.Stripe, ID: event.ID, Type: string(event.Type), Data: event.Data.Raw}
+}
+
+func loadSessionFixture(t *testing.T, name string) *stripe.CheckoutSession {
+	t.Helper()
+
+	var sess stripe.CheckoutSession
+	if err := json.Unmarshal(loadEventFixture(t, name).Data, &sess); err != nil {
+		t.Fatalf("failed to parse session: %v", err)
+	}
+	return &sess
+}
+
+func TestCheckoutSessionExpiredFixture(t *testing.T) {
+	t.Parallel()
+
+	sess := loadSessionFixture(t, "checkout_session_expired.json")
+	if got := checkoutOrderID(sess); got != "7d5f2c1e-3a4b-4c6d-8e9f-0a1b2c3d4e5f" {
+		t.Fatalf("checkoutOrderID = %q", got)
+	}
+	if awaitingAsyncPayment(sess) {
+		t.Fatal("expired session must not be treated as awaiting payment")
+	}
+}
+
+func TestCheckoutAsyncPaymentFixtures(t *testing.T) {
+	t.Parallel()
+
+	pending := loadSessionFixture(t, "checkout_session_completed_async.json")
+	if !awaitingAsyncPayment(pending) {
+		t.Fatal("completed session with unpaid status should await async payment")
+	}
+
+	succeeded := loadSessionFixture(t, "checkout_session_async_payment_succeeded.json")
+	if awaitingAsyncPayment(succeeded) {
+		t.Fatal("async_payment_succeeded session should be fulfilled")
+	}
+	if succeeded.ID != pending.ID || succeeded.PaymentIntent == nil || succeeded.PaymentIntent.ID != pending.PaymentIntent.ID {
+		t.Fatalf("async success does not match the pending session: %s / %v", succeeded.ID, succeeded.PaymentIntent)
+	}
+	if got := checkoutOrderID(succeeded); got != "9a8b7c6d-5e4f-4a3b-9c2d-1e0f9a8b7c6d" {
+		t.Fatalf("checkoutOrderID = %q", got)
+	}
+	if got := common.CentsToDecimal(succeeded.AmountTotal); got != "45.00" {
+		t.Fatalf("amount = %s, want 45.00", got)
+	}
+
+	// 发票支付失败不影响订单，由催缴流程继续跟进
+	failed := loadSessionFixture(t, "checkout_session_async_payment_failed.json")
+	if got := checkoutOrderID(failed); got != "" {
+		t.Fatalf("checkoutOrderID for invoice session = %q, want empty", got)
+	}
+	if failed.Metadata["invoice_id"] != "5c4b3a29-1807-4f6e-9d5c-4b3a29180706" {
+		t.Fatalf("invoice_id = %q", failed.Metadata["invoice_id"])
+	}
+}
+
+func TestDisputeLifecycleFixtures(t *testing.T) {
+	t.Parallel()
+
+	updated, err := parseDispute(loadEventFixture(t, "charge_dispute_updated.json"))
+	if err != nil {
+		t.Fatalf("parseDispute returned error: %v", err)
+	}
+	if updated.DisputeID != "dp_1QyYa8LkdIwHu7ix4nJmKqWe" || updated.PaymentIntentID != "pi_3QyWxPLkdIwHu7ix1aBcDeFg" {
+		t.Fatalf("dispute = %+v", updated)
+	}
+	if updated.Status != "under_review" || updated.Amount != "19.99" || updated.Reason != "product_not_received" {
+		t.Fatalf("dispute = %+v", updated)
+	}
+	if updated.EvidenceDueBy == nil || !updated.EvidenceDueBy.Equal(time.Unix(1761436799, 0)) {
+		t.Fatalf("EvidenceDueBy = %v", updated.EvidenceDueBy)
+	}
+	if disputeResolved("needs_response", updated.Status) {
+		t.Fatal("under_review is not a final outcome")
+	}
+
+	closed, err := parseDispute(loadEventFixture(t, "charge_dispute_closed.json"))
+	if err != nil {
+		t.Fatalf("parseDispute returned error: %v", err)
+	}
+	if closed.Status != "lost" {
+		t.Fatalf("closed status = %s, want lost", closed.Status)
+	}
+	if !disputeResolved(updated.Status, closed.Status) {
+		t.Fatal("closing a dispute as lost should trigger the outcome handling")
+	}
+	// 重复投递同一结案事件不再处理
+	if disputeResolved(closed.Status, closed.Status) {
+		t.Fatal("replayed outcome should not be handled twice")
+	}
+}
+
+func TestRefundUpdatedFixture(t *testing.T) {
+	t.Parallel()
+
+	var refund stripe.Refund
+	if err := json.Unmarshal(loadEventFixture(t, "charge_refund_updated.json").Data, &refund); err != nil {
+		t.Fatalf("failed to parse refund: %v", err)
+	}
+	if refund.ID != "re_3QyWxPLkdIwHu7ix1k7Lm8No" || refund.PaymentIntent == nil || refund.PaymentIntent.ID != "pi_3QyWxPLkdIwHu7ix1aBcDeFg" {
+		t.Fatalf("refund = %s / %v", refund.ID, refund.PaymentIntent)
+	}
+	if got := common.MapRefundStatus(string(refund.Status)); got != "failed" {
+		t.Fatalf("MapRefundStatus(%s) = %s, want failed", refund.Status, got)
+	}
+	if got := common.CentsToDecimal(refund.Amount); got != "19.99" {
+		t.Fatalf("amount = %s, want 19.99", got)
+	}
+}
+
+func TestPaymentIntentSucceededFixture(t *testing.T) {
+	t.Parallel()
+
+	var intent stripe.PaymentIntent
+	if err := json.Unmarshal(loadEventFixture(t, "payment_intent_succeeded.json").Data, &intent); err != nil {
+		t.Fatalf("failed to parse payment intent: %v", err)
+	}
+	invoiceID, userID := autoChargeInvoice(&intent)
+	if invoiceID != "e1d2c3b4-a596-4877-8695-a4b3c2d1e0f9" || userID != "0f1e2d3c-4b5a-4968-8776-655443322110" {
+		t.Fatalf("autoChargeInvoice = %q, %q", invoiceID, userID)
+	}
+
+	// Checkout 发起的 PaymentIntent 由 Session 事件处理
+	intent.Metadata = map[string]string{"invoice_id": invoiceID, "user_id": userID}
+	if invoiceID, _ := autoChargeInvoice(&intent); invoiceID != "" {
+		t.Fatalf("autoChargeInvoice for checkout intent = %q, want empty", invoiceID)
+	}
+}
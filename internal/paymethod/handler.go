@@ -0,0 +1,67 @@
+package paymethod
+
+import (
+	"net/http"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type Handler struct {
+	pool     *pgxpool.Pool
+	gateways *gateway.Registry
+}
+
+func NewHandler(pool *pgxpool.Pool, gateways *gateway.Registry) *Handler {
+	return &Handler{pool: pool, gateways: gateways}
+}
+
+// ListMethods - GET /api/v1/portal/payment-methods
+func (h *Handler) ListMethods(c *gin.Context) {
+	userID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	methods, svcErr := h.listMethods(c.Request.Context(), userID)
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"payment_methods": methods})
+}
+
+// SetDefault - POST /api/v1/portal/payment-methods/:id/default
+// 续费发票开具后使用默认卡自动扣款
+func (h *Handler) SetDefault(c *gin.Context) {
+	userID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	method, svcErr := h.setDefault(c.Request.Context(), userID, c.Param("id"))
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, method)
+}
+
+// RemoveMethod - DELETE /api/v1/portal/payment-methods/:id
+func (h *Handler) RemoveMethod(c *gin.Context) {
+	userID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	if svcErr := h.removeMethod(c.Request.Context(), userID, c.Param("id")); svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Payment method removed"})
+}
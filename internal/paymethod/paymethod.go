@@ -0,0 +1,180 @@
+package paymethod
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/db"
+	"github.com/adiecho/echobilling/internal/gateway"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/stripe/stripe-go/v82"
+)
+
+var ErrNotFound = errors.New("payment method not found")
+
+// Method 客户保存的卡片，只保存展示所需的信息
+type Method struct {
+	ID                    string    `json:"id"`
+	StripePaymentMethodID string    `json:"-"`
+	Brand                 string    `json:"brand"`
+	Last4                 string    `json:"last4"`
+	ExpMonth              int       `json:"exp_month"`
+	ExpYear               int       `json:"exp_year"`
+	IsDefault             bool      `json:"is_default"`
+	CreatedAt             time.Time `json:"created_at"`
+}
+
+const methodColumns = `id, stripe_payment_method_id, brand, last4, exp_month, exp_year, is_default, created_at`
+
+func scanMethod(row pgx.Row) (*Method, error) {
+	var m Method
+	if err := row.Scan(&m.ID, &m.StripePaymentMethodID, &m.Brand, &m.Last4, &m.ExpMonth, &m.ExpYear, &m.IsDefault, &m.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// EnsureCustomer 返回用户的 Stripe Customer ID，不存在时通过网关创建并保存
+func EnsureCustomer(ctx context.Context, q db.DBTX, gw gateway.SavedMethods, userID string) (string, error) {
+	var customerID *string
+	var email, name string
+	if err := q.QueryRow(ctx,
+		`SELECT stripe_customer_id, email, COALESCE(name, '') FROM users WHERE id = $1`,
+		userID,
+	).Scan(&customerID, &email, &name); err != nil {
+		return "", fmt.Errorf("failed to query user: %w", err)
+	}
+	if customerID != nil && *customerID != "" {
+		return *customerID, nil
+	}
+
+	created, err := gw.CreateCustomer(ctx, userID, email, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to create stripe customer: %w", err)
+	}
+
+	var saved string
+	if err := q.QueryRow(ctx,
+		`UPDATE users
+		 SET stripe_customer_id = COALESCE(stripe_customer_id, $2), updated_at = NOW()
+		 WHERE id = $1
+		 RETURNING stripe_customer_id`,
+		userID, created,
+	).Scan(&saved); err != nil {
+		return "", fmt.Errorf("failed to save stripe customer: %w", err)
+	}
+	return saved, nil
+}
+
+// UserIDForCustomer 按 Stripe Customer ID 查找用户，找不到时返回空字符串
+func UserIDForCustomer(ctx context.Context, q db.DBTX, customerID string) (string, error) {
+	var userID string
+	err := q.QueryRow(ctx, `SELECT id::text FROM users WHERE stripe_customer_id = $1`, customerID).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return userID, err
+}
+
+// Save 记录已绑定到 Customer 的卡片，用户的第一张卡自动设为默认
+func Save(ctx context.Context, q db.DBTX, userID string, pm *stripe.PaymentMethod, now time.Time) error {
+	var (
+		brand             string
+		last4             string
+		expMonth, expYear int64
+	)
+	if pm.Card != nil {
+		brand = string(pm.Card.Brand)
+		last4 = pm.Card.Last4
+		expMonth = pm.Card.ExpMonth
+		expYear = pm.Card.ExpYear
+	}
+
+	_, err := q.Exec(ctx,
+		`INSERT INTO payment_methods (
+			id, user_id, stripe_payment_method_id, brand, last4, exp_month, exp_year, is_default, created_at, updated_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7,
+		        NOT EXISTS (SELECT 1 FROM payment_methods WHERE user_id = $2 AND is_default), $8, $8)
+		ON CONFLICT (stripe_payment_method_id) DO UPDATE
+		SET brand = EXCLUDED.brand,
+		    last4 = EXCLUDED.last4,
+		    exp_month = EXCLUDED.exp_month,
+		    exp_year = EXCLUDED.exp_year,
+		    updated_at = EXCLUDED.updated_at`,
+		uuid.New().String(), userID, pm.ID, brand, last4, expMonth, expYear, now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save payment method: %w", err)
+	}
+	return nil
+}
+
+// Forget 删除本地记录；删除的是默认卡时把最近添加的卡设为默认
+func Forget(ctx context.Context, tx pgx.Tx, stripePaymentMethodID string, now time.Time) error {
+	var userID string
+	var wasDefault bool
+	err := tx.QueryRow(ctx,
+		`DELETE FROM payment_methods
+		 WHERE stripe_payment_method_id = $1
+		 RETURNING user_id::text, is_default`,
+		stripePaymentMethodID,
+	).Scan(&userID, &wasDefault)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete payment method: %w", err)
+	}
+	if !wasDefault {
+		return nil
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE payment_methods
+		 SET is_default = TRUE, updated_at = $2
+		 WHERE id = (
+			SELECT id FROM payment_methods
+			WHERE user_id = $1
+			ORDER BY created_at DESC
+			LIMIT 1
+		 )`,
+		userID, now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to promote default payment method: %w", err)
+	}
+	return nil
+}
+
+// Default 返回用户的默认卡和 Stripe Customer ID，没有可用卡片时返回 ErrNotFound
+func Default(ctx context.Context, q db.DBTX, userID string) (*Method, string, error) {
+	var customerID string
+	m, err := scanMethodWithCustomer(q.QueryRow(ctx,
+		`SELECT pm.id, pm.stripe_payment_method_id, pm.brand, pm.last4, pm.exp_month, pm.exp_year,
+		        pm.is_default, pm.created_at, u.stripe_customer_id
+		 FROM payment_methods pm
+		 JOIN users u ON u.id = pm.user_id
+		 WHERE pm.user_id = $1 AND pm.is_default AND u.stripe_customer_id IS NOT NULL`,
+		userID,
+	), &customerID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, "", ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return m, customerID, nil
+}
+
+func scanMethodWithCustomer(row pgx.Row, customerID *string) (*Method, error) {
+	var m Method
+	if err := row.Scan(&m.ID, &m.StripePaymentMethodID, &m.Brand, &m.Last4, &m.ExpMonth, &m.ExpYear,
+		&m.IsDefault, &m.CreatedAt, customerID); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -0,0 +1,10 @@
+package paymethod
+
+import "github.com/gin-gonic/gin"
+
+func RegisterRoutes(portal *gin.RouterGroup, h *Handler) {
+	methods := portal.Group("/payment-methods")
+	methods.GET("", h.ListMethods)
+	methods.POST("/:id/default", h.SetDefault)
+	methods.DELETE("/:id", h.RemoveMethod)
+}
@@ -0,0 +1,124 @@
+package paymethod
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/jackc/pgx/v5"
+)
+
+func (h *Handler) listMethods(ctx context.Context, userID string) ([]Method, *common.ServiceError) {
+	rows, err := h.pool.Query(ctx,
+		`SELECT `+methodColumns+`
+		 FROM payment_methods
+		 WHERE user_id = $1
+		 ORDER BY is_default DESC, created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to query payment methods", err)
+	}
+	defer rows.Close()
+
+	methods := make([]Method, 0)
+	for rows.Next() {
+		m, err := scanMethod(rows)
+		if err != nil {
+			return nil, common.ErrInternal("Failed to read payment method", err)
+		}
+		methods = append(methods, *m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, common.ErrInternal("Failed to iterate payment methods", err)
+	}
+	return methods, nil
+}
+
+func (h *Handler) setDefault(ctx context.Context, userID, id string) (*Method, *common.ServiceError) {
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to start transaction", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := lockMethod(ctx, tx, userID, id); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, common.ErrNotFound("Payment method not found", err)
+		}
+		return nil, common.ErrInternal("Failed to query payment method", err)
+	}
+
+	now := time.Now()
+	// 先清除旧默认卡，避免违反每个用户一张默认卡的唯一索引
+	if _, err := tx.Exec(ctx,
+		`UPDATE payment_methods SET is_default = FALSE, updated_at = $2 WHERE user_id = $1 AND is_default`,
+		userID, now,
+	); err != nil {
+		return nil, common.ErrInternal("Failed to update payment methods", err)
+	}
+	m, err := scanMethod(tx.QueryRow(ctx,
+		`UPDATE payment_methods
+		 SET is_default = TRUE, updated_at = $3
+		 WHERE id = $1 AND user_id = $2
+		 RETURNING `+methodColumns,
+		id, userID, now,
+	))
+	if err != nil {
+		return nil, common.ErrInternal("Failed to set default payment method", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, common.ErrInternal("Failed to commit transaction", err)
+	}
+	return m, nil
+}
+
+// removeMethod 通过网关从 Customer 上解绑卡片并删除本地记录
+func (h *Handler) removeMethod(ctx context.Context, userID, id string) *common.ServiceError {
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return common.ErrInternal("Failed to start transaction", err)
+	}
+	defer tx.Rollback(ctx)
+
+	m, err := lockMethod(ctx, tx, userID, id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return common.ErrNotFound("Payment method not found", err)
+		}
+		return common.ErrInternal("Failed to query payment method", err)
+	}
+
+	saved, err := h.gateways.SavedMethods()
+	if err != nil {
+		return common.ErrInternal("Payment gateway does not support saved cards", err)
+	}
+	// 卡片已在网关侧删除时只清理本地记录
+	if err := saved.DetachPaymentMethod(ctx, m.StripePaymentMethodID); err != nil {
+		return common.ErrInternal("Failed to remove card from Stripe", err)
+	}
+
+	if err := Forget(ctx, tx, m.StripePaymentMethodID, time.Now()); err != nil {
+		return common.ErrInternal("Failed to remove payment method", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return common.ErrInternal("Failed to commit transaction", err)
+	}
+	return nil
+}
+
+func lockMethod(ctx context.Context, tx pgx.Tx, userID, id string) (*Method, error) {
+	m, err := scanMethod(tx.QueryRow(ctx,
+		`SELECT `+methodColumns+`
+		 FROM payment_methods
+		 WHERE id = $1 AND user_id = $2
+		 FOR UPDATE`,
+		id, userID,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return m, err
+}
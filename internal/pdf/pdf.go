@@ -0,0 +1,209 @@
+// Package pdf 是一个只依赖标准库的极简 PDF 生成器，支持多页、标准 Helvetica 字体、文本和直线，
+// 足以排版发票等结构化单据。
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// A4 纸张尺寸（单位：point）
+const (
+	PageWidth  = 595.28
+	PageHeight = 841.89
+)
+
+// Document 按页累积绘图指令，调用 Bytes 时输出完整 PDF
+type Document struct {
+	title   string
+	pages   []*bytes.Buffer
+	current *bytes.Buffer
+}
+
+// New 创建空文档，title 写入文档信息字典
+func New(title string) *Document {
+	return &Document{title: title}
+}
+
+// AddPage 新增一页并设为当前页
+func (d *Document) AddPage() {
+	d.current = &bytes.Buffer{}
+	d.pages = append(d.pages, d.current)
+}
+
+// PageCount 返回页数
+func (d *Document) PageCount() int {
+	return len(d.pages)
+}
+
+// Text 在 (x, y) 处绘制文本，坐标原点为页面左上角
+func (d *Document) Text(x, y, size float64, bold bool, text string) {
+	d.ensurePage()
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.current, "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n",
+		font, size, x, PageHeight-y, escape(encodeWinAnsi(text)))
+}
+
+// TextRight 绘制右对齐文本，right 为文本右边缘的横坐标
+func (d *Document) TextRight(right, y, size float64, bold bool, text string) {
+	d.Text(right-TextWidth(text, size, bold), y, size, bold, text)
+}
+
+// Line 绘制一条直线
+func (d *Document) Line(x1, y1, x2, y2, width float64) {
+	d.ensurePage()
+	fmt.Fprintf(d.current, "%.2f w %.2f %.2f m %.2f %.2f l S\n",
+		width, x1, PageHeight-y1, x2, PageHeight-y2)
+}
+
+// FillRect 以灰度 gray（0 黑 - 1 白）填充矩形，(x, y) 为左上角
+func (d *Document) FillRect(x, y, w, h, gray float64) {
+	d.ensurePage()
+	fmt.Fprintf(d.current, "q %.3f g %.2f %.2f %.2f %.2f re f Q\n",
+		gray, x, PageHeight-y-h, w, h)
+}
+
+func (d *Document) ensurePage() {
+	if d.current == nil {
+		d.AddPage()
+	}
+}
+
+// TextWidth 返回文本按指定字号渲染后的宽度
+func TextWidth(text string, size float64, bold bool) float64 {
+	total := 0
+	for _, b := range []byte(encodeWinAnsi(text)) {
+		total += glyphWidth(b, bold)
+	}
+	return float64(total) * size / 1000
+}
+
+// Wrap 按最大宽度折行，单词超长时按字符截断
+func Wrap(text string, size float64, bold bool, maxWidth float64) []string {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return []string{""}
+	}
+
+	lines := make([]string, 0, 1)
+	current := ""
+	for _, word := range words {
+		candidate := word
+		if current != "" {
+			candidate = current + " " + word
+		}
+		if TextWidth(candidate, size, bold) <= maxWidth {
+			current = candidate
+			continue
+		}
+		if current != "" {
+			lines = append(lines, current)
+		}
+		for TextWidth(word, size, bold) > maxWidth && utf8.RuneCountInString(word) > 1 {
+			cut := len(word)
+			for cut > 0 && TextWidth(word[:cut], size, bold) > maxWidth {
+				_, n := utf8.DecodeLastRuneInString(word[:cut])
+				cut -= n
+			}
+			if cut == 0 {
+				_, cut = utf8.DecodeRuneInString(word)
+			}
+			lines = append(lines, word[:cut])
+			word = word[cut:]
+		}
+		current = word
+	}
+	return append(lines, current)
+}
+
+// Bytes 输出完整的 PDF 文件
+func (d *Document) Bytes() []byte {
+	d.ensurePage()
+
+	var out bytes.Buffer
+	offsets := make([]int, 0, 8+2*len(d.pages))
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// 对象编号：1 Catalog，2 Pages，3/4 字体，5 Info，之后每页依次为 Page 与 Contents
+	pageIDs := make([]string, len(d.pages))
+	for i := range d.pages {
+		pageIDs[i] = fmt.Sprintf("%d 0 R", 6+2*i)
+	}
+
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(pageIDs, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	object(fmt.Sprintf("<< /Title (%s) /Producer (EchoBilling) >>", escape(encodeWinAnsi(d.title))))
+
+	for i, page := range d.pages {
+		object(fmt.Sprintf(
+			"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			PageWidth, PageHeight, 7+2*i,
+		))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return out.Bytes()
+}
+
+// escape 转义 PDF 字符串中的特殊字符
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '(', ')':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\r', '\n':
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// winAnsiExtras 是 WinAnsiEncoding 在 0x80-0x9F 区间中常用字符的码位
+var winAnsiExtras = map[rune]byte{
+	'€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'‰': 0x89, '‹': 0x8B, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94,
+	'•': 0x95, '–': 0x96, '—': 0x97, '™': 0x99, '›': 0x9B,
+}
+
+// encodeWinAnsi 将 UTF-8 文本转换为 WinAnsi 单字节编码，无法表示的字符替换为 '?'
+func encodeWinAnsi(s string) string {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r == '\t':
+			out = append(out, ' ')
+		case r >= 0x20 && r < 0x7F, r >= 0xA0 && r <= 0xFF:
+			out = append(out, byte(r))
+		default:
+			if b, ok := winAnsiExtras[r]; ok {
+				out = append(out, b)
+			} else {
+				out = append(out, '?')
+			}
+		}
+	}
+	return string(out)
+}
@@ -0,0 +1,87 @@
+package pdf
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDocumentXrefOffsets(t *testing.T) {
+	t.Parallel()
+
+	doc := New("Invoice (INV-1)")
+	doc.Text(40, 40, 12, true, "Hello (world) \\ €")
+	doc.Line(40, 50, 200, 50, 0.5)
+	doc.AddPage()
+	doc.Text(40, 40, 10, false, "Second page")
+
+	out := doc.Bytes()
+	if !bytes.HasPrefix(out, []byte("%PDF-1.4")) || !bytes.HasSuffix(out, []byte("%%EOF\n")) {
+		t.Fatalf("missing PDF header or trailer")
+	}
+	if !bytes.Contains(out, []byte(`(Hello \(world\) \\ `+"\x80"+`) Tj`)) {
+		t.Fatalf("text was not escaped and encoded: %q", out)
+	}
+	if !bytes.Contains(out, []byte("/Count 2")) {
+		t.Fatalf("expected two pages")
+	}
+
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(out)
+	if m == nil {
+		t.Fatalf("startxref not found")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(out[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point at xref table", xref)
+	}
+
+	// 每个 xref 条目都必须指向对应编号的对象
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(out[xref:], -1)
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		want := strconv.Itoa(i+1) + " 0 obj"
+		if !bytes.HasPrefix(out[offset:], []byte(want)) {
+			t.Fatalf("xref entry %d points at %q, want %q", i+1, out[offset:offset+10], want)
+		}
+	}
+}
+
+func TestTextWidthAndWrap(t *testing.T) {
+	t.Parallel()
+
+	// Helvetica 中 "0" 宽 556/1000 em
+	if got := TextWidth("00", 10, false); got != 11.12 {
+		t.Fatalf("TextWidth = %v, want 11.12", got)
+	}
+	if TextWidth("W", 10, true) <= TextWidth("i", 10, true) {
+		t.Fatalf("expected W to be wider than i")
+	}
+
+	lines := Wrap("Virtual private server renewal for the annual billing period", 10, false, 120)
+	if len(lines) < 2 {
+		t.Fatalf("expected wrapped lines, got %q", lines)
+	}
+	for _, line := range lines {
+		if TextWidth(line, 10, false) > 120 {
+			t.Fatalf("line %q exceeds max width", line)
+		}
+	}
+	if strings.Join(lines, " ") != "Virtual private server renewal for the annual billing period" {
+		t.Fatalf("wrap lost words: %q", lines)
+	}
+
+	long := Wrap(strings.Repeat("x", 80), 10, false, 50)
+	if len(long) < 2 {
+		t.Fatalf("expected overlong word to be split, got %q", long)
+	}
+}
+
+func TestEncodeWinAnsi(t *testing.T) {
+	t.Parallel()
+
+	if got := encodeWinAnsi("Müller – 10€ 日本"); got != "M\xfcller \x96 10\x80 ??" {
+		t.Fatalf("encodeWinAnsi = %q", got)
+	}
+}
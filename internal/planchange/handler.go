@@ -0,0 +1,64 @@
+package planchange
+
+import (
+	"net/http"
+
+	"github.com/adiecho/echobilling/internal/app"
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/gin-gonic/gin"
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type Handler struct {
+	pool        *pgxpool.Pool
+	asynqClient *asynq.Client
+	store       *app.SettingsStore
+}
+
+func NewHandler(pool *pgxpool.Pool, asynqClient *asynq.Client, store *app.SettingsStore) *Handler {
+	return &Handler{pool: pool, asynqClient: asynqClient, store: store}
+}
+
+type ChangePlanRequest struct {
+	PlanID string `json:"plan_id" binding:"required"`
+}
+
+// ChangePlan - POST /api/v1/portal/services/:id/change-plan
+// 升级时返回待支付的差价发票；降级或同价变更无需支付，直接进入执行
+func (h *Handler) ChangePlan(c *gin.Context) {
+	userID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	var req ChangePlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.WriteServiceError(c, common.ErrBadRequest("Invalid request body", err))
+		return
+	}
+
+	change, svcErr := h.changePlan(c.Request.Context(), userID, c.Param("id"), req.PlanID)
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+
+	c.JSON(http.StatusCreated, change)
+}
+
+// ListChanges - GET /api/v1/portal/services/:id/plan-changes
+func (h *Handler) ListChanges(c *gin.Context) {
+	userID, ok := common.GetUserID(c)
+	if !ok {
+		return
+	}
+
+	changes, svcErr := h.listChanges(c.Request.Context(), userID, c.Param("id"))
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"plan_changes": changes})
+}
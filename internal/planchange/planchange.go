@@ -0,0 +1,54 @@
+package planchange
+
+import (
+	"time"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusPaid      = "paid"
+	StatusApplied   = "applied"
+	StatusCancelled = "cancelled"
+)
+
+// Change 一次套餐升降级。Amount 为折算差价：正数通过 InvoiceID 对应的发票补缴，负数退回为账户余额
+type Change struct {
+	ID           string     `json:"id"`
+	ServiceID    string     `json:"service_id"`
+	FromPlanID   string     `json:"from_plan_id"`
+	FromPlanName string     `json:"from_plan_name"`
+	ToPlanID     string     `json:"to_plan_id"`
+	ToPlanName   string     `json:"to_plan_name"`
+	BillingCycle string     `json:"billing_cycle"`
+	OldPrice     string     `json:"old_price"`
+	NewPrice     string     `json:"new_price"`
+	Amount       string     `json:"amount"`
+	PeriodStart  time.Time  `json:"period_start"`
+	PeriodEnd    time.Time  `json:"period_end"`
+	InvoiceID    *string    `json:"invoice_id"`
+	Status       string     `json:"status"`
+	AppliedAt    *time.Time `json:"applied_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// Prorate 按当前计费周期的剩余时间折算新旧单价的差额（分）：正数需补缴，负数应退回。
+// 按秒计算，剩余时间超出周期时按整个周期计。
+func Prorate(oldPrice, newPrice int64, periodStart, periodEnd, now time.Time) int64 {
+	period := int64(periodEnd.Sub(periodStart) / time.Second)
+	remaining := int64(periodEnd.Sub(now) / time.Second)
+	if period <= 0 || remaining <= 0 {
+		return 0
+	}
+	if remaining > period {
+		remaining = period
+	}
+	return divRound((newPrice-oldPrice)*remaining, period)
+}
+
+// divRound 整数除法，四舍五入（远离零）
+func divRound(a, b int64) int64 {
+	if a < 0 {
+		return -divRound(-a, b)
+	}
+	return (a + b/2) / b
+}
@@ -0,0 +1,34 @@
+package planchange
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProrate(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC) // 30 天
+
+	cases := []struct {
+		name     string
+		oldPrice int64
+		newPrice int64
+		now      time.Time
+		want     int64
+	}{
+		{"upgrade halfway", 1000, 2500, start.AddDate(0, 0, 15), 750},
+		{"downgrade halfway", 2500, 1000, start.AddDate(0, 0, 15), -750},
+		{"upgrade at period start", 1000, 2000, start, 1000},
+		{"upgrade with one third left", 1000, 2000, start.AddDate(0, 0, 20), 333},
+		{"same price", 1500, 1500, start.AddDate(0, 0, 3), 0},
+		{"expired", 1000, 2000, end.Add(time.Hour), 0},
+		{"clock before period start", 1000, 2000, start.Add(-time.Hour), 1000},
+	}
+	for _, tc := range cases {
+		if got := Prorate(tc.oldPrice, tc.newPrice, start, end, tc.now); got != tc.want {
+			t.Errorf("%s: Prorate = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+package planchange
+
+import "github.com/gin-gonic/gin"
+
+func RegisterRoutes(portal *gin.RouterGroup, h *Handler) {
+	portal.POST("/services/:id/change-plan", h.ChangePlan)
+	portal.GET("/services/:id/plan-changes", h.ListChanges)
+}
@@ -0,0 +1,366 @@
+package planchange
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/credit"
+	"github.com/adiecho/echobilling/internal/invoicestatus"
+	"github.com/adiecho/echobilling/internal/numbering"
+	"github.com/adiecho/echobilling/internal/provisioning"
+	"github.com/adiecho/echobilling/internal/tax"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
+)
+
+const changeColumns = `
+	pc.id, pc.service_id, pc.from_plan_id, fp.name, pc.to_plan_id, tp.name,
+	pc.billing_cycle::text, pc.old_price::text, pc.new_price::text, pc.amount::text,
+	pc.period_start, pc.period_end, pc.invoice_id::text, pc.status, pc.applied_at, pc.created_at`
+
+func scanChange(row pgx.Row) (*Change, error) {
+	var ch Change
+	err := row.Scan(
+		&ch.ID, &ch.ServiceID, &ch.FromPlanID, &ch.FromPlanName, &ch.ToPlanID, &ch.ToPlanName,
+		&ch.BillingCycle, &ch.OldPrice, &ch.NewPrice, &ch.Amount,
+		&ch.PeriodStart, &ch.PeriodEnd, &ch.InvoiceID, &ch.Status, &ch.AppliedAt, &ch.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
+
+type currentService struct {
+	status       string
+	planID       string
+	planName     string
+	productID    string
+	orderID      string
+	billingCycle string
+	price        string
+	currency     string
+	hostname     string
+	expiresAt    *time.Time
+}
+
+type targetPlan struct {
+	name           string
+	productID      string
+	isActive       bool
+	priceMonthly   *string
+	priceQuarterly *string
+	priceAnnually  *string
+}
+
+// priceFor 返回套餐在指定计费周期的价格，未开放该周期时返回 nil
+func (p *targetPlan) priceFor(billingCycle string) *string {
+	switch billingCycle {
+	case "monthly":
+		return p.priceMonthly
+	case "quarterly":
+		return p.priceQuarterly
+	case "annually":
+		return p.priceAnnually
+	}
+	return nil
+}
+
+func (h *Handler) changePlan(ctx context.Context, userID, serviceID, planID string) (*Change, *common.ServiceError) {
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to start transaction", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+
+	var svc currentService
+	err = tx.QueryRow(ctx,
+		`SELECT s.status::text, s.plan_id::text, p.name, p.product_id::text,
+		        oi.order_id::text, oi.billing_cycle::text,
+		        COALESCE(s.recurring_price, oi.unit_price)::text,
+		        o.currency, COALESCE(s.hostname, ''), s.expires_at
+		 FROM services s
+		 JOIN order_items oi ON oi.id = s.order_item_id
+		 JOIN orders o ON o.id = oi.order_id
+		 JOIN plans p ON p.id = s.plan_id
+		 WHERE s.id = $1 AND s.user_id = $2
+		 FOR UPDATE OF s`,
+		serviceID, userID,
+	).Scan(&svc.status, &svc.planID, &svc.planName, &svc.productID,
+		&svc.orderID, &svc.billingCycle, &svc.price,
+		&svc.currency, &svc.hostname, &svc.expiresAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, common.ErrNotFound("Service not found", err)
+		}
+		return nil, common.ErrInternal("Failed to query service", err)
+	}
+
+	if svc.status != "active" {
+		return nil, common.ErrBadRequest("Only active services can change plan", nil)
+	}
+	if svc.expiresAt == nil || !svc.expiresAt.After(now) {
+		return nil, common.ErrBadRequest("Service has expired, renew it before changing plan", nil)
+	}
+	if svc.planID == planID {
+		return nil, common.ErrBadRequest("Service is already on this plan", nil)
+	}
+
+	var plan targetPlan
+	err = tx.QueryRow(ctx,
+		`SELECT name, product_id::text, is_active,
+		        price_monthly::text, price_quarterly::text, price_annually::text
+		 FROM plans
+		 WHERE id = $1`,
+		planID,
+	).Scan(&plan.name, &plan.productID, &plan.isActive,
+		&plan.priceMonthly, &plan.priceQuarterly, &plan.priceAnnually)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, common.ErrBadRequest("Plan not found", err)
+		}
+		return nil, common.ErrInternal("Failed to query plan", err)
+	}
+	if !plan.isActive {
+		return nil, common.ErrBadRequest("Plan is not active", nil)
+	}
+	if plan.productID != svc.productID {
+		return nil, common.ErrBadRequest("Plan belongs to a different product", nil)
+	}
+	newPrice := plan.priceFor(svc.billingCycle)
+	if newPrice == nil {
+		return nil, common.ErrBadRequest(fmt.Sprintf("Plan is not available for %s billing", svc.billingCycle), nil)
+	}
+
+	if svcErr := h.cancelPendingChanges(ctx, tx, serviceID, now); svcErr != nil {
+		return nil, svcErr
+	}
+
+	oldCents, err := common.DecimalAmountToCents(svc.price)
+	if err != nil {
+		return nil, common.ErrInternal("Invalid service price", err)
+	}
+	newCents, err := common.DecimalAmountToCents(*newPrice)
+	if err != nil {
+		return nil, common.ErrInternal("Invalid plan price", err)
+	}
+
+	periodEnd := *svc.expiresAt
+	periodStart := common.BillingCycleStart(periodEnd, svc.billingCycle)
+	amount := Prorate(oldCents, newCents, periodStart, periodEnd, now)
+
+	changeID := uuid.New().String()
+	status := StatusPaid
+	var invoiceID *string
+	if amount > 0 {
+		// 升级需要先补缴差价，发票结清后再执行变更
+		description := fmt.Sprintf("Plan change %s -> %s (prorated %s - %s)", svc.planName, plan.name,
+			now.Format("2006-01-02"), periodEnd.Format("2006-01-02"))
+		if svc.hostname != "" {
+			description = svc.hostname + " - " + description
+		}
+		id, svcErr := h.createInvoice(ctx, tx, userID, serviceID, svc.orderID, svc.currency, description, amount, now)
+		if svcErr != nil {
+			return nil, svcErr
+		}
+		invoiceID = &id
+		status = StatusPending
+	}
+
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO plan_changes (
+			id, service_id, user_id, from_plan_id, to_plan_id, billing_cycle,
+			old_price, new_price, amount, period_start, period_end, invoice_id, status, created_at, updated_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $14)
+		ON CONFLICT (service_id) WHERE status IN ('pending', 'paid') DO NOTHING`,
+		changeID, serviceID, userID, svc.planID, planID, svc.billingCycle,
+		svc.price, *newPrice, common.CentsToDecimal(amount), periodStart, periodEnd, invoiceID, status, now,
+	)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to create plan change", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, common.NewServiceError(http.StatusConflict, "A plan change is already being applied to this service", nil)
+	}
+
+	// 降级差价退回为账户余额
+	if amount < 0 {
+		if _, err := credit.Post(ctx, tx, credit.Entry{
+			UserID:       userID,
+			Kind:         credit.KindDowngrade,
+			Amount:       -amount,
+			Reason:       "Plan downgrade proration",
+			PlanChangeID: changeID,
+		}, now); err != nil {
+			return nil, common.ErrInternal("Failed to credit downgrade proration", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, common.ErrInternal("Failed to commit plan change", err)
+	}
+
+	if status == StatusPaid {
+		if err := h.enqueueResize(serviceID, changeID); err != nil {
+			log.Printf("Failed to enqueue plan change %s: %v", changeID, err)
+		}
+	}
+
+	change, err := scanChange(h.pool.QueryRow(ctx,
+		`SELECT `+changeColumns+`
+		 FROM plan_changes pc
+		 JOIN plans fp ON fp.id = pc.from_plan_id
+		 JOIN plans tp ON tp.id = pc.to_plan_id
+		 WHERE pc.id = $1`,
+		changeID,
+	))
+	if err != nil {
+		return nil, common.ErrInternal("Failed to load plan change", err)
+	}
+	return change, nil
+}
+
+// cancelPendingChanges 取消该服务尚未支付的变更并作废对应发票，退回已抵扣的余额，客户重新选择套餐时以最新请求为准
+func (h *Handler) cancelPendingChanges(ctx context.Context, tx pgx.Tx, serviceID string, now time.Time) *common.ServiceError {
+	rows, err := tx.Query(ctx,
+		`WITH cancelled AS (
+			UPDATE plan_changes
+			SET status = 'cancelled', updated_at = $2
+			WHERE service_id = $1 AND status = 'pending'
+			RETURNING invoice_id
+		)
+		SELECT id FROM invoices
+		WHERE id IN (SELECT invoice_id FROM cancelled) AND status = 'pending'`,
+		serviceID, now,
+	)
+	if err != nil {
+		return common.ErrInternal("Failed to cancel pending plan change", err)
+	}
+	var invoiceIDs []string
+	for rows.Next() {
+		var invoiceID string
+		if err := rows.Scan(&invoiceID); err != nil {
+			rows.Close()
+			return common.ErrInternal("Failed to cancel pending plan change", err)
+		}
+		invoiceIDs = append(invoiceIDs, invoiceID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return common.ErrInternal("Failed to cancel pending plan change", err)
+	}
+
+	for _, invoiceID := range invoiceIDs {
+		if _, err := invoicestatus.MarkVoid(ctx, tx, invoiceID, "Superseded by a new plan change", now); err != nil {
+			return common.ErrInternal("Failed to void plan change invoice", err)
+		}
+	}
+	return nil
+}
+
+// createInvoice 开具差价发票；不设置计费周期，结清时不会延长服务到期时间
+func (h *Handler) createInvoice(
+	ctx context.Context,
+	tx pgx.Tx,
+	userID, serviceID, orderID, currency, description string,
+	amount int64,
+	now time.Time,
+) (string, *common.ServiceError) {
+	decision, err := tax.ForUser(ctx, tx, h.store, userID)
+	if err != nil {
+		return "", common.ErrInternal("Failed to resolve tax", err)
+	}
+	breakdown, err := decision.Apply([]int64{amount})
+	if err != nil {
+		return "", common.ErrInternal("Failed to calculate tax", err)
+	}
+
+	invoiceNumber, err := numbering.Next(ctx, tx, h.store, numbering.SeriesInvoice, now)
+	if err != nil {
+		return "", common.ErrInternal("Failed to allocate invoice number", err)
+	}
+
+	invoiceID := uuid.New().String()
+	_, err = tx.Exec(ctx,
+		`INSERT INTO invoices (
+			id, user_id, order_id, service_id, invoice_number, status, subtotal, tax, total, currency,
+			tax_inclusive, reverse_charge, due_date, created_at, updated_at
+		)
+		VALUES ($1, $2, $3, $4, $5, 'pending', $6, $7, $8, $9, $10, $11, $12, $12, $12)`,
+		invoiceID, userID, orderID, serviceID, invoiceNumber,
+		common.CentsToDecimal(breakdown.Priced()), common.CentsToDecimal(breakdown.Tax), common.CentsToDecimal(breakdown.Total),
+		strings.ToUpper(currency), decision.Inclusive, decision.ReverseCharge, now,
+	)
+	if err != nil {
+		return "", common.ErrInternal("Failed to create invoice", err)
+	}
+
+	price := common.CentsToDecimal(amount)
+	_, err = tx.Exec(ctx,
+		`INSERT INTO invoice_items (id, invoice_id, description, quantity, unit_price, amount, created_at)
+		 VALUES ($1, $2, $3, 1, $4, $4, $5)`,
+		uuid.New().String(), invoiceID, description, price, now,
+	)
+	if err != nil {
+		return "", common.ErrInternal("Failed to create invoice item", err)
+	}
+	if err := tax.InsertInvoiceLine(ctx, tx, invoiceID, breakdown, now); err != nil {
+		return "", common.ErrInternal("Failed to create invoice tax line", err)
+	}
+
+	return invoiceID, nil
+}
+
+func (h *Handler) enqueueResize(serviceID, changeID string) error {
+	if h.asynqClient == nil {
+		return nil
+	}
+	task, err := provisioning.NewResizeVPSTask(provisioning.ResizeVPSPayload{
+		ServiceID:    serviceID,
+		PlanChangeID: changeID,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = h.asynqClient.Enqueue(task, asynq.Queue("critical"), asynq.MaxRetry(5))
+	return err
+}
+
+func (h *Handler) listChanges(ctx context.Context, userID, serviceID string) ([]Change, *common.ServiceError) {
+	rows, err := h.pool.Query(ctx,
+		`SELECT `+changeColumns+`
+		 FROM plan_changes pc
+		 JOIN plans fp ON fp.id = pc.from_plan_id
+		 JOIN plans tp ON tp.id = pc.to_plan_id
+		 WHERE pc.service_id = $1 AND pc.user_id = $2
+		 ORDER BY pc.created_at DESC`,
+		serviceID, userID,
+	)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to query plan changes", err)
+	}
+	defer rows.Close()
+
+	changes := make([]Change, 0)
+	for rows.Next() {
+		ch, err := scanChange(rows)
+		if err != nil {
+			return nil, common.ErrInternal("Failed to read plan change", err)
+		}
+		changes = append(changes, *ch)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, common.ErrInternal("Failed to iterate plan changes", err)
+	}
+	return changes, nil
+}
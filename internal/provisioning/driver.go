@@ -0,0 +1,136 @@
+package provisioning
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/adiecho/echobilling/internal/app"
+	"github.com/adiecho/echobilling/internal/ipam"
+)
+
+// ErrInstanceNotFound 表示后端已不存在该实例
+var ErrInstanceNotFound = errors.New("instance not found")
+
+// InstanceStatus 后端实例的运行状态
+type InstanceStatus string
+
+const (
+	InstanceRunning InstanceStatus = "running"
+	InstanceStopped InstanceStatus = "stopped"
+	InstanceUnknown InstanceStatus = "unknown"
+)
+
+// CreateRequest 描述一次实例创建所需的资源；Addresses 为 IPAM 预留的地址，未配置地址池时为空
+type CreateRequest struct {
+	ServiceID string
+	Hostname  string
+	CPUCores  int
+	MemoryMB  int
+	DiskGB    int
+	Addresses []ipam.Assignment
+}
+
+// addressOf 返回请求中指定地址族的预留地址
+func (r CreateRequest) addressOf(family string) *ipam.Assignment {
+	for i := range r.Addresses {
+		if r.Addresses[i].Family == family {
+			return &r.Addresses[i]
+		}
+	}
+	return nil
+}
+
+// ResizeRequest 套餐变更后的目标规格；字段为 0 表示不调整。磁盘只能扩容，缩小时调用方传 0
+type ResizeRequest struct {
+	CPUCores int
+	MemoryMB int
+	DiskGB   int
+}
+
+// Instance 驱动创建实例后返回的结果，会写回 services 表
+type Instance struct {
+	ExternalID string
+	Hostname   string
+	IPAddress  string
+	Status     InstanceStatus
+	Metadata   map[string]string
+}
+
+// Driver 是虚拟化后端的统一抽象，每个产品或套餐可以选择不同的驱动
+type Driver interface {
+	Name() string
+	Create(ctx context.Context, req CreateRequest) (*Instance, error)
+	Suspend(ctx context.Context, externalID string) error
+	Unsuspend(ctx context.Context, externalID string) error
+	Terminate(ctx context.Context, externalID string) error
+	Resize(ctx context.Context, externalID string, req ResizeRequest) error
+	Status(ctx context.Context, externalID string) (InstanceStatus, error)
+}
+
+// DriverRegistry 按名称解析驱动，Proxmox 驱动每次根据最新设置构建以支持热更新
+type DriverRegistry struct {
+	store *app.SettingsStore
+
+	mu      sync.Mutex
+	drivers map[string]Driver
+}
+
+// NewDriverRegistry 创建驱动注册表，内置 mock 驱动
+func NewDriverRegistry(store *app.SettingsStore) *DriverRegistry {
+	return &DriverRegistry{
+		store: store,
+		drivers: map[string]Driver{
+			"mock": NewMockDriver(),
+		},
+	}
+}
+
+// Register 注册自定义驱动（主要用于测试或扩展）
+func (r *DriverRegistry) Register(d Driver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.drivers[d.Name()] = d
+}
+
+// DefaultName 返回系统设置中的默认驱动名
+func (r *DriverRegistry) DefaultName() string {
+	if r.store == nil {
+		return "mock"
+	}
+	if name := r.store.Get("provisioning_default_driver"); name != "" {
+		return name
+	}
+	return "mock"
+}
+
+// Get 返回指定名称的驱动，名称为空时使用默认驱动
+func (r *DriverRegistry) Get(name string) (Driver, error) {
+	if name == "" {
+		name = r.DefaultName()
+	}
+
+	r.mu.Lock()
+	d, ok := r.drivers[name]
+	r.mu.Unlock()
+	if ok {
+		return d, nil
+	}
+
+	switch name {
+	case "proxmox":
+		if r.store == nil {
+			return nil, fmt.Errorf("proxmox driver is not configured")
+		}
+		return NewProxmoxDriver(ProxmoxConfig{
+			BaseURL:      r.store.Get("proxmox_api_url"),
+			TokenID:      r.store.Get("proxmox_token_id"),
+			TokenSecret:  r.store.Get("proxmox_token_secret"),
+			Node:         r.store.Get("proxmox_node"),
+			TemplateVMID: r.store.GetInt("proxmox_template_vmid", 0),
+		})
+	default:
+		return nil, fmt.Errorf("unknown provisioning driver %q", name)
+	}
+}
@@ -0,0 +1,123 @@
+package provisioning
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/adiecho/echobilling/internal/ipam"
+	"github.com/google/uuid"
+)
+
+// MockDriver 是进程内的模拟驱动，用于开发环境和测试，不会创建真实资源
+type MockDriver struct {
+	mu        sync.Mutex
+	instances map[string]*Instance
+	nextHost  int
+}
+
+// NewMockDriver 创建模拟驱动
+func NewMockDriver() *MockDriver {
+	return &MockDriver{
+		instances: make(map[string]*Instance),
+	}
+}
+
+func (d *MockDriver) Name() string { return "mock" }
+
+func (d *MockDriver) Create(_ context.Context, req CreateRequest) (*Instance, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.nextHost++
+	hostname := req.Hostname
+	if hostname == "" {
+		hostname = fmt.Sprintf("mock-%d.invalid", d.nextHost)
+	}
+
+	// 未配置地址池时使用 198.51.100.0/24（TEST-NET-2 文档地址段），不会与真实网络冲突
+	ipAddress := fmt.Sprintf("198.51.100.%d", (d.nextHost-1)%254+1)
+	if reserved := req.addressOf(ipam.FamilyIPv4); reserved != nil {
+		ipAddress = reserved.Address
+	}
+
+	inst := &Instance{
+		ExternalID: "mock-" + uuid.NewString(),
+		Hostname:   hostname,
+		IPAddress:  ipAddress,
+		Status:     InstanceRunning,
+		Metadata: map[string]string{
+			"cpu_cores": fmt.Sprintf("%d", req.CPUCores),
+			"memory_mb": fmt.Sprintf("%d", req.MemoryMB),
+			"disk_gb":   fmt.Sprintf("%d", req.DiskGB),
+		},
+	}
+	d.instances[inst.ExternalID] = inst
+
+	copied := *inst
+	return &copied, nil
+}
+
+func (d *MockDriver) Suspend(_ context.Context, externalID string) error {
+	return d.setStatus(externalID, InstanceStopped)
+}
+
+func (d *MockDriver) Unsuspend(_ context.Context, externalID string) error {
+	return d.setStatus(externalID, InstanceRunning)
+}
+
+func (d *MockDriver) Terminate(_ context.Context, externalID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.instances, externalID)
+	return nil
+}
+
+func (d *MockDriver) Resize(_ context.Context, externalID string, req ResizeRequest) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	inst, ok := d.instances[externalID]
+	if !ok {
+		return ErrInstanceNotFound
+	}
+	if inst.Metadata == nil {
+		inst.Metadata = make(map[string]string)
+	}
+	if req.CPUCores > 0 {
+		inst.Metadata["cpu_cores"] = fmt.Sprintf("%d", req.CPUCores)
+	}
+	if req.MemoryMB > 0 {
+		inst.Metadata["memory_mb"] = fmt.Sprintf("%d", req.MemoryMB)
+	}
+	if req.DiskGB > 0 {
+		inst.Metadata["disk_gb"] = fmt.Sprintf("%d", req.DiskGB)
+	}
+	return nil
+}
+
+func (d *MockDriver) Status(_ context.Context, externalID string) (InstanceStatus, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	inst, ok := d.instances[externalID]
+	if !ok {
+		return InstanceUnknown, ErrInstanceNotFound
+	}
+	return inst.Status, nil
+}
+
+// setStatus 更新实例状态；worker 重启后内存状态丢失，未知实例会被重新登记
+func (d *MockDriver) setStatus(externalID string, status InstanceStatus) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	inst, ok := d.instances[externalID]
+	if !ok {
+		inst = &Instance{ExternalID: externalID}
+		d.instances[externalID] = inst
+	}
+	inst.Status = status
+	return nil
+}
@@ -0,0 +1,417 @@
+package provisioning
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/ipam"
+)
+
+const (
+	proxmoxDefaultDisk         = "scsi0"
+	proxmoxDefaultPollInterval = 2 * time.Second
+	proxmoxDefaultTaskTimeout  = 10 * time.Minute
+)
+
+// ProxmoxConfig Proxmox VE 驱动配置
+type ProxmoxConfig struct {
+	BaseURL      string
+	TokenID      string
+	TokenSecret  string
+	Node         string
+	TemplateVMID int
+	Disk         string
+	HTTPClient   *http.Client
+	PollInterval time.Duration
+	TaskTimeout  time.Duration
+}
+
+// ProxmoxDriver 通过 Proxmox VE HTTP API 克隆模板创建 QEMU 虚拟机
+type ProxmoxDriver struct {
+	cfg    ProxmoxConfig
+	client *http.Client
+}
+
+// NewProxmoxDriver 创建 Proxmox 驱动并校验必要配置
+func NewProxmoxDriver(cfg ProxmoxConfig) (*ProxmoxDriver, error) {
+	if cfg.BaseURL == "" || cfg.TokenID == "" || cfg.TokenSecret == "" || cfg.Node == "" {
+		return nil, errors.New("proxmox driver requires api url, token id, token secret and node")
+	}
+	if cfg.TemplateVMID <= 0 {
+		return nil, errors.New("proxmox driver requires a template vmid")
+	}
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	if cfg.Disk == "" {
+		cfg.Disk = proxmoxDefaultDisk
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = proxmoxDefaultPollInterval
+	}
+	if cfg.TaskTimeout <= 0 {
+		cfg.TaskTimeout = proxmoxDefaultTaskTimeout
+	}
+
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	return &ProxmoxDriver{cfg: cfg, client: client}, nil
+}
+
+func (d *ProxmoxDriver) Name() string { return "proxmox" }
+
+func (d *ProxmoxDriver) Create(ctx context.Context, req CreateRequest) (*Instance, error) {
+	var nextID json.RawMessage
+	if err := d.do(ctx, http.MethodGet, "/cluster/nextid", nil, &nextID); err != nil {
+		return nil, fmt.Errorf("failed to allocate vmid: %w", err)
+	}
+	vmid, err := strconv.Atoi(strings.Trim(string(nextID), `"`))
+	if err != nil {
+		return nil, fmt.Errorf("invalid vmid %s: %w", nextID, err)
+	}
+
+	node := d.cfg.Node
+	clone := url.Values{}
+	clone.Set("newid", strconv.Itoa(vmid))
+	clone.Set("full", "1")
+	if req.Hostname != "" {
+		clone.Set("name", req.Hostname)
+	}
+	if err := d.runTask(ctx, node, http.MethodPost,
+		fmt.Sprintf("/nodes/%s/qemu/%d/clone", node, d.cfg.TemplateVMID), clone); err != nil {
+		return nil, fmt.Errorf("failed to clone template: %w", err)
+	}
+
+	if err := d.configure(ctx, node, vmid, req); err != nil {
+		// 克隆成功但后续步骤失败时尽量回收，避免重试时留下孤儿虚拟机
+		_ = d.destroy(ctx, node, vmid)
+		return nil, err
+	}
+
+	ipAddress := ""
+	if reserved := req.addressOf(ipam.FamilyIPv4); reserved != nil {
+		ipAddress = reserved.Address
+	}
+
+	return &Instance{
+		ExternalID: fmt.Sprintf("%s/%d", node, vmid),
+		Hostname:   req.Hostname,
+		IPAddress:  ipAddress,
+		Status:     InstanceRunning,
+		Metadata: map[string]string{
+			"node": node,
+			"vmid": strconv.Itoa(vmid),
+		},
+	}, nil
+}
+
+func (d *ProxmoxDriver) configure(ctx context.Context, node string, vmid int, req CreateRequest) error {
+	vmPath := fmt.Sprintf("/nodes/%s/qemu/%d", node, vmid)
+
+	config := url.Values{}
+	if req.CPUCores > 0 {
+		config.Set("cores", strconv.Itoa(req.CPUCores))
+	}
+	if req.MemoryMB > 0 {
+		config.Set("memory", strconv.Itoa(req.MemoryMB))
+	}
+	if ipconfig := cloudInitIPConfig(req); ipconfig != "" {
+		config.Set("ipconfig0", ipconfig)
+		if dns := cloudInitNameservers(req); dns != "" {
+			config.Set("nameserver", dns)
+		}
+	}
+	if len(config) > 0 {
+		if err := d.runTask(ctx, node, http.MethodPost, vmPath+"/config", config); err != nil {
+			return fmt.Errorf("failed to configure vm: %w", err)
+		}
+	}
+
+	if req.DiskGB > 0 {
+		resize := url.Values{}
+		resize.Set("disk", d.cfg.Disk)
+		resize.Set("size", fmt.Sprintf("%dG", req.DiskGB))
+		if err := d.runTask(ctx, node, http.MethodPut, vmPath+"/resize", resize); err != nil {
+			return fmt.Errorf("failed to resize disk: %w", err)
+		}
+	}
+
+	if err := d.runTask(ctx, node, http.MethodPost, vmPath+"/status/start", nil); err != nil {
+		return fmt.Errorf("failed to start vm: %w", err)
+	}
+	return nil
+}
+
+// cloudInitIPConfig 将预留地址转换为 cloud-init 的 ipconfig0 参数，例如 "ip=203.0.113.10/24,gw=203.0.113.1"
+func cloudInitIPConfig(req CreateRequest) string {
+	parts := make([]string, 0, 4)
+	if v4 := req.addressOf(ipam.FamilyIPv4); v4 != nil {
+		parts = append(parts, fmt.Sprintf("ip=%s/%d", v4.Address, v4.PrefixLength))
+		if v4.Gateway != "" {
+			parts = append(parts, "gw="+v4.Gateway)
+		}
+	}
+	if v6 := req.addressOf(ipam.FamilyIPv6); v6 != nil {
+		parts = append(parts, fmt.Sprintf("ip6=%s/%d", v6.Address, v6.PrefixLength))
+		if v6.Gateway != "" {
+			parts = append(parts, "gw6="+v6.Gateway)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// cloudInitNameservers 合并各地址族子网配置的 DNS 服务器，Proxmox 要求以空格分隔
+func cloudInitNameservers(req CreateRequest) string {
+	seen := make(map[string]bool)
+	servers := make([]string, 0)
+	for _, a := range req.Addresses {
+		for _, server := range strings.FieldsFunc(a.DNSServers, func(r rune) bool { return r == ',' || r == ' ' }) {
+			if !seen[server] {
+				seen[server] = true
+				servers = append(servers, server)
+			}
+		}
+	}
+	return strings.Join(servers, " ")
+}
+
+func (d *ProxmoxDriver) Suspend(ctx context.Context, externalID string) error {
+	node, vmid, err := parseProxmoxID(externalID)
+	if err != nil {
+		return err
+	}
+	return d.runTask(ctx, node, http.MethodPost, fmt.Sprintf("/nodes/%s/qemu/%d/status/stop", node, vmid), nil)
+}
+
+func (d *ProxmoxDriver) Unsuspend(ctx context.Context, externalID string) error {
+	node, vmid, err := parseProxmoxID(externalID)
+	if err != nil {
+		return err
+	}
+	return d.runTask(ctx, node, http.MethodPost, fmt.Sprintf("/nodes/%s/qemu/%d/status/start", node, vmid), nil)
+}
+
+func (d *ProxmoxDriver) Terminate(ctx context.Context, externalID string) error {
+	node, vmid, err := parseProxmoxID(externalID)
+	if err != nil {
+		return err
+	}
+
+	status, err := d.status(ctx, node, vmid)
+	if errors.Is(err, ErrInstanceNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if status == InstanceRunning {
+		if err := d.runTask(ctx, node, http.MethodPost, fmt.Sprintf("/nodes/%s/qemu/%d/status/stop", node, vmid), nil); err != nil {
+			return fmt.Errorf("failed to stop vm: %w", err)
+		}
+	}
+
+	return d.destroy(ctx, node, vmid)
+}
+
+// Resize 修改 CPU 和内存并扩容磁盘；CPU 和内存在重启后生效，运行中的实例会被重启
+func (d *ProxmoxDriver) Resize(ctx context.Context, externalID string, req ResizeRequest) error {
+	node, vmid, err := parseProxmoxID(externalID)
+	if err != nil {
+		return err
+	}
+	vmPath := fmt.Sprintf("/nodes/%s/qemu/%d", node, vmid)
+
+	config := url.Values{}
+	if req.CPUCores > 0 {
+		config.Set("cores", strconv.Itoa(req.CPUCores))
+	}
+	if req.MemoryMB > 0 {
+		config.Set("memory", strconv.Itoa(req.MemoryMB))
+	}
+	if len(config) > 0 {
+		if err := d.runTask(ctx, node, http.MethodPost, vmPath+"/config", config); err != nil {
+			return fmt.Errorf("failed to configure vm: %w", err)
+		}
+	}
+
+	if req.DiskGB > 0 {
+		resize := url.Values{}
+		resize.Set("disk", d.cfg.Disk)
+		resize.Set("size", fmt.Sprintf("%dG", req.DiskGB))
+		if err := d.runTask(ctx, node, http.MethodPut, vmPath+"/resize", resize); err != nil {
+			return fmt.Errorf("failed to resize disk: %w", err)
+		}
+	}
+
+	if len(config) == 0 {
+		return nil
+	}
+	status, err := d.status(ctx, node, vmid)
+	if err != nil {
+		return err
+	}
+	if status == InstanceRunning {
+		if err := d.runTask(ctx, node, http.MethodPost, vmPath+"/status/reboot", nil); err != nil {
+			return fmt.Errorf("failed to reboot vm: %w", err)
+		}
+	}
+	return nil
+}
+
+func (d *ProxmoxDriver) Status(ctx context.Context, externalID string) (InstanceStatus, error) {
+	node, vmid, err := parseProxmoxID(externalID)
+	if err != nil {
+		return InstanceUnknown, err
+	}
+	return d.status(ctx, node, vmid)
+}
+
+func (d *ProxmoxDriver) status(ctx context.Context, node string, vmid int) (InstanceStatus, error) {
+	var current struct {
+		Status string `json:"status"`
+	}
+	if err := d.do(ctx, http.MethodGet, fmt.Sprintf("/nodes/%s/qemu/%d/status/current", node, vmid), nil, &current); err != nil {
+		return InstanceUnknown, err
+	}
+
+	switch current.Status {
+	case "running":
+		return InstanceRunning, nil
+	case "stopped":
+		return InstanceStopped, nil
+	default:
+		return InstanceUnknown, nil
+	}
+}
+
+func (d *ProxmoxDriver) destroy(ctx context.Context, node string, vmid int) error {
+	params := url.Values{}
+	params.Set("purge", "1")
+	params.Set("destroy-unreferenced-disks", "1")
+	if err := d.runTask(ctx, node, http.MethodDelete, fmt.Sprintf("/nodes/%s/qemu/%d", node, vmid), params); err != nil {
+		return fmt.Errorf("failed to destroy vm: %w", err)
+	}
+	return nil
+}
+
+// runTask 调用返回 UPID 的异步接口并等待任务结束
+func (d *ProxmoxDriver) runTask(ctx context.Context, node, method, path string, params url.Values) error {
+	var upid *string
+	if err := d.do(ctx, method, path, params, &upid); err != nil {
+		return err
+	}
+	if upid == nil || *upid == "" {
+		return nil
+	}
+	return d.waitTask(ctx, node, *upid)
+}
+
+func (d *ProxmoxDriver) waitTask(ctx context.Context, node, upid string) error {
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.TaskTimeout)
+	defer cancel()
+
+	path := fmt.Sprintf("/nodes/%s/tasks/%s/status", node, url.PathEscape(upid))
+	for {
+		var task struct {
+			Status     string `json:"status"`
+			ExitStatus string `json:"exitstatus"`
+		}
+		if err := d.do(ctx, http.MethodGet, path, nil, &task); err != nil {
+			return err
+		}
+		if task.Status == "stopped" {
+			if task.ExitStatus != "OK" {
+				return fmt.Errorf("proxmox task %s failed: %s", upid, task.ExitStatus)
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("proxmox task %s: %w", upid, ctx.Err())
+		case <-time.After(d.cfg.PollInterval):
+		}
+	}
+}
+
+// do 发送 API 请求并将响应中的 data 字段解码到 out
+func (d *ProxmoxDriver) do(ctx context.Context, method, path string, params url.Values, out interface{}) error {
+	endpoint := d.cfg.BaseURL + "/api2/json" + path
+
+	var body io.Reader
+	if len(params) > 0 {
+		if method == http.MethodGet || method == http.MethodDelete {
+			endpoint += "?" + params.Encode()
+		} else {
+			body = strings.NewReader(params.Encode())
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("PVEAPIToken=%s=%s", d.cfg.TokenID, d.cfg.TokenSecret))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// Proxmox 把错误原因放在状态行里，例如 "500 Configuration file ... does not exist"
+		if strings.Contains(resp.Status, "does not exist") || strings.Contains(string(raw), "does not exist") {
+			return ErrInstanceNotFound
+		}
+		return fmt.Errorf("proxmox api %s %s returned %s", method, path, resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return fmt.Errorf("invalid proxmox response: %w", err)
+	}
+	if len(envelope.Data) == 0 {
+		return nil
+	}
+	if rawOut, ok := out.(*json.RawMessage); ok {
+		*rawOut = envelope.Data
+		return nil
+	}
+	return json.Unmarshal(envelope.Data, out)
+}
+
+func parseProxmoxID(externalID string) (string, int, error) {
+	node, rawID, ok := strings.Cut(externalID, "/")
+	if !ok || node == "" {
+		return "", 0, fmt.Errorf("invalid proxmox external id %q", externalID)
+	}
+	vmid, err := strconv.Atoi(rawID)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid proxmox external id %q", externalID)
+	}
+	return node, vmid, nil
+}
@@ -0,0 +1,297 @@
+package provisioning
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/ipam"
+)
+
+// fakeProxmox 模拟 Proxmox VE API 中驱动用到的最小子集
+type fakeProxmox struct {
+	mu     sync.Mutex
+	nextID int
+	vms    map[int]*fakeVM
+	tasks  map[string]bool
+}
+
+type fakeVM struct {
+	name    string
+	status  string
+	cores   string
+	memory  string
+	size    string
+	ipcfg   string
+	dns     string
+	reboots int
+}
+
+func newFakeProxmox() *fakeProxmox {
+	return &fakeProxmox{
+		nextID: 100,
+		vms:    map[int]*fakeVM{9000: {name: "template", status: "stopped"}},
+		tasks:  make(map[string]bool),
+	}
+}
+
+func (f *fakeProxmox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "PVEAPIToken=root@pam!billing=secret" {
+		http.Error(w, "authentication failure", http.StatusUnauthorized)
+		return
+	}
+	_ = r.ParseForm()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/api2/json")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case path == "/cluster/nextid":
+		writeData(w, strconv.Itoa(f.nextID))
+	case len(parts) == 5 && parts[2] == "tasks" && parts[4] == "status":
+		writeData(w, map[string]string{"status": "stopped", "exitstatus": "OK"})
+	case len(parts) >= 4 && parts[2] == "qemu":
+		vmid, _ := strconv.Atoi(parts[3])
+		vm, ok := f.vms[vmid]
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = fmt.Fprintf(w, `{"data":null,"message":"Configuration file 'nodes/pve/qemu-server/%d.conf' does not exist"}`, vmid)
+			return
+		}
+		action := strings.Join(parts[4:], "/")
+		switch {
+		case action == "clone" && r.Method == http.MethodPost:
+			newID, _ := strconv.Atoi(r.PostForm.Get("newid"))
+			f.vms[newID] = &fakeVM{name: r.PostForm.Get("name"), status: "stopped"}
+			f.nextID++
+			writeData(w, f.task("qmclone"))
+		case action == "config" && r.Method == http.MethodPost:
+			vm.cores = r.PostForm.Get("cores")
+			vm.memory = r.PostForm.Get("memory")
+			vm.ipcfg = r.PostForm.Get("ipconfig0")
+			vm.dns = r.PostForm.Get("nameserver")
+			writeData(w, nil)
+		case action == "resize" && r.Method == http.MethodPut:
+			vm.size = r.PostForm.Get("size")
+			writeData(w, f.task("resize"))
+		case action == "status/start":
+			vm.status = "running"
+			writeData(w, f.task("qmstart"))
+		case action == "status/stop":
+			vm.status = "stopped"
+			writeData(w, f.task("qmstop"))
+		case action == "status/reboot":
+			vm.reboots++
+			writeData(w, f.task("qmreboot"))
+		case action == "status/current":
+			writeData(w, map[string]string{"status": vm.status})
+		case action == "" && r.Method == http.MethodDelete:
+			delete(f.vms, vmid)
+			writeData(w, f.task("qmdestroy"))
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeProxmox) task(kind string) string {
+	upid := fmt.Sprintf("UPID:pve:%08X:%s:", len(f.tasks), kind)
+	f.tasks[upid] = true
+	return upid
+}
+
+func writeData(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func newTestProxmoxDriver(t *testing.T, fake *fakeProxmox) *ProxmoxDriver {
+	t.Helper()
+
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	driver, err := NewProxmoxDriver(ProxmoxConfig{
+		BaseURL:      srv.URL,
+		TokenID:      "root@pam!billing",
+		TokenSecret:  "secret",
+		Node:         "pve",
+		TemplateVMID: 9000,
+		HTTPClient:   srv.Client(),
+		PollInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewProxmoxDriver returned error: %v", err)
+	}
+	return driver
+}
+
+func TestProxmoxDriverLifecycle(t *testing.T) {
+	t.Parallel()
+
+	fake := newFakeProxmox()
+	driver := newTestProxmoxDriver(t, fake)
+	ctx := context.Background()
+
+	inst, err := driver.Create(ctx, CreateRequest{
+		ServiceID: "3f1c2a9e-0000-0000-0000-000000000000",
+		Hostname:  "vps-3f1c2a9e",
+		CPUCores:  2,
+		MemoryMB:  2048,
+		DiskGB:    40,
+		Addresses: []ipam.Assignment{
+			{Family: ipam.FamilyIPv4, Address: "203.0.113.10", PrefixLength: 24, Gateway: "203.0.113.1", DNSServers: "1.1.1.1, 8.8.8.8"},
+			{Family: ipam.FamilyIPv6, Address: "2001:db8::10", PrefixLength: 64, Gateway: "2001:db8::1", DNSServers: "1.1.1.1"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	if inst.ExternalID != "pve/100" || inst.IPAddress != "203.0.113.10" {
+		t.Fatalf("unexpected instance: %+v", inst)
+	}
+
+	vm := fake.vms[100]
+	if vm == nil || vm.name != "vps-3f1c2a9e" || vm.cores != "2" || vm.memory != "2048" || vm.size != "40G" {
+		t.Fatalf("unexpected cloned vm: %+v", vm)
+	}
+	if vm.ipcfg != "ip=203.0.113.10/24,gw=203.0.113.1,ip6=2001:db8::10/64,gw6=2001:db8::1" || vm.dns != "1.1.1.1 8.8.8.8" {
+		t.Fatalf("unexpected cloud-init network config: ipconfig0=%q nameserver=%q", vm.ipcfg, vm.dns)
+	}
+
+	if status, err := driver.Status(ctx, inst.ExternalID); err != nil || status != InstanceRunning {
+		t.Fatalf("Status after create = %s, %v", status, err)
+	}
+
+	if err := driver.Suspend(ctx, inst.ExternalID); err != nil {
+		t.Fatalf("Suspend returned error: %v", err)
+	}
+	if status, _ := driver.Status(ctx, inst.ExternalID); status != InstanceStopped {
+		t.Fatalf("Status after suspend = %s, want stopped", status)
+	}
+
+	if err := driver.Unsuspend(ctx, inst.ExternalID); err != nil {
+		t.Fatalf("Unsuspend returned error: %v", err)
+	}
+	if status, _ := driver.Status(ctx, inst.ExternalID); status != InstanceRunning {
+		t.Fatalf("Status after unsuspend = %s, want running", status)
+	}
+
+	if err := driver.Terminate(ctx, inst.ExternalID); err != nil {
+		t.Fatalf("Terminate returned error: %v", err)
+	}
+	if _, err := driver.Status(ctx, inst.ExternalID); !errors.Is(err, ErrInstanceNotFound) {
+		t.Fatalf("Status after terminate error = %v, want ErrInstanceNotFound", err)
+	}
+
+	// 重复终止应保持幂等
+	if err := driver.Terminate(ctx, inst.ExternalID); err != nil {
+		t.Fatalf("second Terminate returned error: %v", err)
+	}
+}
+
+func TestProxmoxDriverResize(t *testing.T) {
+	t.Parallel()
+
+	fake := newFakeProxmox()
+	driver := newTestProxmoxDriver(t, fake)
+	ctx := context.Background()
+
+	inst, err := driver.Create(ctx, CreateRequest{Hostname: "vps-resize", CPUCores: 1, MemoryMB: 1024, DiskGB: 20})
+	if err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+
+	if err := driver.Resize(ctx, inst.ExternalID, ResizeRequest{CPUCores: 4, MemoryMB: 8192, DiskGB: 80}); err != nil {
+		t.Fatalf("Resize returned error: %v", err)
+	}
+	vm := fake.vms[100]
+	if vm.cores != "4" || vm.memory != "8192" || vm.size != "80G" || vm.reboots != 1 {
+		t.Fatalf("unexpected vm after resize: %+v", vm)
+	}
+
+	// 降级时不缩小磁盘
+	if err := driver.Resize(ctx, inst.ExternalID, ResizeRequest{CPUCores: 2, MemoryMB: 2048}); err != nil {
+		t.Fatalf("second Resize returned error: %v", err)
+	}
+	if vm.cores != "2" || vm.size != "80G" || vm.reboots != 2 {
+		t.Fatalf("unexpected vm after downgrade: %+v", vm)
+	}
+}
+
+func TestProxmoxDriverRejectsIncompleteConfig(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewProxmoxDriver(ProxmoxConfig{BaseURL: "https://pve.local:8006"}); err == nil {
+		t.Fatalf("expected error for missing credentials")
+	}
+	if _, err := NewProxmoxDriver(ProxmoxConfig{
+		BaseURL: "https://pve.local:8006", TokenID: "a", TokenSecret: "b", Node: "pve",
+	}); err == nil {
+		t.Fatalf("expected error for missing template vmid")
+	}
+}
+
+func TestParseProxmoxID(t *testing.T) {
+	t.Parallel()
+
+	node, vmid, err := parseProxmoxID("pve2/131")
+	if err != nil || node != "pve2" || vmid != 131 {
+		t.Fatalf("parseProxmoxID = %q, %d, %v", node, vmid, err)
+	}
+	for _, bad := range []string{"", "131", "pve/abc", "/131"} {
+		if _, _, err := parseProxmoxID(bad); err == nil {
+			t.Fatalf("parseProxmoxID(%q) expected error", bad)
+		}
+	}
+}
+
+func TestMockDriverLifecycle(t *testing.T) {
+	t.Parallel()
+
+	driver := NewMockDriver()
+	ctx := context.Background()
+
+	first, err := driver.Create(ctx, CreateRequest{Hostname: "a.example"})
+	if err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	second, _ := driver.Create(ctx, CreateRequest{Hostname: "b.example"})
+	if first.IPAddress == second.IPAddress || first.ExternalID == second.ExternalID {
+		t.Fatalf("mock driver returned duplicate instances: %+v %+v", first, second)
+	}
+
+	reserved, _ := driver.Create(ctx, CreateRequest{
+		Hostname:  "c.example",
+		Addresses: []ipam.Assignment{{Family: ipam.FamilyIPv4, Address: "203.0.113.7"}},
+	})
+	if reserved.IPAddress != "203.0.113.7" {
+		t.Fatalf("mock driver ignored reserved address: %+v", reserved)
+	}
+
+	if err := driver.Suspend(ctx, first.ExternalID); err != nil {
+		t.Fatalf("Suspend returned error: %v", err)
+	}
+	if status, _ := driver.Status(ctx, first.ExternalID); status != InstanceStopped {
+		t.Fatalf("Status after suspend = %s", status)
+	}
+	if err := driver.Terminate(ctx, first.ExternalID); err != nil {
+		t.Fatalf("Terminate returned error: %v", err)
+	}
+	if _, err := driver.Status(ctx, first.ExternalID); !errors.Is(err, ErrInstanceNotFound) {
+		t.Fatalf("Status after terminate error = %v", err)
+	}
+}
@@ -0,0 +1,370 @@
+package provisioning
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/db"
+	"github.com/adiecho/echobilling/internal/email"
+	"github.com/adiecho/echobilling/internal/invoicestatus"
+	"github.com/hibiken/asynq"
+)
+
+// 催缴步骤，记录在 audit_logs（entity_type = 'invoice'）
+const (
+	dunningReminderSent   = "dunning_reminder_sent"
+	dunningReminderFailed = "dunning_reminder_failed"
+	dunningSuspended      = "dunning_suspended"
+	dunningTerminated     = "dunning_terminated"
+)
+
+// dunningPolicy 催缴策略，天数均按发票到期日（即服务到期日）起算，终止天数按暂停时间起算
+type dunningPolicy struct {
+	ReminderDays       []int
+	SuspendAfterDays   int
+	TerminateAfterDays int
+}
+
+func (h *TaskHandler) loadDunningPolicy() dunningPolicy {
+	policy := dunningPolicy{
+		ReminderDays:       ParseDays(h.store.Get("dunning_reminder_days")),
+		SuspendAfterDays:   h.store.GetInt("dunning_suspend_after_days", 7),
+		TerminateAfterDays: h.store.GetInt("dunning_terminate_after_days", 14),
+	}
+	if policy.SuspendAfterDays < 0 {
+		policy.SuspendAfterDays = 0
+	}
+	return policy
+}
+
+// ParseDays 解析逗号分隔的天数设置，忽略非法值，结果升序去重
+func ParseDays(raw string) []int {
+	days := make([]int, 0)
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(raw, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n <= 0 || seen[n] {
+			continue
+		}
+		seen[n] = true
+		days = append(days, n)
+	}
+	sort.Ints(days)
+	return days
+}
+
+// nextReminder 返回本次应发送的提醒天数。只补发最近一个已到的提醒，错过的更早提醒不再发送
+func (p dunningPolicy) nextReminder(daysOverdue int, sent map[int]bool) (int, bool) {
+	due := 0
+	for _, d := range p.ReminderDays {
+		if d <= daysOverdue {
+			due = d
+		}
+	}
+	if due == 0 || sent[due] {
+		return 0, false
+	}
+	for d := range sent {
+		if d > due {
+			return 0, false
+		}
+	}
+	return due, true
+}
+
+// shouldTerminate 暂停满 TerminateAfterDays 天后终止，0 表示不自动终止
+func (p dunningPolicy) shouldTerminate(suspendedAt, now time.Time) bool {
+	if p.TerminateAfterDays <= 0 {
+		return false
+	}
+	return !now.Before(suspendedAt.AddDate(0, 0, p.TerminateAfterDays))
+}
+
+// daysOverdue 到期后经过的整天数
+func daysOverdue(dueDate, now time.Time) int {
+	if !now.After(dueDate) {
+		return 0
+	}
+	return int(now.Sub(dueDate) / (24 * time.Hour))
+}
+
+type overdueInvoice struct {
+	ID            string
+	InvoiceNumber string
+	UserID        string
+	Email         string
+	ServiceID     string
+	ServiceStatus string
+	Hostname      string
+	Total         string
+	Currency      string
+	DueDate       time.Time
+}
+
+// dunningState 发票已执行的催缴步骤
+type dunningState struct {
+	RemindersSent map[int]bool
+	SuspendedAt   *time.Time
+}
+
+// runDunning 对逾期未付的续费发票执行催缴：提醒、暂停，暂停期满后作废发票并终止服务
+func (h *TaskHandler) runDunning(ctx context.Context) error {
+	policy := h.loadDunningPolicy()
+
+	rows, err := h.pool.Query(ctx, `
+		SELECT i.id, i.invoice_number, i.user_id::text, u.email, s.id::text, s.status::text,
+		       COALESCE(s.hostname, ''), (i.total - i.credit_applied)::text, i.currency, i.due_date
+		FROM invoices i
+		JOIN services s ON s.id = i.service_id
+		JOIN users u ON u.id = i.user_id
+		WHERE i.status = 'pending'
+		  AND i.billing_period_start IS NOT NULL
+		  AND i.billing_period_start = s.expires_at
+		  AND i.due_date IS NOT NULL
+		  AND i.due_date <= NOW()
+		  AND s.status IN ('active', 'suspended')
+		ORDER BY i.due_date
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to query overdue invoices: %w", err)
+	}
+
+	invoices := make([]overdueInvoice, 0)
+	for rows.Next() {
+		var inv overdueInvoice
+		if err := rows.Scan(&inv.ID, &inv.InvoiceNumber, &inv.UserID, &inv.Email, &inv.ServiceID, &inv.ServiceStatus,
+			&inv.Hostname, &inv.Total, &inv.Currency, &inv.DueDate); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan overdue invoice: %w", err)
+		}
+		invoices = append(invoices, inv)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate overdue invoices: %w", err)
+	}
+
+	errs := make([]string, 0)
+	for _, inv := range invoices {
+		if err := h.dunInvoice(ctx, policy, inv, time.Now()); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", inv.ID, err))
+		}
+	}
+
+	log.Printf("催缴检查完成: overdue_invoices=%d", len(invoices))
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// dunInvoice 每次只推进一个步骤
+func (h *TaskHandler) dunInvoice(ctx context.Context, policy dunningPolicy, inv overdueInvoice, now time.Time) error {
+	state, err := h.loadDunningState(ctx, inv.ID)
+	if err != nil {
+		return err
+	}
+
+	if state.SuspendedAt != nil {
+		if policy.shouldTerminate(*state.SuspendedAt, now) {
+			return h.dunningTerminate(ctx, inv, *state.SuspendedAt, now)
+		}
+		return nil
+	}
+
+	overdue := daysOverdue(inv.DueDate, now)
+	if overdue >= policy.SuspendAfterDays {
+		return h.dunningSuspend(ctx, inv, overdue)
+	}
+
+	if day, ok := policy.nextReminder(overdue, state.RemindersSent); ok {
+		return h.dunningRemind(ctx, inv, day, policy.SuspendAfterDays-overdue)
+	}
+	return nil
+}
+
+func (h *TaskHandler) loadDunningState(ctx context.Context, invoiceID string) (*dunningState, error) {
+	rows, err := h.pool.Query(ctx, `
+		SELECT action, COALESCE((new_values->>'days_overdue')::int, 0), created_at
+		FROM audit_logs
+		WHERE entity_type = 'invoice'
+		  AND entity_id = $1
+		  AND action IN ($2, $3)
+		ORDER BY created_at
+	`, invoiceID, dunningReminderSent, dunningSuspended)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dunning steps: %w", err)
+	}
+	defer rows.Close()
+
+	state := &dunningState{RemindersSent: make(map[int]bool)}
+	for rows.Next() {
+		var (
+			action    string
+			days      int
+			createdAt time.Time
+		)
+		if err := rows.Scan(&action, &days, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan dunning step: %w", err)
+		}
+		switch action {
+		case dunningReminderSent:
+			state.RemindersSent[days] = true
+		case dunningSuspended:
+			if state.SuspendedAt == nil {
+				state.SuspendedAt = &createdAt
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate dunning steps: %w", err)
+	}
+	return state, nil
+}
+
+func (h *TaskHandler) dunningRemind(ctx context.Context, inv overdueInvoice, day, daysUntilSuspension int) error {
+	subject, body := dunningReminderEmail(h.store.Get("site_name"), inv, daysUntilSuspension)
+	channel, sendErr := email.Send(h.store.SMTPConfig(), inv.Email, subject, body)
+
+	action := dunningReminderSent
+	details := map[string]interface{}{
+		"service_id":   inv.ServiceID,
+		"days_overdue": day,
+		"channel":      channel,
+	}
+	if sendErr != nil {
+		action = dunningReminderFailed
+		details["error"] = sendErr.Error()
+	}
+	if err := recordDunningStep(ctx, h.pool, inv, action, details); err != nil {
+		return err
+	}
+	if sendErr != nil {
+		return fmt.Errorf("failed to send dunning reminder: %w", sendErr)
+	}
+
+	log.Printf("催缴提醒已发送: invoice_id=%s, days_overdue=%d", inv.ID, day)
+	return nil
+}
+
+// dunningSuspend 暂停欠费服务。服务已被暂停（例如管理员操作）时只记录步骤，终止计时从此刻开始
+func (h *TaskHandler) dunningSuspend(ctx context.Context, inv overdueInvoice, overdue int) error {
+	if inv.ServiceStatus == "active" {
+		if err := h.runDriverAction(ctx, inv.ServiceID, func(d Driver, externalID string) error {
+			return d.Suspend(ctx, externalID)
+		}); err != nil {
+			return fmt.Errorf("failed to suspend overdue instance: %w", err)
+		}
+
+		_, err := h.pool.Exec(ctx, `
+			UPDATE services
+			SET status = 'suspended',
+			    metadata = COALESCE(metadata, '{}'::jsonb) || jsonb_build_object(
+			        'suspended_at', NOW(),
+			        'suspend_reason', 'overdue',
+			        'overdue_invoice_id', $2::text
+			    ),
+			    updated_at = NOW()
+			WHERE id = $1 AND status = 'active'
+		`, inv.ServiceID, inv.ID)
+		if err != nil {
+			return fmt.Errorf("failed to suspend overdue service: %w", err)
+		}
+	}
+
+	if err := recordDunningStep(ctx, h.pool, inv, dunningSuspended, map[string]interface{}{
+		"service_id":     inv.ServiceID,
+		"days_overdue":   overdue,
+		"service_status": inv.ServiceStatus,
+	}); err != nil {
+		return err
+	}
+
+	log.Printf("欠费服务已暂停: service_id=%s, invoice_id=%s, days_overdue=%d", inv.ServiceID, inv.ID, overdue)
+	return nil
+}
+
+// dunningTerminate 作废发票、退回已抵扣的余额，然后投递终止任务
+func (h *TaskHandler) dunningTerminate(ctx context.Context, inv overdueInvoice, suspendedAt, now time.Time) error {
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := invoicestatus.MarkVoid(ctx, tx, inv.ID, "Service terminated for non-payment", now); err != nil {
+		if errors.Is(err, invoicestatus.ErrInvalidTransition) {
+			// 发票已在此期间付清或作废
+			return nil
+		}
+		return fmt.Errorf("failed to void overdue invoice: %w", err)
+	}
+
+	if err := recordDunningStep(ctx, tx, inv, dunningTerminated, map[string]interface{}{
+		"service_id":   inv.ServiceID,
+		"suspended_at": suspendedAt.UTC().Format(time.RFC3339),
+	}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit dunning termination: %w", err)
+	}
+
+	task, err := NewTerminateVPSTask(TerminateVPSPayload{ServiceID: inv.ServiceID})
+	if err != nil {
+		return err
+	}
+	if h.asynqClient != nil {
+		if _, err = h.asynqClient.Enqueue(task, asynq.Queue("critical"), asynq.MaxRetry(5)); err == nil {
+			log.Printf("欠费服务已投递终止: service_id=%s, invoice_id=%s", inv.ServiceID, inv.ID)
+			return nil
+		}
+		log.Printf("投递终止任务失败，改为直接执行: service_id=%s, err=%v", inv.ServiceID, err)
+	}
+	// 发票已作废，下一轮不会再选中该服务，无法投递时直接执行终止
+	return h.HandleTerminateVPS(ctx, task)
+}
+
+// recordDunningStep 在 audit_logs 中记录一个催缴步骤
+func recordDunningStep(ctx context.Context, q db.DBTX, inv overdueInvoice, action string, details map[string]interface{}) error {
+	details["invoice_number"] = inv.InvoiceNumber
+	payload, _ := json.Marshal(details)
+	_, err := q.Exec(ctx, `
+		INSERT INTO audit_logs (user_id, action, entity_type, entity_id, new_values, ip_address, user_agent, created_at)
+		VALUES ($1, $2, 'invoice', $3, $4, 'worker', 'asynq-worker', NOW())
+	`, inv.UserID, action, inv.ID, payload)
+	if err != nil {
+		return fmt.Errorf("failed to record dunning step %s: %w", action, err)
+	}
+	return nil
+}
+
+func dunningReminderEmail(siteName string, inv overdueInvoice, daysUntilSuspension int) (string, string) {
+	if siteName == "" {
+		siteName = "EchoBilling"
+	}
+	service := inv.Hostname
+	if service == "" {
+		service = "your service"
+	}
+	subject := fmt.Sprintf("%s - Payment overdue for invoice %s", siteName, inv.InvoiceNumber)
+	body := fmt.Sprintf(
+		"Invoice %s for %s was due on %s and is still unpaid.\n\nAmount due: %s %s\n\n",
+		inv.InvoiceNumber, service, inv.DueDate.UTC().Format("2006-01-02"), strings.ToUpper(inv.Currency), inv.Total,
+	)
+	if daysUntilSuspension > 0 {
+		body += fmt.Sprintf("Please pay it within %d day(s) to avoid suspension of the service.", daysUntilSuspension)
+	} else {
+		body += "Please pay it as soon as possible to avoid suspension of the service."
+	}
+	return subject, body
+}
@@ -0,0 +1,75 @@
+package provisioning
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDays(t *testing.T) {
+	t.Parallel()
+
+	if got := ParseDays(" 5,1, 3,x,-2,3 "); !reflect.DeepEqual(got, []int{1, 3, 5}) {
+		t.Fatalf("ParseDays = %v, want [1 3 5]", got)
+	}
+	if got := ParseDays(""); len(got) != 0 {
+		t.Fatalf("ParseDays(\"\") = %v, want empty", got)
+	}
+}
+
+func TestDunningNextReminder(t *testing.T) {
+	t.Parallel()
+
+	policy := dunningPolicy{ReminderDays: []int{1, 3, 5}}
+	cases := []struct {
+		name    string
+		overdue int
+		sent    map[int]bool
+		want    int
+		wantOK  bool
+	}{
+		{"not yet due", 0, nil, 0, false},
+		{"first reminder", 1, nil, 1, true},
+		{"already sent", 2, map[int]bool{1: true}, 0, false},
+		{"second reminder", 3, map[int]bool{1: true}, 3, true},
+		{"missed reminders only send the latest", 6, nil, 5, true},
+		{"later reminder already sent", 3, map[int]bool{5: true}, 0, false},
+	}
+	for _, tc := range cases {
+		got, ok := policy.nextReminder(tc.overdue, tc.sent)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("%s: nextReminder(%d) = (%d, %v), want (%d, %v)", tc.name, tc.overdue, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestDunningShouldTerminate(t *testing.T) {
+	t.Parallel()
+
+	suspendedAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	policy := dunningPolicy{TerminateAfterDays: 14}
+	if policy.shouldTerminate(suspendedAt, suspendedAt.AddDate(0, 0, 13)) {
+		t.Fatalf("terminated before 14 days of suspension")
+	}
+	if !policy.shouldTerminate(suspendedAt, suspendedAt.AddDate(0, 0, 14)) {
+		t.Fatalf("expected termination after 14 days of suspension")
+	}
+	if (dunningPolicy{}).shouldTerminate(suspendedAt, suspendedAt.AddDate(1, 0, 0)) {
+		t.Fatalf("termination should be disabled when TerminateAfterDays is 0")
+	}
+}
+
+func TestDaysOverdue(t *testing.T) {
+	t.Parallel()
+
+	due := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	if got := daysOverdue(due, due.Add(-time.Hour)); got != 0 {
+		t.Fatalf("daysOverdue(before due) = %d, want 0", got)
+	}
+	if got := daysOverdue(due, due.Add(47*time.Hour)); got != 1 {
+		t.Fatalf("daysOverdue(47h) = %d, want 1", got)
+	}
+	if got := daysOverdue(due, due.AddDate(0, 0, 7)); got != 7 {
+		t.Fatalf("daysOverdue(7d) = %d, want 7", got)
+	}
+}
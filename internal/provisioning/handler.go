@@ -13,18 +13,27 @@ import (
 	"time"
 
 	"github.com/adiecho/echobilling/internal/app"
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/coupon"
+	"github.com/adiecho/echobilling/internal/invoicestatus"
+	"github.com/adiecho/echobilling/internal/ipam"
+	"github.com/adiecho/echobilling/internal/numbering"
+	"github.com/adiecho/echobilling/internal/tax"
 	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type TaskHandler struct {
 	pool             *pgxpool.Pool
 	store            *app.SettingsStore
+	drivers          *DriverRegistry
 	notifyHTTPClient *http.Client
+	asynqClient      *asynq.Client
 }
 
-func NewTaskHandler(pool *pgxpool.Pool, cfg *app.Config, store *app.SettingsStore) *TaskHandler {
+func NewTaskHandler(pool *pgxpool.Pool, cfg *app.Config, store *app.SettingsStore, asynqClient *asynq.Client) *TaskHandler {
 	timeout := cfg.NotificationTimeout
 	if timeout <= 0 {
 		timeout = 5 * time.Second
@@ -33,7 +42,9 @@ func NewTaskHandler(pool *pgxpool.Pool, cfg *app.Config, store *app.SettingsStor
 	return &TaskHandler{
 		pool:             pool,
 		store:            store,
+		drivers:          NewDriverRegistry(store),
 		notifyHTTPClient: &http.Client{Timeout: timeout},
+		asynqClient:      asynqClient,
 	}
 }
 
@@ -64,45 +75,64 @@ func (h *TaskHandler) HandleProvisionVPS(ctx context.Context, t *asynq.Task) err
 		return fmt.Errorf("failed to update provisioning job status: %w", err)
 	}
 
-	log.Printf("正在配置 VPS 资源...")
-	time.Sleep(1 * time.Second)
-	log.Printf("正在分配 IP 地址...")
-	time.Sleep(500 * time.Millisecond)
-	log.Printf("正在安装操作系统...")
-	time.Sleep(500 * time.Millisecond)
+	spec, err := h.loadServiceSpec(ctx, payload.ServiceID)
+	if err != nil {
+		h.failLatestJob(ctx, payload.ServiceID, err)
+		return fmt.Errorf("failed to load service spec: %w", err)
+	}
+
+	driver, err := h.drivers.Get(spec.Driver)
+	if err != nil {
+		h.failLatestJob(ctx, payload.ServiceID, err)
+		return fmt.Errorf("failed to resolve provisioning driver: %w", err)
+	}
+
+	if spec.Hostname == "" {
+		spec.Hostname = h.defaultHostname(payload.ServiceID)
+	}
+
+	addresses, err := h.reserveAddresses(ctx, payload.ServiceID, spec.Hostname)
+	if err != nil {
+		h.failLatestJob(ctx, payload.ServiceID, err)
+		return err
+	}
+
+	instance, err := h.createOrReuseInstance(ctx, driver, payload.ServiceID, spec, addresses)
+	if err != nil {
+		h.failLatestJob(ctx, payload.ServiceID, err)
+		return fmt.Errorf("driver %s failed to create instance: %w", driver.Name(), err)
+	}
 
-	hostname := fmt.Sprintf("vps-%s.example.com", payload.ServiceID[:8])
-	ipAddress := fmt.Sprintf("192.168.%d.%d",
-		(time.Now().Unix()%254)+1,
-		(time.Now().Unix()%254)+1)
+	// IPAM 预留的地址优先于驱动返回的地址
+	ipv4, ipv6 := instance.IPAddress, ""
+	for _, a := range addresses {
+		switch a.Family {
+		case ipam.FamilyIPv4:
+			ipv4 = a.Address
+		case ipam.FamilyIPv6:
+			ipv6 = a.Address
+		}
+	}
 
+	driverMetadata, _ := json.Marshal(instance.Metadata)
 	_, err = h.pool.Exec(ctx, `
 		UPDATE services
 		SET status = 'active',
-		    hostname = $1,
-		    ip_address = $2,
+		    driver = $1,
+		    external_id = $2,
+		    hostname = NULLIF($3, ''),
+		    ip_address = NULLIF($4, ''),
+		    ipv6_address = NULLIF($5, ''),
 		    metadata = COALESCE(metadata, '{}'::jsonb) || jsonb_build_object(
 		        'activated_at', NOW(),
-		        'provisioning_source', 'worker'
+		        'provisioning_source', 'worker',
+		        'driver_metadata', $6::jsonb
 		    ),
 		    updated_at = NOW()
-		WHERE id = $3
-	`, hostname, ipAddress, payload.ServiceID)
+		WHERE id = $7
+	`, driver.Name(), instance.ExternalID, instance.Hostname, ipv4, ipv6, driverMetadata, payload.ServiceID)
 	if err != nil {
-		_, _ = h.pool.Exec(ctx, `
-			UPDATE provisioning_jobs
-			SET status = 'failed',
-			    last_error = $2,
-			    completed_at = NOW(),
-			    updated_at = NOW()
-			WHERE id = (
-				SELECT id
-				FROM provisioning_jobs
-				WHERE service_id = $1
-				ORDER BY created_at DESC
-				LIMIT 1
-			)
-		`, payload.ServiceID, err.Error())
+		h.failLatestJob(ctx, payload.ServiceID, err)
 		return fmt.Errorf("failed to update service status: %w", err)
 	}
 
@@ -123,20 +153,111 @@ func (h *TaskHandler) HandleProvisionVPS(ctx context.Context, t *asynq.Task) err
 		return fmt.Errorf("failed to update provisioning job: %w", err)
 	}
 
+	// 订单的所有服务都开通后订单才算完成
 	_, err = h.pool.Exec(ctx, `
 		UPDATE orders
 		SET status = 'active',
 		    updated_at = NOW()
 		WHERE id = $1
+		  AND NOT EXISTS (
+		      SELECT 1
+		      FROM services s
+		      JOIN order_items oi ON oi.id = s.order_item_id
+		      WHERE oi.order_id = $1 AND s.status <> 'active'
+		  )
 	`, payload.OrderID)
 	if err != nil {
 		return fmt.Errorf("failed to update order status: %w", err)
 	}
 
-	log.Printf("VPS 开通完成: hostname=%s, ip=%s", hostname, ipAddress)
+	log.Printf("VPS 开通完成: driver=%s, external_id=%s, hostname=%s, ip=%s",
+		driver.Name(), instance.ExternalID, instance.Hostname, ipv4)
 	return nil
 }
 
+// reserveAddresses 在同一事务内为服务预留 IPv4 与 IPv6 地址；未配置对应地址族的子网时跳过该地址族
+func (h *TaskHandler) reserveAddresses(ctx context.Context, serviceID, hostname string) ([]ipam.Assignment, error) {
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	addresses := make([]ipam.Assignment, 0, 2)
+	for _, family := range []string{ipam.FamilyIPv4, ipam.FamilyIPv6} {
+		assignment, err := ipam.Reserve(ctx, tx, serviceID, family, hostname)
+		if errors.Is(err, ipam.ErrNoSubnets) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to reserve %s address: %w", family, err)
+		}
+		addresses = append(addresses, *assignment)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit address reservation: %w", err)
+	}
+	return addresses, nil
+}
+
+// createOrReuseInstance 创建实例；若上一次尝试已在后端创建成功则直接复用，保证任务重试幂等
+func (h *TaskHandler) createOrReuseInstance(ctx context.Context, driver Driver, serviceID string, spec *serviceSpec, addresses []ipam.Assignment) (*Instance, error) {
+	if spec.ExternalID != "" && spec.Driver == driver.Name() {
+		status, err := driver.Status(ctx, spec.ExternalID)
+		if err == nil {
+			if status != InstanceRunning {
+				if err := driver.Unsuspend(ctx, spec.ExternalID); err != nil {
+					return nil, err
+				}
+			}
+			return &Instance{
+				ExternalID: spec.ExternalID,
+				Hostname:   spec.Hostname,
+				IPAddress:  spec.IPAddress,
+				Status:     InstanceRunning,
+			}, nil
+		}
+		if !errors.Is(err, ErrInstanceNotFound) {
+			return nil, err
+		}
+	}
+
+	instance, err := driver.Create(ctx, CreateRequest{
+		ServiceID: serviceID,
+		Hostname:  spec.Hostname,
+		CPUCores:  spec.CPUCores,
+		MemoryMB:  spec.MemoryMB,
+		DiskGB:    spec.DiskGB,
+		Addresses: addresses,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 创建成功后立即记录实例 ID，之后的步骤失败时重试会复用该实例，而不是再创建一台
+	if _, err := h.pool.Exec(ctx, `
+		UPDATE services
+		SET driver = $1, external_id = $2, updated_at = NOW()
+		WHERE id = $3
+	`, driver.Name(), instance.ExternalID, serviceID); err != nil {
+		// 无法记录时销毁刚创建的实例，避免重试后留下无人管理的实例
+		if termErr := driver.Terminate(ctx, instance.ExternalID); termErr != nil {
+			log.Printf("无法清理未记录的实例: driver=%s, external_id=%s, err=%v", driver.Name(), instance.ExternalID, termErr)
+		}
+		return nil, fmt.Errorf("failed to record instance: %w", err)
+	}
+	return instance, nil
+}
+
+func (h *TaskHandler) defaultHostname(serviceID string) string {
+	hostname := "vps-" + serviceID[:8]
+	if domain := h.store.Get("site_domain"); domain != "" {
+		hostname += "." + domain
+	}
+	return hostname
+}
+
 // HandleSuspendVPS 处理 VPS 暂停任务
 func (h *TaskHandler) HandleSuspendVPS(ctx context.Context, t *asynq.Task) error {
 	var payload SuspendVPSPayload
@@ -146,12 +267,18 @@ func (h *TaskHandler) HandleSuspendVPS(ctx context.Context, t *asynq.Task) error
 
 	log.Printf("暂停 VPS: service_id=%s, reason=%s", payload.ServiceID, payload.Reason)
 
+	if err := h.runDriverAction(ctx, payload.ServiceID, func(d Driver, externalID string) error {
+		return d.Suspend(ctx, externalID)
+	}); err != nil {
+		return fmt.Errorf("failed to suspend instance: %w", err)
+	}
+
 	_, err := h.pool.Exec(ctx, `
 		UPDATE services
 		SET status = 'suspended',
 		    metadata = COALESCE(metadata, '{}'::jsonb) || jsonb_build_object(
 		        'suspended_at', NOW(),
-		        'suspend_reason', $2
+		        'suspend_reason', $2::text
 		    ),
 		    updated_at = NOW()
 		WHERE id = $1
@@ -164,6 +291,36 @@ func (h *TaskHandler) HandleSuspendVPS(ctx context.Context, t *asynq.Task) error
 	return nil
 }
 
+// HandleUnsuspendVPS 处理 VPS 恢复任务
+func (h *TaskHandler) HandleUnsuspendVPS(ctx context.Context, t *asynq.Task) error {
+	var payload UnsuspendVPSPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal payload: %w", err)
+	}
+
+	log.Printf("恢复 VPS: service_id=%s", payload.ServiceID)
+
+	if err := h.runDriverAction(ctx, payload.ServiceID, func(d Driver, externalID string) error {
+		return d.Unsuspend(ctx, externalID)
+	}); err != nil {
+		return fmt.Errorf("failed to unsuspend instance: %w", err)
+	}
+
+	_, err := h.pool.Exec(ctx, `
+		UPDATE services
+		SET status = 'active',
+		    metadata = COALESCE(metadata, '{}'::jsonb) || jsonb_build_object('unsuspended_at', NOW()),
+		    updated_at = NOW()
+		WHERE id = $1 AND status = 'suspended'
+	`, payload.ServiceID)
+	if err != nil {
+		return fmt.Errorf("failed to unsuspend service: %w", err)
+	}
+
+	log.Printf("VPS 已恢复: service_id=%s", payload.ServiceID)
+	return nil
+}
+
 // HandleTerminateVPS 处理 VPS 终止任务
 func (h *TaskHandler) HandleTerminateVPS(ctx context.Context, t *asynq.Task) error {
 	var payload TerminateVPSPayload
@@ -173,7 +330,22 @@ func (h *TaskHandler) HandleTerminateVPS(ctx context.Context, t *asynq.Task) err
 
 	log.Printf("终止 VPS: service_id=%s", payload.ServiceID)
 
-	_, err := h.pool.Exec(ctx, `
+	if err := h.runDriverAction(ctx, payload.ServiceID, func(d Driver, externalID string) error {
+		if err := d.Terminate(ctx, externalID); err != nil && !errors.Is(err, ErrInstanceNotFound) {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to terminate instance: %w", err)
+	}
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
 		UPDATE services
 		SET status = 'terminated',
 		    cancelled_at = COALESCE(cancelled_at, NOW()),
@@ -185,10 +357,199 @@ func (h *TaskHandler) HandleTerminateVPS(ctx context.Context, t *asynq.Task) err
 		return fmt.Errorf("failed to terminate service: %w", err)
 	}
 
-	log.Printf("VPS 已终止: service_id=%s", payload.ServiceID)
+	released, err := ipam.Release(ctx, tx, payload.ServiceID)
+	if err != nil {
+		return fmt.Errorf("failed to release ip addresses: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit termination: %w", err)
+	}
+
+	log.Printf("VPS 已终止: service_id=%s, released_addresses=%d", payload.ServiceID, released)
 	return nil
 }
 
+// HandleResizeVPS 执行套餐变更：按新套餐调整实例规格，然后切换服务的套餐和续费单价。
+// 变更已执行或已取消时直接返回，任务重投是幂等的。
+func (h *TaskHandler) HandleResizeVPS(ctx context.Context, t *asynq.Task) error {
+	var payload ResizeVPSPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal payload: %w", err)
+	}
+
+	var (
+		status    string
+		toPlanID  string
+		newPrice  string
+		cpuCores  int
+		memoryMB  int
+		diskGB    int
+		oldDiskGB int
+	)
+	err := h.pool.QueryRow(ctx, `
+		SELECT pc.status,
+		       pc.to_plan_id::text,
+		       pc.new_price::text,
+		       COALESCE(np.cpu_cores, 0),
+		       COALESCE(np.memory_mb, 0),
+		       COALESCE(np.disk_gb, 0),
+		       COALESCE(op.disk_gb, 0)
+		FROM plan_changes pc
+		JOIN plans np ON np.id = pc.to_plan_id
+		JOIN plans op ON op.id = pc.from_plan_id
+		WHERE pc.id = $1 AND pc.service_id = $2
+	`, payload.PlanChangeID, payload.ServiceID).Scan(&status, &toPlanID, &newPrice, &cpuCores, &memoryMB, &diskGB, &oldDiskGB)
+	if err != nil {
+		return fmt.Errorf("failed to load plan change: %w", err)
+	}
+	if status != "paid" {
+		log.Printf("套餐变更无需执行: plan_change_id=%s, status=%s", payload.PlanChangeID, status)
+		return nil
+	}
+
+	log.Printf("变更 VPS 套餐: service_id=%s, plan_change_id=%s", payload.ServiceID, payload.PlanChangeID)
+
+	resize := ResizeRequest{CPUCores: cpuCores, MemoryMB: memoryMB}
+	if diskGB > oldDiskGB {
+		resize.DiskGB = diskGB
+	}
+	if err := h.runDriverAction(ctx, payload.ServiceID, func(d Driver, externalID string) error {
+		return d.Resize(ctx, externalID, resize)
+	}); err != nil {
+		return fmt.Errorf("failed to resize instance: %w", err)
+	}
+
+	tx, err := h.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		UPDATE services
+		SET plan_id = $2,
+		    recurring_price = $3,
+		    metadata = COALESCE(metadata, '{}'::jsonb) || jsonb_build_object(
+		        'plan_changed_at', NOW(),
+		        'last_plan_change_id', $4::text
+		    ),
+		    updated_at = NOW()
+		WHERE id = $1
+	`, payload.ServiceID, toPlanID, newPrice, payload.PlanChangeID)
+	if err != nil {
+		return fmt.Errorf("failed to update service plan: %w", err)
+	}
+
+	// 按旧价格提前开出的续费发票作废并退回已抵扣的余额，由定时任务按新价格重新生成
+	now := time.Now()
+	var staleID string
+	err = tx.QueryRow(ctx, `
+		SELECT i.id
+		FROM invoices i
+		JOIN services s ON s.id = i.service_id
+		WHERE s.id = $1
+		  AND i.billing_period_start = s.expires_at
+		  AND i.status = 'pending'
+		FOR UPDATE OF i
+	`, payload.ServiceID).Scan(&staleID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+	case err != nil:
+		return fmt.Errorf("failed to query stale renewal invoice: %w", err)
+	default:
+		if _, err := invoicestatus.MarkVoid(ctx, tx, staleID, "Repriced after plan change", now); err != nil {
+			return fmt.Errorf("failed to void stale renewal invoice: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE plan_changes
+		SET status = 'applied', applied_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND status = 'paid'
+	`, payload.PlanChangeID)
+	if err != nil {
+		return fmt.Errorf("failed to mark plan change applied: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit plan change: %w", err)
+	}
+
+	log.Printf("VPS 套餐已变更: service_id=%s, plan_id=%s", payload.ServiceID, toPlanID)
+	return nil
+}
+
+// serviceSpec 汇总开通或操作一个服务所需的驱动和资源信息
+type serviceSpec struct {
+	Driver     string
+	ExternalID string
+	Hostname   string
+	IPAddress  string
+	CPUCores   int
+	MemoryMB   int
+	DiskGB     int
+}
+
+// loadServiceSpec 读取服务的驱动选择：已开通的服务沿用开通时的驱动，否则按套餐、产品、系统默认的顺序选择
+func (h *TaskHandler) loadServiceSpec(ctx context.Context, serviceID string) (*serviceSpec, error) {
+	var spec serviceSpec
+	err := h.pool.QueryRow(ctx, `
+		SELECT COALESCE(s.driver, pl.provisioning_driver, pr.provisioning_driver, ''),
+		       COALESCE(s.external_id, ''),
+		       COALESCE(s.hostname, ''),
+		       COALESCE(s.ip_address, ''),
+		       COALESCE(pl.cpu_cores, 0),
+		       COALESCE(pl.memory_mb, 0),
+		       COALESCE(pl.disk_gb, 0)
+		FROM services s
+		JOIN plans pl ON pl.id = s.plan_id
+		JOIN products pr ON pr.id = pl.product_id
+		WHERE s.id = $1
+	`, serviceID).Scan(
+		&spec.Driver, &spec.ExternalID, &spec.Hostname, &spec.IPAddress,
+		&spec.CPUCores, &spec.MemoryMB, &spec.DiskGB,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// runDriverAction 对已在后端创建的实例执行驱动操作；尚未开通的服务没有 external_id，直接跳过
+func (h *TaskHandler) runDriverAction(ctx context.Context, serviceID string, action func(Driver, string) error) error {
+	spec, err := h.loadServiceSpec(ctx, serviceID)
+	if err != nil {
+		return fmt.Errorf("failed to load service spec: %w", err)
+	}
+	if spec.ExternalID == "" {
+		return nil
+	}
+
+	driver, err := h.drivers.Get(spec.Driver)
+	if err != nil {
+		return err
+	}
+	return action(driver, spec.ExternalID)
+}
+
+func (h *TaskHandler) failLatestJob(ctx context.Context, serviceID string, cause error) {
+	_, _ = h.pool.Exec(ctx, `
+		UPDATE provisioning_jobs
+		SET status = 'failed',
+		    last_error = $2,
+		    completed_at = NOW(),
+		    updated_at = NOW()
+		WHERE id = (
+			SELECT id
+			FROM provisioning_jobs
+			WHERE service_id = $1
+			ORDER BY created_at DESC
+			LIMIT 1
+		)
+	`, serviceID, cause.Error())
+}
+
 // HandleRenewalReminder 处理续费提醒任务
 func (h *TaskHandler) HandleRenewalReminder(ctx context.Context, t *asynq.Task) error {
 	var payload RenewalReminderPayload
@@ -390,79 +751,245 @@ func daysUntil(future time.Time, now time.Time) int {
 	return int(math.Ceil(hours / 24))
 }
 
-// HandleGenerateInvoice 处理生成发票任务
+// HandleGenerateInvoice 处理生成续费发票任务；未指定服务时为即将到期的服务批量开票
 func (h *TaskHandler) HandleGenerateInvoice(ctx context.Context, t *asynq.Task) error {
 	var payload GenerateInvoicePayload
-	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
-		return fmt.Errorf("failed to unmarshal payload: %w", err)
+	if len(t.Payload()) > 0 {
+		if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+			return fmt.Errorf("failed to unmarshal payload: %w", err)
+		}
+	}
+
+	if payload.ServiceID == "" {
+		return h.generateDueRenewalInvoices(ctx)
+	}
+
+	_, err := h.generateRenewalInvoice(ctx, payload.ServiceID)
+	return err
+}
+
+func (h *TaskHandler) generateDueRenewalInvoices(ctx context.Context) error {
+	daysBefore := h.store.GetInt("renewal_invoice_days_before", 7)
+	if daysBefore < 0 {
+		daysBefore = 0
+	}
+
+	rows, err := h.pool.Query(ctx, `
+		SELECT s.id
+		FROM services s
+		WHERE s.status IN ('active', 'suspended')
+		  AND s.cancelled_at IS NULL
+		  AND s.expires_at IS NOT NULL
+		  AND s.expires_at <= NOW() + make_interval(days => $1)
+		  AND NOT EXISTS (
+		      SELECT 1
+		      FROM invoices i
+		      WHERE i.service_id = s.id
+		        AND i.billing_period_start = s.expires_at
+		        AND i.status <> 'void'
+		  )
+	`, daysBefore)
+	if err != nil {
+		return fmt.Errorf("failed to query services due for renewal: %w", err)
+	}
+
+	serviceIDs := make([]string, 0)
+	for rows.Next() {
+		var serviceID string
+		if err := rows.Scan(&serviceID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan service due for renewal: %w", err)
+		}
+		serviceIDs = append(serviceIDs, serviceID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate services due for renewal: %w", err)
+	}
+
+	created := 0
+	errs := make([]string, 0)
+	for _, serviceID := range serviceIDs {
+		ok, err := h.generateRenewalInvoice(ctx, serviceID)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", serviceID, err))
+			continue
+		}
+		if ok {
+			created++
+		}
 	}
 
-	log.Printf("生成续费发票: service_id=%s, user_id=%s", payload.ServiceID, payload.UserID)
+	log.Printf("续费发票批量生成完成: candidates=%d, created=%d", len(serviceIDs), created)
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
 
+// generateRenewalInvoice 为服务从当前到期日开始的下一个计费周期开具续费发票。
+// 同一服务同一周期只会存在一张有效发票，已开票时返回 false。
+func (h *TaskHandler) generateRenewalInvoice(ctx context.Context, serviceID string) (bool, error) {
 	var (
+		userID       string
+		orderID      string
 		unitPrice    string
 		billingCycle string
-		orderID      string
 		currency     string
+		planName     string
+		hostname     string
+		status       string
+		expiresAt    *time.Time
+		planID       string
+		couponID     *string
 	)
 	err := h.pool.QueryRow(ctx, `
-		SELECT oi.unit_price::text,
-		       oi.billing_cycle::text,
+		SELECT s.user_id::text,
 		       oi.order_id::text,
-		       o.currency
+		       COALESCE(s.recurring_price, oi.unit_price)::text,
+		       oi.billing_cycle::text,
+		       o.currency,
+		       CASE WHEN s.plan_id = oi.plan_id
+		            THEN COALESCE(oi.plan_snapshot->>'name', p.name, 'Service')
+		            ELSE COALESCE(p.name, 'Service')
+		       END,
+		       COALESCE(s.hostname, ''),
+		       s.status::text,
+		       s.expires_at,
+		       s.plan_id::text,
+		       s.coupon_id::text
 		FROM services s
 		JOIN order_items oi ON oi.id = s.order_item_id
 		JOIN orders o ON o.id = oi.order_id
+		LEFT JOIN plans p ON p.id = s.plan_id
 		WHERE s.id = $1
-	`, payload.ServiceID).Scan(&unitPrice, &billingCycle, &orderID, &currency)
+	`, serviceID).Scan(&userID, &orderID, &unitPrice, &billingCycle, &currency, &planName, &hostname, &status, &expiresAt, &planID, &couponID)
 	if err != nil {
-		return fmt.Errorf("failed to get service pricing info: %w", err)
+		return false, fmt.Errorf("failed to get service pricing info: %w", err)
 	}
 
-	now := time.Now()
-	dueDate := now.AddDate(0, 0, 7)
-	switch billingCycle {
-	case "monthly":
-		dueDate = now.AddDate(0, 1, 0)
-	case "quarterly":
-		dueDate = now.AddDate(0, 3, 0)
-	case "annually":
-		dueDate = now.AddDate(1, 0, 0)
+	if expiresAt == nil || (status != "active" && status != "suspended") {
+		return false, nil
 	}
 
+	periodStart := *expiresAt
+	periodEnd := common.AddBillingCycle(periodStart, billingCycle)
+
+	priceCents, err := common.DecimalAmountToCents(unitPrice)
+	if err != nil {
+		return false, fmt.Errorf("invalid renewal price %q: %w", unitPrice, err)
+	}
+
+	// 持续优惠的优惠券在每次续费时按当前价格重新计算折扣
+	var (
+		discountCents int64
+		couponCode    string
+	)
+	if couponID != nil {
+		applied, err := coupon.Get(ctx, h.pool, *couponID)
+		if err != nil && !errors.Is(err, coupon.ErrNotFound) {
+			return false, fmt.Errorf("failed to load coupon: %w", err)
+		}
+		if applied != nil && applied.AppliesTo(planID, billingCycle) {
+			discountCents = applied.UnitDiscount(priceCents)
+			couponCode = applied.Code
+		}
+	}
+
+	decision, err := tax.ForUser(ctx, h.pool, h.store, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve tax: %w", err)
+	}
+	breakdown, err := decision.Apply([]int64{priceCents - discountCents})
+	if err != nil {
+		return false, fmt.Errorf("failed to calculate tax: %w", err)
+	}
+
+	now := time.Now()
 	invoiceID := uuid.New().String()
-	invoiceNumber := fmt.Sprintf("INV-%s-%s", now.Format("20060102"), uuid.NewString()[:8])
 
 	tx, err := h.pool.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to begin tx: %w", err)
+		return false, fmt.Errorf("failed to begin tx: %w", err)
 	}
 	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(ctx, `
+	// 编号在同一事务内分配；周期已开票时事务回滚，计数器不会留下空号
+	invoiceNumber, err := numbering.Next(ctx, tx, h.store, numbering.SeriesInvoice, now)
+	if err != nil {
+		return false, err
+	}
+
+	tag, err := tx.Exec(ctx, `
 		INSERT INTO invoices (
-			id, user_id, order_id, invoice_number, status, subtotal, tax, total, currency, due_date, created_at, updated_at
+			id, user_id, order_id, service_id, invoice_number, status, subtotal, tax, total, currency,
+			tax_inclusive, reverse_charge, due_date, billing_period_start, billing_period_end, created_at, updated_at
 		)
-		VALUES ($1, $2, $3, $4, 'pending', $5, 0, $5, $6, $7, $8, $8)
-	`, invoiceID, payload.UserID, orderID, invoiceNumber, unitPrice, currency, dueDate, now)
+		VALUES ($1, $2, $3, $4, $5, 'pending', $6, $7, $8, $9, $10, $11, $12, $12, $13, $14, $14)
+		ON CONFLICT (service_id, billing_period_start) WHERE service_id IS NOT NULL AND status <> 'void'
+		DO NOTHING
+	`, invoiceID, userID, orderID, serviceID, invoiceNumber,
+		common.CentsToDecimal(breakdown.Priced()), common.CentsToDecimal(breakdown.Tax), common.CentsToDecimal(breakdown.Total),
+		strings.ToUpper(currency), decision.Inclusive, decision.ReverseCharge, periodStart, periodEnd, now)
 	if err != nil {
-		return fmt.Errorf("failed to create invoice: %w", err)
+		return false, fmt.Errorf("failed to create invoice: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	description := fmt.Sprintf("%s renewal (%s, %s - %s)", planName, billingCycle,
+		periodStart.Format("2006-01-02"), periodEnd.Format("2006-01-02"))
+	if hostname != "" {
+		description = hostname + " - " + description
 	}
 
 	_, err = tx.Exec(ctx, `
 		INSERT INTO invoice_items (id, invoice_id, description, quantity, unit_price, amount, created_at)
 		VALUES ($1, $2, $3, 1, $4, $4, $5)
-	`, uuid.New().String(), invoiceID, fmt.Sprintf("Service renewal (%s)", billingCycle), unitPrice, now)
+	`, uuid.New().String(), invoiceID, description, unitPrice, now)
 	if err != nil {
-		return fmt.Errorf("failed to create invoice item: %w", err)
+		return false, fmt.Errorf("failed to create invoice item: %w", err)
+	}
+	if discountCents > 0 {
+		discount := "-" + common.CentsToDecimal(discountCents)
+		_, err = tx.Exec(ctx, `
+			INSERT INTO invoice_items (id, invoice_id, kind, description, quantity, unit_price, amount, created_at)
+			VALUES ($1, $2, 'discount', $3, 1, $4, $4, $5)
+		`, uuid.New().String(), invoiceID, fmt.Sprintf("Discount (%s) - %s", couponCode, planName), discount, now)
+		if err != nil {
+			return false, fmt.Errorf("failed to create invoice discount item: %w", err)
+		}
+	}
+	if err := tax.InsertInvoiceLine(ctx, tx, invoiceID, breakdown, now); err != nil {
+		return false, fmt.Errorf("failed to create invoice tax line: %w", err)
 	}
 
 	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("failed to commit invoice tx: %w", err)
+		return false, fmt.Errorf("failed to commit invoice tx: %w", err)
 	}
 
-	log.Printf("续费发票已生成: invoice_id=%s, amount=%s", invoiceID, unitPrice)
-	return nil
+	log.Printf("续费发票已生成: invoice_id=%s, service_id=%s, amount=%s, period=%s~%s",
+		invoiceID, serviceID, common.CentsToDecimal(breakdown.Total), periodStart.Format("2006-01-02"), periodEnd.Format("2006-01-02"))
+
+	// 有默认卡的客户在开票后自动扣款，扣款失败时由催缴流程提醒手动支付
+	if err := h.enqueueAutoCharge(invoiceID); err != nil {
+		log.Printf("投递自动扣款任务失败: invoice_id=%s, err=%v", invoiceID, err)
+	}
+	return true, nil
+}
+
+func (h *TaskHandler) enqueueAutoCharge(invoiceID string) error {
+	if h.asynqClient == nil {
+		return nil
+	}
+	task, err := NewAutoChargeTask(AutoChargePayload{InvoiceID: invoiceID})
+	if err != nil {
+		return err
+	}
+	_, err = h.asynqClient.Enqueue(task, asynq.Queue("default"), asynq.MaxRetry(3))
+	return err
 }
 
 // HandleExpireService 处理服务过期检查任务
@@ -501,11 +1028,22 @@ func (h *TaskHandler) expireSingleService(ctx context.Context, serviceID string)
 		return nil
 	}
 
-	if time.Now().After(*expiresAt) && status == "active" {
+	// 宽限期内不暂停，欠费暂停的天数见 dunning_suspend_after_days
+	grace := h.loadDunningPolicy().SuspendAfterDays
+	if time.Now().After(expiresAt.AddDate(0, 0, grace)) && status == "active" {
+		if err := h.runDriverAction(ctx, serviceID, func(d Driver, externalID string) error {
+			return d.Suspend(ctx, externalID)
+		}); err != nil {
+			return fmt.Errorf("failed to suspend expired instance: %w", err)
+		}
+
 		_, err = h.pool.Exec(ctx, `
 			UPDATE services
 			SET status = 'suspended',
-			    metadata = COALESCE(metadata, '{}'::jsonb) || jsonb_build_object('expired_at', NOW()),
+			    metadata = COALESCE(metadata, '{}'::jsonb) || jsonb_build_object(
+			        'expired_at', NOW(),
+			        'suspend_reason', 'expired'
+			    ),
 			    updated_at = NOW()
 			WHERE id = $1
 		`, serviceID)
@@ -518,16 +1056,29 @@ func (h *TaskHandler) expireSingleService(ctx context.Context, serviceID string)
 	return nil
 }
 
+// expireAllServices 先对逾期的续费发票执行催缴，再暂停宽限期已过但没有待付续费发票的服务
 func (h *TaskHandler) expireAllServices(ctx context.Context) error {
+	if err := h.runDunning(ctx); err != nil {
+		log.Printf("催缴流程执行失败: %v", err)
+	}
+
 	log.Printf("开始批量检查过期服务")
 
+	grace := h.loadDunningPolicy().SuspendAfterDays
 	rows, err := h.pool.Query(ctx, `
-		SELECT id
-		FROM services
-		WHERE status = 'active'
-		  AND expires_at IS NOT NULL
-		  AND expires_at <= NOW()
-	`)
+		SELECT s.id
+		FROM services s
+		WHERE s.status = 'active'
+		  AND s.expires_at IS NOT NULL
+		  AND s.expires_at <= NOW() - make_interval(days => $1)
+		  AND NOT EXISTS (
+		      SELECT 1
+		      FROM invoices i
+		      WHERE i.service_id = s.id
+		        AND i.billing_period_start = s.expires_at
+		        AND i.status = 'pending'
+		  )
+	`, grace)
 	if err != nil {
 		return fmt.Errorf("failed to query expiring services: %w", err)
 	}
@@ -6,12 +6,30 @@ import (
 
 // RegisterPeriodicTasks 注册周期性任务
 func RegisterPeriodicTasks(scheduler *asynq.Scheduler) error {
-	// 每小时检查一次过期服务
+	// 每小时执行催缴并检查过期服务
 	_, err := scheduler.Register("@every 1h", asynq.NewTask(TypeExpireService, []byte(`{}`)))
 	if err != nil {
 		return err
 	}
 
+	// 每 6 小时为即将到期的服务开具续费发票（提前天数见 renewal_invoice_days_before）
+	_, err = scheduler.Register("@every 6h", asynq.NewTask(TypeGenerateInvoice, []byte(`{}`)))
+	if err != nil {
+		return err
+	}
+
+	// 每 6 小时检查未答辩的争议，临近证据截止日期时提醒管理员（天数见 dispute_alert_days）
+	_, err = scheduler.Register("@every 6h", asynq.NewTask(TypeDisputeAlert, []byte(`{}`)))
+	if err != nil {
+		return err
+	}
+
+	// 每分钟使已作废或已结清发票的未完成支付会话失效
+	_, err = scheduler.Register("@every 1m", asynq.NewTask(TypeExpireCheckouts, []byte(`{}`)))
+	if err != nil {
+		return err
+	}
+
 	// 每天批量发送续费提醒（7/3/1 天）
 	_, err = scheduler.Register("@every 24h", asynq.NewTask(TypeRenewalReminder, []byte(`{}`)))
 	if err != nil {
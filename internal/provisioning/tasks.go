@@ -10,10 +10,15 @@ import (
 const (
 	TypeProvisionVPS    = "vps:provision"
 	TypeSuspendVPS      = "vps:suspend"
+	TypeUnsuspendVPS    = "vps:unsuspend"
 	TypeTerminateVPS    = "vps:terminate"
+	TypeResizeVPS       = "vps:resize"
 	TypeRenewalReminder = "billing:renewal_reminder"
 	TypeGenerateInvoice = "billing:generate_invoice"
+	TypeAutoCharge      = "billing:auto_charge"
 	TypeExpireService   = "service:expire"
+	TypeDisputeAlert    = "billing:dispute_alert"
+	TypeExpireCheckouts = "billing:expire_checkouts"
 )
 
 type ProvisionVPSPayload struct {
@@ -28,10 +33,20 @@ type SuspendVPSPayload struct {
 	Reason    string `json:"reason"`
 }
 
+type UnsuspendVPSPayload struct {
+	ServiceID string `json:"service_id"`
+}
+
 type TerminateVPSPayload struct {
 	ServiceID string `json:"service_id"`
 }
 
+// ResizeVPSPayload 执行已支付（或无需支付）的套餐变更
+type ResizeVPSPayload struct {
+	ServiceID    string `json:"service_id"`
+	PlanChangeID string `json:"plan_change_id"`
+}
+
 type RenewalReminderPayload struct {
 	ServiceID string `json:"service_id"`
 	UserID    string `json:"user_id"`
@@ -44,6 +59,11 @@ type GenerateInvoicePayload struct {
 	OrderID   string `json:"order_id"`
 }
 
+// AutoChargePayload 使用客户默认卡为续费发票自动扣款
+type AutoChargePayload struct {
+	InvoiceID string `json:"invoice_id"`
+}
+
 type ExpireServicePayload struct {
 	ServiceID string `json:"service_id"`
 }
@@ -66,6 +86,15 @@ func NewSuspendVPSTask(payload SuspendVPSPayload) (*asynq.Task, error) {
 	return asynq.NewTask(TypeSuspendVPS, data), nil
 }
 
+// NewUnsuspendVPSTask 创建 VPS 恢复任务
+func NewUnsuspendVPSTask(payload UnsuspendVPSPayload) (*asynq.Task, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	return asynq.NewTask(TypeUnsuspendVPS, data), nil
+}
+
 // NewTerminateVPSTask 创建 VPS 终止任务
 func NewTerminateVPSTask(payload TerminateVPSPayload) (*asynq.Task, error) {
 	data, err := json.Marshal(payload)
@@ -75,6 +104,15 @@ func NewTerminateVPSTask(payload TerminateVPSPayload) (*asynq.Task, error) {
 	return asynq.NewTask(TypeTerminateVPS, data), nil
 }
 
+// NewResizeVPSTask 创建 VPS 套餐变更任务
+func NewResizeVPSTask(payload ResizeVPSPayload) (*asynq.Task, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	return asynq.NewTask(TypeResizeVPS, data), nil
+}
+
 // NewRenewalReminderTask 创建续费提醒任务
 func NewRenewalReminderTask(payload RenewalReminderPayload) (*asynq.Task, error) {
 	data, err := json.Marshal(payload)
@@ -93,6 +131,15 @@ func NewGenerateInvoiceTask(payload GenerateInvoicePayload) (*asynq.Task, error)
 	return asynq.NewTask(TypeGenerateInvoice, data), nil
 }
 
+// NewAutoChargeTask 创建续费发票自动扣款任务
+func NewAutoChargeTask(payload AutoChargePayload) (*asynq.Task, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	return asynq.NewTask(TypeAutoCharge, data), nil
+}
+
 // NewExpireServiceTask 创建服务过期检查任务
 func NewExpireServiceTask(payload ExpireServicePayload) (*asynq.Task, error) {
 	data, err := json.Marshal(payload)
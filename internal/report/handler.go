@@ -0,0 +1,216 @@
+package report
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// maxReportMonths 单次报表最多覆盖的月数
+const maxReportMonths = 36
+
+type Handler struct {
+	pool *pgxpool.Pool
+}
+
+func NewHandler(pool *pgxpool.Pool) *Handler {
+	return &Handler{pool: pool}
+}
+
+// MRRSummary 当前的 MRR、ARR、付费客户数和客单价（ARPU）
+type MRRSummary struct {
+	MRR       string `json:"mrr"`
+	ARR       string `json:"arr"`
+	Customers int    `json:"customers"`
+	ARPU      string `json:"arpu"`
+}
+
+// MRRMonth 单月 MRR 变动，contraction 和 churned 为减少额（正数）
+type MRRMonth struct {
+	Month        string `json:"month"`
+	StartingMRR  string `json:"starting_mrr"`
+	New          string `json:"new"`
+	Expansion    string `json:"expansion"`
+	Contraction  string `json:"contraction"`
+	Churned      string `json:"churned"`
+	NetNew       string `json:"net_new"`
+	EndingMRR    string `json:"ending_mrr"`
+	ARR          string `json:"arr"`
+	Customers    int    `json:"customers"`
+	NewCustomers int    `json:"new_customers"`
+}
+
+type MRRReport struct {
+	Currency string     `json:"currency"`
+	From     string     `json:"from"`
+	To       string     `json:"to"`
+	Current  MRRSummary `json:"current"`
+	Months   []MRRMonth `json:"months"`
+}
+
+// ChurnMonth 单月流失率，rate 字段均为百分比
+type ChurnMonth struct {
+	Month               string  `json:"month"`
+	StartingCustomers   int     `json:"starting_customers"`
+	ChurnedCustomers    int     `json:"churned_customers"`
+	CustomerChurnRate   float64 `json:"customer_churn_rate"`
+	StartingMRR         string  `json:"starting_mrr"`
+	ChurnedMRR          string  `json:"churned_mrr"`
+	ContractionMRR      string  `json:"contraction_mrr"`
+	ExpansionMRR        string  `json:"expansion_mrr"`
+	RevenueChurnRate    float64 `json:"revenue_churn_rate"`
+	NetRevenueChurnRate float64 `json:"net_revenue_churn_rate"`
+}
+
+// ChurnSummary 整个区间的月均流失率
+type ChurnSummary struct {
+	ChurnedCustomers    int     `json:"churned_customers"`
+	ChurnedMRR          string  `json:"churned_mrr"`
+	CustomerChurnRate   float64 `json:"customer_churn_rate"`
+	RevenueChurnRate    float64 `json:"revenue_churn_rate"`
+	NetRevenueChurnRate float64 `json:"net_revenue_churn_rate"`
+}
+
+type ChurnReport struct {
+	Currency string       `json:"currency"`
+	From     string       `json:"from"`
+	To       string       `json:"to"`
+	Summary  ChurnSummary `json:"summary"`
+	Months   []ChurnMonth `json:"months"`
+}
+
+// CohortCell 客户群开通后第 month_offset 个月的留存，retention 为百分比
+type CohortCell struct {
+	Offset            int     `json:"month_offset"`
+	Month             string  `json:"month"`
+	Customers         int     `json:"customers"`
+	CustomerRetention float64 `json:"customer_retention"`
+	MRR               string  `json:"mrr"`
+	RevenueRetention  float64 `json:"revenue_retention"`
+}
+
+// CohortRow 一个客户群，initial_mrr 为开通当月月末的 MRR
+type CohortRow struct {
+	Cohort     string       `json:"cohort"`
+	Customers  int          `json:"customers"`
+	InitialMRR string       `json:"initial_mrr"`
+	Periods    []CohortCell `json:"periods"`
+}
+
+type CohortReport struct {
+	Currency string      `json:"currency"`
+	From     string      `json:"from"`
+	To       string      `json:"to"`
+	Cohorts  []CohortRow `json:"cohorts"`
+}
+
+// reportRange 报表的月份区间，From 和 To 为月初
+type reportRange struct {
+	Currency string
+	From     time.Time
+	To       time.Time
+	Now      time.Time
+}
+
+// parseMonth 接受 2006-01 或 2006-01-02，返回所在月份的第一天
+func parseMonth(value string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return MonthStart(t), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseRange 解析 from、to 和 currency 参数。默认最近 12 个月，to 不晚于当月
+func parseRange(c *gin.Context, now time.Time) (reportRange, *common.ServiceError) {
+	r := reportRange{
+		Currency: strings.ToUpper(c.DefaultQuery("currency", "USD")),
+		To:       MonthStart(now),
+		Now:      now,
+	}
+	if len(r.Currency) != 3 {
+		return r, common.ErrBadRequest("Invalid currency", nil)
+	}
+
+	if value := c.Query("to"); value != "" {
+		to, ok := parseMonth(value)
+		if !ok {
+			return r, common.ErrBadRequest("Invalid to month, expected YYYY-MM", nil)
+		}
+		if to.Before(r.To) {
+			r.To = to
+		}
+	}
+	r.From = r.To.AddDate(0, -11, 0)
+	if value := c.Query("from"); value != "" {
+		from, ok := parseMonth(value)
+		if !ok {
+			return r, common.ErrBadRequest("Invalid from month, expected YYYY-MM", nil)
+		}
+		r.From = from
+	}
+
+	if r.From.After(r.To) {
+		return r, common.ErrBadRequest("from must not be after to", nil)
+	}
+	if r.From.AddDate(0, maxReportMonths-1, 0).Before(r.To) {
+		return r, common.ErrBadRequest("Report range cannot exceed 36 months", nil)
+	}
+	return r, nil
+}
+
+// GetMRR - GET /api/v1/admin/reports/mrr
+// 当前 MRR/ARR 以及区间内每月的新增、扩张、收缩和流失 MRR
+func (h *Handler) GetMRR(c *gin.Context) {
+	r, svcErr := parseRange(c, time.Now())
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+
+	report, svcErr := h.mrrReport(c.Request.Context(), r)
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// GetChurn - GET /api/v1/admin/reports/churn
+// 每月客户流失率和收入流失率
+func (h *Handler) GetChurn(c *gin.Context) {
+	r, svcErr := parseRange(c, time.Now())
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+
+	report, svcErr := h.churnReport(c.Request.Context(), r)
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// GetCohorts - GET /api/v1/admin/reports/cohorts
+// 按首次开通月份分组的客户和收入留存表
+func (h *Handler) GetCohorts(c *gin.Context) {
+	r, svcErr := parseRange(c, time.Now())
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+
+	report, svcErr := h.cohortReport(c.Request.Context(), r)
+	if svcErr != nil {
+		common.WriteServiceError(c, svcErr)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
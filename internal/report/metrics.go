@@ -0,0 +1,259 @@
+package report
+
+import (
+	"math"
+	"time"
+)
+
+// Subscription 一个服务计入 MRR 的区间：从开通到取消（或终止），期间单价随套餐变更调整
+type Subscription struct {
+	ServiceID    string
+	UserID       string
+	BillingCycle string
+	Start        time.Time
+	End          *time.Time
+	// Prices 按 From 升序，第一个价格点的 From 为零值
+	Prices []PricePoint
+}
+
+// PricePoint 自 From 起每个计费周期的续费金额（分，已扣除持续优惠）
+type PricePoint struct {
+	From   time.Time
+	Amount int64
+}
+
+// MonthlyAmount 把一个计费周期的金额折算为月金额，未知周期按月计算
+func MonthlyAmount(amount int64, billingCycle string) int64 {
+	switch billingCycle {
+	case "quarterly":
+		return divRound(amount, 3)
+	case "annually":
+		return divRound(amount, 12)
+	default:
+		return amount
+	}
+}
+
+func divRound(n, d int64) int64 {
+	if n < 0 {
+		return -divRound(-n, d)
+	}
+	return (n + d/2) / d
+}
+
+// MRRAt 服务在 t 时刻的月经常性收入，不在计费区间内时为 0
+func (s *Subscription) MRRAt(t time.Time) int64 {
+	if t.Before(s.Start) || (s.End != nil && !t.Before(*s.End)) {
+		return 0
+	}
+	var amount int64
+	for _, p := range s.Prices {
+		if p.From.After(t) {
+			break
+		}
+		amount = p.Amount
+	}
+	return MonthlyAmount(amount, s.BillingCycle)
+}
+
+func (s *Subscription) paying() bool {
+	for _, p := range s.Prices {
+		if p.Amount > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot 各客户在 t 时刻的 MRR，只保留大于 0 的客户
+func snapshot(subs []Subscription, t time.Time) map[string]int64 {
+	result := make(map[string]int64)
+	for i := range subs {
+		if mrr := subs[i].MRRAt(t); mrr > 0 {
+			result[subs[i].UserID] += mrr
+		}
+	}
+	return result
+}
+
+func sum(values map[string]int64) int64 {
+	var total int64
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+// MonthStart 返回 t 所在自然月的第一天（UTC）
+func MonthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// period 报表中的一个自然月；当月的 End 截止到 now
+type period struct {
+	Label string
+	Start time.Time
+	End   time.Time
+}
+
+func periods(from, to, now time.Time) []period {
+	var result []period
+	for start := MonthStart(from); !start.After(MonthStart(to)) && start.Before(now); start = start.AddDate(0, 1, 0) {
+		end := start.AddDate(0, 1, 0)
+		if end.After(now) {
+			end = now
+		}
+		result = append(result, period{Label: start.Format("2006-01"), Start: start, End: end})
+	}
+	return result
+}
+
+// Movement 一个月内的 MRR 变动。按客户比较月初和月末的 MRR：
+// 从 0 变为正数计入新增（含流失后回归的客户），变为 0 计入流失，其余按增减计入扩张或收缩。
+// Contraction 和 Churned 以正数表示减少额
+type Movement struct {
+	Month             string
+	StartingMRR       int64
+	New               int64
+	Expansion         int64
+	Contraction       int64
+	Churned           int64
+	EndingMRR         int64
+	StartingCustomers int
+	NewCustomers      int
+	ChurnedCustomers  int
+	EndingCustomers   int
+}
+
+// NetNew 当月 MRR 净变化
+func (m Movement) NetNew() int64 {
+	return m.New + m.Expansion - m.Contraction - m.Churned
+}
+
+func movement(label string, before, after map[string]int64) Movement {
+	m := Movement{
+		Month:             label,
+		StartingMRR:       sum(before),
+		EndingMRR:         sum(after),
+		StartingCustomers: len(before),
+		EndingCustomers:   len(after),
+	}
+	for userID, prev := range before {
+		cur, ok := after[userID]
+		switch {
+		case !ok:
+			m.Churned += prev
+			m.ChurnedCustomers++
+		case cur > prev:
+			m.Expansion += cur - prev
+		case cur < prev:
+			m.Contraction += prev - cur
+		}
+	}
+	for userID, cur := range after {
+		if _, ok := before[userID]; !ok {
+			m.New += cur
+			m.NewCustomers++
+		}
+	}
+	return m
+}
+
+// Movements 计算 from 到 to（按月，含两端）每个月的 MRR 变动，不包含 now 之后的月份
+func Movements(subs []Subscription, from, to, now time.Time) []Movement {
+	months := periods(from, to, now)
+	result := make([]Movement, 0, len(months))
+	var before map[string]int64
+	for i, p := range months {
+		if i == 0 {
+			before = snapshot(subs, p.Start)
+		}
+		after := snapshot(subs, p.End)
+		result = append(result, movement(p.Label, before, after))
+		before = after
+	}
+	return result
+}
+
+// CustomerChurnRate 当月流失客户占月初付费客户的百分比
+func (m Movement) CustomerChurnRate() float64 {
+	return rate(int64(m.ChurnedCustomers), int64(m.StartingCustomers))
+}
+
+// RevenueChurnRate 当月流失和收缩的 MRR 占月初 MRR 的百分比（毛收入流失率）
+func (m Movement) RevenueChurnRate() float64 {
+	return rate(m.Churned+m.Contraction, m.StartingMRR)
+}
+
+// NetRevenueChurnRate 扣除扩张后的收入流失率，为负数表示存量客户收入净增长
+func (m Movement) NetRevenueChurnRate() float64 {
+	return rate(m.Churned+m.Contraction-m.Expansion, m.StartingMRR)
+}
+
+// rate 百分比，保留两位小数；分母为 0 时为 0
+func rate(numerator, denominator int64) float64 {
+	if denominator == 0 {
+		return 0
+	}
+	return math.Round(float64(numerator)*10000/float64(denominator)) / 100
+}
+
+// Cohort 按首次开通服务的月份划分的客户群
+type Cohort struct {
+	Month     string
+	Customers int
+	// Periods[k] 为开通后第 k 个月月末仍在付费的客户数及其 MRR，第 0 个月为开通当月
+	Periods []CohortPeriod
+}
+
+// CohortPeriod 客户群在某个月月末的留存情况
+type CohortPeriod struct {
+	Offset    int
+	Month     string
+	Customers int
+	MRR       int64
+}
+
+// Cohorts 计算首次开通月份在 from 到 to 之间的客户群，每个客户群统计到 to 为止的逐月留存。
+// 只计算付费服务，免费服务不影响客户的首次开通月份
+func Cohorts(subs []Subscription, from, to, now time.Time) []Cohort {
+	firstStart := make(map[string]time.Time)
+	for i := range subs {
+		if !subs[i].paying() {
+			continue
+		}
+		if first, ok := firstStart[subs[i].UserID]; !ok || subs[i].Start.Before(first) {
+			firstStart[subs[i].UserID] = subs[i].Start
+		}
+	}
+
+	months := periods(from, to, now)
+	members := make(map[string][]string, len(months))
+	for userID, start := range firstStart {
+		label := MonthStart(start).Format("2006-01")
+		members[label] = append(members[label], userID)
+	}
+
+	snapshots := make([]map[string]int64, len(months))
+	for i, p := range months {
+		snapshots[i] = snapshot(subs, p.End)
+	}
+
+	result := make([]Cohort, 0, len(months))
+	for i, p := range months {
+		cohort := Cohort{Month: p.Label, Customers: len(members[p.Label]), Periods: []CohortPeriod{}}
+		for j := i; j < len(months); j++ {
+			cell := CohortPeriod{Offset: j - i, Month: months[j].Label}
+			for _, userID := range members[p.Label] {
+				if mrr, ok := snapshots[j][userID]; ok {
+					cell.Customers++
+					cell.MRR += mrr
+				}
+			}
+			cohort.Periods = append(cohort.Periods, cell)
+		}
+		result = append(result, cohort)
+	}
+	return result
+}
@@ -0,0 +1,144 @@
+package report
+
+import (
+	"testing"
+	"time"
+)
+
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+func sub(userID, cycle string, amount int64, start time.Time, end *time.Time) Subscription {
+	return Subscription{
+		ServiceID:    userID + "-" + cycle,
+		UserID:       userID,
+		BillingCycle: cycle,
+		Start:        start,
+		End:          end,
+		Prices:       []PricePoint{{Amount: amount}},
+	}
+}
+
+func TestMonthlyAmount(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		amount int64
+		cycle  string
+		want   int64
+	}{
+		{1000, "monthly", 1000},
+		{3000, "quarterly", 1000},
+		{1000, "quarterly", 333},
+		{12000, "annually", 1000},
+		{1000, "annually", 83},
+	}
+	for _, tt := range tests {
+		if got := MonthlyAmount(tt.amount, tt.cycle); got != tt.want {
+			t.Errorf("MonthlyAmount(%d, %s) = %d, want %d", tt.amount, tt.cycle, got, tt.want)
+		}
+	}
+}
+
+func TestMovements(t *testing.T) {
+	t.Parallel()
+
+	churnedAt := day(2026, time.February, 10)
+	upgrade := sub("b", "monthly", 2000, day(2025, time.December, 5), nil)
+	upgrade.Prices = append(upgrade.Prices, PricePoint{From: day(2026, time.February, 3), Amount: 5000})
+
+	subs := []Subscription{
+		// a：年付，二月流失
+		sub("a", "annually", 12000, day(2025, time.December, 1), &churnedAt),
+		// b：二月升级
+		upgrade,
+		// c：二月新增季付
+		sub("c", "quarterly", 3000, day(2026, time.February, 20), nil),
+		// d：二月降级到另一个更便宜的服务
+		sub("d", "monthly", 4000, day(2025, time.November, 1), &churnedAt),
+		sub("d", "monthly", 1500, churnedAt, nil),
+	}
+
+	now := day(2026, time.March, 15)
+	got := Movements(subs, day(2026, time.January, 1), day(2026, time.March, 1), now)
+	if len(got) != 3 {
+		t.Fatalf("got %d months, want 3", len(got))
+	}
+
+	jan := got[0]
+	if jan.StartingMRR != 7000 || jan.EndingMRR != 7000 || jan.NetNew() != 0 {
+		t.Fatalf("january = %+v", jan)
+	}
+
+	feb := got[1]
+	if feb.New != 1000 || feb.NewCustomers != 1 {
+		t.Errorf("new = %d (%d customers), want 1000 (1)", feb.New, feb.NewCustomers)
+	}
+	if feb.Expansion != 3000 {
+		t.Errorf("expansion = %d, want 3000", feb.Expansion)
+	}
+	if feb.Contraction != 2500 {
+		t.Errorf("contraction = %d, want 2500", feb.Contraction)
+	}
+	if feb.Churned != 1000 || feb.ChurnedCustomers != 1 {
+		t.Errorf("churned = %d (%d customers), want 1000 (1)", feb.Churned, feb.ChurnedCustomers)
+	}
+	if feb.EndingMRR != feb.StartingMRR+feb.NetNew() || feb.EndingMRR != 7500 {
+		t.Errorf("ending MRR = %d, want 7500", feb.EndingMRR)
+	}
+	if feb.CustomerChurnRate() != 33.33 {
+		t.Errorf("customer churn rate = %v, want 33.33", feb.CustomerChurnRate())
+	}
+	// (1000 + 2500) / 7000
+	if feb.RevenueChurnRate() != 50 {
+		t.Errorf("revenue churn rate = %v, want 50", feb.RevenueChurnRate())
+	}
+	if feb.NetRevenueChurnRate() != 7.14 {
+		t.Errorf("net revenue churn rate = %v, want 7.14", feb.NetRevenueChurnRate())
+	}
+
+	if got[2].StartingMRR != feb.EndingMRR {
+		t.Errorf("march should start where february ended: %d != %d", got[2].StartingMRR, feb.EndingMRR)
+	}
+
+	if months := Movements(subs, day(2026, time.March, 1), day(2026, time.June, 1), now); len(months) != 1 {
+		t.Errorf("future months should be skipped, got %d", len(months))
+	}
+}
+
+func TestCohorts(t *testing.T) {
+	t.Parallel()
+
+	churnedAt := day(2026, time.February, 15)
+	subs := []Subscription{
+		sub("a", "monthly", 1000, day(2026, time.January, 3), nil),
+		sub("b", "monthly", 2000, day(2026, time.January, 20), &churnedAt),
+		sub("c", "monthly", 1000, day(2026, time.February, 1), nil),
+		// 免费服务不决定客户的首次开通月份
+		sub("c", "monthly", 0, day(2025, time.October, 1), nil),
+	}
+
+	got := Cohorts(subs, day(2026, time.January, 1), day(2026, time.March, 1), day(2026, time.April, 1))
+	if len(got) != 3 {
+		t.Fatalf("got %d cohorts, want 3", len(got))
+	}
+
+	jan := got[0]
+	if jan.Month != "2026-01" || jan.Customers != 2 || len(jan.Periods) != 3 {
+		t.Fatalf("january cohort = %+v", jan)
+	}
+	if jan.Periods[0].Customers != 2 || jan.Periods[0].MRR != 3000 {
+		t.Errorf("month 0 = %+v", jan.Periods[0])
+	}
+	if jan.Periods[1].Customers != 1 || jan.Periods[1].MRR != 1000 {
+		t.Errorf("month 1 = %+v", jan.Periods[1])
+	}
+
+	if got[1].Customers != 1 || len(got[1].Periods) != 2 {
+		t.Errorf("february cohort = %+v", got[1])
+	}
+	if got[2].Customers != 0 || len(got[2].Periods) != 1 {
+		t.Errorf("march cohort = %+v", got[2])
+	}
+}
@@ -0,0 +1,10 @@
+package report
+
+import "github.com/gin-gonic/gin"
+
+func RegisterRoutes(admin *gin.RouterGroup, h *Handler) {
+	reports := admin.Group("/reports")
+	reports.GET("/mrr", h.GetMRR)
+	reports.GET("/churn", h.GetChurn)
+	reports.GET("/cohorts", h.GetCohorts)
+}
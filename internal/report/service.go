@@ -0,0 +1,257 @@
+package report
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/coupon"
+)
+
+// subscriptionRow 服务及其定价信息，价格变动来自已生效的套餐变更
+type subscriptionRow struct {
+	sub       Subscription
+	planID    string
+	unitPrice string
+	couponID  *string
+}
+
+type priceChange struct {
+	planID  string
+	price   string
+	applied time.Time
+}
+
+// loadSubscriptions 读取指定币种下曾经开通过的服务。开通时间取 metadata.activated_at（缺失时用创建时间），
+// 结束时间为取消时间（终止服务时同样会写入）；单价为订单项单价，套餐变更生效后改为新单价，并按持续优惠扣减
+func (h *Handler) loadSubscriptions(ctx context.Context, currency string) ([]Subscription, error) {
+	rows, err := h.pool.Query(ctx, `
+		SELECT s.id::text, s.user_id::text, oi.billing_cycle::text, oi.plan_id::text,
+		       oi.unit_price::text, s.coupon_id::text,
+		       COALESCE((s.metadata->>'activated_at')::timestamptz, s.created_at),
+		       COALESCE(s.cancelled_at, (s.metadata->>'terminated_at')::timestamptz)
+		FROM services s
+		JOIN order_items oi ON oi.id = s.order_item_id
+		JOIN orders o ON o.id = oi.order_id
+		WHERE o.currency = $1
+		  AND (s.metadata->>'activated_at' IS NOT NULL OR s.status IN ('active', 'suspended', 'terminated'))
+	`, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var services []subscriptionRow
+	for rows.Next() {
+		var r subscriptionRow
+		if err := rows.Scan(&r.sub.ServiceID, &r.sub.UserID, &r.sub.BillingCycle, &r.planID,
+			&r.unitPrice, &r.couponID, &r.sub.Start, &r.sub.End); err != nil {
+			return nil, err
+		}
+		services = append(services, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	changes, err := h.loadPriceChanges(ctx, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	coupons := make(map[string]*coupon.Coupon)
+	result := make([]Subscription, 0, len(services))
+	for _, r := range services {
+		points := []priceChange{{planID: r.planID, price: r.unitPrice}}
+		points = append(points, changes[r.sub.ServiceID]...)
+
+		var applied *coupon.Coupon
+		if r.couponID != nil {
+			applied, err = h.cachedCoupon(ctx, coupons, *r.couponID)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		sub := r.sub
+		for _, p := range points {
+			cents, err := common.DecimalAmountToCents(p.price)
+			if err != nil {
+				return nil, fmt.Errorf("invalid price %q for service %s: %w", p.price, sub.ServiceID, err)
+			}
+			if applied != nil && applied.AppliesTo(p.planID, sub.BillingCycle) {
+				cents -= applied.UnitDiscount(cents)
+			}
+			sub.Prices = append(sub.Prices, PricePoint{From: p.applied, Amount: cents})
+		}
+		result = append(result, sub)
+	}
+	return result, nil
+}
+
+// loadPriceChanges 按服务分组的已生效套餐变更，按生效时间升序
+func (h *Handler) loadPriceChanges(ctx context.Context, currency string) (map[string][]priceChange, error) {
+	rows, err := h.pool.Query(ctx, `
+		SELECT pc.service_id::text, pc.to_plan_id::text, pc.new_price::text, pc.applied_at
+		FROM plan_changes pc
+		JOIN services s ON s.id = pc.service_id
+		JOIN order_items oi ON oi.id = s.order_item_id
+		JOIN orders o ON o.id = oi.order_id
+		WHERE pc.status = 'applied' AND pc.applied_at IS NOT NULL AND o.currency = $1
+		ORDER BY pc.applied_at
+	`, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string][]priceChange)
+	for rows.Next() {
+		var serviceID string
+		var p priceChange
+		if err := rows.Scan(&serviceID, &p.planID, &p.price, &p.applied); err != nil {
+			return nil, err
+		}
+		result[serviceID] = append(result[serviceID], p)
+	}
+	return result, rows.Err()
+}
+
+func (h *Handler) cachedCoupon(ctx context.Context, cache map[string]*coupon.Coupon, id string) (*coupon.Coupon, error) {
+	if c, ok := cache[id]; ok {
+		return c, nil
+	}
+	c, err := coupon.Get(ctx, h.pool, id)
+	if err != nil && !errors.Is(err, coupon.ErrNotFound) {
+		return nil, fmt.Errorf("failed to load coupon: %w", err)
+	}
+	cache[id] = c
+	return c, nil
+}
+
+// currentMRR 当前时刻的 MRR 概览
+func currentMRR(subs []Subscription, now time.Time) MRRSummary {
+	customers := snapshot(subs, now)
+	mrr := sum(customers)
+	summary := MRRSummary{
+		MRR:       common.CentsToDecimal(mrr),
+		ARR:       common.CentsToDecimal(mrr * 12),
+		Customers: len(customers),
+		ARPU:      "0.00",
+	}
+	if len(customers) > 0 {
+		summary.ARPU = common.CentsToDecimal(divRound(mrr, int64(len(customers))))
+	}
+	return summary
+}
+
+func (h *Handler) mrrReport(ctx context.Context, r reportRange) (*MRRReport, *common.ServiceError) {
+	subs, err := h.loadSubscriptions(ctx, r.Currency)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to load subscriptions", err)
+	}
+
+	report := &MRRReport{
+		Currency: r.Currency,
+		From:     r.From.Format("2006-01"),
+		To:       r.To.Format("2006-01"),
+		Current:  currentMRR(subs, r.Now),
+		Months:   []MRRMonth{},
+	}
+	for _, m := range Movements(subs, r.From, r.To, r.Now) {
+		report.Months = append(report.Months, MRRMonth{
+			Month:        m.Month,
+			StartingMRR:  common.CentsToDecimal(m.StartingMRR),
+			New:          common.CentsToDecimal(m.New),
+			Expansion:    common.CentsToDecimal(m.Expansion),
+			Contraction:  common.CentsToDecimal(m.Contraction),
+			Churned:      common.CentsToDecimal(m.Churned),
+			NetNew:       common.CentsToDecimal(m.NetNew()),
+			EndingMRR:    common.CentsToDecimal(m.EndingMRR),
+			ARR:          common.CentsToDecimal(m.EndingMRR * 12),
+			Customers:    m.EndingCustomers,
+			NewCustomers: m.NewCustomers,
+		})
+	}
+	return report, nil
+}
+
+func (h *Handler) churnReport(ctx context.Context, r reportRange) (*ChurnReport, *common.ServiceError) {
+	subs, err := h.loadSubscriptions(ctx, r.Currency)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to load subscriptions", err)
+	}
+
+	report := &ChurnReport{
+		Currency: r.Currency,
+		From:     r.From.Format("2006-01"),
+		To:       r.To.Format("2006-01"),
+		Months:   []ChurnMonth{},
+	}
+	// 汇总按月加权：各月流失之和除以各月月初之和
+	var total Movement
+	for _, m := range Movements(subs, r.From, r.To, r.Now) {
+		report.Months = append(report.Months, ChurnMonth{
+			Month:               m.Month,
+			StartingCustomers:   m.StartingCustomers,
+			ChurnedCustomers:    m.ChurnedCustomers,
+			CustomerChurnRate:   m.CustomerChurnRate(),
+			StartingMRR:         common.CentsToDecimal(m.StartingMRR),
+			ChurnedMRR:          common.CentsToDecimal(m.Churned),
+			ContractionMRR:      common.CentsToDecimal(m.Contraction),
+			ExpansionMRR:        common.CentsToDecimal(m.Expansion),
+			RevenueChurnRate:    m.RevenueChurnRate(),
+			NetRevenueChurnRate: m.NetRevenueChurnRate(),
+		})
+		total.StartingCustomers += m.StartingCustomers
+		total.ChurnedCustomers += m.ChurnedCustomers
+		total.StartingMRR += m.StartingMRR
+		total.Churned += m.Churned
+		total.Contraction += m.Contraction
+		total.Expansion += m.Expansion
+	}
+	report.Summary = ChurnSummary{
+		ChurnedCustomers:    total.ChurnedCustomers,
+		ChurnedMRR:          common.CentsToDecimal(total.Churned),
+		CustomerChurnRate:   total.CustomerChurnRate(),
+		RevenueChurnRate:    total.RevenueChurnRate(),
+		NetRevenueChurnRate: total.NetRevenueChurnRate(),
+	}
+	return report, nil
+}
+
+func (h *Handler) cohortReport(ctx context.Context, r reportRange) (*CohortReport, *common.ServiceError) {
+	subs, err := h.loadSubscriptions(ctx, r.Currency)
+	if err != nil {
+		return nil, common.ErrInternal("Failed to load subscriptions", err)
+	}
+
+	report := &CohortReport{
+		Currency: r.Currency,
+		From:     r.From.Format("2006-01"),
+		To:       r.To.Format("2006-01"),
+		Cohorts:  []CohortRow{},
+	}
+	for _, cohort := range Cohorts(subs, r.From, r.To, r.Now) {
+		row := CohortRow{Cohort: cohort.Month, Customers: cohort.Customers, Periods: []CohortCell{}}
+		var initialMRR int64
+		if len(cohort.Periods) > 0 {
+			initialMRR = cohort.Periods[0].MRR
+		}
+		row.InitialMRR = common.CentsToDecimal(initialMRR)
+		for _, p := range cohort.Periods {
+			row.Periods = append(row.Periods, CohortCell{
+				Offset:            p.Offset,
+				Month:             p.Month,
+				Customers:         p.Customers,
+				CustomerRetention: rate(int64(p.Customers), int64(cohort.Customers)),
+				MRR:               common.CentsToDecimal(p.MRR),
+				RevenueRetention:  rate(p.MRR, initialMRR),
+			})
+		}
+		report.Cohorts = append(report.Cohorts, row)
+	}
+	return report, nil
+}
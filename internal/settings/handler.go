@@ -8,8 +8,8 @@ import (
 
 	"github.com/adiecho/echobilling/internal/app"
 	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/numbering"
 	"github.com/gin-gonic/gin"
-	"github.com/stripe/stripe-go/v82"
 )
 
 // Handler handles system settings API requests.
@@ -119,6 +119,25 @@ func (h *Handler) UpdateSettings(c *gin.Context) {
 		return
 	}
 
+	// Number patterns must stay unique once their counter resets.
+	for _, series := range numbering.Series {
+		_, patternChanged := filtered[series+"_number_pattern"]
+		_, resetChanged := filtered[series+"_number_reset"]
+		if !patternChanged && !resetChanged {
+			continue
+		}
+		err := numbering.ValidateSettings(series, func(key string) string {
+			if v, ok := filtered[key]; ok {
+				return v
+			}
+			return h.store.Get(key)
+		})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	if err := h.svc.UpdateBatch(c.Request.Context(), filtered, userID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save settings"})
 		return
@@ -130,11 +149,6 @@ func (h *Handler) UpdateSettings(c *gin.Context) {
 		return
 	}
 
-	// If the Stripe secret key was updated, apply it globally.
-	if _, changed := filtered["stripe_secret_key"]; changed {
-		stripe.Key = h.store.StripeSecretKey()
-	}
-
 	c.JSON(http.StatusOK, gin.H{"message": "Settings saved"})
 }
 
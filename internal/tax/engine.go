@@ -0,0 +1,268 @@
+package tax
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rateScale 税率以千分之一个百分点存储为整数（19.5% => 19500），避免浮点误差
+const rateScale = 100000
+
+// Rule 按国家/地区配置的税率规则；Region 为空表示适用于整个国家
+type Rule struct {
+	ID            string `json:"id"`
+	Country       string `json:"country"`
+	Region        string `json:"region"`
+	Name          string `json:"name"`
+	Rate          string `json:"rate"`
+	ReverseCharge bool   `json:"reverse_charge"`
+	IsActive      bool   `json:"is_active"`
+}
+
+// Customer 计税所需的客户信息，取自 customer_profiles
+type Customer struct {
+	Country string
+	State   string
+	TaxID   string
+}
+
+// Decision 针对某个客户确定的计税方式，会随订单和发票一起保存
+type Decision struct {
+	RuleID        string `json:"rule_id,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Country       string `json:"country,omitempty"`
+	Region        string `json:"region,omitempty"`
+	Rate          string `json:"rate"`
+	Inclusive     bool   `json:"inclusive"`
+	ReverseCharge bool   `json:"reverse_charge"`
+	TaxID         string `json:"tax_id,omitempty"`
+}
+
+// Line 一行应税金额（分），按行计税后汇总
+type Line struct {
+	Net   int64
+	Tax   int64
+	Gross int64
+}
+
+// Breakdown 计税结果。Subtotal 为不含税金额，Total 为应付金额
+type Breakdown struct {
+	Decision Decision
+	Lines    []Line
+	Subtotal int64
+	Tax      int64
+	Total    int64
+}
+
+// 税种类别代码（UNCL 5305），用于电子发票
+const (
+	CategoryStandard      = "S"
+	CategoryZeroRated     = "Z"
+	CategoryReverseCharge = "AE"
+	CategoryNotSubject    = "O"
+)
+
+// Category 税种类别：反向征收为 AE，税率为 0 为 Z，其余为 S；没有匹配规则时不属于征税范围（O）
+func (d Decision) Category() string {
+	switch {
+	case !d.Applies():
+		return CategoryNotSubject
+	case d.ReverseCharge:
+		return CategoryReverseCharge
+	}
+	if rate, err := ParseRate(d.Rate); err == nil && rate == 0 {
+		return CategoryZeroRated
+	}
+	return CategoryStandard
+}
+
+// Applies 是否需要在单据上体现税费（含反向征收的零税率说明）
+func (d Decision) Applies() bool {
+	return d.RuleID != ""
+}
+
+// Label 税费行的描述，如 "VAT 19% (DE)"
+func (d Decision) Label() string {
+	name := d.Name
+	if name == "" {
+		name = "Tax"
+	}
+	place := d.Country
+	if d.Region != "" {
+		place += "-" + d.Region
+	}
+
+	if d.ReverseCharge {
+		return fmt.Sprintf("%s reverse charge (%s)", name, place)
+	}
+	label := fmt.Sprintf("%s %s%% (%s)", name, trimRate(d.Rate), place)
+	if d.Inclusive {
+		label += " included"
+	}
+	return label
+}
+
+// Resolve 为客户选择税率规则：优先匹配国家+地区，其次匹配整个国家；无规则时不计税。
+// 规则允许反向征收、客户持有有效税号且不在卖方所在国时，按 0% 反向征收处理。
+func Resolve(rules []Rule, customer Customer, homeCountry string, inclusive bool) Decision {
+	country := NormalizeCountry(customer.Country)
+	region := strings.ToUpper(strings.TrimSpace(customer.State))
+
+	var matched *Rule
+	for i := range rules {
+		r := &rules[i]
+		if !r.IsActive || !strings.EqualFold(r.Country, country) {
+			continue
+		}
+		if r.Region != "" && strings.EqualFold(r.Region, region) {
+			matched = r
+			break
+		}
+		if r.Region == "" && matched == nil {
+			matched = r
+		}
+	}
+
+	d := Decision{Rate: "0", Inclusive: inclusive}
+	if matched == nil {
+		return d
+	}
+
+	d.RuleID = matched.ID
+	d.Name = matched.Name
+	d.Country = strings.ToUpper(matched.Country)
+	d.Region = strings.ToUpper(matched.Region)
+	d.Rate = matched.Rate
+
+	if matched.ReverseCharge && ValidTaxID(country, customer.TaxID) &&
+		!strings.EqualFold(country, NormalizeCountry(homeCountry)) {
+		d.Rate = "0"
+		d.ReverseCharge = true
+		d.TaxID = NormalizeTaxID(customer.TaxID)
+	}
+	return d
+}
+
+// Apply 按行计算税额。含税定价时金额视为含税价，从中拆出税额；否则在金额之上加税。
+func (d Decision) Apply(amounts []int64) (*Breakdown, error) {
+	rate, err := ParseRate(d.Rate)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Breakdown{Decision: d, Lines: make([]Line, 0, len(amounts))}
+	for _, amount := range amounts {
+		var line Line
+		if d.Inclusive {
+			line.Gross = amount
+			line.Net = divRound(amount*rateScale, rateScale+rate)
+			line.Tax = line.Gross - line.Net
+		} else {
+			line.Net = amount
+			line.Tax = divRound(amount*rate, rateScale)
+			line.Gross = line.Net + line.Tax
+		}
+		b.Lines = append(b.Lines, line)
+		b.Subtotal += line.Net
+		b.Tax += line.Tax
+		b.Total += line.Gross
+	}
+	return b, nil
+}
+
+// Priced 单据上按定价展示的合计：含税定价时为含税额，否则为不含税额
+func (b *Breakdown) Priced() int64 {
+	if b.Decision.Inclusive {
+		return b.Total
+	}
+	return b.Subtotal
+}
+
+// ParseRate 解析百分比税率字符串（最多三位小数）
+func ParseRate(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	intPart, fracPart, _ := strings.Cut(value, ".")
+	if len(fracPart) > 3 {
+		fracPart = strings.TrimRight(fracPart, "0")
+		if len(fracPart) > 3 {
+			return 0, fmt.Errorf("tax rate %q has more than three decimals", value)
+		}
+	}
+	fracPart += strings.Repeat("0", 3-len(fracPart))
+
+	whole, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid tax rate %q", value)
+	}
+	frac, err := strconv.ParseInt(fracPart, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid tax rate %q", value)
+	}
+	rate := whole*1000 + frac
+	if rate < 0 || rate > 100*1000 {
+		return 0, fmt.Errorf("tax rate %q out of range", value)
+	}
+	return rate, nil
+}
+
+func trimRate(rate string) string {
+	if !strings.Contains(rate, ".") {
+		return rate
+	}
+	return strings.TrimRight(strings.TrimRight(rate, "0"), ".")
+}
+
+// divRound 非负整数除法，四舍五入
+func divRound(a, b int64) int64 {
+	if a < 0 {
+		return -divRound(-a, b)
+	}
+	return (a + b/2) / b
+}
+
+// NormalizeCountry 将国家统一为大写两位代码
+func NormalizeCountry(country string) string {
+	return strings.ToUpper(strings.TrimSpace(country))
+}
+
+// NormalizeTaxID 去掉税号中的空格、点和横线并转为大写
+func NormalizeTaxID(taxID string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '.', '-':
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(taxID)))
+}
+
+// euVATPrefixes 欧盟成员国（含北爱尔兰 XI）与 VAT 号前缀的对应关系，希腊使用 EL
+var euVATPrefixes = map[string]string{
+	"AT": "AT", "BE": "BE", "BG": "BG", "CY": "CY", "CZ": "CZ", "DE": "DE", "DK": "DK",
+	"EE": "EE", "ES": "ES", "FI": "FI", "FR": "FR", "GR": "EL", "HR": "HR", "HU": "HU",
+	"IE": "IE", "IT": "IT", "LT": "LT", "LU": "LU", "LV": "LV", "MT": "MT", "NL": "NL",
+	"PL": "PL", "PT": "PT", "RO": "RO", "SE": "SE", "SI": "SI", "SK": "SK", "XI": "XI",
+}
+
+var (
+	euVATPattern     = regexp.MustCompile(`^[A-Z]{2}[0-9A-Z+*]{2,12}$`)
+	genericTaxIDForm = regexp.MustCompile(`^[0-9A-Z]{4,20}$`)
+)
+
+// ValidTaxID 校验税号格式：欧盟国家要求带本国前缀的 VAT 号，其他国家只做基本字符校验。
+// 这里不做 VIES 在线核验。
+func ValidTaxID(country, taxID string) bool {
+	id := NormalizeTaxID(taxID)
+	if id == "" {
+		return false
+	}
+	if prefix, ok := euVATPrefixes[NormalizeCountry(country)]; ok {
+		return strings.HasPrefix(id, prefix) && euVATPattern.MatchString(id)
+	}
+	return genericTaxIDForm.MatchString(id)
+}
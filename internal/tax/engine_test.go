@@ -0,0 +1,112 @@
+package tax
+
+import "testing"
+
+var testRules = []Rule{
+	{ID: "de", Country: "DE", Name: "VAT", Rate: "19.000", ReverseCharge: true, IsActive: true},
+	{ID: "fr", Country: "FR", Name: "VAT", Rate: "20.000", ReverseCharge: true, IsActive: true},
+	{ID: "us-ny", Country: "US", Region: "NY", Name: "Sales Tax", Rate: "8.875", IsActive: true},
+	{ID: "us", Country: "US", Name: "Sales Tax", Rate: "0", IsActive: false},
+}
+
+func TestResolve(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		customer Customer
+		wantRule string
+		wantRate string
+		reverse  bool
+	}{
+		{"domestic consumer", Customer{Country: "de"}, "de", "19.000", false},
+		{"domestic business keeps vat", Customer{Country: "DE", TaxID: "DE123456789"}, "de", "19.000", false},
+		{"eu business reverse charge", Customer{Country: "FR", TaxID: "FR 12 345678901"}, "fr", "0", true},
+		{"eu business with foreign prefix", Customer{Country: "FR", TaxID: "DE123456789"}, "fr", "20.000", false},
+		{"us state rule", Customer{Country: "US", State: "ny"}, "us-ny", "8.875", false},
+		{"inactive country rule", Customer{Country: "US", State: "TX"}, "", "0", false},
+		{"no profile", Customer{}, "", "0", false},
+	}
+
+	for _, tt := range tests {
+		d := Resolve(testRules, tt.customer, "DE", false)
+		if d.RuleID != tt.wantRule || d.Rate != tt.wantRate || d.ReverseCharge != tt.reverse {
+			t.Fatalf("%s: Resolve = %+v", tt.name, d)
+		}
+	}
+}
+
+func TestDecisionApply(t *testing.T) {
+	t.Parallel()
+
+	exclusive, err := Decision{RuleID: "de", Rate: "19"}.Apply([]int64{1000, 599})
+	if err != nil {
+		t.Fatalf("Apply returned error: %v", err)
+	}
+	// 1000 * 19% = 190, 599 * 19% = 113.81 -> 114
+	if exclusive.Subtotal != 1599 || exclusive.Tax != 304 || exclusive.Total != 1903 || exclusive.Priced() != 1599 {
+		t.Fatalf("unexpected exclusive breakdown: %+v", exclusive)
+	}
+
+	inclusive, err := Decision{RuleID: "de", Rate: "19", Inclusive: true}.Apply([]int64{1190})
+	if err != nil {
+		t.Fatalf("Apply returned error: %v", err)
+	}
+	if inclusive.Subtotal != 1000 || inclusive.Tax != 190 || inclusive.Total != 1190 || inclusive.Priced() != 1190 {
+		t.Fatalf("unexpected inclusive breakdown: %+v", inclusive)
+	}
+
+	if _, err := (Decision{Rate: "19.1234"}).Apply([]int64{100}); err == nil {
+		t.Fatalf("expected error for rate with four decimals")
+	}
+}
+
+func TestDecisionLabel(t *testing.T) {
+	t.Parallel()
+
+	if got := (Decision{Name: "VAT", Country: "DE", Rate: "19.000"}).Label(); got != "VAT 19% (DE)" {
+		t.Fatalf("Label = %q", got)
+	}
+	if got := (Decision{Name: "Sales Tax", Country: "US", Region: "NY", Rate: "8.875", Inclusive: true}).Label(); got != "Sales Tax 8.875% (US-NY) included" {
+		t.Fatalf("Label = %q", got)
+	}
+	if got := (Decision{Name: "VAT", Country: "FR", Rate: "0", ReverseCharge: true}).Label(); got != "VAT reverse charge (FR)" {
+		t.Fatalf("Label = %q", got)
+	}
+}
+
+func TestDecisionCategory(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		decision Decision
+		want     string
+	}{
+		{Decision{Rate: "0"}, CategoryNotSubject},
+		{Decision{RuleID: "r1", Rate: "19.000"}, CategoryStandard},
+		{Decision{RuleID: "r1", Rate: "0.000"}, CategoryZeroRated},
+		{Decision{RuleID: "r1", Rate: "0", ReverseCharge: true}, CategoryReverseCharge},
+	}
+	for _, tt := range tests {
+		if got := tt.decision.Category(); got != tt.want {
+			t.Errorf("Category(%+v) = %q, want %q", tt.decision, got, tt.want)
+		}
+	}
+}
+
+func TestValidTaxID(t *testing.T) {
+	t.Parallel()
+
+	valid := [][2]string{{"DE", "DE123456789"}, {"GR", "EL123456789"}, {"AT", "atu12345678"}, {"GB", "GB 123 4567 89"}}
+	for _, v := range valid {
+		if !ValidTaxID(v[0], v[1]) {
+			t.Fatalf("ValidTaxID(%q, %q) = false", v[0], v[1])
+		}
+	}
+	invalid := [][2]string{{"DE", ""}, {"DE", "123456789"}, {"GR", "GR123456789"}, {"US", "12"}}
+	for _, v := range invalid {
+		if ValidTaxID(v[0], v[1]) {
+			t.Fatalf("ValidTaxID(%q, %q) = true", v[0], v[1])
+		}
+	}
+}
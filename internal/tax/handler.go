@@ -0,0 +1,83 @@
+package tax
+
+import (
+	"net/http"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type Handler struct {
+	pool *pgxpool.Pool
+}
+
+func NewHandler(pool *pgxpool.Pool) *Handler {
+	return &Handler{pool: pool}
+}
+
+type CreateRuleRequest struct {
+	Country       string `json:"country" binding:"required,len=2"`
+	Region        string `json:"region"`
+	Name          string `json:"name" binding:"required"`
+	Rate          string `json:"rate" binding:"required"`
+	ReverseCharge bool   `json:"reverse_charge"`
+	IsActive      *bool  `json:"is_active"`
+}
+
+type UpdateRuleRequest struct {
+	Name          string  `json:"name"`
+	Rate          *string `json:"rate"`
+	ReverseCharge *bool   `json:"reverse_charge"`
+	IsActive      *bool   `json:"is_active"`
+}
+
+// ListRules - GET /api/v1/admin/tax-rules
+func (h *Handler) ListRules(c *gin.Context) {
+	rules, err := h.listRules(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query tax rules"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+// CreateRule - POST /api/v1/admin/tax-rules
+func (h *Handler) CreateRule(c *gin.Context) {
+	var req CreateRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule, err := h.createRule(c.Request.Context(), req)
+	if err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, rule)
+}
+
+// UpdateRule - PUT /api/v1/admin/tax-rules/:id
+func (h *Handler) UpdateRule(c *gin.Context) {
+	var req UpdateRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.updateRule(c.Request.Context(), c.Param("id"), req); err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Tax rule updated"})
+}
+
+// DeleteRule - DELETE /api/v1/admin/tax-rules/:id
+func (h *Handler) DeleteRule(c *gin.Context) {
+	if err := h.deleteRule(c.Request.Context(), c.Param("id")); err != nil {
+		common.WriteServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Tax rule deleted"})
+}
@@ -0,0 +1,84 @@
+package tax
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/adiecho/echobilling/internal/app"
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/adiecho/echobilling/internal/db"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// ForUser 根据客户资料和当前税率规则确定计税方式；没有客户资料时按无匹配规则处理
+func ForUser(ctx context.Context, q db.DBTX, store *app.SettingsStore, userID string) (Decision, error) {
+	var customer Customer
+	err := q.QueryRow(ctx,
+		`SELECT COALESCE(country, ''), COALESCE(state, ''), COALESCE(tax_id, '')
+		 FROM customer_profiles
+		 WHERE user_id = $1`,
+		userID,
+	).Scan(&customer.Country, &customer.State, &customer.TaxID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return Decision{}, err
+	}
+
+	rules, err := activeRules(ctx, q, NormalizeCountry(customer.Country))
+	if err != nil {
+		return Decision{}, err
+	}
+
+	homeCountry, inclusive := "", false
+	if store != nil {
+		homeCountry = store.Get("tax_home_country")
+		inclusive, _ = strconv.ParseBool(store.Get("tax_prices_include_tax"))
+	}
+	return Resolve(rules, customer, homeCountry, inclusive), nil
+}
+
+func activeRules(ctx context.Context, q db.DBTX, country string) ([]Rule, error) {
+	if country == "" {
+		return nil, nil
+	}
+	rows, err := q.Query(ctx,
+		`SELECT id, country, region, name, rate::text, reverse_charge, is_active
+		 FROM tax_rules
+		 WHERE country = $1 AND is_active = TRUE`,
+		country,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := make([]Rule, 0)
+	for rows.Next() {
+		var r Rule
+		if err := rows.Scan(&r.ID, &r.Country, &r.Region, &r.Name, &r.Rate, &r.ReverseCharge, &r.IsActive); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// InsertInvoiceLine 将税费写为发票的独立明细行（kind = 'tax'），同时记录税种类别和税率；不适用税费时不写入
+func InsertInvoiceLine(ctx context.Context, q db.DBTX, invoiceID string, b *Breakdown, now time.Time) error {
+	if b == nil || !b.Decision.Applies() {
+		return nil
+	}
+	rate := b.Decision.Rate
+	if b.Decision.ReverseCharge || rate == "" {
+		rate = "0"
+	}
+	tax := common.CentsToDecimal(b.Tax)
+	_, err := q.Exec(ctx,
+		`INSERT INTO invoice_items (id, invoice_id, description, quantity, unit_price, amount, kind, tax_category, tax_rate, created_at)
+		 VALUES ($1, $2, $3, 1, $4, $4, 'tax', $5, $6, $7)`,
+		uuid.New().String(), invoiceID, b.Decision.Label(), tax, b.Decision.Category(), rate, now,
+	)
+	return err
+}
@@ -0,0 +1,11 @@
+package tax
+
+import "github.com/gin-gonic/gin"
+
+func RegisterRoutes(admin *gin.RouterGroup, h *Handler) {
+	rules := admin.Group("/tax-rules")
+	rules.GET("", h.ListRules)
+	rules.POST("", h.CreateRule)
+	rules.PUT("/:id", h.UpdateRule)
+	rules.DELETE("/:id", h.DeleteRule)
+}
@@ -0,0 +1,99 @@
+package tax
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/adiecho/echobilling/internal/common"
+	"github.com/jackc/pgx/v5"
+)
+
+const ruleColumns = `id, country, region, name, rate::text, reverse_charge, is_active`
+
+func (h *Handler) listRules(ctx context.Context) ([]Rule, error) {
+	rows, err := h.pool.Query(ctx, `
+		SELECT `+ruleColumns+`
+		FROM tax_rules
+		ORDER BY country, region
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := make([]Rule, 0)
+	for rows.Next() {
+		var r Rule
+		if err := rows.Scan(&r.ID, &r.Country, &r.Region, &r.Name, &r.Rate, &r.ReverseCharge, &r.IsActive); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (h *Handler) createRule(ctx context.Context, req CreateRuleRequest) (*Rule, *common.ServiceError) {
+	if _, err := ParseRate(req.Rate); err != nil {
+		return nil, common.ErrBadRequest("Invalid tax rate", err)
+	}
+
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+
+	var r Rule
+	err := h.pool.QueryRow(ctx, `
+		INSERT INTO tax_rules (country, region, name, rate, reverse_charge, is_active)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (country, region) DO NOTHING
+		RETURNING `+ruleColumns,
+		NormalizeCountry(req.Country), strings.ToUpper(strings.TrimSpace(req.Region)),
+		strings.TrimSpace(req.Name), req.Rate, req.ReverseCharge, isActive,
+	).Scan(&r.ID, &r.Country, &r.Region, &r.Name, &r.Rate, &r.ReverseCharge, &r.IsActive)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, common.NewServiceError(http.StatusConflict, "A tax rule for this country and region already exists", err)
+		}
+		return nil, common.ErrInternal("Failed to create tax rule", err)
+	}
+	return &r, nil
+}
+
+func (h *Handler) updateRule(ctx context.Context, id string, req UpdateRuleRequest) *common.ServiceError {
+	if req.Rate != nil {
+		if _, err := ParseRate(*req.Rate); err != nil {
+			return common.ErrBadRequest("Invalid tax rate", err)
+		}
+	}
+
+	tag, err := h.pool.Exec(ctx, `
+		UPDATE tax_rules
+		SET name = COALESCE(NULLIF($2, ''), name),
+		    rate = COALESCE($3::numeric, rate),
+		    reverse_charge = COALESCE($4, reverse_charge),
+		    is_active = COALESCE($5, is_active),
+		    updated_at = NOW()
+		WHERE id = $1
+	`, id, strings.TrimSpace(req.Name), req.Rate, req.ReverseCharge, req.IsActive)
+	if err != nil {
+		return common.ErrInternal("Failed to update tax rule", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return common.ErrNotFound("Tax rule not found", nil)
+	}
+	return nil
+}
+
+func (h *Handler) deleteRule(ctx context.Context, id string) *common.ServiceError {
+	tag, err := h.pool.Exec(ctx, `DELETE FROM tax_rules WHERE id = $1`, id)
+	if err != nil {
+		return common.ErrInternal("Failed to delete tax rule", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return common.ErrNotFound("Tax rule not found", nil)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+// Package testdb 为需要真实 PostgreSQL 的测试提供连接池。
+// 设置 TEST_DATABASE_URL 后运行迁移并返回连接池，未设置时跳过测试
+package testdb
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/adiecho/echobilling/internal/app"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	migrateOnce sync.Once
+	migrateErr  error
+)
+
+// Pool 返回测试数据库连接池，测试结束时关闭。测试应在事务内写入并回滚，避免相互影响
+func Pool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	migrateOnce.Do(func() {
+		migrateErr = app.RunMigrations(url)
+	})
+	if migrateErr != nil {
+		t.Fatalf("failed to migrate test database: %v", migrateErr)
+	}
+
+	pool, err := pgxpool.New(context.Background(), url)
+	if err != nil {
+		t.Fatalf("failed to connect to test database: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
@@ -0,0 +1,38 @@
+-- +goose Up
+ALTER TABLE products
+  ADD COLUMN provisioning_driver VARCHAR(50);
+
+ALTER TABLE plans
+  ADD COLUMN provisioning_driver VARCHAR(50);
+
+ALTER TABLE services
+  ADD COLUMN driver VARCHAR(50),
+  ADD COLUMN external_id VARCHAR(255);
+
+CREATE INDEX idx_services_external_id ON services(driver, external_id);
+
+INSERT INTO system_settings (key, value, is_secret, description, group_name) VALUES
+    ('provisioning_default_driver', 'mock', FALSE, 'Default provisioning driver (mock, proxmox)', 'provisioning'),
+    ('proxmox_api_url',      '', FALSE, 'Proxmox VE API URL (e.g. https://pve.example.com:8006)', 'provisioning'),
+    ('proxmox_token_id',     '', FALSE, 'Proxmox API token ID (user@realm!token)',               'provisioning'),
+    ('proxmox_token_secret', '', TRUE,  'Proxmox API token secret',                              'provisioning'),
+    ('proxmox_node',         '', FALSE, 'Proxmox node that hosts new VMs',                       'provisioning'),
+    ('proxmox_template_vmid', '', FALSE, 'VMID of the template cloned for new VMs',              'provisioning');
+
+-- +goose Down
+DELETE FROM system_settings WHERE key IN (
+    'provisioning_default_driver', 'proxmox_api_url', 'proxmox_token_id',
+    'proxmox_token_secret', 'proxmox_node', 'proxmox_template_vmid'
+);
+
+DROP INDEX IF EXISTS idx_services_external_id;
+
+ALTER TABLE services
+  DROP COLUMN IF EXISTS external_id,
+  DROP COLUMN IF EXISTS driver;
+
+ALTER TABLE plans
+  DROP COLUMN IF EXISTS provisioning_driver;
+
+ALTER TABLE products
+  DROP COLUMN IF EXISTS provisioning_driver;
@@ -0,0 +1,57 @@
+-- +goose Up
+CREATE TYPE ip_family AS ENUM ('ipv4', 'ipv6');
+CREATE TYPE ip_address_status AS ENUM ('available', 'assigned');
+
+CREATE TABLE ip_pools (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(255) NOT NULL,
+    description TEXT,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    sort_order INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE ip_subnets (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    pool_id UUID NOT NULL REFERENCES ip_pools(id) ON DELETE CASCADE,
+    family ip_family NOT NULL,
+    cidr CIDR UNIQUE NOT NULL,
+    gateway INET,
+    dns_servers TEXT NOT NULL DEFAULT '',
+    next_offset BIGINT NOT NULL DEFAULT 1,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE ip_addresses (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    subnet_id UUID NOT NULL REFERENCES ip_subnets(id) ON DELETE CASCADE,
+    address INET UNIQUE NOT NULL,
+    status ip_address_status NOT NULL DEFAULT 'assigned',
+    service_id UUID REFERENCES services(id) ON DELETE SET NULL,
+    reverse_dns VARCHAR(255),
+    assigned_at TIMESTAMPTZ,
+    released_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE services
+  ADD COLUMN ipv6_address VARCHAR(45);
+
+CREATE INDEX idx_ip_subnets_pool_id ON ip_subnets(pool_id);
+CREATE INDEX idx_ip_subnets_family ON ip_subnets(family);
+CREATE INDEX idx_ip_addresses_subnet_id ON ip_addresses(subnet_id);
+CREATE INDEX idx_ip_addresses_service_id ON ip_addresses(service_id);
+CREATE INDEX idx_ip_addresses_status ON ip_addresses(status);
+
+-- +goose Down
+ALTER TABLE services
+  DROP COLUMN IF EXISTS ipv6_address;
+
+DROP TABLE IF EXISTS ip_addresses;
+DROP TABLE IF EXISTS ip_subnets;
+DROP TABLE IF EXISTS ip_pools;
+DROP TYPE IF EXISTS ip_address_status;
+DROP TYPE IF EXISTS ip_family;
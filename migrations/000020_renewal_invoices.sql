@@ -0,0 +1,26 @@
+-- +goose Up
+ALTER TABLE invoices
+  ADD COLUMN service_id UUID REFERENCES services(id) ON DELETE SET NULL,
+  ADD COLUMN billing_period_start TIMESTAMPTZ,
+  ADD COLUMN billing_period_end TIMESTAMPTZ;
+
+CREATE INDEX idx_invoices_service_id ON invoices(service_id);
+
+-- 每个服务的每个计费周期最多一张有效续费发票，作废后允许重新生成
+CREATE UNIQUE INDEX idx_invoices_service_period
+  ON invoices(service_id, billing_period_start)
+  WHERE service_id IS NOT NULL AND status <> 'void';
+
+INSERT INTO system_settings (key, value, is_secret, description, group_name) VALUES
+    ('renewal_invoice_days_before', '7', FALSE, 'Days before service expiry to issue the renewal invoice', 'billing');
+
+-- +goose Down
+DELETE FROM system_settings WHERE key = 'renewal_invoice_days_before';
+
+DROP INDEX IF EXISTS idx_invoices_service_period;
+DROP INDEX IF EXISTS idx_invoices_service_id;
+
+ALTER TABLE invoices
+  DROP COLUMN IF EXISTS billing_period_end,
+  DROP COLUMN IF EXISTS billing_period_start,
+  DROP COLUMN IF EXISTS service_id;
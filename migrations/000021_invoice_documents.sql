@@ -0,0 +1,21 @@
+-- +goose Up
+-- 发票定稿后冻结卖方/买方信息，之后品牌或客户资料变更不影响已开具的单据
+ALTER TABLE invoices
+  ADD COLUMN party_snapshot JSONB;
+
+-- 已渲染的单据缓存，variant 为渲染时的发票状态，同一状态下的单据内容不再变化
+CREATE TABLE invoice_documents (
+    invoice_id UUID NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    format VARCHAR(20) NOT NULL,
+    variant VARCHAR(20) NOT NULL,
+    content BYTEA NOT NULL,
+    checksum VARCHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (invoice_id, format, variant)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS invoice_documents;
+
+ALTER TABLE invoices
+  DROP COLUMN IF EXISTS party_snapshot;
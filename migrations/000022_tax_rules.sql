@@ -0,0 +1,49 @@
+-- +goose Up
+CREATE TABLE tax_rules (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    country VARCHAR(2) NOT NULL,
+    region VARCHAR(100) NOT NULL DEFAULT '',
+    name VARCHAR(100) NOT NULL,
+    rate NUMERIC(6,3) NOT NULL CHECK (rate >= 0 AND rate <= 100),
+    reverse_charge BOOLEAN NOT NULL DEFAULT FALSE,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (country, region)
+);
+
+-- 购物车计税结果：subtotal 为按定价的商品合计，total_amount 为应付金额
+ALTER TABLE orders
+  ADD COLUMN subtotal NUMERIC(10,2) NOT NULL DEFAULT 0,
+  ADD COLUMN tax_amount NUMERIC(10,2) NOT NULL DEFAULT 0,
+  ADD COLUMN tax_details JSONB;
+
+UPDATE orders SET subtotal = total_amount;
+
+ALTER TABLE invoices
+  ADD COLUMN tax_inclusive BOOLEAN NOT NULL DEFAULT FALSE,
+  ADD COLUMN reverse_charge BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- 税费作为单独的明细行保存，kind = 'tax'
+ALTER TABLE invoice_items
+  ADD COLUMN kind VARCHAR(20) NOT NULL DEFAULT 'line';
+
+INSERT INTO system_settings (key, value, is_secret, description, group_name) VALUES
+    ('tax_home_country',       '',      FALSE, 'Seller country (ISO 3166-1 alpha-2); reverse charge never applies to domestic customers', 'tax'),
+    ('tax_prices_include_tax', 'false', FALSE, 'Whether plan prices already include tax',                                                  'tax');
+
+-- +goose Down
+DELETE FROM system_settings WHERE key IN ('tax_home_country', 'tax_prices_include_tax');
+
+ALTER TABLE invoice_items DROP COLUMN IF EXISTS kind;
+
+ALTER TABLE invoices
+  DROP COLUMN IF EXISTS reverse_charge,
+  DROP COLUMN IF EXISTS tax_inclusive;
+
+ALTER TABLE orders
+  DROP COLUMN IF EXISTS tax_details,
+  DROP COLUMN IF EXISTS tax_amount,
+  DROP COLUMN IF EXISTS subtotal;
+
+DROP TABLE IF EXISTS tax_rules;
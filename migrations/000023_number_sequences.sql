@@ -0,0 +1,19 @@
+-- +goose Up
+-- 单据编号计数器，按序列和周期（年/月，不重置时为空）分别计数
+CREATE TABLE number_sequences (
+    series VARCHAR(50) NOT NULL,
+    period VARCHAR(20) NOT NULL DEFAULT '',
+    last_value BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (series, period)
+);
+
+INSERT INTO system_settings (key, value, is_secret, description, group_name) VALUES
+    ('invoice_number_prefix',  'INV',                     FALSE, 'Invoice number prefix',                                                    'billing'),
+    ('invoice_number_pattern', '{PREFIX}-{YYYY}-{SEQ:6}', FALSE, 'Invoice number pattern: {PREFIX} {YYYY} {YY} {MM} {DD} {SEQ} {SEQ:n}',     'billing'),
+    ('invoice_number_reset',   'yearly',                  FALSE, 'When the invoice counter restarts: yearly, monthly or never',              'billing');
+
+-- +goose Down
+DELETE FROM system_settings WHERE key IN ('invoice_number_prefix', 'invoice_number_pattern', 'invoice_number_reset');
+
+DROP TABLE IF EXISTS number_sequences;
@@ -0,0 +1,17 @@
+-- +goose Up
+-- 开通费按单价记录在订单项上，仅在首单收取，续费不再计入
+ALTER TABLE order_items
+  ADD COLUMN setup_fee NUMERIC(10,2) NOT NULL DEFAULT 0;
+
+ALTER TABLE orders
+  ADD COLUMN setup_fee_waived BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- 尚未下单的购物车按套餐快照补齐开通费
+UPDATE order_items oi
+SET setup_fee = COALESCE((oi.plan_snapshot->>'setup_fee')::numeric, 0)
+FROM orders o
+WHERE o.id = oi.order_id AND o.status = 'draft';
+
+-- +goose Down
+ALTER TABLE orders DROP COLUMN IF EXISTS setup_fee_waived;
+ALTER TABLE order_items DROP COLUMN IF EXISTS setup_fee;
@@ -0,0 +1,15 @@
+-- +goose Up
+-- 订单项数量大于 1 时每个单位对应一个独立服务，unit_index 从 0 开始编号
+ALTER TABLE services
+  ADD COLUMN unit_index INT NOT NULL DEFAULT 0;
+
+ALTER TABLE services DROP CONSTRAINT IF EXISTS services_order_item_id_key;
+
+CREATE UNIQUE INDEX idx_services_order_item_unit ON services(order_item_id, unit_index);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_services_order_item_unit;
+
+ALTER TABLE services ADD CONSTRAINT services_order_item_id_key UNIQUE (order_item_id);
+
+ALTER TABLE services DROP COLUMN IF EXISTS unit_index;
@@ -0,0 +1,55 @@
+-- +goose Up
+CREATE TABLE coupons (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    code VARCHAR(50) UNIQUE NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    discount_type VARCHAR(20) NOT NULL CHECK (discount_type IN ('percent', 'fixed')),
+    discount_value NUMERIC(10,2) NOT NULL CHECK (discount_value > 0),
+    plan_ids UUID[] NOT NULL DEFAULT '{}',
+    billing_cycles TEXT[] NOT NULL DEFAULT '{}',
+    duration VARCHAR(20) NOT NULL DEFAULT 'once' CHECK (duration IN ('once', 'forever')),
+    max_redemptions INT,
+    max_redemptions_per_user INT,
+    redemption_count INT NOT NULL DEFAULT 0,
+    starts_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE coupon_redemptions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    coupon_id UUID NOT NULL REFERENCES coupons(id) ON DELETE RESTRICT,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    invoice_id UUID REFERENCES invoices(id) ON DELETE SET NULL,
+    amount NUMERIC(10,2) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (coupon_id, order_id)
+);
+
+CREATE INDEX idx_coupon_redemptions_user ON coupon_redemptions(coupon_id, user_id);
+
+-- subtotal 保持折扣前金额，discount_amount 为整单折扣
+ALTER TABLE orders
+  ADD COLUMN coupon_id UUID REFERENCES coupons(id) ON DELETE SET NULL,
+  ADD COLUMN discount_amount NUMERIC(10,2) NOT NULL DEFAULT 0;
+
+-- 每个单位的折扣额，订单项折扣 = quantity * unit_discount
+ALTER TABLE order_items
+  ADD COLUMN unit_discount NUMERIC(10,2) NOT NULL DEFAULT 0;
+
+-- 持续优惠（duration = forever）的服务续费时继续享受折扣
+ALTER TABLE services
+  ADD COLUMN coupon_id UUID REFERENCES coupons(id) ON DELETE SET NULL;
+
+-- +goose Down
+ALTER TABLE services DROP COLUMN IF EXISTS coupon_id;
+ALTER TABLE order_items DROP COLUMN IF EXISTS unit_discount;
+ALTER TABLE orders
+  DROP COLUMN IF EXISTS discount_amount,
+  DROP COLUMN IF EXISTS coupon_id;
+
+DROP TABLE IF EXISTS coupon_redemptions;
+DROP TABLE IF EXISTS coupons;
@@ -0,0 +1,32 @@
+-- +goose Up
+-- 套餐升降级记录。amount 为按剩余时间折算的差价：正数需要补缴（关联 invoice_id），负数为退回的账户余额
+CREATE TABLE plan_changes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    service_id UUID NOT NULL REFERENCES services(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    from_plan_id UUID NOT NULL REFERENCES plans(id),
+    to_plan_id UUID NOT NULL REFERENCES plans(id),
+    billing_cycle billing_cycle NOT NULL,
+    old_price NUMERIC(10,2) NOT NULL,
+    new_price NUMERIC(10,2) NOT NULL,
+    amount NUMERIC(10,2) NOT NULL,
+    period_start TIMESTAMPTZ NOT NULL,
+    period_end TIMESTAMPTZ NOT NULL,
+    invoice_id UUID REFERENCES invoices(id) ON DELETE SET NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'paid', 'applied', 'cancelled')),
+    applied_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- 同一服务同时只能有一个未完成的变更
+CREATE UNIQUE INDEX idx_plan_changes_in_flight ON plan_changes(service_id) WHERE status IN ('pending', 'paid');
+CREATE INDEX idx_plan_changes_invoice ON plan_changes(invoice_id) WHERE invoice_id IS NOT NULL;
+
+-- 变更套餐后的续费单价；为空时沿用订单项单价
+ALTER TABLE services ADD COLUMN recurring_price NUMERIC(10,2);
+
+-- +goose Down
+ALTER TABLE services DROP COLUMN IF EXISTS recurring_price;
+DROP TABLE IF EXISTS plan_changes;
@@ -0,0 +1,51 @@
+-- +goose Up
+-- 账户余额流水，只追加不修改。amount 为正表示增加余额，为负表示扣减
+CREATE TABLE credit_transactions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind VARCHAR(20) NOT NULL
+        CHECK (kind IN ('adjustment', 'top_up', 'downgrade', 'applied', 'released')),
+    amount NUMERIC(10,2) NOT NULL CHECK (amount <> 0),
+    reason TEXT NOT NULL DEFAULT '',
+    order_id UUID REFERENCES orders(id) ON DELETE SET NULL,
+    invoice_id UUID REFERENCES invoices(id) ON DELETE SET NULL,
+    plan_change_id UUID REFERENCES plan_changes(id) ON DELETE SET NULL,
+    stripe_checkout_session_id VARCHAR(255),
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_credit_transactions_user ON credit_transactions(user_id, created_at);
+CREATE INDEX idx_credit_transactions_order ON credit_transactions(order_id) WHERE order_id IS NOT NULL;
+CREATE INDEX idx_credit_transactions_invoice ON credit_transactions(invoice_id) WHERE invoice_id IS NOT NULL;
+-- Webhook 重投和重复执行的降级不会重复入账
+CREATE UNIQUE INDEX idx_credit_transactions_top_up ON credit_transactions(stripe_checkout_session_id)
+    WHERE stripe_checkout_session_id IS NOT NULL;
+CREATE UNIQUE INDEX idx_credit_transactions_downgrade ON credit_transactions(plan_change_id)
+    WHERE kind = 'downgrade';
+
+CREATE VIEW credit_balances AS
+SELECT user_id, SUM(amount) AS balance
+FROM credit_transactions
+GROUP BY user_id;
+
+-- 订单和发票上已用余额抵扣的金额，应付金额 = total - credit_applied
+ALTER TABLE orders ADD COLUMN credit_applied NUMERIC(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE invoices ADD COLUMN credit_applied NUMERIC(10,2) NOT NULL DEFAULT 0;
+
+-- 已执行的降级差价补记为余额
+INSERT INTO credit_transactions (user_id, kind, amount, reason, plan_change_id, created_at)
+SELECT user_id, 'downgrade', -amount, 'Plan downgrade proration', id, created_at
+FROM plan_changes
+WHERE amount < 0 AND status IN ('paid', 'applied');
+
+INSERT INTO system_settings (key, value, is_secret, description, group_name) VALUES
+    ('credit_top_up_min', '5.00',    FALSE, 'Minimum amount a customer can add to their account credit in one top-up', 'billing'),
+    ('credit_top_up_max', '1000.00', FALSE, 'Maximum amount a customer can add to their account credit in one top-up', 'billing');
+
+-- +goose Down
+DELETE FROM system_settings WHERE key IN ('credit_top_up_min', 'credit_top_up_max');
+ALTER TABLE invoices DROP COLUMN IF EXISTS credit_applied;
+ALTER TABLE orders DROP COLUMN IF EXISTS credit_applied;
+DROP VIEW IF EXISTS credit_balances;
+DROP TABLE IF EXISTS credit_transactions;
@@ -0,0 +1,15 @@
+-- +goose Up
+-- 催缴流程：到期日后按设定天数发送提醒、暂停服务，暂停一段时间后终止服务并作废发票
+INSERT INTO system_settings (key, value, is_secret, description, group_name) VALUES
+    ('dunning_reminder_days',        '1,3,5', FALSE, 'Comma-separated days after the renewal due date on which payment reminders are emailed', 'billing'),
+    ('dunning_suspend_after_days',   '7',     FALSE, 'Grace period: days after the renewal due date before an unpaid service is suspended', 'billing'),
+    ('dunning_terminate_after_days', '14',    FALSE, 'Days a service stays suspended for non-payment before it is terminated and the invoice is voided (0 disables termination)', 'billing');
+
+-- 按发票查询催缴步骤
+CREATE INDEX idx_audit_logs_dunning ON audit_logs(entity_id, action)
+    WHERE entity_type = 'invoice' AND action LIKE 'dunning_%';
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_audit_logs_dunning;
+DELETE FROM system_settings
+WHERE key IN ('dunning_reminder_days', 'dunning_suspend_after_days', 'dunning_terminate_after_days');
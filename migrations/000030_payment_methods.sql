@@ -0,0 +1,30 @@
+-- +goose Up
+-- Stripe Customer，首次结账时创建，用于保存卡片和离线扣款
+ALTER TABLE users ADD COLUMN stripe_customer_id VARCHAR(255);
+CREATE UNIQUE INDEX idx_users_stripe_customer_id ON users(stripe_customer_id) WHERE stripe_customer_id IS NOT NULL;
+
+-- 客户在 Stripe 保存的卡片，每个用户最多一张默认卡
+CREATE TABLE payment_methods (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    stripe_payment_method_id VARCHAR(255) NOT NULL UNIQUE,
+    brand VARCHAR(50) NOT NULL DEFAULT '',
+    last4 VARCHAR(4) NOT NULL DEFAULT '',
+    exp_month INT NOT NULL DEFAULT 0,
+    exp_year INT NOT NULL DEFAULT 0,
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_payment_methods_user ON payment_methods(user_id);
+CREATE UNIQUE INDEX idx_payment_methods_default ON payment_methods(user_id) WHERE is_default;
+
+-- 续费发票自动扣款的尝试时间，每张发票只自动扣款一次
+ALTER TABLE invoices ADD COLUMN auto_charge_attempted_at TIMESTAMPTZ;
+
+-- +goose Down
+ALTER TABLE invoices DROP COLUMN IF EXISTS auto_charge_attempted_at;
+DROP TABLE IF EXISTS payment_methods;
+DROP INDEX IF EXISTS idx_users_stripe_customer_id;
+ALTER TABLE users DROP COLUMN IF EXISTS stripe_customer_id;
@@ -0,0 +1,15 @@
+-- +goose Up
+-- 支付网关：客户可选的网关列表（第一个为默认）和线下转账的付款说明
+INSERT INTO system_settings (key, value, is_secret, description, group_name) VALUES
+    ('payment_gateways_enabled',    'stripe', FALSE, 'Comma-separated payment gateways offered at checkout (stripe, manual); the first one is the default', 'payment'),
+    ('manual_payment_instructions', '',       FALSE, 'Bank transfer details shown to customers who choose the manual gateway', 'payment');
+
+-- 每笔付款记录收款网关；线下付款保存管理员登记的银行流水号
+ALTER TABLE payments ADD COLUMN gateway VARCHAR(50) NOT NULL DEFAULT 'stripe';
+ALTER TABLE payments ADD COLUMN transaction_reference VARCHAR(255);
+
+-- +goose Down
+ALTER TABLE payments DROP COLUMN IF EXISTS transaction_reference;
+ALTER TABLE payments DROP COLUMN IF EXISTS gateway;
+DELETE FROM system_settings
+WHERE key IN ('payment_gateways_enabled', 'manual_payment_instructions');
@@ -0,0 +1,14 @@
+-- +goose Up
+-- 沙箱支付网关：仅在 ENVIRONMENT 不为 prod 时可用，将 sandbox 加入 payment_gateways_enabled 即可在结账时选择
+UPDATE system_settings
+SET description = 'Comma-separated payment gateways offered at checkout (stripe, manual, sandbox outside prod); the first one is the default'
+WHERE key = 'payment_gateways_enabled';
+
+INSERT INTO system_settings (key, value, is_secret, description, group_name) VALUES
+    ('sandbox_webhook_secret', '', TRUE, 'Signing secret for sandbox gateway events; a random per-process secret is used when empty', 'payment');
+
+-- +goose Down
+DELETE FROM system_settings WHERE key = 'sandbox_webhook_secret';
+UPDATE system_settings
+SET description = 'Comma-separated payment gateways offered at checkout (stripe, manual); the first one is the default'
+WHERE key = 'payment_gateways_enabled';
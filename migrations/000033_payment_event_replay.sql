@@ -0,0 +1,31 @@
+-- +goose Up
+-- 网关事件处理状态：processed 只表示处理成功，失败单独记录在 failed_at，可由管理员重放
+ALTER TABLE payment_events
+    ADD COLUMN gateway VARCHAR(50) NOT NULL DEFAULT 'stripe',
+    ADD COLUMN attempts INT NOT NULL DEFAULT 0,
+    ADD COLUMN failed_at TIMESTAMPTZ,
+    ADD COLUMN locked_at TIMESTAMPTZ;
+
+-- 旧数据中处理失败的事件也被标记为 processed，恢复为失败状态
+UPDATE payment_events
+SET processed = FALSE, failed_at = COALESCE(processed_at, created_at), processed_at = NULL
+WHERE error_message IS NOT NULL;
+
+UPDATE payment_events SET attempts = 1;
+
+CREATE INDEX idx_payment_events_event_type ON payment_events(event_type);
+CREATE INDEX idx_payment_events_failed_at ON payment_events(failed_at) WHERE failed_at IS NOT NULL;
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_payment_events_failed_at;
+DROP INDEX IF EXISTS idx_payment_events_event_type;
+
+UPDATE payment_events
+SET processed = TRUE, processed_at = failed_at
+WHERE failed_at IS NOT NULL AND NOT processed;
+
+ALTER TABLE payment_events
+    DROP COLUMN locked_at,
+    DROP COLUMN failed_at,
+    DROP COLUMN attempts,
+    DROP COLUMN gateway;
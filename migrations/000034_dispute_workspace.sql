@@ -0,0 +1,30 @@
+-- +goose Up
+-- 争议处理：证据草稿、提交记录，以及争议期间自动暂停的服务
+ALTER TABLE disputes
+    ADD COLUMN evidence JSONB,
+    ADD COLUMN evidence_submitted_at TIMESTAMPTZ,
+    ADD COLUMN evidence_submitted_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    ADD COLUMN services_suspended_at TIMESTAMPTZ;
+
+CREATE INDEX idx_disputes_evidence_due_by ON disputes(evidence_due_by) WHERE evidence_submitted_at IS NULL;
+
+-- 登录记录和服务条款接受记录写入 audit_logs，作为争议证据
+CREATE INDEX idx_audit_logs_action_user_id ON audit_logs(action, user_id, created_at);
+
+INSERT INTO system_settings (key, value, is_secret, description, group_name) VALUES
+    ('dispute_alert_days',   '7,3,1', FALSE, 'Comma-separated days before the evidence due date on which admins are alerted about an unanswered dispute', 'payment'),
+    ('dispute_alert_email',  '',      FALSE, 'Recipient of dispute alerts; all admin users are alerted when empty',                                          'payment'),
+    ('dispute_auto_suspend', 'false', FALSE, 'Suspend the services paid by a disputed payment while the dispute is open',                                    'payment'),
+    ('terms_of_service_url', '',      FALSE, 'Public URL of the terms of service customers accept at registration, quoted in dispute evidence',            'branding');
+
+-- +goose Down
+DELETE FROM system_settings WHERE key IN ('dispute_alert_days', 'dispute_alert_email', 'dispute_auto_suspend', 'terms_of_service_url');
+
+DROP INDEX IF EXISTS idx_audit_logs_action_user_id;
+DROP INDEX IF EXISTS idx_disputes_evidence_due_by;
+
+ALTER TABLE disputes
+    DROP COLUMN services_suspended_at,
+    DROP COLUMN evidence_submitted_by,
+    DROP COLUMN evidence_submitted_at,
+    DROP COLUMN evidence;
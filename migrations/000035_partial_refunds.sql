@@ -0,0 +1,80 @@
+-- +goose NO TRANSACTION
+-- 新增的枚举值不能在添加它的事务中使用，本迁移不在事务中执行
+
+-- +goose Up
+ALTER TYPE payment_status ADD VALUE IF NOT EXISTS 'partially_refunded';
+ALTER TYPE invoice_status ADD VALUE IF NOT EXISTS 'partially_refunded';
+
+-- 累计已退金额（不含失败的退款），状态按累计金额推导
+ALTER TABLE payments ADD COLUMN amount_refunded NUMERIC(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE invoices ADD COLUMN amount_refunded NUMERIC(10,2) NOT NULL DEFAULT 0;
+
+UPDATE payments p
+SET amount_refunded = r.total
+FROM (
+    SELECT payment_id, SUM(amount) AS total
+    FROM refunds
+    WHERE status <> 'failed'
+    GROUP BY payment_id
+) r
+WHERE r.payment_id = p.id;
+
+UPDATE payments
+SET status = 'partially_refunded'
+WHERE status = 'refunded' AND amount_refunded > 0 AND amount_refunded < amount;
+
+UPDATE invoices i
+SET amount_refunded = p.total
+FROM (
+    SELECT invoice_id, SUM(amount_refunded) AS total
+    FROM payments
+    WHERE invoice_id IS NOT NULL
+    GROUP BY invoice_id
+) p
+WHERE p.invoice_id = i.id AND p.total > 0;
+
+UPDATE invoices
+SET status = 'partially_refunded'
+WHERE status IN ('paid', 'refunded') AND amount_refunded > 0 AND amount_refunded < total - credit_applied;
+
+-- 部分退款的单据缓存按累计退款金额区分
+ALTER TABLE invoice_documents ALTER COLUMN variant TYPE VARCHAR(50);
+
+-- 每笔退款对应一张贷项通知单（红字凭证），退款失败时作废
+CREATE TABLE credit_notes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    credit_note_number VARCHAR(50) UNIQUE NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    invoice_id UUID REFERENCES invoices(id) ON DELETE SET NULL,
+    refund_id UUID UNIQUE REFERENCES refunds(id) ON DELETE SET NULL,
+    amount NUMERIC(10,2) NOT NULL,
+    currency VARCHAR(3) NOT NULL DEFAULT 'USD',
+    reason TEXT,
+    status VARCHAR(20) NOT NULL DEFAULT 'issued',
+    voided_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_credit_notes_user_id ON credit_notes(user_id);
+CREATE INDEX idx_credit_notes_invoice_id ON credit_notes(invoice_id);
+
+INSERT INTO system_settings (key, value, is_secret, description, group_name) VALUES
+    ('credit_note_number_prefix',  'CN',                      FALSE, 'Credit note number prefix',                                                'billing'),
+    ('credit_note_number_pattern', '{PREFIX}-{YYYY}-{SEQ:6}', FALSE, 'Credit note number pattern: {PREFIX} {YYYY} {YY} {MM} {DD} {SEQ} {SEQ:n}', 'billing'),
+    ('credit_note_number_reset',   'yearly',                  FALSE, 'When the credit note counter restarts: yearly, monthly or never',          'billing');
+
+-- +goose Down
+DELETE FROM system_settings WHERE key IN ('credit_note_number_prefix', 'credit_note_number_pattern', 'credit_note_number_reset');
+
+DROP TABLE IF EXISTS credit_notes;
+
+DELETE FROM invoice_documents WHERE variant LIKE 'partially_refunded%';
+ALTER TABLE invoice_documents ALTER COLUMN variant TYPE VARCHAR(20);
+
+-- 枚举值无法删除，部分退款的记录退回原状态
+UPDATE invoices SET status = 'paid' WHERE status = 'partially_refunded';
+UPDATE payments SET status = 'succeeded' WHERE status = 'partially_refunded';
+
+ALTER TABLE invoices DROP COLUMN IF EXISTS amount_refunded;
+ALTER TABLE payments DROP COLUMN IF EXISTS amount_refunded;
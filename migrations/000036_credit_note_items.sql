@@ -0,0 +1,54 @@
+-- +goose Up
+-- 贷项通知单来源：refund 由退款签发，manual 由管理员手工开具
+-- 结算方式：refund 已原路退款，account_credit 计入账户余额，none 仅调整账目
+ALTER TABLE credit_notes
+    ADD COLUMN kind VARCHAR(20) NOT NULL DEFAULT 'refund' CHECK (kind IN ('refund', 'manual')),
+    ADD COLUMN settlement VARCHAR(20) NOT NULL DEFAULT 'refund' CHECK (settlement IN ('refund', 'account_credit', 'none')),
+    ADD COLUMN created_by UUID REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_credit_notes_created_at ON credit_notes(created_at);
+
+-- 明细金额为正数，表示冲减原发票的金额；kind 与 invoice_items 相同，税费行为 tax
+CREATE TABLE credit_note_items (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    credit_note_id UUID NOT NULL REFERENCES credit_notes(id) ON DELETE CASCADE,
+    invoice_item_id UUID REFERENCES invoice_items(id) ON DELETE SET NULL,
+    description TEXT NOT NULL,
+    quantity INTEGER NOT NULL DEFAULT 1 CHECK (quantity > 0),
+    unit_price NUMERIC(10,2) NOT NULL,
+    amount NUMERIC(10,2) NOT NULL,
+    kind VARCHAR(20) NOT NULL DEFAULT 'line',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_credit_note_items_credit_note_id ON credit_note_items(credit_note_id);
+
+INSERT INTO credit_note_items (credit_note_id, description, quantity, unit_price, amount, created_at)
+SELECT cn.id,
+       COALESCE('Refund of invoice ' || i.invoice_number, 'Refund'),
+       1, cn.amount, cn.amount, cn.created_at
+FROM credit_notes cn
+LEFT JOIN invoices i ON i.id = cn.invoice_id;
+
+-- 计入余额的贷项通知单在流水中记为 credit_note，每张只入账一次
+ALTER TABLE credit_transactions DROP CONSTRAINT IF EXISTS credit_transactions_kind_check;
+ALTER TABLE credit_transactions ADD CONSTRAINT credit_transactions_kind_check
+    CHECK (kind IN ('adjustment', 'top_up', 'downgrade', 'applied', 'released', 'credit_note'));
+ALTER TABLE credit_transactions ADD COLUMN credit_note_id UUID REFERENCES credit_notes(id) ON DELETE SET NULL;
+CREATE UNIQUE INDEX idx_credit_transactions_credit_note ON credit_transactions(credit_note_id)
+    WHERE credit_note_id IS NOT NULL;
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_credit_transactions_credit_note;
+ALTER TABLE credit_transactions DROP COLUMN IF EXISTS credit_note_id;
+DELETE FROM credit_transactions WHERE kind = 'credit_note';
+ALTER TABLE credit_transactions DROP CONSTRAINT IF EXISTS credit_transactions_kind_check;
+ALTER TABLE credit_transactions ADD CONSTRAINT credit_transactions_kind_check
+    CHECK (kind IN ('adjustment', 'top_up', 'downgrade', 'applied', 'released'));
+
+DROP TABLE IF EXISTS credit_note_items;
+DROP INDEX IF EXISTS idx_credit_notes_created_at;
+ALTER TABLE credit_notes
+    DROP COLUMN IF EXISTS created_by,
+    DROP COLUMN IF EXISTS settlement,
+    DROP COLUMN IF EXISTS kind;
@@ -0,0 +1,23 @@
+-- +goose Up
+-- 管理员手工开具的发票：草稿阶段没有编号，定稿时分配
+ALTER TABLE invoices ALTER COLUMN invoice_number DROP NOT NULL;
+ALTER TABLE invoices ADD CONSTRAINT invoices_number_required
+    CHECK (status = 'draft' OR invoice_number IS NOT NULL);
+
+ALTER TABLE invoices
+    ADD COLUMN notes TEXT,
+    ADD COLUMN created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    ADD COLUMN finalized_at TIMESTAMPTZ,
+    ADD COLUMN voided_at TIMESTAMPTZ,
+    ADD COLUMN void_reason TEXT;
+
+-- +goose Down
+DELETE FROM invoices WHERE invoice_number IS NULL;
+ALTER TABLE invoices
+    DROP COLUMN IF EXISTS void_reason,
+    DROP COLUMN IF EXISTS voided_at,
+    DROP COLUMN IF EXISTS finalized_at,
+    DROP COLUMN IF EXISTS created_by,
+    DROP COLUMN IF EXISTS notes;
+ALTER TABLE invoices DROP CONSTRAINT IF EXISTS invoices_number_required;
+ALTER TABLE invoices ALTER COLUMN invoice_number SET NOT NULL;
@@ -0,0 +1,40 @@
+-- +goose Up
+-- 会计科目表：日记账按用途（role）记账，导出时使用这里配置的科目编码和名称
+CREATE TABLE accounting_accounts (
+    role VARCHAR(50) PRIMARY KEY,
+    code VARCHAR(20) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO accounting_accounts (role, code, name) VALUES
+    ('accounts_receivable', '1100', 'Accounts Receivable'),
+    ('bank',                '1200', 'Payment Gateway Clearing'),
+    ('disputed_funds',      '1300', 'Disputed Funds'),
+    ('tax_payable',         '2200', 'Sales Tax Payable'),
+    ('customer_credit',     '2300', 'Customer Account Credit'),
+    ('revenue',             '4000', 'Sales'),
+    ('credit_adjustments',  '6100', 'Customer Credit Adjustments'),
+    ('chargeback_losses',   '6200', 'Chargeback Losses');
+
+-- 每次导出的批次，保留导出文件以便重新下载；period_end 含当天
+CREATE TABLE accounting_exports (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    period_start DATE NOT NULL,
+    period_end DATE NOT NULL,
+    format VARCHAR(20) NOT NULL CHECK (format IN ('csv', 'xero', 'iif')),
+    currency VARCHAR(3),
+    entry_count INT NOT NULL,
+    total_debit NUMERIC(12,2) NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    content BYTEA NOT NULL,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK (period_end >= period_start)
+);
+
+CREATE INDEX idx_accounting_exports_period ON accounting_exports(period_start, period_end);
+
+-- +goose Down
+DROP TABLE IF EXISTS accounting_exports;
+DROP TABLE IF EXISTS accounting_accounts;
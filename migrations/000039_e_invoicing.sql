@@ -0,0 +1,39 @@
+-- +goose Up
+-- 税费行记录税种类别（UNCL 5305）和税率，电子发票按此输出税种信息
+ALTER TABLE invoice_items
+    ADD COLUMN tax_category VARCHAR(3),
+    ADD COLUMN tax_rate NUMERIC(6,3);
+
+-- 已有的税费行从描述中还原：反向征收为 AE，其余按描述中的百分比区分 S 和 Z
+UPDATE invoice_items
+SET tax_category = 'AE', tax_rate = 0
+WHERE kind = 'tax' AND description ILIKE '%reverse charge%';
+
+UPDATE invoice_items
+SET tax_rate = COALESCE(substring(description FROM '([0-9]+(\.[0-9]+)?)%')::numeric, 0)
+WHERE kind = 'tax' AND tax_category IS NULL;
+
+UPDATE invoice_items
+SET tax_category = CASE WHEN tax_rate > 0 THEN 'S' ELSE 'Z' END
+WHERE kind = 'tax' AND tax_category IS NULL;
+
+-- 电子发票要求的卖方地址和税号
+INSERT INTO system_settings (key, value, is_secret, description, group_name) VALUES
+    ('company_address_line1', '', FALSE, 'Company street address shown on invoices and e-invoices',                     'branding'),
+    ('company_address_line2', '', FALSE, 'Company address line 2',                                                       'branding'),
+    ('company_city',          '', FALSE, 'Company city',                                                                 'branding'),
+    ('company_state',         '', FALSE, 'Company state or region',                                                      'branding'),
+    ('company_postal_code',   '', FALSE, 'Company postal code',                                                          'branding'),
+    ('company_country',       '', FALSE, 'Company country (ISO 3166-1 alpha-2); falls back to tax_home_country',         'branding'),
+    ('company_tax_id',        '', FALSE, 'Company VAT or tax registration number',                                       'branding'),
+    ('company_email',         '', FALSE, 'Billing contact email shown as the seller contact on e-invoices',              'branding');
+
+-- +goose Down
+DELETE FROM system_settings WHERE key IN (
+    'company_address_line1', 'company_address_line2', 'company_city', 'company_state',
+    'company_postal_code', 'company_country', 'company_tax_id', 'company_email'
+);
+
+ALTER TABLE invoice_items
+    DROP COLUMN IF EXISTS tax_rate,
+    DROP COLUMN IF EXISTS tax_category;
@@ -0,0 +1,16 @@
+-- +goose Up
+-- 已收款但无法结清单据的付款转入账户余额，每笔付款只入账一次
+ALTER TABLE credit_transactions DROP CONSTRAINT IF EXISTS credit_transactions_kind_check;
+ALTER TABLE credit_transactions ADD CONSTRAINT credit_transactions_kind_check
+    CHECK (kind IN ('adjustment', 'top_up', 'downgrade', 'applied', 'released', 'credit_note', 'unapplied_payment'));
+ALTER TABLE credit_transactions ADD COLUMN payment_id UUID REFERENCES payments(id) ON DELETE SET NULL;
+CREATE UNIQUE INDEX idx_credit_transactions_payment ON credit_transactions(payment_id)
+    WHERE payment_id IS NOT NULL;
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_credit_transactions_payment;
+ALTER TABLE credit_transactions DROP COLUMN IF EXISTS payment_id;
+DELETE FROM credit_transactions WHERE kind = 'unapplied_payment';
+ALTER TABLE credit_transactions DROP CONSTRAINT IF EXISTS credit_transactions_kind_check;
+ALTER TABLE credit_transactions ADD CONSTRAINT credit_transactions_kind_check
+    CHECK (kind IN ('adjustment', 'top_up', 'downgrade', 'applied', 'released', 'credit_note'));
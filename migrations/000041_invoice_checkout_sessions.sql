@@ -0,0 +1,18 @@
+-- +goose Up
+-- 发票发起的托管支付会话。发票作废或已在别处付清后，仍未完成的会话由定时任务在网关侧使其失效
+CREATE TABLE invoice_checkout_sessions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    invoice_id UUID NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    gateway VARCHAR(20) NOT NULL,
+    session_id VARCHAR(255) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'completed', 'expired')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    closed_at TIMESTAMPTZ,
+    UNIQUE (gateway, session_id)
+);
+
+CREATE INDEX idx_invoice_checkout_sessions_open ON invoice_checkout_sessions(invoice_id)
+    WHERE status = 'open';
+
+-- +goose Down
+DROP TABLE IF EXISTS invoice_checkout_sessions;
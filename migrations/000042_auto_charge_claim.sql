@@ -0,0 +1,6 @@
+-- +goose Up
+-- 自动扣款开始的时间：扣款进行中时客户不能再为该发票发起付款，避免重复扣款
+ALTER TABLE invoices ADD COLUMN auto_charge_started_at TIMESTAMPTZ;
+
+-- +goose Down
+ALTER TABLE invoices DROP COLUMN IF EXISTS auto_charge_started_at;